@@ -3,9 +3,12 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"slices"
+	"strings"
 )
 
-// requireAdmin returns the current user if they are an admin, else writes 401/403 and returns nil.
+// requireAdmin returns the current user if they are an admin who stepped up recently,
+// else writes 401/403 and returns nil. Admins manage the realm they belong to.
 func requireAdmin(w http.ResponseWriter, r *http.Request) *PasskeyUser {
 	sid := getSessionID(r)
 	session, err := GetSession(sid)
@@ -13,7 +16,7 @@ func requireAdmin(w http.ResponseWriter, r *http.Request) *PasskeyUser {
 		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
 		return nil
 	}
-	user, err := GetUser(string(session.UserID))
+	user, err := repo.GetUser(string(session.UserID))
 	if err != nil {
 		JSONResponse(w, "User not found", http.StatusUnauthorized)
 		return nil
@@ -22,6 +25,9 @@ func requireAdmin(w http.ResponseWriter, r *http.Request) *PasskeyUser {
 		JSONResponse(w, "Forbidden", http.StatusForbidden)
 		return nil
 	}
+	if requireStepUp(w, r) == nil {
+		return nil
+	}
 	return user
 }
 
@@ -35,7 +41,7 @@ func AdminListClients(w http.ResponseWriter, r *http.Request) {
 	if requireAdmin(w, r) == nil {
 		return
 	}
-	clients, err := GetAllSSOClients()
+	clients, err := repo.GetAllSSOClients(realmOf(r).ID)
 	if err != nil {
 		JSONResponse(w, "Failed to list clients", http.StatusInternalServerError)
 		return
@@ -56,7 +62,8 @@ func AdminCreateClient(w http.ResponseWriter, r *http.Request) {
 		JSONResponse(w, "id, client_secret, and redirect_uri are required", http.StatusBadRequest)
 		return
 	}
-	if err := CreateSSOClient(&client); err != nil {
+	client.RealmID = realmOf(r).ID
+	if err := repo.CreateSSOClient(&client); err != nil {
 		JSONResponse(w, "Failed to create client: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -78,7 +85,8 @@ func AdminUpdateClient(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	client.ID = clientID
-	if err := UpdateSSOClient(&client); err != nil {
+	client.RealmID = realmOf(r).ID
+	if err := repo.UpdateSSOClient(&client); err != nil {
 		JSONResponse(w, "Failed to update client: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -94,7 +102,7 @@ func AdminDeleteClient(w http.ResponseWriter, r *http.Request) {
 		JSONResponse(w, "Missing id", http.StatusBadRequest)
 		return
 	}
-	if err := DeleteSSOClient(clientID); err != nil {
+	if err := repo.DeleteSSOClient(realmOf(r).ID, clientID); err != nil {
 		JSONResponse(w, "Failed to delete client: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -111,7 +119,7 @@ func AdminListUsers(w http.ResponseWriter, r *http.Request) {
 	if requireAdmin(w, r) == nil {
 		return
 	}
-	users, err := GetAllUsers()
+	users, err := repo.GetAllUsers(realmOf(r).ID)
 	if err != nil {
 		JSONResponse(w, "Failed to list users", http.StatusInternalServerError)
 		return
@@ -129,7 +137,7 @@ func AdminUpdateUser(w http.ResponseWriter, r *http.Request) {
 		JSONResponse(w, "Missing id", http.StatusBadRequest)
 		return
 	}
-	user, err := GetUser(userID)
+	user, err := getRealmUser(r, userID)
 	if err != nil {
 		JSONResponse(w, "User not found", http.StatusNotFound)
 		return
@@ -140,6 +148,9 @@ func AdminUpdateUser(w http.ResponseWriter, r *http.Request) {
 		DisplayName *string `json:"display_name"`
 		IsActive    *bool   `json:"is_active"`
 		IsAdmin     *bool   `json:"is_admin"`
+		Roles       *string `json:"roles"`
+		Groups      *string `json:"groups"`
+		Clients     *string `json:"clients"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		JSONResponse(w, "Invalid request", http.StatusBadRequest)
@@ -163,8 +174,31 @@ func AdminUpdateUser(w http.ResponseWriter, r *http.Request) {
 		}
 		user.IsAdmin = *req.IsAdmin
 	}
+	if req.Roles != nil {
+		if err := validateNames("role", parseList(*req.Roles)); err != nil {
+			JSONResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user.Roles = strings.Join(parseList(*req.Roles), ",")
+	}
+	if req.Groups != nil {
+		if err := validateNames("group", parseList(*req.Groups)); err != nil {
+			JSONResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user.Groups = strings.Join(parseList(*req.Groups), ",")
+	}
+	if req.Clients != nil {
+		for _, clientID := range parseList(*req.Clients) {
+			if _, err := getRealmClient(r, clientID); err != nil {
+				JSONResponse(w, "Unknown client: "+clientID, http.StatusBadRequest)
+				return
+			}
+		}
+		user.Clients = strings.Join(parseList(*req.Clients), ",")
+	}
 
-	if err := SaveUser(user); err != nil {
+	if err := repo.SaveUser(user); err != nil {
 		JSONResponse(w, "Failed to update user: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -185,9 +219,267 @@ func AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
 		JSONResponse(w, "Cannot delete yourself", http.StatusBadRequest)
 		return
 	}
-	if err := DeleteUser(userID); err != nil {
+	if _, err := getRealmUser(r, userID); err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := repo.DeleteUser(userID); err != nil {
 		JSONResponse(w, "Failed to delete user: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	JSONResponse(w, "User deleted", http.StatusOK)
 }
+
+/////////////////////////////
+//                         //
+//    Credential Admin     //
+//                         //
+/////////////////////////////
+
+func AdminListUserCredentials(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	userID := r.URL.Query().Get("id")
+	if userID == "" {
+		JSONResponse(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+	user, err := getRealmUser(r, userID)
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+	JSONResponse(w, credentialInfos(user.Credentials()), http.StatusOK)
+}
+
+func AdminRenameCredential(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	credID := r.URL.Query().Get("id")
+	if credID == "" {
+		JSONResponse(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+	cred, err := repo.GetCredential(credID)
+	if err != nil || cred.UserID == nil {
+		JSONResponse(w, "Credential not found", http.StatusNotFound)
+		return
+	}
+	if _, err := getRealmUser(r, *cred.UserID); err != nil {
+		JSONResponse(w, "Credential not found", http.StatusNotFound)
+		return
+	}
+	label, err := getCredentialLabel(r)
+	if err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := repo.UpdateCredentialLabel(credID, label); err != nil {
+		JSONResponse(w, "Failed to rename credential: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, "Credential renamed", http.StatusOK)
+}
+
+/////////////////////////////
+//                         //
+//    Settings Admin       //
+//                         //
+/////////////////////////////
+
+// settingValues lists the settings admins may change and their allowed values.
+// A nil slice accepts any value.
+var settingValues = map[string][]string{
+	"clone_warning_policy": clonePolicies,
+	"related_origins":      nil,
+	"totp_mode":            totpModes,
+	"magic_link_binding":   {"true", "false"},
+	"rate_limits":          nil,
+	"rate_limit_allowlist": nil,
+	"signup_policy":        signupPolicies,
+	"signup_domains":       nil,
+}
+
+// settingValidators check free-form setting values.
+var settingValidators = map[string]func(string) error{
+	"related_origins":      validateOrigins,
+	"rate_limits":          validateRateLimits,
+	"rate_limit_allowlist": validateNetworks,
+	"signup_domains":       validateDomains,
+}
+
+// settingReloaders apply a changed setting that is cached in memory.
+var settingReloaders = map[string]func(){
+	"related_origins":      reloadPasskeyStore,
+	"totp_mode":            reloadPasskeyStore,
+	"rate_limits":          reloadRateLimits,
+	"rate_limit_allowlist": reloadRateLimits,
+	"signup_policy":        reloadPasskeyStore,
+	"signup_domains":       reloadPasskeyStore,
+}
+
+func AdminListSettings(w http.ResponseWriter, r *http.Request) {
+	if requireRealmAdmin(w, r) == nil {
+		return
+	}
+	settings, err := GetAllSettings()
+	if err != nil {
+		JSONResponse(w, "Failed to list settings", http.StatusInternalServerError)
+		return
+	}
+	settings = slices.DeleteFunc(settings, func(setting Setting) bool { return isSecretSetting(setting.Name) })
+	JSONResponse(w, settings, http.StatusOK)
+}
+
+func AdminUpdateSetting(w http.ResponseWriter, r *http.Request) {
+	if requireRealmAdmin(w, r) == nil {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	allowed, ok := settingValues[name]
+	if !ok {
+		JSONResponse(w, "Unknown setting", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if allowed != nil && !slices.Contains(allowed, req.Value) {
+		JSONResponse(w, "Invalid value for "+name, http.StatusBadRequest)
+		return
+	}
+	if validate := settingValidators[name]; validate != nil {
+		if err := validate(req.Value); err != nil {
+			JSONResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := SaveSetting(name, req.Value); err != nil {
+		JSONResponse(w, "Failed to update setting: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reload := settingReloaders[name]; reload != nil {
+		reload()
+	}
+	JSONResponse(w, "Setting updated", http.StatusOK)
+}
+
+func AdminListSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	events, err := GetSecurityEvents(realmOf(r).ID, 200)
+	if err != nil {
+		JSONResponse(w, "Failed to list security events", http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, events, http.StatusOK)
+}
+
+/////////////////////////////
+//                         //
+//    Realm Admin          //
+//                         //
+/////////////////////////////
+
+// requireRealmAdmin returns the current user if they are an admin of the default realm,
+// the only realm whose admins may manage realms and global settings.
+func requireRealmAdmin(w http.ResponseWriter, r *http.Request) *PasskeyUser {
+	if realmOf(r).ID != defaultRealmID {
+		JSONResponse(w, "Forbidden", http.StatusForbidden)
+		return nil
+	}
+	return requireAdmin(w, r)
+}
+
+func AdminListRealms(w http.ResponseWriter, r *http.Request) {
+	if requireRealmAdmin(w, r) == nil {
+		return
+	}
+	realms, err := GetAllRealms()
+	if err != nil {
+		JSONResponse(w, "Failed to list realms", http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, realms, http.StatusOK)
+}
+
+func AdminCreateRealm(w http.ResponseWriter, r *http.Request) {
+	if requireRealmAdmin(w, r) == nil {
+		return
+	}
+	var realm Realm
+	if err := json.NewDecoder(r.Body).Decode(&realm); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := validateRealm(&realm); err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CreateRealm(&realm); err != nil {
+		JSONResponse(w, "Failed to create realm: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reloadPasskeyStore()
+	JSONResponse(w, "Realm created", http.StatusOK)
+}
+
+func AdminUpdateRealm(w http.ResponseWriter, r *http.Request) {
+	if requireRealmAdmin(w, r) == nil {
+		return
+	}
+	realmID := r.URL.Query().Get("id")
+	realm, err := GetRealmByID(realmID)
+	if err != nil {
+		JSONResponse(w, "Realm not found", http.StatusNotFound)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(realm); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	realm.ID = realmID
+	if err := validateRealm(realm); err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := UpdateRealm(realm); err != nil {
+		JSONResponse(w, "Failed to update realm: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reloadPasskeyStore()
+	JSONResponse(w, "Realm updated", http.StatusOK)
+}
+
+func AdminDeleteRealm(w http.ResponseWriter, r *http.Request) {
+	if requireRealmAdmin(w, r) == nil {
+		return
+	}
+	realmID := r.URL.Query().Get("id")
+	if realmID == "" || realmID == defaultRealmID {
+		JSONResponse(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	users, err := repo.GetAllUsers(realmID)
+	if err != nil {
+		JSONResponse(w, "Failed to delete realm: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(users) > 0 {
+		JSONResponse(w, "Realm still has users", http.StatusBadRequest)
+		return
+	}
+	if err := DeleteRealm(realmID); err != nil {
+		JSONResponse(w, "Failed to delete realm: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reloadPasskeyStore()
+	JSONResponse(w, "Realm deleted", http.StatusOK)
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Admin commands work on the database and session store of the configuration the server
+// uses, so the first admin of a realm can be set up without SQL:
+//
+//	gopasskey user create -admin admin@example.com
+
+// parseCommandArgs parses the flags, which may come before, between or after the
+// positional arguments, and returns the positional arguments.
+func parseCommandArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// newCommandFlags returns the flags of a command, with -realm.
+func newCommandFlags(name, usage string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: gopasskey %s\n", usage)
+		flags.PrintDefaults()
+	}
+	realmID := flags.String("realm", defaultRealmID, "realm `id`")
+	return flags, realmID
+}
+
+// commandMisused prints the usage of a command given wrong arguments, unless parsing its
+// flags already did, and returns the exit code.
+func commandMisused(flags *flag.FlagSet, err error) int {
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err == nil {
+		flags.Usage()
+	}
+	return 2
+}
+
+// commandFailed prints err and returns the exit code of a failed command.
+func commandFailed(err error) int {
+	fmt.Fprintf(os.Stderr, "[ERRO] %s\n", err.Error())
+	return 1
+}
+
+// openCommandDB connects to the database, and to the session store if the command needs it.
+// Unlike the server it doesn't print what it connected to, so the output of a command can be
+// piped.
+func openCommandDB(withStore bool) {
+	var err error
+	config := currentConfig()
+	if db, err = openDB(config.Database.Driver, dataSourceName(config.Database)); err != nil {
+		os.Exit(commandFailed(err))
+	}
+	repo = newSQLRepository(db)
+	checkSchema()
+	if withStore {
+		if store, err = newStore(config.SessionStore.Kind); err != nil {
+			os.Exit(commandFailed(err))
+		}
+		if config.SessionStore.Kind == StoreMemory {
+			fmt.Fprintln(os.Stderr, "[WARN] the memory store of a command doesn't hold the sessions of the server")
+		}
+	}
+}
+
+// commandRealm returns realmID if the realm exists.
+func commandRealm(realmID string) (string, error) {
+	if realmID == defaultRealmID {
+		return realmID, nil
+	}
+	if _, err := GetRealmByID(realmID); err != nil {
+		return "", fmt.Errorf("unknown realm %q", realmID)
+	}
+	return realmID, nil
+}
+
+// recordCommandEvent records a security event of a change made with a command.
+func recordCommandEvent(userID, eventType, detail string) {
+	source := "gopasskey command"
+	event := &SecurityEvent{UserID: &userID, Type: &eventType, UserAgent: &source}
+	if detail != "" {
+		event.Detail = &detail
+	}
+	if err := CreateSecurityEvent(event); err != nil {
+		fmt.Fprintf(os.Stderr, "[ERRO] can't record security event: %s\n", err.Error())
+	}
+}
+
+////////////////////////
+//                    //
+//       Users        //
+//                    //
+////////////////////////
+
+const userCommandUsage = `usage: gopasskey user <command> [-realm id] ...
+
+Commands:
+  create [-name name] [-admin] <email>      create a user
+  grant-admin <email>                       make a user an admin of the realm
+  revoke-admin <email>                      make an admin a normal user
+  sessions <email>                          list the sessions and SSO tokens of a user
+  revoke-sessions [-id id] <email>          end all sessions and SSO tokens of a user, or one
+  export [file]                             write the users of the realm as JSON
+  import <file>                             create the users of a JSON export, - for stdin
+`
+
+// userCommand runs gopasskey user.
+func userCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, userCommandUsage)
+		return 2
+	}
+	switch args[0] {
+	case "create":
+		return userCreateCommand(args[1:])
+	case "grant-admin":
+		return userAdminCommand(args[1:], true)
+	case "revoke-admin":
+		return userAdminCommand(args[1:], false)
+	case "sessions":
+		return userSessionsCommand(args[1:])
+	case "revoke-sessions":
+		return userRevokeSessionsCommand(args[1:])
+	case "export":
+		return userExportCommand(args[1:])
+	case "import":
+		return userImportCommand(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(userCommandUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], userCommandUsage)
+		return 2
+	}
+}
+
+// commandUser returns the user with email in realmID.
+func commandUser(realmID, email string) (*PasskeyUser, error) {
+	realmID, err := commandRealm(realmID)
+	if err != nil {
+		return nil, err
+	}
+	user, err := repo.GetUserByEmail(realmID, email)
+	if err != nil {
+		return nil, fmt.Errorf("no user %s in realm %s", email, realmID)
+	}
+	return user, nil
+}
+
+func userCreateCommand(args []string) int {
+	flags, realmID := newCommandFlags("user create", "user create [-realm id] [-name name] [-admin] <email>")
+	name := flags.String("name", "", "display `name`, the email if empty")
+	admin := flags.Bool("admin", false, "make the user an admin of the realm")
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		return commandMisused(flags, err)
+	}
+	email := strings.TrimSpace(positional[0])
+	if emailDomain(email) == "" {
+		return commandFailed(fmt.Errorf("%q is not an email", email))
+	}
+	if *name == "" {
+		*name = email
+	}
+	openCommandDB(false)
+	defer db.Close()
+	realm, err := commandRealm(*realmID)
+	if err != nil {
+		return commandFailed(err)
+	}
+	user, err := repo.CreateUser(realm, email, *name, *name)
+	if err != nil {
+		return commandFailed(fmt.Errorf("can't create user: %w", err))
+	}
+	if *admin {
+		user.IsAdmin = true
+		if err := repo.SaveUser(user); err != nil {
+			return commandFailed(err)
+		}
+		recordCommandEvent(user.ID, "admin_granted", "")
+	}
+	fmt.Printf("[INFO] created user %s with ID %s in realm %s\n", user.Email, user.ID, realm)
+	return 0
+}
+
+func userAdminCommand(args []string, grant bool) int {
+	command := "user revoke-admin"
+	if grant {
+		command = "user grant-admin"
+	}
+	flags, realmID := newCommandFlags(command, command+" [-realm id] <email>")
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		return commandMisused(flags, err)
+	}
+	openCommandDB(false)
+	defer db.Close()
+	user, err := commandUser(*realmID, positional[0])
+	if err != nil {
+		return commandFailed(err)
+	}
+	if user.IsAdmin == grant {
+		fmt.Printf("[INFO] nothing to do for %s\n", user.Email)
+		return 0
+	}
+	user.IsAdmin = grant
+	if err := repo.SaveUser(user); err != nil {
+		return commandFailed(err)
+	}
+	if grant {
+		recordCommandEvent(user.ID, "admin_granted", "")
+		fmt.Printf("[INFO] %s is now an admin of realm %s\n", user.Email, user.RealmID)
+	} else {
+		recordCommandEvent(user.ID, "admin_revoked", "")
+		fmt.Printf("[INFO] %s is no longer an admin of realm %s\n", user.Email, user.RealmID)
+	}
+	return 0
+}
+
+func userSessionsCommand(args []string) int {
+	flags, realmID := newCommandFlags("user sessions", "user sessions [-realm id] <email>")
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		return commandMisused(flags, err)
+	}
+	openCommandDB(true)
+	defer db.Close()
+	user, err := commandUser(*realmID, positional[0])
+	if err != nil {
+		return commandFailed(err)
+	}
+	sessions, err := GetUserLoginSessions(user.ID)
+	if err != nil {
+		return commandFailed(err)
+	}
+	tokens, err := store.SMembers(fmt.Sprintf("sso_user_tokens:%s", user.ID))
+	if err != nil {
+		return commandFailed(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tID\tCLIENT\tCREATED\tUSER AGENT")
+	ids := make([]string, 0, len(sessions))
+	for id := range sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		session := sessions[id]
+		fmt.Fprintf(w, "session\t%s\t\t%s\t\n", id, session.AuthTime.Local().Format("2006-01-02 15:04"))
+	}
+	sort.Strings(tokens)
+	for _, token := range tokens {
+		data, err := getSSOTokenData(token)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "token\t%s\t%s\t%s\t%s\n", token, data.ClientID, data.Created, data.UserAgent)
+	}
+	return commandDone(w.Flush())
+}
+
+func userRevokeSessionsCommand(args []string) int {
+	flags, realmID := newCommandFlags("user revoke-sessions", "user revoke-sessions [-realm id] [-id id] <email>")
+	id := flags.String("id", "", "session `id` or SSO token listed by user sessions, all if empty")
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		return commandMisused(flags, err)
+	}
+	openCommandDB(true)
+	defer db.Close()
+	user, err := commandUser(*realmID, positional[0])
+	if err != nil {
+		return commandFailed(err)
+	}
+
+	if *id == "" {
+		revokeUserSSOTokens(user.ID)
+		if err := DeleteUserLoginSessions(user.ID); err != nil {
+			return commandFailed(err)
+		}
+		recordCommandEvent(user.ID, "sessions_revoked", "")
+		fmt.Printf("[INFO] ended all sessions of %s\n", user.Email)
+		return 0
+	}
+	if data, err := getSSOTokenData(*id); err == nil && data.UserID == user.ID {
+		revokeSSOTokenAndSession(*id)
+	} else if session, err := GetLoginSession(*id); err == nil && string(session.UserID) == user.ID {
+		if err := DeleteSession(*id); err != nil {
+			return commandFailed(err)
+		}
+	} else {
+		return commandFailed(fmt.Errorf("%s has no session or token %s", user.Email, *id))
+	}
+	recordCommandEvent(user.ID, "sessions_revoked", *id)
+	fmt.Printf("[INFO] ended session %s of %s\n", *id, user.Email)
+	return 0
+}
+
+func userExportCommand(args []string) int {
+	flags, realmID := newCommandFlags("user export", "user export [-realm id] [file]")
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil || len(positional) > 1 {
+		return commandMisused(flags, err)
+	}
+	openCommandDB(false)
+	defer db.Close()
+	realm, err := commandRealm(*realmID)
+	if err != nil {
+		return commandFailed(err)
+	}
+	users, err := repo.GetAllUsers(realm)
+	if err != nil {
+		return commandFailed(err)
+	}
+	out := io.Writer(os.Stdout)
+	if len(positional) == 1 && positional[0] != "-" {
+		file, err := os.Create(positional[0])
+		if err != nil {
+			return commandFailed(err)
+		}
+		defer file.Close()
+		out = file
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(users); err != nil {
+		return commandFailed(err)
+	}
+	fmt.Fprintf(os.Stderr, "[INFO] exported %d users of realm %s\n", len(users), realm)
+	return 0
+}
+
+// userImportCommand creates the users of an export. Users whose email already has an account
+// in the realm are skipped. Passkeys aren't exported, so imported users sign in by email and
+// register new ones.
+func userImportCommand(args []string) int {
+	flags, realmID := newCommandFlags("user import", "user import [-realm id] <file>")
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		return commandMisused(flags, err)
+	}
+	in := io.Reader(os.Stdin)
+	if positional[0] != "-" {
+		file, err := os.Open(positional[0])
+		if err != nil {
+			return commandFailed(err)
+		}
+		defer file.Close()
+		in = file
+	}
+	var users []PasskeyUser
+	if err := json.NewDecoder(in).Decode(&users); err != nil {
+		return commandFailed(fmt.Errorf("can't read users: %w", err))
+	}
+	realmSet := false
+	flags.Visit(func(f *flag.Flag) { realmSet = realmSet || f.Name == "realm" })
+
+	openCommandDB(false)
+	defer db.Close()
+	realms := map[string]error{}
+	imported, skipped := 0, 0
+	for _, user := range users {
+		// -realm overrides the realms of the export
+		if realmSet || user.RealmID == "" {
+			user.RealmID = *realmID
+		}
+		if _, checked := realms[user.RealmID]; !checked {
+			_, realms[user.RealmID] = commandRealm(user.RealmID)
+		}
+		if err := realms[user.RealmID]; err != nil {
+			return commandFailed(err)
+		}
+		user.Email = strings.TrimSpace(user.Email)
+		if emailDomain(user.Email) == "" {
+			fmt.Fprintf(os.Stderr, "[WARN] skipped %q: not an email\n", user.Email)
+			skipped++
+			continue
+		}
+		if _, err := repo.GetUserByEmail(user.RealmID, user.Email); err == nil {
+			fmt.Fprintf(os.Stderr, "[WARN] skipped %s: already has an account\n", user.Email)
+			skipped++
+			continue
+		}
+		if user.ID == "" {
+			user.ID = uuid.New().String()
+		} else if _, err := repo.GetUser(user.ID); err == nil {
+			user.ID = uuid.New().String()
+		}
+		if user.Created.IsZero() {
+			user.Created = time.Now()
+		}
+		if err := repo.InsertUser(&user); err != nil {
+			return commandFailed(fmt.Errorf("can't import %s: %w", user.Email, err))
+		}
+		if user.IsAdmin {
+			recordCommandEvent(user.ID, "admin_granted", "imported")
+		}
+		imported++
+	}
+	fmt.Printf("[INFO] imported %d users, skipped %d\n", imported, skipped)
+	return 0
+}
+
+////////////////////////
+//                    //
+//    SSO Clients     //
+//                    //
+////////////////////////
+
+const clientCommandUsage = `usage: gopasskey client <command> [-realm id] ...
+
+Commands:
+  list                                 list the SSO clients of the realm
+  create [-name name] <id> <redirect_uri>
+                                       register an SSO client and print its secret
+  rotate <id>                          replace the secret of an SSO client and print it
+`
+
+// clientCommand runs gopasskey client.
+func clientCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, clientCommandUsage)
+		return 2
+	}
+	switch args[0] {
+	case "list":
+		return clientListCommand(args[1:])
+	case "create":
+		return clientCreateCommand(args[1:])
+	case "rotate":
+		return clientRotateCommand(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(clientCommandUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], clientCommandUsage)
+		return 2
+	}
+}
+
+func clientListCommand(args []string) int {
+	flags, realmID := newCommandFlags("client list", "client list [-realm id]")
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil || len(positional) != 0 {
+		return commandMisused(flags, err)
+	}
+	openCommandDB(false)
+	defer db.Close()
+	realm, err := commandRealm(*realmID)
+	if err != nil {
+		return commandFailed(err)
+	}
+	clients, err := repo.GetAllSSOClients(realm)
+	if err != nil {
+		return commandFailed(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tREDIRECT URI")
+	for _, client := range clients {
+		name := ""
+		if client.Name != nil {
+			name = *client.Name
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", client.ID, name, client.RedirectURI)
+	}
+	return commandDone(w.Flush())
+}
+
+func clientCreateCommand(args []string) int {
+	flags, realmID := newCommandFlags("client create", "client create [-realm id] [-name name] <id> <redirect_uri>")
+	name := flags.String("name", "", "`name` shown to users")
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil || len(positional) != 2 {
+		return commandMisused(flags, err)
+	}
+	openCommandDB(false)
+	defer db.Close()
+	realm, err := commandRealm(*realmID)
+	if err != nil {
+		return commandFailed(err)
+	}
+	client := &SSOClient{
+		ID:           positional[0],
+		RealmID:      realm,
+		ClientSecret: generateCode(),
+		RedirectURI:  positional[1],
+	}
+	if *name != "" {
+		client.Name = name
+	}
+	if err := repo.CreateSSOClient(client); err != nil {
+		return commandFailed(fmt.Errorf("can't create client: %w", err))
+	}
+	fmt.Printf("client_id=%s\nclient_secret=%s\n", client.ID, client.ClientSecret)
+	return 0
+}
+
+func clientRotateCommand(args []string) int {
+	flags, realmID := newCommandFlags("client rotate", "client rotate [-realm id] <id>")
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil || len(positional) != 1 {
+		return commandMisused(flags, err)
+	}
+	openCommandDB(false)
+	defer db.Close()
+	client, err := repo.GetSSOClient(positional[0])
+	if err != nil || client.RealmID != *realmID {
+		return commandFailed(fmt.Errorf("no client %s in realm %s", positional[0], *realmID))
+	}
+	client.ClientSecret = generateCode()
+	if err := repo.UpdateSSOClient(client); err != nil {
+		return commandFailed(err)
+	}
+	fmt.Printf("client_id=%s\nclient_secret=%s\n", client.ID, client.ClientSecret)
+	return 0
+}
+
+////////////////////////
+//                    //
+//   Configuration    //
+//                    //
+////////////////////////
+
+// configCommand prints the configuration in effect and the settings stored in the database,
+// with secrets masked. An invalid configuration stops the binary before it gets here.
+func configCommand(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: gopasskey config")
+		return 2
+	}
+	openCommandDB(false)
+	defer db.Close()
+	settings, err := GetAllSettings()
+	if err != nil {
+		return commandFailed(err)
+	}
+
+	file := configFile
+	if file == "" {
+		file = "none, set CONFIG_FILE to use one"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Configuration file: %s\n", file)
+	fmt.Fprintln(w, "\nConfiguration:")
+	for _, field := range currentConfig().fields() {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", field.key, field.display(), field.env)
+	}
+	fmt.Fprintln(w, "\nSettings:")
+	for _, setting := range settings {
+		value := ""
+		if setting.Value != nil {
+			value = *setting.Value
+		}
+		if value != "" && isSecretSetting(setting.Name) {
+			value = "********"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", setting.Name, value)
+	}
+	return commandDone(w.Flush())
+}
+
+// commandDone returns the exit code of a command that ended with err.
+func commandDone(err error) int {
+	if err != nil {
+		return commandFailed(err)
+	}
+	return 0
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestParseCommandArgs(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	realm := flags.String("realm", defaultRealmID, "")
+	admin := flags.Bool("admin", false, "")
+	positional, err := parseCommandArgs(flags, []string{"-admin", "a@example.com", "-realm", "acme", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(positional, []string{"a@example.com", "b"}) || *realm != "acme" || !*admin {
+		t.Errorf("parseCommandArgs = %v, realm %q, admin %v", positional, *realm, *admin)
+	}
+}
+
+func TestUserLoginSessions(t *testing.T) {
+	store = newMemoryStore()
+	for _, id := range []string{"s1", "s2"} {
+		if err := SaveLoginSession(id, &Session{SessionData: webauthn.SessionData{UserID: []byte("u1")}}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	DeleteSession("s1")
+	sessions, err := GetUserLoginSessions("u1")
+	if err != nil || len(sessions) != 1 || sessions["s2"] == nil {
+		t.Errorf("GetUserLoginSessions = %v, %v; want s2", sessions, err)
+	}
+	if members, _ := store.SMembers("user_sessions:u1"); !slices.Equal(members, []string{"s2"}) {
+		t.Errorf("ended session s1 still listed: %v", members)
+	}
+	if err := DeleteUserLoginSessions("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetLoginSession("s2"); err == nil {
+		t.Error("session s2 not ended")
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	if os.Getenv("DB_DRIVER") != "" {
+		t.Skip("the commands would change the database of DB_DRIVER")
+	}
+	dir := t.TempDir()
+	setTestConfig(t, func(c *Config) {
+		c.Database = DatabaseConfig{Driver: DriverSQLite, DSN: filepath.Join(dir, "appdb.db")}
+	})
+	if code := runCommand([]string{"migrate", "up"}); code != 0 {
+		t.Fatalf("migrate up = %d", code)
+	}
+
+	run := func(args ...string) int {
+		t.Helper()
+		code := runCommand(args)
+		// Commands close the database when they are done
+		db, _ = openDB(DriverSQLite, currentConfig().Database.DSN)
+		repo = newSQLRepository(db)
+		t.Cleanup(func() { db.Close() })
+		return code
+	}
+	if code := run("user", "create", "ann@example.com", "-admin"); code != 0 {
+		t.Fatalf("user create = %d", code)
+	}
+	if code := run("user", "create", "bob@example.com"); code != 0 {
+		t.Fatalf("user create = %d", code)
+	}
+	if code := run("user", "create", "not-an-email"); code == 0 {
+		t.Error("user create accepted an invalid email")
+	}
+	if code := run("user", "revoke-admin", "ann@example.com"); code != 0 {
+		t.Fatalf("user revoke-admin = %d", code)
+	}
+	if code := run("user", "grant-admin", "BOB@example.com"); code != 0 {
+		t.Fatalf("user grant-admin = %d", code)
+	}
+	if admins, err := repo.GetAdminUsers(defaultRealmID); err != nil || len(admins) != 1 || admins[0].Email != "bob@example.com" {
+		t.Errorf("admins = %v, %v; want bob", admins, err)
+	}
+
+	// The config command masks the key of the decoy passkey logins
+	if err := SaveSetting("login_decoy_key", "0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	var code int
+	output := captureStdout(t, func() { code = run("config") })
+	if code != 0 || !strings.Contains(output, "login_decoy_key") || strings.Contains(output, "0123456789abcdef") {
+		t.Errorf("config = %d, output:\n%s\nwant login_decoy_key masked", code, output)
+	}
+
+	export := filepath.Join(dir, "users.json")
+	if code := run("user", "export", export); code != 0 {
+		t.Fatalf("user export = %d", code)
+	}
+	if code := run("user", "import", export); code != 0 {
+		t.Fatalf("user import = %d", code)
+	}
+	if users, _ := repo.GetAllUsers(defaultRealmID); len(users) != 2 {
+		t.Errorf("import of existing users changed them: %v", users)
+	}
+
+	// Import into an empty database recreates the users with their roles
+	db.Close()
+	setTestConfig(t, func(c *Config) { c.Database.DSN = filepath.Join(dir, "imported.db") })
+	if code := runCommand([]string{"migrate", "up"}); code != 0 {
+		t.Fatalf("migrate up = %d", code)
+	}
+	if code := run("user", "import", export); code != 0 {
+		t.Fatalf("user import = %d", code)
+	}
+	users, err := repo.GetAllUsers(defaultRealmID)
+	if err != nil || len(users) != 2 {
+		t.Fatalf("users after import = %v, %v; want 2", users, err)
+	}
+	if bob := mustGetUserByEmail(t, "bob@example.com"); !bob.IsAdmin {
+		t.Error("import dropped bob's admin role")
+	}
+}
+
+// captureStdout returns what f prints to the standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	f()
+	w.Close()
+	output, _ := io.ReadAll(r)
+	return string(output)
+}
+
+func mustGetUserByEmail(t *testing.T, email string) *PasskeyUser {
+	t.Helper()
+	user, err := repo.GetUserByEmail(defaultRealmID, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 )
@@ -20,46 +28,214 @@ func GetUserCredentials(w http.ResponseWriter, r *http.Request) {
 		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	user, err := GetUser(string(session.UserID))
+	user, err := repo.GetUser(string(session.UserID))
 	if err != nil {
 		JSONResponse(w, "User not found", http.StatusNotFound)
 		return
 	}
-	creds := user.Credentials()
-	type credInfo struct {
-		ID      string `json:"id"`
-		AAGUID  string `json:"aaguid"`
-		Label   string `json:"label"`
-		Created string `json:"created"`
+	result := credentialInfos(user.Credentials())
+	totps, err := GetUserTOTPs(user.ID)
+	if err != nil {
+		log.Printf("[ERRO] can't get TOTPs: %s", err.Error())
 	}
+	JSONResponse(w, append(result, totpInfos(totps)...), http.StatusOK)
+}
+
+// credInfo is the public view of a stored credential
+type credInfo struct {
+	ID                string `json:"id"`
+	Type              string `json:"type"` // passkey or totp
+	AAGUID            string `json:"aaguid"`
+	Label             string `json:"label"`
+	Created           string `json:"created"`
+	LastUsed          string `json:"last_used"`
+	LastUsedIP        string `json:"last_used_ip"`
+	LastUsedUserAgent string `json:"last_used_user_agent"`
+	BackupEligible    bool   `json:"backup_eligible"`
+	BackupState       bool   `json:"backup_state"`
+	SignCount         int64  `json:"sign_count"`
+	Suspect           bool   `json:"suspect"`
+	Disabled          bool   `json:"disabled"`
+	PRF               bool   `json:"prf"`
+}
+
+func credentialInfos(creds []*PasskeyUserCredential) []credInfo {
 	var result []credInfo
 	for _, cred := range creds {
-		aaguid := ""
+		info := credInfo{ID: cred.ID, Type: "passkey"}
 		if cred.AAGUID != nil {
-			aaguid = *cred.AAGUID
+			info.AAGUID = *cred.AAGUID
 		}
-		label := ""
 		if cred.Label != nil {
-			label = *cred.Label
+			info.Label = *cred.Label
 		}
-		created := ""
+		info.Label = displayCredentialLabel(info.Label, info.AAGUID)
 		if cred.Created != nil {
-			created = cred.Created.Format("2006-01-02 15:04")
+			info.Created = cred.Created.Format("2006-01-02 15:04")
+		}
+		if cred.LastUsed != nil {
+			info.LastUsed = cred.LastUsed.Format("2006-01-02 15:04")
+		}
+		if cred.LastUsedIP != nil {
+			info.LastUsedIP = *cred.LastUsedIP
+		}
+		if cred.LastUsedUserAgent != nil {
+			info.LastUsedUserAgent = *cred.LastUsedUserAgent
+		}
+		if cred.BackupEligible != nil {
+			info.BackupEligible = *cred.BackupEligible
 		}
-		result = append(result, credInfo{ID: cred.ID, AAGUID: aaguid, Label: label, Created: created})
+		if cred.BackupState != nil {
+			info.BackupState = *cred.BackupState
+		}
+		info.PRF = cred.PRFSalt != nil
+		if cred.SignCount != nil {
+			info.SignCount = *cred.SignCount
+		}
+		if cred.Suspect != nil {
+			info.Suspect = *cred.Suspect
+		}
+		if cred.Disabled != nil {
+			info.Disabled = *cred.Disabled
+		}
+		result = append(result, info)
 	}
-	JSONResponse(w, result, http.StatusOK)
+	return result
 }
 
-// DeleteUserCredential deletes a credential by ID
-func DeleteUserCredential(w http.ResponseWriter, r *http.Request) {
+// totpInfos returns the public view of TOTP enrolments, listed next to passkeys.
+func totpInfos(totps []*UserTOTP) []credInfo {
+	var result []credInfo
+	for _, t := range totps {
+		info := credInfo{ID: t.ID, Type: "totp"}
+		if t.Label != nil {
+			info.Label = *t.Label
+		}
+		if t.Created != nil {
+			info.Created = t.Created.Format("2006-01-02 15:04")
+		}
+		if t.LastUsed != nil {
+			info.LastUsed = t.LastUsed.Format("2006-01-02 15:04")
+		}
+		result = append(result, info)
+	}
+	return result
+}
+
+// RenameUserCredential changes the label of one of the user's credentials
+func RenameUserCredential(w http.ResponseWriter, r *http.Request) {
+	sid := getSessionID(r)
+	session, err := GetSession(sid)
+	if err != nil {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, err := repo.GetUser(string(session.UserID))
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	credID := r.URL.Query().Get("id")
+	if credID == "" {
+		JSONResponse(w, "Missing credential id", http.StatusBadRequest)
+		return
+	}
+	label, err := getCredentialLabel(r)
+	if err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The dashboard lists authenticator apps with the passkeys, so the ID may be either
+	if user.Credential(credID) == nil {
+		found, err := RenameUserTOTP(user.ID, credID, label)
+		if err != nil {
+			log.Printf("[ERRO] can't rename TOTP: %s", err.Error())
+			JSONResponse(w, "Failed to rename authenticator app", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			JSONResponse(w, "Credential not found", http.StatusNotFound)
+			return
+		}
+		JSONResponse(w, "Authenticator app renamed", http.StatusOK)
+		return
+	}
+	if err := repo.UpdateCredentialLabel(credID, label); err != nil {
+		log.Printf("[ERRO] can't rename credential: %s", err.Error())
+		JSONResponse(w, "Failed to rename passkey", http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, "Passkey renamed", http.StatusOK)
+}
+
+// getCredentialLabel reads and validates {"label": "..."} from the request body
+func getCredentialLabel(r *http.Request) (string, error) {
+	var req struct {
+		Label string `json:"label"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return "", fmt.Errorf("Invalid request")
+	}
+	label := strings.TrimSpace(req.Label)
+	if label == "" {
+		return "", fmt.Errorf("Label is required")
+	}
+	if len(label) > 255 {
+		return "", fmt.Errorf("Label is too long")
+	}
+	return label, nil
+}
+
+// GetCredentialUsageHistory returns the most recent uses of one of the user's credentials
+func GetCredentialUsageHistory(w http.ResponseWriter, r *http.Request) {
 	sid := getSessionID(r)
 	session, err := GetSession(sid)
 	if err != nil {
 		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	user, err := GetUser(string(session.UserID))
+	user, err := repo.GetUser(string(session.UserID))
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	credID := r.URL.Query().Get("id")
+	if credID == "" {
+		JSONResponse(w, "Missing credential id", http.StatusBadRequest)
+		return
+	}
+
+	found := false
+	for _, cred := range user.Credentials() {
+		if cred.ID == credID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		JSONResponse(w, "Credential not found", http.StatusNotFound)
+		return
+	}
+
+	usage, err := repo.GetCredentialUsage(credID, 50)
+	if err != nil {
+		log.Printf("[ERRO] can't get credential usage: %s", err.Error())
+		JSONResponse(w, "Failed to get credential usage", http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, usage, http.StatusOK)
+}
+
+// DeleteUserCredential deletes a credential by ID. Requires a recent step-up.
+func DeleteUserCredential(w http.ResponseWriter, r *http.Request) {
+	session := requireStepUp(w, r)
+	if session == nil {
+		return
+	}
+	user, err := repo.GetUser(string(session.UserID))
 	if err != nil {
 		JSONResponse(w, "User not found", http.StatusNotFound)
 		return
@@ -81,7 +257,19 @@ func DeleteUserCredential(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if !found {
-		JSONResponse(w, "Credential not found", http.StatusNotFound)
+		// Not a passkey, it may be an authenticator app
+		deleted, err := DeleteUserTOTP(user.ID, credID)
+		if err != nil {
+			log.Printf("[ERRO] can't delete TOTP: %s", err.Error())
+			JSONResponse(w, "Failed to delete credential", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			JSONResponse(w, "Credential not found", http.StatusNotFound)
+			return
+		}
+		recordSecurityEvent(r, user.ID, "totp_removed", credID)
+		JSONResponse(w, "Credential deleted", http.StatusOK)
 		return
 	}
 
@@ -89,15 +277,13 @@ func DeleteUserCredential(w http.ResponseWriter, r *http.Request) {
 	JSONResponse(w, "Credential deleted", http.StatusOK)
 }
 
-// UpdateProfile updates user name and display name
+// UpdateProfile updates user name and display name. Requires a recent step-up.
 func UpdateProfile(w http.ResponseWriter, r *http.Request) {
-	sid := getSessionID(r)
-	session, err := GetSession(sid)
-	if err != nil {
-		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+	session := requireStepUp(w, r)
+	if session == nil {
 		return
 	}
-	user, err := GetUser(string(session.UserID))
+	user, err := repo.GetUser(string(session.UserID))
 	if err != nil {
 		JSONResponse(w, "User not found", http.StatusNotFound)
 		return
@@ -114,7 +300,7 @@ func UpdateProfile(w http.ResponseWriter, r *http.Request) {
 
 	user.Name = req.Name
 	user.DisplayName = req.DisplayName
-	if err := SaveUser(user); err != nil {
+	if err := repo.SaveUser(user); err != nil {
 		log.Printf("[ERRO] can't update user: %s", err.Error())
 		JSONResponse(w, "Failed to update profile", http.StatusInternalServerError)
 		return
@@ -132,8 +318,8 @@ func UpdateProfile(w http.ResponseWriter, r *http.Request) {
 func BeginEmailLogin(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[INFO] begin email login ----------------------\\")
 
-	u, err := getUserData(r)
-	if err != nil {
+	var u Req
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
 		log.Printf("[ERRO] can't get user data: %s", err.Error())
 		JSONResponse(w, err.Error(), http.StatusBadRequest)
 		return
@@ -143,54 +329,129 @@ func BeginEmailLogin(w http.ResponseWriter, r *http.Request) {
 		JSONResponse(w, "Email is required", http.StatusBadRequest)
 		return
 	}
+	if u.Method != "" && u.Method != "link" && u.Method != "code" {
+		JSONResponse(w, "Method must be link or code", http.StatusBadRequest)
+		return
+	}
 
-	// Check if user exists; if not, create one
-	_, err = GetUserByEmail(u.Email)
-	if err != nil {
-		// User doesn't exist, create a new one with email as name
-		_, err = CreateUser(u.Email, u.Email, u.Email)
-		if err != nil {
-			msg := fmt.Sprintf("can't create user: %s", err.Error())
-			log.Printf("[ERRO] %s", msg)
-			JSONResponse(w, msg, http.StatusInternalServerError)
-			return
+	// The account is created once the email is verified. Emails that may not sign up get
+	// the same response as everyone else, but no mail.
+	send := mayLogIn(r, u.Email)
+	if !send {
+		log.Printf("[INFO] sign-up not allowed for email: %s", u.Email)
+	}
+
+	var err error
+	if u.Method == "code" {
+		if send {
+			err = sendLoginCode(r, u.Email)
+		}
+	} else {
+		bindingHash, ssoRequest := "", ""
+		ttl := currentConfig().TTL.LoginLink
+		if u.SSO != nil {
+			ssoRequest, err = savePendingSSO(r, u.SSO, ttl)
+			if err != nil {
+				JSONResponse(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if magicLinkBinding() {
+			bindingHash = newLoginBinding(w, r, ttl)
+		}
+		if send {
+			err = sendLoginLink(r, u.Email, bindingHash, ssoRequest)
 		}
-		log.Printf("[INFO] created new user for email: %s", u.Email)
+	}
+	if err != nil {
+		log.Printf("[ERRO] can't send login email: %s", err.Error())
+		JSONResponse(w, "Failed to send login email", http.StatusInternalServerError)
+		return
 	}
 
+	if u.Method == "code" {
+		JSONResponse(w, "Login code sent to your email", http.StatusOK)
+	} else {
+		JSONResponse(w, "Login link sent to your email", http.StatusOK)
+	}
+	log.Printf("[INFO] end email login ----------------------/")
+}
+
+// sendLoginLink creates a one-time login token for the email and mails the magic link.
+func sendLoginLink(r *http.Request, email, bindingHash, ssoRequest string) error {
 	// Generate a random token for the magic link
 	token := uuid.New().String()
-	expires := time.Now().Add(10 * time.Minute)
+	ttl := currentConfig().TTL.LoginLink
+	expires := time.Now().Add(ttl)
 
-	_, err = CreateUserLogin(u.Email, token, expires)
+	realm := realmOf(r)
+	userLogin, err := repo.CreateUserLogin(realm.ID, email, token, "", expires)
 	if err != nil {
-		log.Printf("[ERRO] can't create login token: %s", err.Error())
-		JSONResponse(w, "Failed to create login token", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("can't create login token: %w", err)
 	}
-
-	// Build the magic link URL
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+	if bindingHash != "" {
+		if err := repo.BindUserLogin(userLogin.ID, bindingHash, clientIP(r), r.UserAgent()); err != nil {
+			return fmt.Errorf("can't bind login token: %w", err)
+		}
 	}
-	if fwdProto := r.Header.Get("X-Forwarded-Proto"); fwdProto != "" {
-		scheme = fwdProto
+	if ssoRequest != "" {
+		if err := repo.SetUserLoginSSORequest(userLogin.ID, ssoRequest); err != nil {
+			return fmt.Errorf("can't save SSO request of login token: %w", err)
+		}
 	}
-	loginLink := fmt.Sprintf("%s://%s/api/pub/verify_login?token=%s", scheme, r.Host, token)
 
+	loginLink := fmt.Sprintf("%s/api/pub/verify_login?token=%s", baseURL(r), token)
 	log.Printf("[INFO] login link: %s", loginLink)
 
 	// Send the magic link to the user's email
-	err = SendMail(u.Email, "Your login link", fmt.Sprintf("Click the link below to log in:\n\n%s\n\nThis link expires in 10 minutes.", loginLink))
+	return SendMail(r, email, MailLoginLink, "login_link:"+userLogin.ID, expires, map[string]any{"Link": loginLink, "Minutes": int(ttl.Minutes())})
+}
+
+// sendLoginCode emails a six-digit code that VerifyLoginCode exchanges for a session. Unlike
+// a link, it survives mail scanners that pre-fetch links and can be typed on another device.
+func sendLoginCode(r *http.Request, email string) error {
+	code, err := newLoginCode()
 	if err != nil {
-		log.Printf("[ERRO] can't send login email: %s", err.Error())
-		JSONResponse(w, "Failed to send login email", http.StatusInternalServerError)
-		return
+		return err
 	}
+	ttl := currentConfig().TTL.LoginLink
+	expires := time.Now().Add(ttl)
 
-	JSONResponse(w, "Login link sent to your email", http.StatusOK)
-	log.Printf("[INFO] end email login ----------------------/")
+	realm := realmOf(r)
+	userLogin, err := repo.CreateUserLogin(realm.ID, email, uuid.New().String(), code, expires)
+	if err != nil {
+		return fmt.Errorf("can't create login code: %w", err)
+	}
+
+	return SendMail(r, email, MailLoginCode, "login_code:"+userLogin.ID, expires, map[string]any{"Code": code, "Minutes": int(ttl.Minutes())})
+}
+
+// newLoginCode returns a random six-digit code.
+func newLoginCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// hashLoginCode hashes a login code for storage, salted with its user_login ID.
+func hashLoginCode(loginID, code string) string {
+	sum := sha256.Sum256([]byte(loginID + ":" + strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// baseURL returns scheme://host of the current request, honouring X-Forwarded-Proto,
+// followed by the realm's path prefix.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if fwdProto := r.Header.Get("X-Forwarded-Proto"); fwdProto != "" {
+		scheme = fwdProto
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, realmPath(r, ""))
 }
 
 /////////////////////////////
@@ -209,40 +470,139 @@ func VerifyLoginLink(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Look up the token in the user_login table
-	userLogin, err := GetUserLoginByToken(token)
+	userLogin, err := repo.GetUserLoginByToken(token)
 	if err != nil {
 		log.Printf("[ERRO] invalid login token: %s", err.Error())
 		http.Error(w, "Invalid or expired login link", http.StatusBadRequest)
 		return
 	}
 
+	// The link only works in the realm it was sent from
+	if userLogin.RealmID != nil && *userLogin.RealmID != realmOf(r).ID {
+		http.Error(w, "Invalid or expired login link", http.StatusBadRequest)
+		return
+	}
+
+	// A link bound to another browser asks to approve that browser's sign-in instead
+	if userLogin.BindingHash != nil && !sameBrowser(r, *userLogin.BindingHash) {
+		renderApprovePage(w, r, userLogin)
+		return
+	}
+
 	// Mark the token as used
-	err = MarkUserLoginUsed(userLogin.ID)
+	err = repo.UseUserLogin(userLogin.ID)
 	if err != nil {
 		log.Printf("[ERRO] can't mark login token as used: %s", err.Error())
+		http.Error(w, "Invalid or expired login link", http.StatusBadRequest)
+		return
+	}
+	if userLogin.BindingHash != nil {
+		clearLoginBinding(w, r)
 	}
 
-	// Find the user
-	user, err := GetUserByEmail(*userLogin.Email)
+	// Find the user, or create the account of a new one
+	user, err := loginUser(r, *userLogin.Email)
 	if err != nil {
 		log.Printf("[ERRO] can't get user: %s", err.Error())
 		http.Error(w, "User not found", http.StatusBadRequest)
 		return
 	}
 
-	// Create a session for the user
-	sessionID := uuid.New().String()
-	SaveSession(sessionID, &webauthn.SessionData{
-		UserID:  []byte(user.ID),
-		Expires: time.Now().Add(time.Hour),
-	}, time.Hour)
+	pending := takePendingSSO(userLogin)
+
+	// In a second_factor realm, users with an authenticator app enter a code first
+	if requireTOTP(w, r, user, pending) {
+		return
+	}
 
-	setSessionCookies(w, sessionID, time.Hour)
-	http.Redirect(w, r, "/", http.StatusFound)
+	// Create a session for the user, and go back into SSOAuthorize if the login came from there
+	createLoginSession(w, r, user.ID, []string{AMREmail})
+	if pending != nil {
+		http.Redirect(w, r, ssoAuthorizeURL(r, pending), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, realmPath(r, "/"), http.StatusFound)
 
 	log.Printf("[INFO] verify login link ----------------------/")
 }
 
+/////////////////////////////
+//                         //
+//    VerifyLoginCode      //
+//                         //
+/////////////////////////////
+
+// Wrong codes are limited per code and per email. A code is used up after
+// loginCodeMaxAttempts wrong tries; an email is locked for loginCodeLockout after
+// loginCodeMaxFailures wrong tries across all its codes.
+const (
+	loginCodeMaxAttempts = 5
+	loginCodeMaxFailures = 10
+	loginCodeLockout     = 15 * time.Minute
+)
+
+// VerifyLoginCode checks an emailed login code and creates the session. In a second_factor
+// realm it answers {"status": "totp_required"} instead for users with an authenticator app.
+// POST /api/pub/verify_code {"email": "...", "code": "123456"}
+func VerifyLoginCode(w http.ResponseWriter, r *http.Request) {
+	var req Req
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Email == "" || req.Code == "" {
+		JSONResponse(w, "Email and code are required", http.StatusBadRequest)
+		return
+	}
+
+	realm := realmOf(r)
+	failuresKey := fmt.Sprintf("login_code_attempts:%s:%s", realm.ID, strings.ToLower(req.Email))
+	if GetFailures(failuresKey) >= loginCodeMaxFailures {
+		JSONResponse(w, "Too many attempts, please try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	userLogin, err := repo.GetUserLoginByCode(realm.ID, req.Email)
+	if err != nil {
+		JSONResponse(w, "Invalid or expired code", http.StatusBadRequest)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hashLoginCode(userLogin.ID, req.Code)), []byte(*userLogin.CodeHash)) != 1 {
+		if err := repo.CountUserLoginAttempt(userLogin.ID, loginCodeMaxAttempts); err != nil {
+			log.Printf("[ERRO] can't count login attempt: %s", err.Error())
+		}
+		if CountFailure(failuresKey, loginCodeLockout) == loginCodeMaxFailures {
+			log.Printf("[WARN] login codes locked for %s in realm %s", req.Email, realm.ID)
+		}
+		JSONResponse(w, "Invalid or expired code", http.StatusBadRequest)
+		return
+	}
+	if err := repo.UseUserLogin(userLogin.ID); err != nil {
+		JSONResponse(w, "Invalid or expired code", http.StatusBadRequest)
+		return
+	}
+	ResetFailures(failuresKey)
+
+	user, err := loginUser(r, *userLogin.Email)
+	if err != nil {
+		log.Printf("[ERRO] can't get user: %s", err.Error())
+		JSONResponse(w, "User not found", http.StatusBadRequest)
+		return
+	}
+	held, err := holdForTOTP(w, r, user)
+	if err != nil {
+		log.Printf("[ERRO] can't save TOTP pending login: %s", err.Error())
+		JSONResponse(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if held {
+		JSONResponse(w, map[string]any{"status": "totp_required"}, http.StatusOK)
+		return
+	}
+	createLoginSession(w, r, user.ID, []string{AMREmail})
+	JSONResponse(w, map[string]any{"status": "ok"}, http.StatusOK)
+}
+
 /////////////////////////////
 //                         //
 //    BeginRegistration    //
@@ -252,14 +612,17 @@ func VerifyLoginLink(w http.ResponseWriter, r *http.Request) {
 func BeginRegistration(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[INFO] begin registration ----------------------\\")
 
-	u, err := getUserData(r)
-	if err != nil {
-		log.Printf("[ERRO]can't get user name: %s", err.Error())
-		JSONResponse(w, err.Error(), http.StatusBadRequest)
+	// The passkey is registered for the user of the recovery session, or else for the
+	// logged-in user after a step-up. The request body names no one.
+	userID := ""
+	if _, recoveryUserID := getRecoveryUserID(r); recoveryUserID != "" {
+		userID = recoveryUserID
+	} else if session := requireStepUp(w, r); session != nil {
+		userID = string(session.UserID)
+	} else {
 		return
 	}
-
-	user, err := GetUserByEmail(u.Email) // Find the user
+	user, err := repo.GetUser(userID)
 	if err != nil {
 		log.Printf("[ERRO] can't get user: %s", err.Error())
 		JSONResponse(w, err.Error(), http.StatusBadRequest)
@@ -268,7 +631,13 @@ func BeginRegistration(w http.ResponseWriter, r *http.Request) {
 
 	// Begin the registration process, which will return options to be sent to the client
 	// along with session data to be stored on the server until verification is finished
-	options, session, err := webAuthn.BeginRegistration(user)
+	// Let the authenticator refuse true duplicates. With the confirm policy, platform
+	// credentials stay off the list so that a re-enrolled Touch ID / Windows Hello key
+	// can be offered as a replacement in FinishRegistration.
+	exclusions := user.CredentialDescriptors(currentConfig().Policies.PasskeyReplace == PasskeyReplaceConfirm)
+	options, session, err := getWebAuthn(r).BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithExtensions(prfRegistrationExtensions()))
 	if err != nil {
 		msg := fmt.Sprintf("can't begin registration: %s", err.Error())
 		log.Printf("[ERRO] %s", msg)
@@ -276,8 +645,8 @@ func BeginRegistration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionID := uuid.New().String()
-	err = SaveSession(sessionID, session, time.Minute*5) // save session for 5 minutes
+	sessionID := realmOf(r).newID()
+	err = SaveSession(sessionID, session, currentConfig().TTL.Ceremony)
 	if err != nil {
 		log.Printf("[ERRO] can't save session: %s", err.Error())
 		JSONResponse(w, err.Error(), http.StatusBadRequest)
@@ -289,6 +658,72 @@ func BeginRegistration(w http.ResponseWriter, r *http.Request) {
 	// options.publicKey contain our registration options
 }
 
+// decoyUser stands in for an email without usable passkeys in BeginLogin. Its credentials
+// are derived from the email with the login_decoy_key setting, so that asking twice, or
+// another replica, gives the same list, as it would for a real account.
+type decoyUser struct {
+	id          []byte
+	credentials []webauthn.Credential
+}
+
+func newDecoyUser(realmID, email string) *decoyUser {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, loginDecoyKey())
+		mac.Write([]byte(realmID + ":" + strings.ToLower(email) + ":" + label))
+		return mac.Sum(nil)
+	}
+	user := &decoyUser{id: derive("user")}
+	// One or two credential IDs of 16 or 32 bytes, the lengths common authenticators use
+	shape := derive("shape")
+	for i := range 1 + int(shape[0]%2) {
+		id := derive(fmt.Sprintf("credential-%d", i))
+		if shape[1+i]%2 == 0 {
+			id = id[:16]
+		}
+		user.credentials = append(user.credentials, webauthn.Credential{
+			ID:        id,
+			Transport: []protocol.AuthenticatorTransport{protocol.Internal, protocol.Hybrid},
+		})
+	}
+	return user
+}
+
+func (u *decoyUser) WebAuthnID() []byte                         { return u.id }
+func (u *decoyUser) WebAuthnName() string                       { return "" }
+func (u *decoyUser) WebAuthnDisplayName() string                { return "" }
+func (u *decoyUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+func (u *decoyUser) descriptors() []protocol.CredentialDescriptor {
+	var descriptors []protocol.CredentialDescriptor
+	for _, c := range u.credentials {
+		descriptors = append(descriptors, c.Descriptor())
+	}
+	return descriptors
+}
+
+var decoyKey atomic.Pointer[[]byte]
+
+// loginDecoyKey returns the key decoy credentials are derived from. The first instance to
+// need it stores a random one; the insert keeps a key that another replica stored first.
+func loginDecoyKey() []byte {
+	if key := decoyKey.Load(); key != nil {
+		return *key
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	_, err := db.Exec("INSERT INTO setting (name, value, updated) VALUES (?, ?, ?) "+db.dialect.ignoreDuplicate("name"),
+		"login_decoy_key", hex.EncodeToString(b), time.Now())
+	if err != nil {
+		log.Printf("[ERRO] can't save login decoy key: %s", err.Error())
+	}
+	key, err := hex.DecodeString(GetSetting("login_decoy_key", ""))
+	if err != nil || len(key) == 0 {
+		return b
+	}
+	decoyKey.Store(&key)
+	return key
+}
+
 //////////////////////////////
 //                          //
 //    FinishRegistration    //
@@ -297,7 +732,7 @@ func BeginRegistration(w http.ResponseWriter, r *http.Request) {
 
 func FinishRegistration(w http.ResponseWriter, r *http.Request) {
 	// read register_sid from header
-	registerSid := r.Header.Get("register_sid")
+	registerSid := realmHeader(r, "register_sid")
 	if registerSid == "" {
 		log.Printf("[ERRO] missing register_sid header")
 		JSONResponse(w, "missing register_sid header", http.StatusBadRequest)
@@ -311,47 +746,168 @@ func FinishRegistration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUser(string(session.UserID))
+	user, err := repo.GetUser(string(session.UserID))
 	if err != nil {
 		log.Printf("[ERRO] can't get user: %s", err.Error())
 		JSONResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	credential, err := webAuthn.FinishRegistration(user, *session, r)
+	parsed, err := protocol.ParseCredentialCreationResponse(r)
 	if err != nil {
 		msg := fmt.Sprintf("can't finish registration: %s", err.Error())
 		log.Printf("[ERRO] %s", msg)
 		JSONResponse(w, msg, http.StatusBadRequest)
 		return
 	}
-
-	// Check if an existing credential uses the same authenticator (AAGUID).
-	// Platform authenticators (e.g. Touch ID) overwrite the old key pair internally.
-	aaguid := credential.Authenticator.AAGUID
-	newAAGUID := fmt.Sprintf("%08x-%04x-%04x-%04x-%012x", aaguid[0:4], aaguid[4:6], aaguid[6:8], aaguid[8:10], aaguid[10:16])
-	var duplicateIDs []string
-	for _, existing := range user.Credentials() {
-		if existing.AAGUID != nil && *existing.AAGUID == newAAGUID {
-			duplicateIDs = append(duplicateIDs, existing.ID)
-		}
-	}
-
-	if len(duplicateIDs) > 0 {
-		DeleteSession(registerSid)
-		log.Printf("[INFO] duplicate authenticator detected, rejecting registration")
-		JSONResponse(w, "A passkey from this authenticator is already registered. Delete the existing passkey first.", http.StatusBadRequest)
+	credential, err := getWebAuthn(r).CreateCredential(user, *session, parsed)
+	if err != nil {
+		msg := fmt.Sprintf("can't finish registration: %s", err.Error())
+		log.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusBadRequest)
 		return
 	}
+	prf := prfEnabled(parsed.ClientExtensionResults)
+
+	// Duplicates are refused by the authenticator through excludeCredentials. The only case
+	// left is a platform authenticator that overwrote its old key pair internally; with the
+	// confirm policy the user decides whether the new passkey replaces the old one.
+	if currentConfig().Policies.PasskeyReplace == PasskeyReplaceConfirm && isPlatformCredential(credential) {
+		replaceIDs := replaceableCredentialIDs(user, credential)
+		if len(replaceIDs) > 0 {
+			DeleteSession(registerSid)
+			err = SavePendingCredential(registerSid, user.ID, credential, prf, currentConfig().TTL.Ceremony)
+			if err != nil {
+				log.Printf("[ERRO] can't save pending credential: %s", err.Error())
+				JSONResponse(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("[INFO] platform authenticator already registered, asking user to confirm replacement")
+			JSONResponse(w, map[string]any{
+				"status":  "confirm_replace",
+				"message": "A passkey from this device is already registered. Replace it with the new one?",
+				"replace": replaceIDs,
+			}, http.StatusOK)
+			return
+		}
+	}
 
-	user.AddCredential(credential, r.UserAgent())
+	addCredential(r, user, credential, prf)
 	DeleteSession(registerSid)
+	finishRecovery(w, r, user.ID)
 	log.Printf("[INFO] finish registration ----------------------/")
 	JSONResponse(w, map[string]any{"status": "ok", "message": "Registration Success"}, http.StatusOK)
 
 	// SendMail(user.WebAuthnEmail(), "Welcome to Go Passkey", "Thank you for registering with Go Passkey!")
 }
 
+///////////////////////////////
+//                           //
+//    ConfirmRegistration    //
+//                           //
+///////////////////////////////
+
+// ConfirmRegistration stores a credential held back by FinishRegistration.
+// With replace set, the platform credentials it supersedes are removed; otherwise both are kept.
+func ConfirmRegistration(w http.ResponseWriter, r *http.Request) {
+	registerSid := realmHeader(r, "register_sid")
+	if registerSid == "" {
+		log.Printf("[ERRO] missing register_sid header")
+		JSONResponse(w, "missing register_sid header", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Replace bool `json:"replace"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	pending, err := GetPendingCredential(registerSid)
+	if err != nil {
+		log.Printf("[ERRO] can't get pending credential: %s", err.Error())
+		JSONResponse(w, "Registration expired, please try again", http.StatusBadRequest)
+		return
+	}
+	DeletePendingCredential(registerSid)
+	credential := pending.Credential
+
+	user, err := repo.GetUser(pending.UserID)
+	if err != nil {
+		log.Printf("[ERRO] can't get user: %s", err.Error())
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Replace {
+		for _, id := range replaceableCredentialIDs(user, credential) {
+			user.RemoveCredential([]byte(id))
+		}
+	}
+	addCredential(r, user, credential, pending.PRF)
+	finishRecovery(w, r, user.ID)
+	log.Printf("[INFO] confirm registration, replace: %t", req.Replace)
+	JSONResponse(w, map[string]any{"status": "ok", "message": "Registration Success"}, http.StatusOK)
+}
+
+// addCredential stores a newly registered credential with a default label and, if the
+// authenticator supports it, a PRF salt.
+func addCredential(r *http.Request, user *PasskeyUser, credential *webauthn.Credential, prf bool) {
+	label := defaultCredentialLabel(formatAAGUID(credential.Authenticator.AAGUID), r.UserAgent())
+	user.AddCredential(credential, label)
+	notifyNewPasskey(r, user, fmt.Sprintf("%x", credential.ID), label)
+	if !prf {
+		return
+	}
+	if err := repo.SetCredentialPRFSalt(fmt.Sprintf("%x", credential.ID)); err != nil {
+		log.Printf("[ERRO] can't store PRF salt: %s", err.Error())
+	}
+}
+
+// notifyNewPasskey emails the user that a passkey was added to their account.
+func notifyNewPasskey(r *http.Request, user *PasskeyUser, credID, label string) {
+	browser, os := parseUserAgent(r.UserAgent())
+	err := SendMail(r, user.Email, MailNewPasskey, mailDedupeKey(0, "new_passkey", credID), time.Time{}, map[string]any{
+		"Label":   label,
+		"Browser": browser + " on " + os,
+		"IP":      clientIP(r),
+		"Time":    time.Now().UTC().Format("2006-01-02 15:04 MST"),
+	})
+	if err != nil {
+		log.Printf("[ERRO] can't send new passkey mail: %s", err.Error())
+	}
+}
+
+// finishRecovery ends the recovery session of the user after a passkey was registered, so
+// that they sign in with it.
+func finishRecovery(w http.ResponseWriter, r *http.Request, userID string) {
+	if sid, recoveryUserID := getRecoveryUserID(r); recoveryUserID == userID {
+		endRecoverySession(w, r, sid)
+		log.Printf("[INFO] recovery finished for user %s", userID)
+	}
+}
+
+// replaceableCredentialIDs returns the user's platform credentials from the same authenticator
+// model as the new credential. Authenticators reporting the all-zero AAGUID never match.
+func replaceableCredentialIDs(user *PasskeyUser, credential *webauthn.Credential) []string {
+	aaguid := formatAAGUID(credential.Authenticator.AAGUID)
+	if isZeroAAGUID(aaguid) {
+		return nil
+	}
+	var ids []string
+	for _, existing := range user.Credentials() {
+		if existing.AAGUID == nil || *existing.AAGUID != aaguid || existing.Credential == nil {
+			continue
+		}
+		if isPlatformCredential(existing.Credential) {
+			ids = append(ids, existing.ID)
+		}
+	}
+	return ids
+}
+
 //////////////////////
 //                  //
 //    BeginLogin    //
@@ -368,14 +924,30 @@ func BeginLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUserByEmail(u.Email) // Find the user
-	if err != nil {
-		log.Printf("[ERRO] can't get user: %s", err.Error())
-		JSONResponse(w, err.Error(), http.StatusBadRequest)
-		return
+	// Unknown emails and accounts without usable passkeys get options for made-up
+	// credentials, so that the answer doesn't tell whether the account exists. The
+	// assertion then fails in FinishLogin like one with a wrong passkey.
+	var webAuthnUser webauthn.User
+	var allowed []protocol.CredentialDescriptor
+	user, err := repo.GetUserByEmail(realmOf(r).ID, u.Email) // Find the user
+	if err == nil {
+		webAuthnUser, allowed = user, user.LoginCredentialDescriptors()
+	}
+	if len(allowed) == 0 {
+		log.Printf("[INFO] begin login without usable passkeys, sending decoy options")
+		decoy := newDecoyUser(realmOf(r).ID, u.Email)
+		webAuthnUser, allowed = decoy, decoy.descriptors()
 	}
 
-	options, session, err := webAuthn.BeginLogin(user)
+	opts := []webauthn.LoginOption{webauthn.WithAllowedCredentials(allowed)}
+	// ?prf=1 also evaluates the PRF on credentials that support it. The output stays in the
+	// browser and must be removed from the assertion before it is posted back.
+	if r.URL.Query().Get("prf") == "1" && user != nil {
+		if extensions, ok := prfLoginExtensions(user, prfContextSelf); ok {
+			opts = append(opts, webauthn.WithAssertionExtensions(extensions))
+		}
+	}
+	options, session, err := getWebAuthn(r).BeginLogin(webAuthnUser, opts...)
 	if err != nil {
 		msg := fmt.Sprintf("can't begin login: %s", err.Error())
 		log.Printf("[ERRO] %s", msg)
@@ -384,8 +956,8 @@ func BeginLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Make a session key and store the sessionData values
-	sessionID := uuid.New().String()
-	err = SaveSession(sessionID, session, time.Minute*5) // save session for 5 minutes
+	sessionID := realmOf(r).newID()
+	err = SaveSession(sessionID, session, currentConfig().TTL.Ceremony)
 	if err != nil {
 		log.Printf("[ERRO] can't save session: %s", err.Error())
 		JSONResponse(w, err.Error(), http.StatusBadRequest)
@@ -405,7 +977,7 @@ func BeginLogin(w http.ResponseWriter, r *http.Request) {
 ///////////////////////
 
 func FinishLogin(w http.ResponseWriter, r *http.Request) {
-	loginSid := r.Header.Get("login_sid")
+	loginSid := realmHeader(r, "login_sid")
 	if loginSid == "" {
 		log.Printf("[ERRO] missing login_sid header")
 		JSONResponse(w, "missing login_sid header", http.StatusBadRequest)
@@ -420,42 +992,48 @@ func FinishLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// In out example username == userID, but in real world it should be different
-	user, err := GetUser(string(session.UserID))
+	user, err := repo.GetUser(string(session.UserID))
 	if err != nil {
 		log.Printf("[ERRO] can't get user: %s", err.Error())
 		JSONResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	credential, err := webAuthn.FinishLogin(user, *session, r)
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		log.Printf("[ERRO] can't finish login: %s", err.Error())
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dropPRFResults(parsed)
+	credential, err := getWebAuthn(r).ValidateLogin(user, *session, parsed)
 	if err != nil {
 		log.Printf("[ERRO] can't finish login: %s", err.Error())
 		JSONResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Handle credential.Authenticator.CloneWarning
-	if credential.Authenticator.CloneWarning {
-		log.Printf("[WARN] can't finish login: %s", "CloneWarning")
-		JSONResponse(w, "CloneWarning", http.StatusBadRequest)
+	// Disabled credentials are left out of allowCredentials, but refuse them here as well
+	if stored := user.Credential(fmt.Sprintf("%x", credential.ID)); stored != nil && stored.Disabled != nil && *stored.Disabled {
+		log.Printf("[WARN] can't finish login: credential is disabled")
+		JSONResponse(w, "This passkey has been disabled", http.StatusForbidden)
+		return
+	}
+
+	// The sign counter went backwards, apply the configured clone-warning policy
+	if credential.Authenticator.CloneWarning && !handleCloneWarning(w, r, user, credential) {
+		DeleteSession(loginSid)
 		return
 	}
 
-	// If login was successful, update the credential object
-	user.UpdateCredential(credential)
-	// SaveUser(user)
+	// If login was successful, update the credential object and its usage data
+	user.UpdateCredential(credential, clientIP(r), r.UserAgent())
+	// repo.SaveUser(user)
 
 	// Delete the login session data
 	DeleteSession(loginSid)
 
-	/////////////////////////////////////////////////////////////////
-	sessionID := uuid.New().String()
-	SaveSession(sessionID, &webauthn.SessionData{
-		UserID:  user.WebAuthnID(),
-		Expires: time.Now().Add(time.Hour),
-	}, time.Hour) // save session for 1 hour
-	setSessionCookies(w, sessionID, time.Hour)
-	/////////////////////////////////////////////////////////////////
+	createLoginSession(w, r, user.ID, passkeyAMR(credential))
 
 	log.Printf("[INFO] finish login ----------------------/")
 	JSONResponse(w, "Login Success", http.StatusOK)
@@ -477,7 +1055,7 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("Logging out session", sid)
 	DeleteSession(sid)
-	clearSessionCookies(w)
+	clearSessionCookies(w, r)
 	JSONResponse(w, "Logout Success", http.StatusOK)
 }
 
@@ -530,19 +1108,50 @@ func Auth(next http.Handler) http.Handler {
 	})
 }
 
+// createLoginSession starts a logged-in session of ttl.session and sets the session cookies.
+func createLoginSession(w http.ResponseWriter, r *http.Request, userID string, amr []string) string {
+	sessionID := realmOf(r).newID()
+	now := time.Now()
+	ttl := currentConfig().TTL.Session
+	err := SaveLoginSession(sessionID, &Session{
+		SessionData: webauthn.SessionData{
+			UserID:  []byte(userID),
+			Expires: now.Add(ttl),
+		},
+		AuthTime: now,
+		AMR:      amr,
+	}, ttl)
+	if err != nil {
+		log.Printf("[ERRO] can't save session: %s", err.Error())
+	}
+	setSessionCookies(w, r, sessionID, ttl)
+	return sessionID
+}
+
+// passkeyAMR returns the authentication methods proven by a passkey assertion.
+func passkeyAMR(credential *webauthn.Credential) []string {
+	if credential.Flags.UserVerified {
+		return []string{AMRPasskey, AMRMFA}
+	}
+	return []string{AMRPasskey}
+}
+
+// getSessionID returns the session ID from the cookie, or "" if it belongs to another realm.
 func getSessionID(r *http.Request) string {
 	cookie, err := r.Cookie("sso_session")
-	if err != nil {
+	if err != nil || !realmOf(r).owns(cookie.Value) {
 		return ""
 	}
 	return cookie.Value
 }
 
-func setSessionCookies(w http.ResponseWriter, sid string, ttl time.Duration) {
+// setSessionCookies sets the session cookies, scoped to the realm's path prefix if any.
+func setSessionCookies(w http.ResponseWriter, r *http.Request, sid string, ttl time.Duration) {
+	path := realmPath(r, "/")
 	http.SetCookie(w, &http.Cookie{
 		Name:     "sso_session",
 		Value:    sid,
-		Path:     "/",
+		Path:     path,
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 		MaxAge:   int(ttl.Seconds()),
@@ -550,15 +1159,16 @@ func setSessionCookies(w http.ResponseWriter, sid string, ttl time.Duration) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "sso_logged_in",
 		Value:    "1",
-		Path:     "/",
+		Path:     path,
 		SameSite: http.SameSiteLaxMode,
 		MaxAge:   int(ttl.Seconds()),
 	})
 }
 
-func clearSessionCookies(w http.ResponseWriter) {
-	http.SetCookie(w, &http.Cookie{Name: "sso_session", Value: "", Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode, MaxAge: -1})
-	http.SetCookie(w, &http.Cookie{Name: "sso_logged_in", Value: "", Path: "/", SameSite: http.SameSiteLaxMode, MaxAge: -1})
+func clearSessionCookies(w http.ResponseWriter, r *http.Request) {
+	path := realmPath(r, "/")
+	http.SetCookie(w, &http.Cookie{Name: "sso_session", Value: "", Path: path, HttpOnly: true, SameSite: http.SameSiteLaxMode, MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: "sso_logged_in", Value: "", Path: path, SameSite: http.SameSiteLaxMode, MaxAge: -1})
 }
 
 // JSONResponse is a helper function to send json response
@@ -618,7 +1228,7 @@ func Me(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUser(string(session.UserID))
+	user, err := repo.GetUser(string(session.UserID))
 	if err != nil {
 		log.Printf("[ERRO] can't get user: %s", err.Error())
 		JSONResponse(w, err.Error(), http.StatusBadRequest)
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+func TestNewLoginCode(t *testing.T) {
+	pattern := regexp.MustCompile(`^[0-9]{6}$`)
+	for range 100 {
+		code, err := newLoginCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pattern.MatchString(code) {
+			t.Fatalf("newLoginCode = %q; want six digits", code)
+		}
+	}
+}
+
+func TestHashLoginCode(t *testing.T) {
+	want := hashLoginCode("login-1", "012345")
+	if got := hashLoginCode("login-1", " 012345 "); got != want {
+		t.Error("hashLoginCode depends on surrounding whitespace")
+	}
+	if hashLoginCode("login-2", "012345") == want {
+		t.Error("hashLoginCode is the same for two logins")
+	}
+	if hashLoginCode("login-1", "012346") == want {
+		t.Error("hashLoginCode is the same for two codes")
+	}
+}
+
+func TestBeginRegistration(t *testing.T) {
+	initTestDB(t)
+	defer db.Close()
+	initTestStore(t)
+	setTestConfig(t, func(c *Config) {
+		c.RelyingParty.ID, c.RelyingParty.Origins = "localhost", []string{"http://localhost"}
+	})
+	reloadPasskeyStore()
+	userID, cleanupUser := createTestUser(t)
+	defer cleanupUser()
+	otherID, cleanupOther := createTestUser(t)
+	defer cleanupOther()
+	other, _ := repo.GetUser(otherID)
+
+	begin := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		t.Helper()
+		// The email in the body must not matter
+		r := httptest.NewRequest(http.MethodPost, "/api/pub/passkey_register_start", strings.NewReader(`{"email": "`+other.Email+`"}`))
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		BeginRegistration(w, r)
+		return w
+	}
+	registeredFor := func(w *httptest.ResponseRecorder) string {
+		t.Helper()
+		session, err := GetSession(w.Header().Get("register_sid"))
+		if err != nil {
+			t.Fatalf("no registration session: %v", err)
+		}
+		return string(session.UserID)
+	}
+
+	if w := begin(nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a session = %d; want 401", w.Code)
+	}
+
+	sid := uuid.New().String()
+	SaveLoginSession(sid, &Session{SessionData: webauthn.SessionData{UserID: []byte(userID)}, AuthTime: time.Now(), AMR: []string{AMREmail}}, time.Hour)
+	w := begin(&http.Cookie{Name: "sso_session", Value: sid})
+	if w.Code != http.StatusOK || registeredFor(w) != userID {
+		t.Errorf("recent login without passkeys = %d; want options for the session's user", w.Code)
+	}
+
+	label := "Key"
+	repo.CreateCredential(&PasskeyUserCredential{ID: "c-" + userID, UserID: &userID, Label: &label, Credential: &webauthn.Credential{ID: []byte("c-" + userID)}})
+	defer repo.DeleteCredential("c-" + userID)
+	if w := begin(&http.Cookie{Name: "sso_session", Value: sid}); w.Code != http.StatusUnauthorized || w.Header().Get("step_up_required") == "" {
+		t.Errorf("login without a passkey assertion = %d; want step_up_required", w.Code)
+	}
+
+	recoverySid := uuid.New().String()
+	SaveRecoverySession(recoverySid, userID, time.Minute)
+	w = begin(&http.Cookie{Name: "recovery_session", Value: recoverySid})
+	if w.Code != http.StatusOK || registeredFor(w) != userID {
+		t.Errorf("recovery session = %d; want options for the recovering user", w.Code)
+	}
+}
+
+func TestBeginLoginDecoy(t *testing.T) {
+	initTestDB(t)
+	defer db.Close()
+	initTestStore(t)
+	setTestConfig(t, func(c *Config) {
+		c.RelyingParty.ID, c.RelyingParty.Origins = "localhost", []string{"http://localhost"}
+	})
+	reloadPasskeyStore()
+	userID, cleanupUser := createTestUser(t)
+	defer cleanupUser()
+	user, _ := repo.GetUser(userID)
+
+	allowed := func(email string) []string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		BeginLogin(w, httptest.NewRequest(http.MethodPost, "/api/pub/passkey_login_start", strings.NewReader(`{"email": "`+email+`"}`)))
+		if w.Code != http.StatusOK || w.Header().Get("login_sid") == "" {
+			t.Fatalf("passkey_login_start(%s) = %d %s; want options", email, w.Code, w.Body.String())
+		}
+		var options struct {
+			PublicKey struct {
+				AllowCredentials []struct {
+					ID string `json:"id"`
+				} `json:"allowCredentials"`
+			} `json:"publicKey"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &options)
+		var ids []string
+		for _, c := range options.PublicKey.AllowCredentials {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+
+	unknown := allowed("nobody@example.com")
+	if len(unknown) == 0 || !slices.Equal(allowed("nobody@example.com"), unknown) {
+		t.Errorf("unknown email got %v; want the same made-up credentials every time", unknown)
+	}
+	if withoutPasskeys := allowed(user.Email); len(withoutPasskeys) == 0 {
+		t.Error("account without passkeys got no credentials")
+	}
+	label := "Key"
+	repo.CreateCredential(&PasskeyUserCredential{ID: "c-" + userID, UserID: &userID, Label: &label, Credential: &webauthn.Credential{ID: []byte("c-" + userID)}})
+	defer repo.DeleteCredential("c-" + userID)
+	if ids := allowed(user.Email); len(ids) != 1 || slices.Equal(ids, unknown) {
+		t.Errorf("account with a passkey got %v; want its credential", ids)
+	}
+}
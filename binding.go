@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// With magic_link_binding (default from MAGIC_LINK_BINDING), BeginEmailLogin gives the
+// browser a random nonce in the login_binding cookie and stores its hash on the user_login
+// row. The link then only logs in that browser. Opened anywhere else, it shows a page where
+// the user can approve the sign-in, which the original browser picks up with LoginPoll.
+// This stops login CSRF, and a relayed link no longer logs in whoever opens it.
+
+// magicLinkBinding reports whether magic links are bound to the requesting browser.
+func magicLinkBinding() bool {
+	return GetSetting("magic_link_binding", strconv.FormatBool(currentConfig().Policies.MagicLinkBinding)) == "true"
+}
+
+func hashBinding(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// newLoginBinding sets the binding nonce cookie and returns the hash to store. A browser
+// that already has a nonce keeps it, so that a second link requested before the first was
+// used doesn't unbind the first one.
+func newLoginBinding(w http.ResponseWriter, r *http.Request, ttl time.Duration) string {
+	nonce := ""
+	if cookie, err := r.Cookie("login_binding"); err == nil && len(cookie.Value) == 64 {
+		nonce = cookie.Value
+	} else {
+		b := make([]byte, 32)
+		rand.Read(b)
+		nonce = hex.EncodeToString(b)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "login_binding",
+		Value:    nonce,
+		Path:     realmPath(r, "/"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(ttl.Seconds()),
+	})
+	return hashBinding(nonce)
+}
+
+// loginBindingHash returns the hash of the request's binding nonce, or "" if it has none.
+func loginBindingHash(r *http.Request) string {
+	cookie, err := r.Cookie("login_binding")
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	return hashBinding(cookie.Value)
+}
+
+// sameBrowser reports whether the request comes from the browser a login was bound to.
+func sameBrowser(r *http.Request, bindingHash string) bool {
+	hash := loginBindingHash(r)
+	return hash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(bindingHash)) == 1
+}
+
+func clearLoginBinding(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: "login_binding", Value: "", Path: realmPath(r, "/"), HttpOnly: true, SameSite: http.SameSiteLaxMode, MaxAge: -1})
+}
+
+// renderApprovePage shows a bound magic link opened in another browser. Approving needs a
+// POST, so mail scanners that fetch the link can't approve it.
+func renderApprovePage(w http.ResponseWriter, r *http.Request, login *UserLogin) {
+	browser, os := "Unknown browser", "unknown system"
+	if login.RequestUserAgent != nil {
+		browser, os = parseUserAgent(*login.RequestUserAgent)
+	}
+	ip := ""
+	if login.RequestIP != nil {
+		ip = *login.RequestIP
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err := approvePageTemplate.Execute(w, map[string]any{
+		"Base":    realmPath(r, ""),
+		"Realm":   realmOf(r).DisplayName(),
+		"Email":   *login.Email,
+		"Token":   *login.Token,
+		"Browser": browser,
+		"OS":      os,
+		"IP":      ip,
+		"Created": login.Created.Format("2006-01-02 15:04"),
+	})
+	if err != nil {
+		log.Printf("[ERRO] can't render approve page: %s", err.Error())
+	}
+}
+
+////////////////////////////
+//                        //
+//    ApproveLogin        //
+//                        //
+////////////////////////////
+
+// ApproveLogin approves or denies a bound magic link opened in another browser.
+// POST /api/pub/approve_login {"token": "...", "approve": true}
+func ApproveLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token   string `json:"token"`
+		Approve bool   `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	userLogin, err := repo.GetUserLoginByToken(req.Token)
+	if err != nil || userLogin.BindingHash == nil || userLogin.RealmID == nil || *userLogin.RealmID != realmOf(r).ID {
+		JSONResponse(w, "Invalid or expired login link", http.StatusBadRequest)
+		return
+	}
+	if !req.Approve {
+		repo.UseUserLogin(userLogin.ID)
+		log.Printf("[INFO] sign-in for %s denied from another browser", *userLogin.Email)
+		JSONResponse(w, "Sign-in denied", http.StatusOK)
+		return
+	}
+	if err := repo.ApproveUserLogin(userLogin.ID); err != nil {
+		JSONResponse(w, "Invalid or expired login link", http.StatusBadRequest)
+		return
+	}
+	log.Printf("[INFO] sign-in for %s approved from another browser", *userLogin.Email)
+	JSONResponse(w, "Sign-in approved. Continue on your other device.", http.StatusOK)
+}
+
+////////////////////////////
+//                        //
+//    LoginPoll           //
+//                        //
+////////////////////////////
+
+// LoginPoll lets the browser that requested a bound magic link wait for its approval, and
+// creates its session once the link was approved elsewhere. The status is none without a
+// binding cookie, pending while waiting, done when the link was used or denied, and ok
+// (or totp_required) when logged in. A login started by SSOAuthorize also returns the
+// redirect back into it.
+// POST /api/pub/login_poll
+func LoginPoll(w http.ResponseWriter, r *http.Request) {
+	hash := loginBindingHash(r)
+	if hash == "" {
+		JSONResponse(w, map[string]any{"status": "none"}, http.StatusOK)
+		return
+	}
+	userLogin, err := repo.GetUserLoginByBinding(realmOf(r).ID, hash)
+	if err != nil {
+		JSONResponse(w, map[string]any{"status": "none"}, http.StatusOK)
+		return
+	}
+	if userLogin.Used != nil && *userLogin.Used {
+		JSONResponse(w, map[string]any{"status": "done"}, http.StatusOK)
+		return
+	}
+	if userLogin.Approved == nil || !*userLogin.Approved {
+		JSONResponse(w, map[string]any{"status": "pending"}, http.StatusOK)
+		return
+	}
+	if err := repo.UseUserLogin(userLogin.ID); err != nil {
+		JSONResponse(w, map[string]any{"status": "done"}, http.StatusOK)
+		return
+	}
+	clearLoginBinding(w, r)
+
+	user, err := loginUser(r, *userLogin.Email)
+	if err != nil {
+		log.Printf("[ERRO] can't get user: %s", err.Error())
+		JSONResponse(w, "User not found", http.StatusBadRequest)
+		return
+	}
+	pending := takePendingSSO(userLogin)
+	held, err := holdForTOTP(w, r, user)
+	if err != nil {
+		log.Printf("[ERRO] can't save TOTP pending login: %s", err.Error())
+		JSONResponse(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if held {
+		JSONResponse(w, map[string]any{"status": "totp_required"}, http.StatusOK)
+		return
+	}
+	createLoginSession(w, r, user.ID, []string{AMREmail})
+	if pending != nil {
+		JSONResponse(w, map[string]any{"status": "ok", "redirect": ssoAuthorizeURL(r, pending)}, http.StatusOK)
+		return
+	}
+	JSONResponse(w, map[string]any{"status": "ok"}, http.StatusOK)
+}
+
+var approvePageTemplate = template.Must(template.New("approve").Parse(`<!DOCTYPE html>
+<html data-ui-theme="nord">
+<head>
+  <meta charset="UTF-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Approve sign-in</title>
+  <link rel="stylesheet" href="https://cdn.jsdelivr.net/gh/az-code-lab/ui/src/ui.css">
+  <link rel="stylesheet" href="https://cdn.jsdelivr.net/gh/az-code-lab/ui/src/themes/nord.css">
+  <style>body { display: flex; align-items: center; justify-content: center; min-height: 100vh; } .ui-panel { max-width: 420px; width: 100%; }</style>
+</head>
+<body>
+  <div class="ui-panel raised">
+    <div class="ui-panel-header"><h2 class="ui-panel-title">Approve sign-in on your other device?</h2></div>
+    <div class="ui-panel-body">
+      <div class="ui-stack">
+        <p>This link was requested on another browser. Approving signs that browser in to <strong>{{.Realm}}</strong> as <strong>{{.Email}}</strong>.</p>
+        <table class="ui-table borderless">
+          <tr><td>Browser</td><td>{{.Browser}} on {{.OS}}</td></tr>
+          <tr><td>IP</td><td>{{.IP}}</td></tr>
+          <tr><td>Requested</td><td>{{.Created}}</td></tr>
+        </table>
+        <div class="ui-alert warning">Only approve if you requested this sign-in yourself. Nobody from {{.Realm}} will ask you to approve a sign-in.</div>
+        <div id="message" class="ui-alert" hidden></div>
+        <div id="actions" class="ui-stack sm">
+          <button id="approve" class="ui-btn block">Approve</button>
+          <button id="deny" class="ui-btn outline danger block">Deny</button>
+        </div>
+      </div>
+    </div>
+  </div>
+  <script>
+    const base = {{.Base}};
+    const token = {{.Token}};
+    const message = document.getElementById('message');
+    async function answer(approve) {
+      const response = await fetch(base + '/api/pub/approve_login', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ token, approve }) });
+      message.hidden = false;
+      message.classList.toggle('danger', !response.ok);
+      message.textContent = await response.json();
+      document.getElementById('actions').hidden = true;
+    }
+    document.getElementById('approve').addEventListener('click', () => answer(true));
+    document.getElementById('deny').addEventListener('click', () => answer(false));
+  </script>
+</body>
+</html>
+`))
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSameBrowser(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/pub/verify_login", nil)
+	hash := hashBinding("nonce-1")
+	if sameBrowser(r, hash) {
+		t.Error("sameBrowser without a binding cookie")
+	}
+	r.AddCookie(&http.Cookie{Name: "login_binding", Value: "nonce-2"})
+	if sameBrowser(r, hash) {
+		t.Error("sameBrowser with another browser's nonce")
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/pub/verify_login", nil)
+	r.AddCookie(&http.Cookie{Name: "login_binding", Value: "nonce-1"})
+	if !sameBrowser(r, hash) {
+		t.Error("not sameBrowser with the bound nonce")
+	}
+}
+
+func TestNewLoginBinding(t *testing.T) {
+	w := httptest.NewRecorder()
+	hash := newLoginBinding(w, httptest.NewRequest(http.MethodPost, "/api/pub/login_start", nil), time.Minute)
+	nonce := w.Result().Cookies()[0].Value
+	if hashBinding(nonce) != hash {
+		t.Fatal("newLoginBinding returned another nonce's hash")
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/pub/login_start", nil)
+	r.AddCookie(&http.Cookie{Name: "login_binding", Value: nonce})
+	if newLoginBinding(httptest.NewRecorder(), r, time.Minute) != hash {
+		t.Error("a second link request replaced the browser's nonce")
+	}
+}
+
+func TestApproveLoginPoll(t *testing.T) {
+	initTestDB(t)
+	defer db.Close()
+	initTestStore(t)
+	userID, cleanupUser := createTestUser(t)
+	defer cleanupUser()
+	user, _ := repo.GetUser(userID)
+	token := uuid.New().String()
+	login, err := repo.CreateUserLogin(defaultRealmID, user.Email, token, "", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.BindUserLogin(login.ID, hashBinding("nonce-1"), "192.0.2.1", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	poll := func() (map[string]any, *httptest.ResponseRecorder) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/api/pub/login_poll", nil)
+		r.AddCookie(&http.Cookie{Name: "login_binding", Value: "nonce-1"})
+		w := httptest.NewRecorder()
+		LoginPoll(w, r)
+		var result map[string]any
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return result, w
+	}
+	if result, _ := poll(); result["status"] != "pending" {
+		t.Errorf("status before approval = %v; want pending", result["status"])
+	}
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		ApproveLogin(w, httptest.NewRequest(http.MethodPost, "/api/pub/approve_login", strings.NewReader(`{"token": "`+token+`", "approve": true}`)))
+		if w.Code != http.StatusOK {
+			t.Errorf("approve_login = %d %s; want 200 every time", w.Code, w.Body.String())
+		}
+	}
+
+	result, w := poll()
+	if result["status"] != "ok" {
+		t.Fatalf("status after approval = %v; want ok", result["status"])
+	}
+	var sid string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "sso_session" {
+			sid = cookie.Value
+		}
+	}
+	if session, err := GetLoginSession(sid); err != nil || string(session.UserID) != userID {
+		t.Errorf("no session for the approved login: %v", err)
+	}
+	if result, _ := poll(); result["status"] != "done" {
+		t.Errorf("status after login = %v; want done", result["status"])
+	}
+}
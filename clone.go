@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Clone-warning policies, selected by the clone_warning_policy setting
+// (default from CLONE_WARNING_POLICY).
+const (
+	ClonePolicyReject  = "reject"  // fail the login
+	ClonePolicyAlert   = "alert"   // allow the login, record and notify
+	ClonePolicyDisable = "disable" // disable the credential and send a login link by email
+)
+
+var clonePolicies = []string{ClonePolicyReject, ClonePolicyAlert, ClonePolicyDisable}
+
+// handleCloneWarning applies the clone-warning policy to a login whose sign counter went
+// backwards. It returns true if the login may continue; otherwise the response is written.
+func handleCloneWarning(w http.ResponseWriter, r *http.Request, user *PasskeyUser, credential *webauthn.Credential) bool {
+	policy := GetSetting("clone_warning_policy", currentConfig().Policies.CloneWarning)
+	credID := fmt.Sprintf("%x", credential.ID)
+	log.Printf("[WARN] clone warning for credential %s of user %s, policy: %s", credID, user.ID, policy)
+
+	if err := repo.MarkCredentialSuspect(credID, policy == ClonePolicyDisable); err != nil {
+		log.Printf("[ERRO] can't mark credential suspect: %s", err.Error())
+	}
+
+	eventType := "clone_warning"
+	detail := fmt.Sprintf("sign counter went backwards, policy: %s", policy)
+	ip := clientIP(r)
+	userAgent := r.UserAgent()
+	err := CreateSecurityEvent(&SecurityEvent{
+		UserID:       &user.ID,
+		CredentialID: &credID,
+		Type:         &eventType,
+		Detail:       &detail,
+		IP:           &ip,
+		UserAgent:    &userAgent,
+	})
+	if err != nil {
+		log.Printf("[ERRO] can't record security event: %s", err.Error())
+	}
+
+	notifyCloneWarning(r, user, credID, policy, ip, userAgent)
+
+	switch policy {
+	case ClonePolicyAlert:
+		return true
+	case ClonePolicyDisable:
+		if err := sendLoginLink(r, user.Email, "", ""); err != nil {
+			log.Printf("[ERRO] can't send login link: %s", err.Error())
+		}
+		JSONResponse(w, "This passkey may have been cloned and has been disabled. Check your email to sign in.", http.StatusForbidden)
+		return false
+	default:
+		JSONResponse(w, "CloneWarning", http.StatusBadRequest)
+		return false
+	}
+}
+
+// notifyCloneWarning emails the user and all admins about a clone warning.
+func notifyCloneWarning(r *http.Request, user *PasskeyUser, credID, policy, ip, userAgent string) {
+	realm := realmOf(r)
+	data := map[string]any{
+		"Kind":       "clone_warning",
+		"Policy":     policy,
+		"IP":         ip,
+		"Browser":    userAgent,
+		"User":       user.Email,
+		"UserID":     user.ID,
+		"Credential": credID,
+	}
+	err := SendMail(r, user.Email, MailSecurityAlert, mailDedupeKey(time.Hour, "clone_warning", credID, user.Email), time.Time{}, data)
+	if err != nil {
+		log.Printf("[ERRO] can't send clone warning to user: %s", err.Error())
+	}
+
+	admins, err := repo.GetAdminUsers(user.RealmID)
+	if err != nil {
+		log.Printf("[ERRO] can't get admins: %s", err.Error())
+		return
+	}
+	data["Kind"] = "clone_warning_admin"
+	for _, admin := range admins {
+		mail, err := renderMail(realm, nil, admin.Email, MailSecurityAlert, data)
+		if err == nil {
+			err = QueueMail(mail, mailDedupeKey(time.Hour, "clone_warning", credID, admin.Email), time.Time{})
+		}
+		if err != nil {
+			log.Printf("[ERRO] can't send clone warning to admin: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const commandUsage = `usage: gopasskey [command]
+
+Without a command, gopasskey runs the server.
+
+Commands:
+  migrate up|down|status   apply the pending migrations, roll back the latest one, or list them
+  user <command>           create users, grant admin, list or end sessions, import and export
+  client <command>         list, create and rotate the secrets of SSO clients
+  config                   print the configuration
+  help                     show this help
+
+Run gopasskey user or gopasskey client to list their commands.
+`
+
+// runCommand runs the command given on the command line and returns the exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "migrate":
+		return migrateCommand(args[1:])
+	case "user":
+		return userCommand(args[1:])
+	case "client":
+		return clientCommand(args[1:])
+	case "config":
+		return configCommand(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(commandUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], commandUsage)
+		return 2
+	}
+}
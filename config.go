@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the server and the commands. It is built from defaults,
+// then the file named by CONFIG_FILE, then environment variables, each overriding the one
+// before. The file is YAML, TOML or JSON, chosen by its extension. Every setting has the key
+// of its config tags, e.g. ttl.session, and can be overridden by the variable of its env tag.
+//
+// SIGHUP reloads the file and the environment. TTLs, policies, origins and limits apply at
+// once; the server, database, session store and mail transport keep their values until a
+// restart. Settings stored by admins in the setting table still override their defaults here.
+type Config struct {
+	Server       ServerConfig       `config:"server"`
+	Database     DatabaseConfig     `config:"database"`
+	SessionStore SessionStoreConfig `config:"session_store"`
+	Mail         MailConfig         `config:"mail"`
+	RelyingParty RelyingPartyConfig `config:"relying_party"`
+	Policies     PolicyConfig       `config:"policies"`
+	Limits       LimitConfig        `config:"limits"`
+	TTL          TTLConfig          `config:"ttl"`
+
+	// Parsed by validate
+	trustedProxies    []*net.IPNet
+	disposableDomains map[string]bool
+}
+
+// ServerConfig needs a restart to change.
+type ServerConfig struct {
+	Env  string `config:"env" env:"ENV"` // dev serves web/build from disk
+	Host string `config:"host" env:"HOST"`
+	Port int    `config:"port" env:"PORT"`
+}
+
+// DatabaseConfig needs a restart to change. DSN, when set, replaces the other fields.
+type DatabaseConfig struct {
+	Driver   string `config:"driver" env:"DB_DRIVER"`
+	DSN      string `config:"dsn" env:"DB_DSN" secret:"true"`
+	User     string `config:"user" env:"DB_USER"`
+	Password string `config:"password" env:"DB_PASSWORD" secret:"true"`
+	Host     string `config:"host" env:"DB_HOST"`
+	Port     int    `config:"port" env:"DB_PORT"` // 0 for the driver's default
+	Name     string `config:"name" env:"DB_NAME"` // the database file for SQLite
+}
+
+// SessionStoreConfig needs a restart to change.
+type SessionStoreConfig struct {
+	Kind     string `config:"kind" env:"SESSION_STORE"`
+	RedisURL string `config:"redis_url" env:"REDIS_URL"`
+}
+
+// MailConfig needs a restart to change, except TemplateDir.
+type MailConfig struct {
+	Mailer      string `config:"mailer" env:"MAILER"` // smtp, file or log; empty for smtp if SMTPHost is set, or log in dev
+	SMTPHost    string `config:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort    int    `config:"smtp_port" env:"SMTP_PORT"`
+	SMTPUser    string `config:"smtp_user" env:"SMTP_USER"`
+	SMTPPass    string `config:"smtp_pass" env:"SMTP_PASS" secret:"true"`
+	SMTPTLS     string `config:"smtp_tls" env:"SMTP_TLS"`   // empty for tls on port 465, else starttls
+	SMTPFrom    string `config:"smtp_from" env:"SMTP_FROM"` // empty for SMTPUser
+	Dir         string `config:"dir" env:"MAIL_DIR"`
+	TemplateDir string `config:"template_dir" env:"MAIL_TEMPLATE_DIR"`
+}
+
+// RelyingPartyConfig configures the default realm.
+type RelyingPartyConfig struct {
+	ID             string   `config:"id" env:"RP_ID"` // empty for the server host
+	Name           string   `config:"name" env:"RP_NAME"`
+	Origins        []string `config:"origins" env:"ORIGINS"`
+	RelatedOrigins []string `config:"related_origins" env:"RELATED_ORIGINS"` // default of the related_origins setting
+}
+
+// PolicyConfig holds the policies of the default realm. Those with a setting of the same
+// name are its default.
+type PolicyConfig struct {
+	PasskeyReplace         string   `config:"passkey_replace" env:"PASSKEY_REPLACE_POLICY"`
+	CloneWarning           string   `config:"clone_warning" env:"CLONE_WARNING_POLICY"`
+	CredentialUsageHistory bool     `config:"credential_usage_history" env:"CREDENTIAL_USAGE_HISTORY"`
+	TOTPMode               string   `config:"totp_mode" env:"TOTP_MODE"`
+	MagicLinkBinding       bool     `config:"magic_link_binding" env:"MAGIC_LINK_BINDING"`
+	Signup                 string   `config:"signup" env:"SIGNUP_POLICY"`
+	SignupDomains          []string `config:"signup_domains" env:"SIGNUP_DOMAINS"`
+	DisposableDomainsFile  string   `config:"disposable_domains_file" env:"DISPOSABLE_DOMAINS_FILE"` // empty for the built-in list
+}
+
+// LimitConfig holds the rate limits and the proxies trusted to report client IPs.
+type LimitConfig struct {
+	RateLimits         string   `config:"rate_limits" env:"RATE_LIMITS"` // like ip=600/1m,email=5/15m
+	RateLimitAllowlist []string `config:"rate_limit_allowlist" env:"RATE_LIMIT_ALLOWLIST"`
+	TrustedProxies     []string `config:"trusted_proxies" env:"TRUSTED_PROXIES"`
+}
+
+// TTLConfig holds how long sessions, tokens and links last.
+type TTLConfig struct {
+	Ceremony          time.Duration `config:"ceremony" env:"TTL_CEREMONY"` // WebAuthn ceremonies and other short handshakes
+	Session           time.Duration `config:"session" env:"TTL_SESSION"`
+	SSOCode           time.Duration `config:"sso_code" env:"TTL_SSO_CODE"`
+	SSOToken          time.Duration `config:"sso_token" env:"TTL_SSO_TOKEN"`
+	SSOConfirm        time.Duration `config:"sso_confirm" env:"TTL_SSO_CONFIRM"`
+	LoginLink         time.Duration `config:"login_link" env:"TTL_LOGIN_LINK"` // magic links and login codes
+	StepUp            time.Duration `config:"step_up" env:"STEP_UP_WINDOW"`
+	RecoverySession   time.Duration `config:"recovery_session" env:"TTL_RECOVERY_SESSION"`
+	TOTPEnrolment     time.Duration `config:"totp_enrolment" env:"TTL_TOTP_ENROLMENT"`
+	EmailChange       time.Duration `config:"email_change" env:"TTL_EMAIL_CHANGE"`
+	EmailChangeRevert time.Duration `config:"email_change_revert" env:"TTL_EMAIL_CHANGE_REVERT"`
+	Invitation        time.Duration `config:"invitation" env:"TTL_INVITATION"` // default of new invitations
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Server:       ServerConfig{Host: "localhost", Port: 8080},
+		Database:     DatabaseConfig{Driver: DriverMySQL, User: "root", Password: "password", Host: "localhost", Name: "appdb"},
+		SessionStore: SessionStoreConfig{Kind: StoreRedis, RedisURL: "localhost:6379"},
+		Mail:         MailConfig{SMTPPort: 587, Dir: "mail"},
+		RelyingParty: RelyingPartyConfig{Name: "Webauthn"},
+		Policies: PolicyConfig{
+			PasskeyReplace: PasskeyReplaceReject,
+			CloneWarning:   ClonePolicyReject,
+			TOTPMode:       TOTPModeOff,
+			Signup:         SignupOpen,
+		},
+		Limits: LimitConfig{
+			TrustedProxies: []string{"127.0.0.0/8", "::1"},
+		},
+		TTL: TTLConfig{
+			Ceremony:          5 * time.Minute,
+			Session:           time.Hour,
+			SSOCode:           5 * time.Minute,
+			SSOToken:          time.Hour,
+			SSOConfirm:        10 * time.Minute,
+			LoginLink:         10 * time.Minute,
+			StepUp:            5 * time.Minute,
+			RecoverySession:   10 * time.Minute,
+			TOTPEnrolment:     10 * time.Minute,
+			EmailChange:       24 * time.Hour,
+			EmailChangeRevert: 7 * 24 * time.Hour,
+			Invitation:        7 * 24 * time.Hour,
+		},
+	}
+}
+
+const (
+	PasskeyReplaceReject  = "reject"  // a second passkey of the same authenticator is refused
+	PasskeyReplaceConfirm = "confirm" // the user may confirm replacing the old platform passkey
+)
+
+var passkeyReplacePolicies = []string{PasskeyReplaceReject, PasskeyReplaceConfirm}
+
+var configFile = getEnv("CONFIG_FILE", "")
+
+var configStore atomic.Pointer[Config]
+
+// currentConfig returns the configuration in effect. Callers read it once per use so that a
+// reload applies to the next request.
+func currentConfig() *Config {
+	return configStore.Load()
+}
+
+// initConfig loads the configuration the server and the commands start with, and exits if it
+// is invalid.
+func initConfig() {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatalf("[FATA] invalid configuration:\n%s", err.Error())
+	}
+	configStore.Store(config)
+}
+
+// loadConfig builds the configuration from the defaults, file, if not empty, and the
+// environment, and validates it. The error lists every problem found.
+func loadConfig(file string) (*Config, error) {
+	config := defaultConfig()
+	var errs []error
+	if file != "" {
+		errs = append(errs, config.readFile(file))
+	}
+	errs = append(errs, config.readEnv())
+	if config.RelyingParty.ID == "" {
+		config.RelyingParty.ID = config.Server.Host
+	}
+	errs = append(errs, config.validate())
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// configField is a setting of Config.
+type configField struct {
+	key   string // like ttl.session
+	env   string
+	field reflect.StructField
+	value reflect.Value
+}
+
+// fields returns the settings of config in declaration order.
+func (config *Config) fields() []configField {
+	var fields []configField
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			key, ok := field.Tag.Lookup("config")
+			if !ok {
+				continue
+			}
+			key = prefix + key
+			if field.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), key+".")
+				continue
+			}
+			fields = append(fields, configField{key, field.Tag.Get("env"), field, v.Field(i)})
+		}
+	}
+	walk(reflect.ValueOf(config).Elem(), "")
+	return fields
+}
+
+// readFile sets the settings found in file. Errors are prefixed with the file name.
+func (config *Config) readFile(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	doc := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(file)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	case ".toml":
+		err = toml.Unmarshal(b, &doc)
+	case ".json":
+		err = json.Unmarshal(b, &doc)
+	default:
+		return fmt.Errorf("%s: unknown format %q, use .yaml, .yml, .toml or .json", file, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	values := map[string]any{}
+	var flatten func(m map[string]any, prefix string)
+	flatten = func(m map[string]any, prefix string) {
+		for key, value := range m {
+			if section, ok := value.(map[string]any); ok {
+				flatten(section, prefix+key+".")
+			} else {
+				values[prefix+key] = value
+			}
+		}
+	}
+	flatten(doc, "")
+
+	var errs []error
+	for _, field := range config.fields() {
+		value, ok := values[field.key]
+		if !ok {
+			continue
+		}
+		delete(values, field.key)
+		if err := setConfigValue(field.value, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", file, field.key, err))
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		errs = append(errs, fmt.Errorf("%s: %s: unknown setting", file, key))
+	}
+	return errors.Join(errs...)
+}
+
+// readEnv sets the settings whose environment variable is set. An empty variable clears
+// text and lists, and is ignored for numbers, booleans and durations.
+func (config *Config) readEnv() error {
+	var errs []error
+	for _, field := range config.fields() {
+		s, ok := os.LookupEnv(field.env)
+		if !ok {
+			continue
+		}
+		var value any = s
+		var err error
+		switch field.value.Kind() {
+		case reflect.String, reflect.Slice:
+		default:
+			if s == "" {
+				continue
+			}
+			if field.value.Kind() == reflect.Bool {
+				value, err = strconv.ParseBool(s)
+			} else if field.value.Type() != reflect.TypeFor[time.Duration]() {
+				value, err = strconv.Atoi(s)
+			}
+		}
+		if err == nil {
+			err = setConfigValue(field.value, value)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field.env, configValueError(field.value)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setConfigValue sets a setting to a value decoded from a file or the environment.
+// Lists may also be given as one comma or newline separated string.
+func setConfigValue(v reflect.Value, value any) error {
+	switch {
+	case v.Type() == reflect.TypeFor[time.Duration]():
+		s, ok := value.(string)
+		d, err := time.ParseDuration(s)
+		if !ok || err != nil {
+			return configValueError(v)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return configValueError(v)
+		}
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return configValueError(v)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int:
+		var n int64
+		switch value := value.(type) {
+		case int:
+			n = int64(value)
+		case int64:
+			n = value
+		case float64: // JSON
+			if value != math.Trunc(value) {
+				return configValueError(v)
+			}
+			n = int64(value)
+		default:
+			return configValueError(v)
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Slice:
+		var list []string
+		switch value := value.(type) {
+		case string:
+			list = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' })
+		case []any:
+			for _, item := range value {
+				s, ok := item.(string)
+				if !ok {
+					return configValueError(v)
+				}
+				list = append(list, s)
+			}
+		default:
+			return configValueError(v)
+		}
+		for i := range list {
+			list[i] = strings.TrimSpace(list[i])
+		}
+		v.Set(reflect.ValueOf(slices.DeleteFunc(list, func(s string) bool { return s == "" })))
+	}
+	return nil
+}
+
+// configValueError describes the values a setting accepts.
+func configValueError(v reflect.Value) error {
+	switch {
+	case v.Type() == reflect.TypeFor[time.Duration]():
+		return errors.New("must be a duration like 90s, 10m or 1h")
+	case v.Kind() == reflect.Bool:
+		return errors.New("must be true or false")
+	case v.Kind() == reflect.Int:
+		return errors.New("must be a whole number")
+	case v.Kind() == reflect.Slice:
+		return errors.New("must be a list of strings")
+	default:
+		return errors.New("must be a string")
+	}
+}
+
+// validate checks every setting and parses those kept parsed in config.
+func (config *Config) validate() error {
+	var errs []error
+	check := func(key string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	oneOf := func(value string, allowed ...string) error {
+		if !slices.Contains(allowed, value) {
+			return fmt.Errorf("%q is not one of %s", value, strings.Join(allowed, ", "))
+		}
+		return nil
+	}
+	port := func(port int, optional bool) error {
+		if (port == 0 && optional) || (port > 0 && port < 65536) {
+			return nil
+		}
+		return fmt.Errorf("%d is not a port", port)
+	}
+
+	check("server.port", port(config.Server.Port, false))
+	check("database.driver", oneOf(config.Database.Driver, dbDrivers...))
+	check("database.port", port(config.Database.Port, true))
+	check("session_store.kind", oneOf(config.SessionStore.Kind, StoreRedis, StoreMemory, StoreSQL))
+	check("mail.mailer", oneOf(config.Mail.Mailer, "", "smtp", "file", "log"))
+	check("mail.smtp_port", port(config.Mail.SMTPPort, false))
+	check("mail.smtp_tls", oneOf(config.Mail.SMTPTLS, "", SMTPTLSStartTLS, SMTPTLSImplicit, SMTPTLSNone))
+	if config.Mail.Mailer == "smtp" && config.Mail.SMTPHost == "" {
+		check("mail.smtp_host", errors.New("is required by the smtp mailer"))
+	}
+
+	if config.RelyingParty.ID == "" {
+		check("relying_party.id", errors.New("is required"))
+	}
+	check("relying_party.origins", validateOrigins(strings.Join(config.RelyingParty.Origins, ",")))
+	check("relying_party.related_origins", validateOrigins(strings.Join(config.RelyingParty.RelatedOrigins, ",")))
+
+	check("policies.passkey_replace", oneOf(config.Policies.PasskeyReplace, passkeyReplacePolicies...))
+	check("policies.clone_warning", oneOf(config.Policies.CloneWarning, clonePolicies...))
+	check("policies.totp_mode", oneOf(config.Policies.TOTPMode, totpModes...))
+	check("policies.signup", oneOf(config.Policies.Signup, signupPolicies...))
+	check("policies.signup_domains", validateDomains(strings.Join(config.Policies.SignupDomains, ",")))
+	var err error
+	config.disposableDomains, err = loadDisposableDomains(config.Policies.DisposableDomainsFile)
+	check("policies.disposable_domains_file", err)
+
+	check("limits.rate_limits", validateRateLimits(config.Limits.RateLimits))
+	check("limits.rate_limit_allowlist", validateNetworks(strings.Join(config.Limits.RateLimitAllowlist, ",")))
+	config.trustedProxies, err = parseNetworks(strings.Join(config.Limits.TrustedProxies, ","))
+	check("limits.trusted_proxies", err)
+
+	for _, field := range config.fields() {
+		if strings.HasPrefix(field.key, "ttl.") && field.value.Int() <= 0 {
+			check(field.key, errors.New("must be positive"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// display returns the value of a setting as text, with secrets masked.
+func (field configField) display() string {
+	switch value := field.value.Interface().(type) {
+	case []string:
+		return strings.Join(value, ",")
+	case string:
+		if value != "" && field.field.Tag.Get("secret") == "true" {
+			return "********"
+		}
+		return value
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// restartOnly copies the settings that need a restart from current into config and returns
+// the sections whose value differed.
+func (config *Config) restartOnly(current *Config) []string {
+	var changed []string
+	if config.Server != current.Server {
+		changed = append(changed, "server")
+	}
+	if config.Database != current.Database {
+		changed = append(changed, "database")
+	}
+	if config.SessionStore != current.SessionStore {
+		changed = append(changed, "session_store")
+	}
+	mail := current.Mail
+	mail.TemplateDir = config.Mail.TemplateDir
+	if config.Mail != mail {
+		changed = append(changed, "mail")
+	}
+	config.Server = current.Server
+	config.Database = current.Database
+	config.SessionStore = current.SessionStore
+	config.Mail = mail
+	return changed
+}
+
+// reloadConfig loads the configuration again, keeping the current one if it's invalid, and
+// reloads what is cached from it.
+func reloadConfig() {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		log.Printf("[ERRO] can't reload configuration, keeping the current one:\n%s", err.Error())
+		return
+	}
+	for _, section := range config.restartOnly(currentConfig()) {
+		log.Printf("[WARN] %s settings changed, restart to apply them", section)
+	}
+	configStore.Store(config)
+	reloadPasskeyStore()
+	reloadRateLimits()
+	log.Printf("[INFO] configuration reloaded")
+}
+
+// watchConfig reloads the configuration on SIGHUP.
+func watchConfig() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadConfig()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain loads the configuration the tests start with, from CONFIG_FILE and the environment
+// like the binary does.
+func TestMain(m *testing.M) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", err.Error())
+		os.Exit(1)
+	}
+	configStore.Store(config)
+	os.Exit(m.Run())
+}
+
+// setTestConfig changes the configuration for the rest of the test.
+func setTestConfig(t *testing.T, change func(*Config)) {
+	t.Helper()
+	current := currentConfig()
+	config := *current
+	change(&config)
+	configStore.Store(&config)
+	t.Cleanup(func() { configStore.Store(current) })
+}
+
+// writeTestConfig writes a configuration file into a temporary directory.
+func writeTestConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadConfig(t *testing.T) {
+	files := map[string]string{
+		"gopasskey.yaml": `
+server:
+  port: 9000
+relying_party:
+  id: example.com
+  origins: [https://example.com, https://login.example.com]
+policies:
+  credential_usage_history: true
+ttl:
+  session: 2h
+`,
+		"gopasskey.toml": `
+[server]
+port = 9000
+
+[relying_party]
+id = "example.com"
+origins = "https://example.com,https://login.example.com"
+
+[policies]
+credential_usage_history = true
+
+[ttl]
+session = "2h"
+`,
+		"gopasskey.json": `{
+  "server": {"port": 9000},
+  "relying_party": {"id": "example.com", "origins": ["https://example.com", "https://login.example.com"]},
+  "policies": {"credential_usage_history": true},
+  "ttl": {"session": "2h"}
+}`,
+	}
+	t.Setenv("TTL_SSO_TOKEN", "30m")
+	t.Setenv("DB_PORT", "")
+	var configs []*Config
+	for name, content := range files {
+		config, err := loadConfig(writeTestConfig(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if config.Server.Port != 9000 || config.RelyingParty.ID != "example.com" || len(config.RelyingParty.Origins) != 2 ||
+			!config.Policies.CredentialUsageHistory || config.TTL.Session != 2*time.Hour {
+			t.Errorf("%s: settings of the file not applied: %+v", name, config)
+		}
+		if config.TTL.SSOToken != 30*time.Minute {
+			t.Errorf("%s: ttl.sso_token = %s; want 30m from the environment", name, config.TTL.SSOToken)
+		}
+		if config.TTL.Ceremony != 5*time.Minute || config.Database.Port != 0 {
+			t.Errorf("%s: defaults not kept: %+v", name, config)
+		}
+		configs = append(configs, config)
+	}
+	for _, config := range configs[1:] {
+		if !reflect.DeepEqual(config, configs[0]) {
+			t.Errorf("formats differ:\n%+v\n%+v", config, configs[0])
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	file := writeTestConfig(t, "gopasskey.yaml", `
+server:
+  port: http
+sesion_store:
+  kind: memory
+policies:
+  signup: anyone
+ttl:
+  session: an hour
+  sso_code: 0s
+`)
+	t.Setenv("CREDENTIAL_USAGE_HISTORY", "yes")
+	if _, err := loadConfig(file); err == nil || !strings.Contains(err.Error(), "server.port: must be a whole number") ||
+		!strings.Contains(err.Error(), "sesion_store.kind: unknown setting") || !strings.Contains(err.Error(), "ttl.session: must be a duration") {
+		t.Errorf("loadConfig = %v; want every error of the file", err)
+	}
+	if _, err := loadConfig(writeTestConfig(t, "gopasskey.yaml", "ttl:\n  sso_code: 0s\npolicies:\n  signup: anyone\n")); err == nil ||
+		!strings.Contains(err.Error(), "CREDENTIAL_USAGE_HISTORY: must be true or false") {
+		t.Errorf("loadConfig = %v; want the error of the environment", err)
+	}
+	t.Setenv("CREDENTIAL_USAGE_HISTORY", "")
+	_, err := loadConfig(writeTestConfig(t, "gopasskey.yaml", "ttl:\n  sso_code: 0s\npolicies:\n  signup: anyone\n"))
+	if err == nil || !strings.Contains(err.Error(), "ttl.sso_code: must be positive") || !strings.Contains(err.Error(), `policies.signup: "anyone" is not one of`) {
+		t.Errorf("loadConfig = %v; want the validation errors", err)
+	}
+	if _, err := loadConfig(writeTestConfig(t, "gopasskey.ini", "")); err == nil {
+		t.Error("loadConfig accepted an unknown format")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	initTestDB(t)
+	defer db.Close()
+	current := currentConfig()
+	defer configStore.Store(current)
+	file := writeTestConfig(t, "gopasskey.yaml", "server:\n  port: 1234\nrelying_party:\n  name: Reloaded\nttl:\n  session: 3h\n")
+	defer func(file string) { configFile = file }(configFile)
+	configFile = file
+
+	reloadConfig()
+	config := currentConfig()
+	if config.TTL.Session != 3*time.Hour || defaultRealm().DisplayName() != "Reloaded" {
+		t.Errorf("reload not applied: ttl.session = %s, realm %s", config.TTL.Session, defaultRealm().DisplayName())
+	}
+	if config.Server.Port != current.Server.Port {
+		t.Errorf("server.port = %d; want %d until a restart", config.Server.Port, current.Server.Port)
+	}
+
+	os.WriteFile(file, []byte("ttl:\n  session: forever\n"), 0o600)
+	reloadConfig()
+	if currentConfig() != config {
+		t.Error("invalid configuration replaced the current one")
+	}
+}
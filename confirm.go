@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// SSOConfirmation is a transaction confirmation requested by an SSO client. The user approves
+// it with a passkey assertion whose challenge is bound to a hash of the payload.
+type SSOConfirmation struct {
+	ID          string `json:"id"`
+	ClientID    string `json:"client_id"`
+	UserID      string `json:"user_id"`
+	Payload     string `json:"payload"`
+	RedirectURI string `json:"redirect_uri"`
+	Nonce       string `json:"nonce"`
+	Status      string `json:"status"` // pending | approved | declined
+	Created     int64  `json:"created"`
+	Receipt     string `json:"receipt,omitempty"`
+}
+
+// challenge binds the WebAuthn challenge to this confirmation: SHA-256 over the ID,
+// client ID, payload hash and a random nonce.
+func (c *SSOConfirmation) challenge() []byte {
+	payloadHash := sha256.Sum256([]byte(c.Payload))
+	sum := sha256.Sum256([]byte("gopasskey-confirm\n" + c.ID + "\n" + c.ClientID + "\n" + hex.EncodeToString(payloadHash[:]) + "\n" + c.Nonce))
+	return sum[:]
+}
+
+// getSSOConfirmation returns a confirmation of the given realm.
+func getSSOConfirmation(realm *Realm, id string) (*SSOConfirmation, error) {
+	if !realm.owns(id) {
+		return nil, fmt.Errorf("confirmation not found")
+	}
+	val, err := store.Get(fmt.Sprintf("sso_confirm:%s", id))
+	if err != nil {
+		return nil, err
+	}
+	var c SSOConfirmation
+	if err := json.Unmarshal([]byte(val), &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func saveSSOConfirmation(c *SSOConfirmation) error {
+	dataJSON, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(time.Unix(c.Created, 0).Add(currentConfig().TTL.SSOConfirm))
+	if ttl <= 0 {
+		return fmt.Errorf("confirmation expired")
+	}
+	return store.Set(fmt.Sprintf("sso_confirm:%s", c.ID), string(dataJSON), ttl)
+}
+
+// SSOConfirmCreate creates a transaction confirmation request for a user.
+// POST /api/pub/sso/confirm
+// {"client_id", "client_secret", "sub", "payload", "redirect_uri"}
+func SSOConfirmCreate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		Sub          string `json:"sub"`
+		Payload      string `json:"payload"`
+		RedirectURI  string `json:"redirect_uri"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	client, err := getRealmClient(r, req.ClientID)
+	if err != nil || client.ClientSecret != req.ClientSecret {
+		JSONResponse(w, "Invalid client credentials", http.StatusUnauthorized)
+		return
+	}
+	if req.Payload == "" || len(req.Payload) > 2000 {
+		JSONResponse(w, "payload is required and must be at most 2000 characters", http.StatusBadRequest)
+		return
+	}
+	if req.RedirectURI != "" && !sameOrigin(req.RedirectURI, client.RedirectURI) {
+		JSONResponse(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if _, err := getRealmUser(r, req.Sub); err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	c := &SSOConfirmation{
+		ID:          realmOf(r).newCode(),
+		ClientID:    client.ID,
+		UserID:      req.Sub,
+		Payload:     req.Payload,
+		RedirectURI: req.RedirectURI,
+		Nonce:       generateCode(),
+		Status:      "pending",
+		Created:     time.Now().Unix(),
+	}
+	if err := saveSSOConfirmation(c); err != nil {
+		log.Printf("[ERRO] can't save confirmation: %s", err.Error())
+		JSONResponse(w, "Failed to create confirmation", http.StatusInternalServerError)
+		return
+	}
+
+	JSONResponse(w, map[string]any{
+		"id":          c.ID,
+		"confirm_url": fmt.Sprintf("%s/api/pub/sso/confirm/page?id=%s", baseURL(r), url.QueryEscape(c.ID)),
+		"expires_in":  int(currentConfig().TTL.SSOConfirm.Seconds()),
+	}, http.StatusOK)
+}
+
+// SSOConfirmResult returns the status of a confirmation and, once approved, the signed receipt.
+// POST /api/pub/sso/confirm/result
+// {"client_id", "client_secret", "id"}
+func SSOConfirmResult(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		ID           string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	client, err := getRealmClient(r, req.ClientID)
+	if err != nil || client.ClientSecret != req.ClientSecret {
+		JSONResponse(w, "Invalid client credentials", http.StatusUnauthorized)
+		return
+	}
+	c, err := getSSOConfirmation(realmOf(r), req.ID)
+	if err != nil || c.ClientID != client.ID {
+		JSONResponse(w, "Confirmation not found or expired", http.StatusNotFound)
+		return
+	}
+	JSONResponse(w, map[string]any{
+		"status":  c.Status,
+		"receipt": c.Receipt,
+	}, http.StatusOK)
+}
+
+// SSOConfirmPage renders the page on which the user reviews and approves a confirmation.
+// GET /api/pub/sso/confirm/page?id=X
+func SSOConfirmPage(w http.ResponseWriter, r *http.Request) {
+	c, err := getSSOConfirmation(realmOf(r), r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Confirmation not found or expired", http.StatusNotFound)
+		return
+	}
+	clientName := c.ClientID
+	if client, err := repo.GetSSOClient(c.ClientID); err == nil && client.Name != nil {
+		clientName = *client.Name
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = confirmPageTemplate.Execute(w, map[string]any{
+		"Base":       realmPath(r, ""),
+		"ID":         c.ID,
+		"ClientName": clientName,
+		"Payload":    c.Payload,
+		"Status":     c.Status,
+	})
+	if err != nil {
+		log.Printf("[ERRO] can't render confirmation page: %s", err.Error())
+	}
+}
+
+// BeginSSOConfirm starts the passkey assertion for a pending confirmation.
+// POST /api/pub/sso/confirm/start {"id"}
+func BeginSSOConfirm(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	c, err := getSSOConfirmation(realmOf(r), req.ID)
+	if err != nil || c.Status != "pending" {
+		JSONResponse(w, "Confirmation not found or expired", http.StatusNotFound)
+		return
+	}
+	user, err := repo.GetUser(c.UserID)
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	options, session, err := getWebAuthn(r).BeginLogin(user,
+		webauthn.WithAllowedCredentials(user.LoginCredentialDescriptors()),
+		webauthn.WithChallenge(c.challenge()),
+		webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		msg := fmt.Sprintf("can't begin confirmation: %s", err.Error())
+		log.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	confirmSid := realmOf(r).newID()
+	if err := SaveSession(confirmSid, session, currentConfig().TTL.Ceremony); err != nil {
+		log.Printf("[ERRO] can't save session: %s", err.Error())
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Access-Control-Expose-Headers", "confirm_sid")
+	w.Header().Set("confirm_sid", confirmSid)
+	JSONResponse(w, options, http.StatusOK)
+}
+
+// FinishSSOConfirm verifies the assertion, marks the confirmation approved and signs the receipt.
+// POST /api/pub/sso/confirm/finish?id=X (header confirm_sid)
+func FinishSSOConfirm(w http.ResponseWriter, r *http.Request) {
+	confirmSid := realmHeader(r, "confirm_sid")
+	if confirmSid == "" {
+		JSONResponse(w, "missing confirm_sid header", http.StatusBadRequest)
+		return
+	}
+	session, err := GetSession(confirmSid)
+	if err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	DeleteSession(confirmSid)
+
+	c, err := getSSOConfirmation(realmOf(r), r.URL.Query().Get("id"))
+	if err != nil || c.Status != "pending" {
+		JSONResponse(w, "Confirmation not found or expired", http.StatusNotFound)
+		return
+	}
+	// The ceremony must be the one started for this confirmation
+	if session.Challenge != base64.RawURLEncoding.EncodeToString(c.challenge()) || string(session.UserID) != c.UserID {
+		JSONResponse(w, "Challenge mismatch", http.StatusBadRequest)
+		return
+	}
+	user, err := repo.GetUser(c.UserID)
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	credential, err := getWebAuthn(r).ValidateLogin(user, *session, parsed)
+	if err != nil {
+		log.Printf("[ERRO] can't finish confirmation: %s", err.Error())
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !credential.Flags.UserVerified {
+		JSONResponse(w, "User verification is required", http.StatusBadRequest)
+		return
+	}
+	if credential.Authenticator.CloneWarning && !handleCloneWarning(w, r, user, credential) {
+		return
+	}
+	user.UpdateCredential(credential, clientIP(r), r.UserAgent())
+
+	client, err := repo.GetSSOClient(c.ClientID)
+	if err != nil {
+		JSONResponse(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	payloadHash := sha256.Sum256([]byte(c.Payload))
+	c.Status = "approved"
+	c.Receipt = signReceipt(client.ClientSecret, map[string]any{
+		"iss":                r.Host,
+		"aud":                c.ClientID,
+		"sub":                c.UserID,
+		"jti":                c.ID,
+		"iat":                time.Now().Unix(),
+		"payload":            c.Payload,
+		"payload_sha256":     hex.EncodeToString(payloadHash[:]),
+		"nonce":              c.Nonce,
+		"challenge":          session.Challenge,
+		"credential_id":      base64.RawURLEncoding.EncodeToString(credential.ID),
+		"authenticator_data": base64.RawURLEncoding.EncodeToString(parsed.Raw.AssertionResponse.AuthenticatorData),
+		"client_data_json":   base64.RawURLEncoding.EncodeToString(parsed.Raw.AssertionResponse.ClientDataJSON),
+		"signature":          base64.RawURLEncoding.EncodeToString(parsed.Raw.AssertionResponse.Signature),
+	})
+	if err := saveSSOConfirmation(c); err != nil {
+		log.Printf("[ERRO] can't save confirmation: %s", err.Error())
+		JSONResponse(w, "Failed to save confirmation", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[INFO] confirmation %s approved by user %s", c.ID, c.UserID)
+	JSONResponse(w, map[string]any{
+		"status":   c.Status,
+		"redirect": confirmRedirect(c),
+	}, http.StatusOK)
+}
+
+// DeclineSSOConfirm marks a pending confirmation declined.
+// POST /api/pub/sso/confirm/decline {"id"}
+func DeclineSSOConfirm(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	c, err := getSSOConfirmation(realmOf(r), req.ID)
+	if err != nil || c.Status != "pending" {
+		JSONResponse(w, "Confirmation not found or expired", http.StatusNotFound)
+		return
+	}
+	c.Status = "declined"
+	if err := saveSSOConfirmation(c); err != nil {
+		JSONResponse(w, "Failed to save confirmation", http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, map[string]any{
+		"status":   c.Status,
+		"redirect": confirmRedirect(c),
+	}, http.StatusOK)
+}
+
+func confirmRedirect(c *SSOConfirmation) string {
+	if c.RedirectURI == "" {
+		return ""
+	}
+	u, err := url.Parse(c.RedirectURI)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	q.Set("confirmation_id", c.ID)
+	q.Set("status", c.Status)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// signReceipt returns claims as a compact HS256 JWT keyed with the client secret,
+// so the client can verify it with any JWT library.
+func signReceipt(secret string, claims map[string]any) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claimsJSON, _ := json.Marshal(claims)
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host
+}
+
+var confirmPageTemplate = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html data-ui-theme="nord">
+<head>
+  <meta charset="UTF-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Confirm</title>
+  <link rel="stylesheet" href="https://cdn.jsdelivr.net/gh/az-code-lab/ui/src/ui.css">
+  <link rel="stylesheet" href="https://cdn.jsdelivr.net/gh/az-code-lab/ui/src/themes/nord.css">
+  <script src="https://unpkg.com/@simplewebauthn/browser/dist/bundle/index.umd.min.js"></script>
+  <style>body { display: flex; align-items: center; justify-content: center; min-height: 100vh; } .ui-panel { max-width: 420px; width: 100%; } pre { white-space: pre-wrap; }</style>
+</head>
+<body>
+  <div class="ui-panel raised">
+    <div class="ui-panel-header"><h2 class="ui-panel-title">Confirm with your passkey</h2></div>
+    <div class="ui-panel-body">
+      <div class="ui-stack">
+        <p><strong>{{.ClientName}}</strong> asks you to confirm:</p>
+        <pre class="ui-alert">{{.Payload}}</pre>
+        <div id="message" class="ui-alert" hidden></div>
+        {{if eq .Status "pending"}}
+        <button id="approve" class="ui-btn block">Approve</button>
+        <button id="decline" class="ui-btn ghost block">Decline</button>
+        {{else}}
+        <p>This request has already been {{.Status}}.</p>
+        {{end}}
+      </div>
+    </div>
+  </div>
+  <script>
+    const base = {{.Base}};
+    const id = {{.ID}};
+    const message = document.getElementById('message');
+    function done(result) {
+      if (result.redirect) { window.location.href = result.redirect; return; }
+      message.hidden = false;
+      message.textContent = result.status === 'approved' ? 'Confirmed. You can close this window.' : 'Declined. You can close this window.';
+      document.getElementById('approve')?.remove();
+      document.getElementById('decline')?.remove();
+    }
+    function fail(msg) {
+      message.hidden = false;
+      message.classList.add('danger');
+      message.textContent = msg;
+    }
+    document.getElementById('approve')?.addEventListener('click', async () => {
+      try {
+        const response = await fetch(base + '/api/pub/sso/confirm/start', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ id }) });
+        if (!response.ok) return fail(await response.json());
+        const confirmSid = response.headers.get('confirm_sid');
+        const options = await response.json();
+        const assertion = await SimpleWebAuthnBrowser.startAuthentication({ optionsJSON: options.publicKey });
+        const finish = await fetch(base + '/api/pub/sso/confirm/finish?id=' + encodeURIComponent(id), { method: 'POST', headers: { 'Content-Type': 'application/json', 'confirm_sid': confirmSid }, body: JSON.stringify(assertion) });
+        const result = await finish.json();
+        finish.ok ? done(result) : fail(result);
+      } catch (e) { fail(e.message); }
+    });
+    document.getElementById('decline')?.addEventListener('click', async () => {
+      const response = await fetch(base + '/api/pub/sso/confirm/decline', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ id }) });
+      const result = await response.json();
+      response.ok ? done(result) : fail(result);
+    });
+  </script>
+</body>
+</html>
+`))
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The database is MySQL/MariaDB, PostgreSQL or SQLite, chosen by DB_DRIVER. Each has its
+// schema: appdb.sql, appdb.postgres.sql and appdb.sqlite.sql.
+//
+// Queries are written once, in the subset the three understand: placeholders are ?,
+// identifiers that are reserved words are quoted with backticks, booleans are compared with
+// TRUE and FALSE, and the current time is passed as a parameter rather than NOW(). sqlDB
+// rewrites placeholders and quotes for PostgreSQL. The few statements that can't be written
+// portably, like upserts, are built by the dialect.
+
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+var dbDrivers = []string{DriverMySQL, DriverPostgres, DriverSQLite}
+
+type dialect string
+
+// rebind rewrites a query written with ? placeholders and backtick quotes for the dialect.
+// String literals are left alone.
+func (d dialect) rebind(query string) string {
+	if d != DriverPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	inString := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			inString = !inString
+			b.WriteRune(c)
+		case inString:
+			b.WriteRune(c)
+		case c == '?':
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		case c == '`':
+			b.WriteRune('"')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// upsert returns an INSERT of columns into table that overwrites the row with the same key,
+// the first column.
+func (d dialect) upsert(table string, columns ...string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ", table, strings.Join(columns, ", "), placeholders)
+	var set []string
+	for _, c := range columns[1:] {
+		if d == DriverMySQL {
+			set = append(set, fmt.Sprintf("%s = VALUES(%s)", c, c))
+		} else {
+			set = append(set, fmt.Sprintf("%s = excluded.%s", c, c))
+		}
+	}
+	if d == DriverMySQL {
+		return query + "ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+	}
+	return query + fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET ", columns[0]) + strings.Join(set, ", ")
+}
+
+// ignoreDuplicate is appended to an INSERT to skip rows that violate a unique key without
+// failing, unlike INSERT IGNORE, on other errors. key is a column of the table.
+func (d dialect) ignoreDuplicate(key string) string {
+	if d == DriverMySQL {
+		return fmt.Sprintf("ON DUPLICATE KEY UPDATE %s = %s", key, key)
+	}
+	return "ON CONFLICT DO NOTHING"
+}
+
+// forUpdate is appended to a SELECT in a transaction to lock the rows it reads. SQLite
+// transactions lock the whole database when they begin.
+func (d dialect) forUpdate() string {
+	if d == DriverSQLite {
+		return ""
+	}
+	return " FOR UPDATE"
+}
+
+// sqlDB is a database handle that rewrites queries for its dialect. It is passed to
+// gosqlcrud like a *sql.DB.
+type sqlDB struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (db *sqlDB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.rebind(query), args...)
+}
+
+func (db *sqlDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.rebind(query), args...)
+}
+
+func (db *sqlDB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.dialect.rebind(query), args...)
+}
+
+func (db *sqlDB) Begin() (*sqlTx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{tx, db.dialect}, nil
+}
+
+type sqlTx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (tx *sqlTx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx *sqlTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx *sqlTx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
+
+// dataSourceName returns the DSN of c, or builds one for its driver from its host, port,
+// user, password and name. For SQLite, the name is the database file.
+func dataSourceName(c DatabaseConfig) string {
+	if c.DSN != "" {
+		return c.DSN
+	}
+	switch c.Driver {
+	case DriverPostgres:
+		port := c.Port
+		if port == 0 {
+			port = 5432
+		}
+		return fmt.Sprintf("postgres://%s:%s@%s:%d/%s", c.User, c.Password, c.Host, port, c.Name)
+	case DriverSQLite:
+		return c.Name + ".db"
+	default:
+		port := c.Port
+		if port == 0 {
+			port = 3306
+		}
+		return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", c.User, c.Password, c.Host, port, c.Name)
+	}
+}
+
+// openDB connects to the database of driver at dsn.
+func openDB(driver, dsn string) (*sqlDB, error) {
+	var conn *sql.DB
+	var err error
+	switch driver {
+	case DriverMySQL:
+		conn, err = sql.Open("mysql", dsn)
+	case DriverPostgres:
+		conn, err = sql.Open("pgx", dsn)
+	case DriverSQLite:
+		// Writers wait for each other instead of failing with "database is locked", and
+		// transactions take the write lock when they begin, so they can't deadlock on it
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		conn, err = sql.Open("sqlite3", dsn+sep+"_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
+		if err == nil && strings.Contains(dsn, ":memory:") {
+			conn.SetMaxOpenConns(1) // each connection would get its own database
+		}
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q, use one of %s", driver, strings.Join(dbDrivers, ", "))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &sqlDB{conn, dialect(driver)}, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// initTestDB connects to the database of DB_DRIVER, or, when it isn't set, to a new migrated
+// SQLite database, so tests need no database server.
+func initTestDB(t *testing.T) {
+	t.Helper()
+	if os.Getenv("DB_DRIVER") != "" {
+		initDB()
+		return
+	}
+	var err error
+	db, err = openDB(DriverSQLite, filepath.Join(t.TempDir(), "appdb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	repo = newSQLRepository(db)
+}
+
+func TestRebind(t *testing.T) {
+	query := "SELECT * FROM `user` WHERE realm_id = ? AND name <> 'a?`b' AND email = ?"
+	if got := dialect(DriverMySQL).rebind(query); got != query {
+		t.Errorf("mysql rebind = %q", got)
+	}
+	want := `SELECT * FROM "user" WHERE realm_id = $1 AND name <> 'a?` + "`" + `b' AND email = $2`
+	if got := dialect(DriverPostgres).rebind(query); got != want {
+		t.Errorf("postgres rebind = %q; want %q", got, want)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	if got := dialect(DriverMySQL).upsert("setting", "name", "value"); !strings.HasSuffix(got, "ON DUPLICATE KEY UPDATE value = VALUES(value)") {
+		t.Errorf("mysql upsert = %q", got)
+	}
+	if got := dialect(DriverPostgres).upsert("setting", "name", "value"); got != "INSERT INTO setting (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value" {
+		t.Errorf("postgres upsert = %q", got)
+	}
+}
+
+func TestSQLRepository(t *testing.T) {
+	initTestDB(t)
+	defer db.Close()
+
+	user, err := repo.CreateUser("acme", "Ann@example.com", "Ann", "Ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateUser("acme", "ann@example.com", "Ann", "Ann"); err == nil {
+		t.Error("created a second user with the same email")
+	}
+	if found, err := repo.GetUserByEmail("acme", "ANN@example.com"); err != nil || found.ID != user.ID {
+		t.Errorf("GetUserByEmail = %v, %v; emails should compare case-insensitively", found, err)
+	}
+	user.IsAdmin = true
+	if err := repo.SaveUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if admins, err := repo.GetAdminUsers("acme"); err != nil || len(admins) != 1 {
+		t.Errorf("GetAdminUsers = %v, %v", admins, err)
+	}
+	if err := repo.DeleteUser(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if users, err := repo.GetAllUsers("acme"); err != nil || len(users) != 0 {
+		t.Errorf("GetAllUsers after delete = %v, %v", users, err)
+	}
+
+	label := "Key"
+	if err := repo.CreateCredential(&PasskeyUserCredential{ID: "c1", UserID: &user.ID, Label: &label, Credential: &webauthn.Credential{ID: []byte("c1")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UpdateCredentialLabel("c1", label); err != nil {
+		t.Errorf("UpdateCredentialLabel to the same label = %v", err)
+	}
+	if err := repo.MarkCredentialSuspect("c1", true); err != nil {
+		t.Fatal(err)
+	}
+	if creds, err := repo.GetCredentials(user.ID); err != nil || len(creds) != 1 || creds[0].Disabled == nil || !*creds[0].Disabled {
+		t.Errorf("GetCredentials = %v, %v", creds, err)
+	}
+	if err := repo.DeleteCredential("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetCredential("c1"); err == nil {
+		t.Error("credential not deleted")
+	}
+
+	login, err := repo.CreateUserLogin("acme", "ann@example.com", "token-1", "", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetUserLoginByToken("token-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UseUserLogin(login.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UseUserLogin(login.ID); err == nil {
+		t.Error("login used twice")
+	}
+	// A code is used up with the last allowed wrong attempt, not one later
+	login, err = repo.CreateUserLogin("acme", "ann@example.com", "token-3", "123456", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		if err := repo.CountUserLoginAttempt(login.ID, 3); err != nil {
+			t.Fatal(err)
+		}
+		_, err := repo.GetUserLoginByCode("acme", "ann@example.com")
+		if found := err == nil; found != (attempt < 3) {
+			t.Errorf("code usable after %d of 3 wrong attempts: %v", attempt, found)
+		}
+	}
+	if _, err := repo.CreateUserLogin("acme", "ann@example.com", "token-2", "", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetUserLoginByToken("token-2"); err == nil {
+		t.Error("expired login found")
+	}
+
+	name := "CRM"
+	if err := repo.CreateSSOClient(&SSOClient{ID: "crm", RealmID: "acme", ClientSecret: "s", RedirectURI: "https://crm.example/cb", Name: &name}); err != nil {
+		t.Fatal(err)
+	}
+	if client, err := repo.GetSSOClient("crm"); err != nil || client.RedirectURI != "https://crm.example/cb" {
+		t.Errorf("GetSSOClient = %v, %v", client, err)
+	}
+	if err := repo.DeleteSSOClient("acme", "crm"); err != nil {
+		t.Fatal(err)
+	}
+	if clients, err := repo.GetAllSSOClients("acme"); err != nil || len(clients) != 0 {
+		t.Errorf("GetAllSSOClients after delete = %v, %v", clients, err)
+	}
+
+	// Statements built by the dialect
+	SaveSetting("totp_mode", "optional")
+	SaveSetting("totp_mode", "required")
+	if got := GetSetting("totp_mode", ""); got != "required" {
+		t.Errorf("GetSetting = %q; want the second value", got)
+	}
+	mail := &Mail{RealmID: "acme", To: []string{"ann@example.com"}, Subject: "Hi", Text: "Hi"}
+	for range 2 {
+		if err := EnqueueOutboxMail(mail, "dedupe-1", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if claimed, err := ClaimOutboxMail("worker-1", 10, time.Minute); err != nil || len(claimed) != 1 {
+		t.Errorf("ClaimOutboxMail = %d messages, %v; want the deduplicated one", len(claimed), err)
+	}
+	if claimed, err := ClaimOutboxMail("worker-2", 10, time.Minute); err != nil || len(claimed) != 0 {
+		t.Errorf("ClaimOutboxMail claimed %d messages of another worker, %v", len(claimed), err)
+	}
+}
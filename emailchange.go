@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elgs/gosqlcrud"
+	"github.com/google/uuid"
+)
+
+// A user changes their email in two steps. The request sends a confirmation link to the new
+// address and a notice with a cancel link to the old one; the address is swapped when the
+// link is confirmed. The cancel link keeps working for ttl.email_change_revert: before
+// confirmation it cancels the change, afterwards it puts the old address back and revokes
+// the user's SSO tokens, in case the change was made by someone who took over the session.
+// Both links only show a page; the action needs a POST, so mail scanners can't trigger it.
+//
+// The swap relies on the unique (realm_id, email) key of the user table, so two accounts
+// can never end up with the same address. SSO clients read the new address from
+// /api/pub/sso/validate, which always returns the current claims.
+
+// emailAllowed reports whether a user may switch to the email. Realms that only accept
+// some domains for sign-up accept the same for changes.
+func emailAllowed(realm *Realm, email string) bool {
+	switch realm.signupPolicy() {
+	case SignupAllowedDomains, SignupBlockDisposable:
+		return signupAllowed(realm, email)
+	default:
+		return emailDomain(email) != ""
+	}
+}
+
+// GetEmailChange returns the user's pending email change, or null.
+// GET /api/email_change
+func GetEmailChange(w http.ResponseWriter, r *http.Request) {
+	session, err := GetSession(getSessionID(r))
+	if err != nil {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	change, err := GetPendingEmailChange(string(session.UserID))
+	if err != nil {
+		JSONResponse(w, nil, http.StatusOK)
+		return
+	}
+	JSONResponse(w, change, http.StatusOK)
+}
+
+// RequestEmailChange starts changing the user's email. It replaces a pending change.
+// POST /api/email_change {"email": "new@example.com"}
+func RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	session := requireStepUp(w, r)
+	if session == nil {
+		return
+	}
+	user, err := repo.GetUser(string(session.UserID))
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	newEmail := strings.TrimSpace(req.Email)
+	if strings.EqualFold(newEmail, user.Email) {
+		JSONResponse(w, "This is already your email", http.StatusBadRequest)
+		return
+	}
+	realm := realmOf(r)
+	if !emailAllowed(realm, newEmail) {
+		JSONResponse(w, "This email can't be used", http.StatusBadRequest)
+		return
+	}
+
+	// Whether the address belongs to another account only shows on confirmation, so the
+	// request can't be used to find out which addresses have accounts
+	if err := CancelPendingEmailChanges(user.ID); err != nil {
+		log.Printf("[ERRO] can't cancel pending email changes: %s", err.Error())
+	}
+	confirmToken, cancelToken := generateCode(), generateCode()
+	now := time.Now()
+	ttl := currentConfig().TTL
+	expires := now.Add(ttl.EmailChange)
+	change := &EmailChange{
+		ID:          uuid.New().String(),
+		RealmID:     realm.ID,
+		UserID:      user.ID,
+		OldEmail:    user.Email,
+		NewEmail:    newEmail,
+		ConfirmHash: hashToken(confirmToken),
+		CancelHash:  hashToken(cancelToken),
+		Expires:     &expires,
+		Created:     &now,
+	}
+	if err := CreateEmailChange(change); err != nil {
+		log.Printf("[ERRO] can't create email change: %s", err.Error())
+		JSONResponse(w, "Failed to change email", http.StatusInternalServerError)
+		return
+	}
+
+	confirmLink := fmt.Sprintf("%s/api/pub/email_change/confirm?token=%s", baseURL(r), confirmToken)
+	cancelLink := fmt.Sprintf("%s/api/pub/email_change/cancel?token=%s", baseURL(r), cancelToken)
+	data := map[string]any{"OldEmail": user.Email, "NewEmail": newEmail, "Hours": int(ttl.EmailChange.Hours())}
+	data["Link"] = confirmLink
+	if err := SendMail(r, newEmail, MailEmailChange, "email_change:"+change.ID, expires, data); err != nil {
+		log.Printf("[ERRO] can't send email change mail: %s", err.Error())
+		JSONResponse(w, "Failed to send confirmation", http.StatusInternalServerError)
+		return
+	}
+	notice := map[string]any{"OldEmail": user.Email, "NewEmail": newEmail, "Link": cancelLink, "Days": int(ttl.EmailChangeRevert.Hours() / 24)}
+	if err := SendMail(r, user.Email, MailEmailChangeNotice, "email_change_notice:"+change.ID, time.Time{}, notice); err != nil {
+		log.Printf("[ERRO] can't send email change notice: %s", err.Error())
+	}
+	recordSecurityEvent(r, user.ID, "email_change_requested", newEmail)
+	JSONResponse(w, change, http.StatusOK)
+}
+
+// CancelEmailChange cancels the user's pending email change.
+// DELETE /api/email_change
+func CancelEmailChange(w http.ResponseWriter, r *http.Request) {
+	session, err := GetSession(getSessionID(r))
+	if err != nil {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := CancelPendingEmailChanges(string(session.UserID)); err != nil {
+		JSONResponse(w, "Failed to cancel email change", http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, "Email change cancelled", http.StatusOK)
+}
+
+////////////////////////////
+//                        //
+//    Email Change Links  //
+//                        //
+////////////////////////////
+
+// ConfirmEmailChange shows the confirmation page on GET and swaps the address on POST.
+// GET|POST /api/pub/email_change/confirm?token=...
+func ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	change, err := GetEmailChangeByConfirmHash(hashToken(token))
+	if err != nil || change.RealmID != realmOf(r).ID || !change.pending() {
+		renderEmailChangePage(w, r, "Link expired", "This confirmation link is invalid, expired or was already used.", "", "")
+		return
+	}
+	if r.Method == http.MethodGet {
+		renderEmailChangePage(w, r, "Confirm your new email",
+			fmt.Sprintf("Change the email of your %s account from %s to %s?", realmOf(r).DisplayName(), change.OldEmail, change.NewEmail),
+			token, "Confirm")
+		return
+	}
+
+	if err := SwapUserEmail(change); err != nil {
+		log.Printf("[WARN] email change %s failed: %s", change.ID, err.Error())
+		message := "Your email could not be changed. Please try again."
+		if _, taken := repo.GetUserByEmail(change.RealmID, change.NewEmail); taken == nil {
+			message = "This email is already used by another account."
+		}
+		renderEmailChangePage(w, r, "Email not changed", message, "", "")
+		return
+	}
+	recordSecurityEvent(r, change.UserID, "email_changed", change.OldEmail+" -> "+change.NewEmail)
+	renderEmailChangePage(w, r, "Email changed", "Your account now uses "+change.NewEmail+". Sign in with the new address from now on.", "", "")
+}
+
+// CancelEmailChangeLink shows the cancel page on GET, and on POST cancels the change or,
+// once confirmed, reverts it.
+// GET|POST /api/pub/email_change/cancel?token=...
+func CancelEmailChangeLink(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	change, err := GetEmailChangeByCancelHash(hashToken(token))
+	if err != nil || change.RealmID != realmOf(r).ID || change.Cancelled != nil || change.Created.Add(currentConfig().TTL.EmailChangeRevert).Before(time.Now()) {
+		renderEmailChangePage(w, r, "Link expired", "This link is invalid, expired or was already used.", "", "")
+		return
+	}
+	if r.Method == http.MethodGet {
+		message := fmt.Sprintf("Cancel the change of your %s account's email to %s?", realmOf(r).DisplayName(), change.NewEmail)
+		if change.Confirmed != nil {
+			message = fmt.Sprintf("The email of your %s account was changed to %s. Change it back to %s and sign out everywhere?", realmOf(r).DisplayName(), change.NewEmail, change.OldEmail)
+		}
+		renderEmailChangePage(w, r, "Didn't ask for this?", message, token, "Cancel the change")
+		return
+	}
+
+	if change.Confirmed == nil {
+		if err := CancelPendingEmailChange(change.ID); err != nil {
+			renderEmailChangePage(w, r, "Link expired", "This link is invalid, expired or was already used.", "", "")
+			return
+		}
+		recordSecurityEvent(r, change.UserID, "email_change_cancelled", change.NewEmail)
+		renderEmailChangePage(w, r, "Change cancelled", "Your email stays "+change.OldEmail+".", "", "")
+		return
+	}
+	if err := RevertUserEmail(change); err != nil {
+		log.Printf("[WARN] reverting email change %s failed: %s", change.ID, err.Error())
+		renderEmailChangePage(w, r, "Email not changed back", "Your email could not be changed back. Please contact support.", "", "")
+		return
+	}
+	// Whoever changed the email may still be signed in, or recovering the account
+	revokeUserSSOTokens(change.UserID)
+	if err := DeleteUserLoginSessions(change.UserID); err != nil {
+		log.Printf("[ERRO] can't end sessions of user %s: %s", change.UserID, err.Error())
+	}
+	if err := DeleteUserRecoverySessions(change.UserID); err != nil {
+		log.Printf("[ERRO] can't end recovery sessions of user %s: %s", change.UserID, err.Error())
+	}
+	recordSecurityEvent(r, change.UserID, "email_change_reverted", change.NewEmail+" -> "+change.OldEmail)
+	renderEmailChangePage(w, r, "Email changed back", "Your account uses "+change.OldEmail+" again and was signed out of all applications. Sign in again and review your passkeys.", "", "")
+}
+
+// revokeUserSSOTokens revokes all SSO tokens of a user and the sessions behind them.
+func revokeUserSSOTokens(userID string) {
+	tokens, err := store.SMembers(fmt.Sprintf("sso_user_tokens:%s", userID))
+	if err != nil {
+		log.Printf("[ERRO] can't list SSO tokens: %s", err.Error())
+		return
+	}
+	for _, token := range tokens {
+		revokeSSOTokenAndSession(token)
+	}
+}
+
+func renderEmailChangePage(w http.ResponseWriter, r *http.Request, title, message, token, action string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err := emailChangePageTemplate.Execute(w, map[string]any{
+		"Title":   title,
+		"Message": message,
+		"Token":   token,
+		"Action":  action,
+		"Home":    realmPath(r, "/"),
+	})
+	if err != nil {
+		log.Printf("[ERRO] can't render email change page: %s", err.Error())
+	}
+}
+
+var emailChangePageTemplate = template.Must(template.New("email_change").Parse(`<!DOCTYPE html>
+<html data-ui-theme="nord">
+<head>
+  <meta charset="UTF-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>{{.Title}}</title>
+  <link rel="stylesheet" href="https://cdn.jsdelivr.net/gh/az-code-lab/ui/src/ui.css">
+  <link rel="stylesheet" href="https://cdn.jsdelivr.net/gh/az-code-lab/ui/src/themes/nord.css">
+  <style>body { display: flex; align-items: center; justify-content: center; min-height: 100vh; } .ui-panel { max-width: 420px; width: 100%; }</style>
+</head>
+<body>
+  <div class="ui-panel raised">
+    <div class="ui-panel-header"><h2 class="ui-panel-title">{{.Title}}</h2></div>
+    <div class="ui-panel-body">
+      <div class="ui-stack">
+        <p>{{.Message}}</p>
+        {{if .Action}}<form method="post" class="ui-stack sm">
+          <input type="hidden" name="token" value="{{.Token}}">
+          <button type="submit" class="ui-btn block">{{.Action}}</button>
+        </form>{{else}}<a class="ui-btn outline block" href="{{.Home}}">Go to sign-in</a>{{end}}
+      </div>
+    </div>
+  </div>
+</body>
+</html>`))
+
+////////////////////////////
+//                        //
+//    EmailChange Model   //
+//                        //
+////////////////////////////
+
+type EmailChange struct {
+	ID          string     `json:"id" db:"id" pk:"true"`
+	RealmID     string     `json:"realm_id" db:"realm_id"`
+	UserID      string     `json:"user_id" db:"user_id"`
+	OldEmail    string     `json:"old_email" db:"old_email"`
+	NewEmail    string     `json:"new_email" db:"new_email"`
+	ConfirmHash string     `json:"-" db:"confirm_hash"`
+	CancelHash  string     `json:"-" db:"cancel_hash"`
+	Expires     *time.Time `json:"expires" db:"expires"`
+	Created     *time.Time `json:"created" db:"created"`
+	Confirmed   *time.Time `json:"confirmed" db:"confirmed"`
+	Cancelled   *time.Time `json:"cancelled" db:"cancelled"`
+}
+
+func (change *EmailChange) pending() bool {
+	return change.Confirmed == nil && change.Cancelled == nil && change.Expires != nil && change.Expires.After(time.Now())
+}
+
+func CreateEmailChange(change *EmailChange) error {
+	_, err := gosqlcrud.Create(db, change, "email_change")
+	return err
+}
+
+func getEmailChange(query string, args ...any) (*EmailChange, error) {
+	changes := []EmailChange{}
+	if err := gosqlcrud.QueryToStructs(db, &changes, query, args...); err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return nil, fmt.Errorf("email change not found")
+	}
+	return &changes[0], nil
+}
+
+func GetPendingEmailChange(userID string) (*EmailChange, error) {
+	return getEmailChange("SELECT * FROM email_change WHERE user_id = ? AND confirmed IS NULL AND cancelled IS NULL AND expires > ? ORDER BY created DESC LIMIT 1", userID, time.Now())
+}
+
+func GetEmailChangeByConfirmHash(hash string) (*EmailChange, error) {
+	return getEmailChange("SELECT * FROM email_change WHERE confirm_hash = ?", hash)
+}
+
+func GetEmailChangeByCancelHash(hash string) (*EmailChange, error) {
+	return getEmailChange("SELECT * FROM email_change WHERE cancel_hash = ?", hash)
+}
+
+func CancelPendingEmailChanges(userID string) error {
+	_, err := db.Exec("UPDATE email_change SET cancelled = ? WHERE user_id = ? AND confirmed IS NULL AND cancelled IS NULL", time.Now(), userID)
+	return err
+}
+
+func CancelPendingEmailChange(id string) error {
+	result, err := db.Exec("UPDATE email_change SET cancelled = ? WHERE id = ? AND confirmed IS NULL AND cancelled IS NULL", time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("email change not pending")
+	}
+	return nil
+}
+
+// SwapUserEmail confirms a pending change and moves the user to the new address in one
+// transaction. The unique key on (realm_id, email) fails it if the address is taken.
+// Unused login links of the old address are used up, so they can't sign up a new account.
+func SwapUserEmail(change *EmailChange) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	result, err := tx.Exec("UPDATE email_change SET confirmed = ? WHERE id = ? AND confirmed IS NULL AND cancelled IS NULL AND expires > ?", now, change.ID, now)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("email change not pending")
+	}
+	if err := moveUserEmail(tx, change.UserID, change.RealmID, change.OldEmail, change.NewEmail); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RevertUserEmail cancels a confirmed change and moves the user back to the old address.
+func RevertUserEmail(change *EmailChange) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("UPDATE email_change SET cancelled = ? WHERE id = ? AND confirmed IS NOT NULL AND cancelled IS NULL", time.Now(), change.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("email change already reverted")
+	}
+	if err := moveUserEmail(tx, change.UserID, change.RealmID, change.NewEmail, change.OldEmail); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func moveUserEmail(tx *sqlTx, userID, realmID, from, to string) error {
+	// Names that were just the email, as sign-up sets them, follow it
+	result, err := tx.Exec("UPDATE `user` SET email = ?, "+
+		"name = CASE WHEN name = ? THEN ? ELSE name END, "+
+		"display_name = CASE WHEN display_name = ? THEN ? ELSE display_name END "+
+		"WHERE id = ? AND email = ?", to, from, to, from, to, userID, from)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("email of user %s is no longer %s", userID, from)
+	}
+	_, err = tx.Exec("UPDATE user_login SET used = TRUE WHERE realm_id = ? AND email = ? AND used = FALSE", realmID, from)
+	return err
+}
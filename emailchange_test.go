@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+func TestEmailAllowed(t *testing.T) {
+	realm := func(policy, domains string) *Realm {
+		return &Realm{ID: "acme", SignupPolicy: &policy, SignupDomains: &domains}
+	}
+	cases := []struct {
+		realm *Realm
+		email string
+		want  bool
+	}{
+		{realm(SignupOpen, ""), "a@mailinator.com", true},
+		{realm(SignupOpen, ""), "not-an-email", false},
+		{realm(SignupInviteOnly, ""), "a@example.com", true}, // existing users may change their email
+		{realm(SignupAllowedDomains, "example.com"), "a@example.com", true},
+		{realm(SignupAllowedDomains, "example.com"), "a@other.com", false},
+		{realm(SignupBlockDisposable, ""), "a@mailinator.com", false},
+	}
+	for _, c := range cases {
+		if got := emailAllowed(c.realm, c.email); got != c.want {
+			t.Errorf("emailAllowed(%s, %q) = %v; want %v", c.realm.signupPolicy(), c.email, got, c.want)
+		}
+	}
+}
+
+func TestEmailChangePending(t *testing.T) {
+	now := time.Now()
+	later, earlier := now.Add(time.Hour), now.Add(-time.Hour)
+	cases := []struct {
+		change EmailChange
+		want   bool
+	}{
+		{EmailChange{Expires: &later}, true},
+		{EmailChange{Expires: &earlier}, false},
+		{EmailChange{Expires: &later, Confirmed: &now}, false},
+		{EmailChange{Expires: &later, Cancelled: &now}, false},
+		{EmailChange{}, false},
+	}
+	for i, c := range cases {
+		if got := c.change.pending(); got != c.want {
+			t.Errorf("case %d: pending() = %v; want %v", i, got, c.want)
+		}
+	}
+}
+
+// newTestEmailChange stores a pending change of the user's email with the tokens
+// confirm-<id> and cancel-<id>.
+func newTestEmailChange(t *testing.T, user *PasskeyUser, newEmail string) *EmailChange {
+	t.Helper()
+	now := time.Now()
+	expires := now.Add(time.Hour)
+	change := &EmailChange{ID: uuid.New().String(), RealmID: user.RealmID, UserID: user.ID, OldEmail: user.Email, NewEmail: newEmail, Expires: &expires, Created: &now}
+	change.ConfirmHash, change.CancelHash = hashToken("confirm-"+change.ID), hashToken("cancel-"+change.ID)
+	if err := CreateEmailChange(change); err != nil {
+		t.Fatal(err)
+	}
+	return change
+}
+
+func postEmailChangeLink(handler http.HandlerFunc, path, token string) string {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, path+"?token="+url.QueryEscape(token), nil))
+	return w.Body.String()
+}
+
+func TestConfirmEmailChangeTaken(t *testing.T) {
+	initTestDB(t)
+	defer db.Close()
+	initTestStore(t)
+	userID, cleanupUser := createTestUser(t)
+	defer cleanupUser()
+	user, _ := repo.GetUser(userID)
+	change := newTestEmailChange(t, user, "taken@example.com")
+
+	// Another account takes the address between the request and the confirmation
+	other, err := repo.CreateUser(defaultRealmID, "taken@example.com", "Other", "Other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DELETE FROM `user` WHERE id = ?", other.ID)
+
+	if page := postEmailChangeLink(ConfirmEmailChange, "/api/pub/email_change/confirm", "confirm-"+change.ID); !strings.Contains(page, "already used by another account") {
+		t.Errorf("confirm page = %s; want the address reported as taken", page)
+	}
+	if email := mustGetUser(t, userID).Email; email != user.Email {
+		t.Errorf("email = %s; want %s kept", email, user.Email)
+	}
+	if pending, err := GetPendingEmailChange(userID); err != nil || pending.ID != change.ID {
+		t.Errorf("GetPendingEmailChange = %v, %v; want the change still pending", pending, err)
+	}
+}
+
+func TestRevertEmailChange(t *testing.T) {
+	initTestDB(t)
+	defer db.Close()
+	initTestStore(t)
+	userID, cleanupUser := createTestUser(t)
+	defer cleanupUser()
+	user, _ := repo.GetUser(userID)
+	change := newTestEmailChange(t, user, "new-"+user.Email)
+	postEmailChangeLink(ConfirmEmailChange, "/api/pub/email_change/confirm", "confirm-"+change.ID)
+	if email := mustGetUser(t, userID).Email; email != change.NewEmail {
+		t.Fatalf("email after confirmation = %s; want %s", email, change.NewEmail)
+	}
+
+	// Whoever changed the email is signed in and has a recovery session
+	SaveLoginSession("s1", &Session{SessionData: webauthn.SessionData{UserID: []byte(userID)}}, time.Hour)
+	SaveRecoverySession("r1", userID, time.Hour)
+
+	if page := postEmailChangeLink(CancelEmailChangeLink, "/api/pub/email_change/cancel", "cancel-"+change.ID); !strings.Contains(page, "Email changed back") {
+		t.Errorf("cancel page = %s; want the email changed back", page)
+	}
+	if email := mustGetUser(t, userID).Email; email != user.Email {
+		t.Errorf("email after revert = %s; want %s", email, user.Email)
+	}
+	if _, err := GetLoginSession("s1"); err == nil {
+		t.Error("logged-in session survived the revert")
+	}
+	if _, err := GetRecoverySession("r1"); err == nil {
+		t.Error("recovery session survived the revert")
+	}
+	if page := postEmailChangeLink(CancelEmailChangeLink, "/api/pub/email_change/cancel", "cancel-"+change.ID); !strings.Contains(page, "Link expired") {
+		t.Errorf("second revert page = %s; want the link expired", page)
+	}
+}
+
+func mustGetUser(t *testing.T, id string) *PasskeyUser {
+	t.Helper()
+	user, err := repo.GetUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/elgs/gosqlcrud"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// Admins, and users with the inviter role, invite people by email. The invitation can give
+// the new user roles and groups, which SSO clients receive from /api/pub/sso/validate, and
+// limit the SSO clients the user may sign in to. The emailed link opens the login page,
+// which registers a passkey for the invited email; the account is created when that
+// succeeds, whatever the realm's sign-up policy. Invitations are used once.
+
+// RoleInviter lets a user who isn't an admin invite people, without roles, groups or
+// client limits.
+const RoleInviter = "inviter"
+
+var rolePattern = regexp.MustCompile(`^[a-zA-Z0-9_.:-]{1,64}$`)
+
+// validateNames checks a list of role or group names.
+func validateNames(kind string, names []string) error {
+	for _, name := range names {
+		if !rolePattern.MatchString(name) {
+			return fmt.Errorf("invalid %s: %s", kind, name)
+		}
+	}
+	return nil
+}
+
+// mayUseClient reports whether the user may sign in to an SSO client. Users without a
+// client list may use all clients of their realm.
+func (user *PasskeyUser) mayUseClient(clientID string) bool {
+	clients := parseList(user.Clients)
+	return len(clients) == 0 || slices.Contains(clients, clientID)
+}
+
+func (user *PasskeyUser) hasRole(role string) bool {
+	return slices.Contains(parseList(user.Roles), role)
+}
+
+// requireInviter returns the current user if they may create invitations.
+func requireInviter(w http.ResponseWriter, r *http.Request) *PasskeyUser {
+	session, err := GetSession(getSessionID(r))
+	if err != nil {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	user, err := repo.GetUser(string(session.UserID))
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusUnauthorized)
+		return nil
+	}
+	if !user.IsAdmin && !user.hasRole(RoleInviter) {
+		JSONResponse(w, "Forbidden", http.StatusForbidden)
+		return nil
+	}
+	if requireStepUp(w, r) == nil {
+		return nil
+	}
+	return user
+}
+
+////////////////////////////
+//                        //
+//    Invitation Admin    //
+//                        //
+////////////////////////////
+
+// AdminCreateInvitation invites an email and mails the invite link.
+// POST /api/admin/invitations {"email": "...", "expires": "2026-01-31T00:00:00Z",
+// "roles": ["editor"], "groups": ["sales"], "clients": ["client-id"]}
+// Without expires the invitation is valid for 7 days; "never_expires": true keeps it open.
+func AdminCreateInvitation(w http.ResponseWriter, r *http.Request) {
+	inviter := requireInviter(w, r)
+	if inviter == nil {
+		return
+	}
+	var req struct {
+		Email        string     `json:"email"`
+		Expires      *time.Time `json:"expires"`
+		NeverExpires bool       `json:"never_expires"`
+		Roles        []string   `json:"roles"`
+		Groups       []string   `json:"groups"`
+		Clients      []string   `json:"clients"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if emailDomain(req.Email) == "" {
+		JSONResponse(w, "A valid email is required", http.StatusBadRequest)
+		return
+	}
+	if !inviter.IsAdmin && (len(req.Roles) > 0 || len(req.Groups) > 0 || len(req.Clients) > 0) {
+		JSONResponse(w, "Only admins can assign roles, groups or clients", http.StatusForbidden)
+		return
+	}
+	if err := validateNames("role", req.Roles); err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateNames("group", req.Groups); err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, clientID := range req.Clients {
+		if _, err := getRealmClient(r, clientID); err != nil {
+			JSONResponse(w, "Unknown client: "+clientID, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var expires *time.Time
+	if !req.NeverExpires {
+		t := time.Now().Add(currentConfig().TTL.Invitation)
+		if req.Expires != nil {
+			t = *req.Expires
+		}
+		if t.Before(time.Now()) {
+			JSONResponse(w, "Expiry must be in the future", http.StatusBadRequest)
+			return
+		}
+		expires = &t
+	}
+
+	realm := realmOf(r)
+	token := generateCode()
+	invitation := &Invitation{
+		ID:        uuid.New().String(),
+		RealmID:   realm.ID,
+		Email:     req.Email,
+		TokenHash: hashToken(token),
+		Roles:     strings.Join(req.Roles, ","),
+		Groups:    strings.Join(req.Groups, ","),
+		Clients:   strings.Join(req.Clients, ","),
+		InvitedBy: &inviter.ID,
+		Expires:   expires,
+	}
+	if err := CreateInvitation(invitation); err != nil {
+		log.Printf("[ERRO] can't create invitation: %s", err.Error())
+		JSONResponse(w, "Failed to create invitation", http.StatusInternalServerError)
+		return
+	}
+
+	link := fmt.Sprintf("%s/?invite=%s", baseURL(r), token)
+	data := map[string]any{"Link": link, "Inviter": inviter.DisplayName, "Expires": ""}
+	var mailExpires time.Time
+	if expires != nil {
+		mailExpires = *expires
+		data["Expires"] = expires.UTC().Format("2006-01-02 15:04 MST")
+	}
+	if err := SendMail(r, req.Email, MailInvitation, "invitation:"+invitation.ID, mailExpires, data); err != nil {
+		log.Printf("[ERRO] can't send invitation mail: %s", err.Error())
+		JSONResponse(w, "Failed to send invitation", http.StatusInternalServerError)
+		return
+	}
+	recordSecurityEvent(r, inviter.ID, "invitation_created", req.Email)
+	JSONResponse(w, invitation, http.StatusOK)
+}
+
+// AdminListInvitations lists the realm's pending invitations, newest first. Inviters who
+// aren't admins see their own.
+// GET /api/admin/invitations
+func AdminListInvitations(w http.ResponseWriter, r *http.Request) {
+	inviter := requireInviter(w, r)
+	if inviter == nil {
+		return
+	}
+	invitedBy := ""
+	if !inviter.IsAdmin {
+		invitedBy = inviter.ID
+	}
+	invitations, err := GetPendingInvitations(realmOf(r).ID, invitedBy)
+	if err != nil {
+		JSONResponse(w, "Failed to list invitations", http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, invitations, http.StatusOK)
+}
+
+// AdminRevokeInvitation revokes a pending invitation, so its link stops working.
+// DELETE /api/admin/invitation?id=...
+func AdminRevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	inviter := requireInviter(w, r)
+	if inviter == nil {
+		return
+	}
+	invitedBy := ""
+	if !inviter.IsAdmin {
+		invitedBy = inviter.ID
+	}
+	id := r.URL.Query().Get("id")
+	if err := RevokeInvitation(realmOf(r).ID, id, invitedBy); err != nil {
+		JSONResponse(w, "Invitation not found or no longer pending", http.StatusNotFound)
+		return
+	}
+	recordSecurityEvent(r, inviter.ID, "invitation_revoked", id)
+	JSONResponse(w, "Invitation revoked", http.StatusOK)
+}
+
+////////////////////////////
+//                        //
+//    Accept Invitation   //
+//                        //
+////////////////////////////
+
+// pendingInvitation links a passkey registration to the invitation it accepts.
+type pendingInvitation struct {
+	InvitationID string `json:"invitation_id"`
+	UserID       string `json:"user_id"`
+}
+
+// validInvitation returns the pending invitation of a token in the request's realm.
+func validInvitation(r *http.Request, token string) (*Invitation, error) {
+	if token == "" {
+		return nil, fmt.Errorf("missing token")
+	}
+	invitation, err := GetInvitationByTokenHash(hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if invitation.RealmID != realmOf(r).ID || !invitation.pending() {
+		return nil, fmt.Errorf("invitation not pending")
+	}
+	return invitation, nil
+}
+
+// InvitationInfo shows the login page who an invitation is for.
+// POST /api/pub/invitation {"token": "..."}
+func InvitationInfo(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	invitation, err := validInvitation(r, req.Token)
+	if err != nil {
+		JSONResponse(w, "Invalid or expired invitation", http.StatusBadRequest)
+		return
+	}
+	JSONResponse(w, map[string]any{"email": invitation.Email, "expires": invitation.Expires}, http.StatusOK)
+}
+
+// BeginInvitationRegistration starts registering a passkey for an invited email. An email
+// that already has an account is refused: its owner signs in and adds passkeys from the
+// dashboard, with step-up.
+// POST /api/pub/invitation/register_start {"token": "..."}
+func BeginInvitationRegistration(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	invitation, err := validInvitation(r, req.Token)
+	if err != nil {
+		JSONResponse(w, "Invalid or expired invitation", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := repo.GetUserByEmail(invitation.RealmID, invitation.Email); err == nil {
+		JSONResponse(w, "This email already has an account, please sign in", http.StatusConflict)
+		return
+	}
+	user := newInvitedUser(invitation, uuid.New().String())
+	options, session, err := getWebAuthn(r).BeginRegistration(user,
+		webauthn.WithExclusions(user.CredentialDescriptors(false)),
+		webauthn.WithExtensions(prfRegistrationExtensions()))
+	if err != nil {
+		log.Printf("[ERRO] can't begin registration: %s", err.Error())
+		JSONResponse(w, "Failed to start registration", http.StatusBadRequest)
+		return
+	}
+
+	sessionID := realmOf(r).newID()
+	if err := SaveSession(sessionID, session, currentConfig().TTL.Ceremony); err != nil {
+		log.Printf("[ERRO] can't save session: %s", err.Error())
+		JSONResponse(w, "Failed to start registration", http.StatusInternalServerError)
+		return
+	}
+	pending, _ := json.Marshal(pendingInvitation{InvitationID: invitation.ID, UserID: user.ID})
+	if err := store.Set("invitation_pending:"+sessionID, string(pending), currentConfig().TTL.Ceremony); err != nil {
+		log.Printf("[ERRO] can't save pending invitation: %s", err.Error())
+		JSONResponse(w, "Failed to start registration", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Access-Control-Expose-Headers", "register_sid")
+	w.Header().Set("register_sid", sessionID)
+	JSONResponse(w, options, http.StatusOK)
+}
+
+// FinishInvitationRegistration stores the passkey, accepts the invitation, creates the
+// account and signs the user in.
+// POST /api/pub/invitation/register_finish (register_sid header)
+func FinishInvitationRegistration(w http.ResponseWriter, r *http.Request) {
+	registerSid := realmHeader(r, "register_sid")
+	session, err := GetSession(registerSid)
+	if err != nil {
+		JSONResponse(w, "Registration expired, please try again", http.StatusBadRequest)
+		return
+	}
+	val, err := store.GetDel("invitation_pending:" + registerSid)
+	if err != nil {
+		JSONResponse(w, "Registration expired, please try again", http.StatusBadRequest)
+		return
+	}
+	DeleteSession(registerSid)
+	var pending pendingInvitation
+	if err := json.Unmarshal([]byte(val), &pending); err != nil || pending.UserID != string(session.UserID) {
+		JSONResponse(w, "Registration expired, please try again", http.StatusBadRequest)
+		return
+	}
+	invitation, err := GetInvitationByID(pending.InvitationID)
+	if err != nil || invitation.RealmID != realmOf(r).ID {
+		JSONResponse(w, "Invalid or expired invitation", http.StatusBadRequest)
+		return
+	}
+
+	user := newInvitedUser(invitation, pending.UserID)
+	parsed, err := protocol.ParseCredentialCreationResponse(r)
+	if err != nil {
+		JSONResponse(w, "Failed to finish registration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	credential, err := getWebAuthn(r).CreateCredential(user, *session, parsed)
+	if err != nil {
+		JSONResponse(w, "Failed to finish registration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch err := AcceptInvitation(invitation, user); err {
+	case nil:
+	case errInvitationNotPending:
+		JSONResponse(w, "This invitation was already accepted", http.StatusConflict)
+		return
+	case errEmailTaken:
+		JSONResponse(w, "This email got an account meanwhile, please sign in", http.StatusConflict)
+		return
+	default:
+		log.Printf("[ERRO] can't accept invitation: %s", err.Error())
+		JSONResponse(w, "Failed to create account", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[INFO] created invited user for email: %s", user.Email)
+
+	addCredential(r, user, credential, prfEnabled(parsed.ClientExtensionResults))
+	recordSecurityEvent(r, user.ID, "invitation_accepted", invitation.ID)
+	createLoginSession(w, r, user.ID, []string{AMREmail})
+	JSONResponse(w, map[string]any{"status": "ok"}, http.StatusOK)
+}
+
+// newInvitedUser returns the account an invitation creates, not yet stored.
+func newInvitedUser(invitation *Invitation, id string) *PasskeyUser {
+	return &PasskeyUser{
+		ID:          id,
+		RealmID:     invitation.RealmID,
+		DisplayName: invitation.Email,
+		Name:        invitation.Email,
+		Email:       invitation.Email,
+		Created:     time.Now(),
+		IsActive:    true,
+		Roles:       invitation.Roles,
+		Groups:      invitation.Groups,
+		Clients:     invitation.Clients,
+	}
+}
+
+////////////////////////////
+//                        //
+//    Invitation Model    //
+//                        //
+////////////////////////////
+
+type Invitation struct {
+	ID         string     `json:"id" db:"id" pk:"true"`
+	RealmID    string     `json:"realm_id" db:"realm_id"`
+	Email      string     `json:"email" db:"email"`
+	TokenHash  string     `json:"-" db:"token_hash"`
+	Roles      string     `json:"roles" db:"roles"`
+	Groups     string     `json:"groups" db:"user_groups"`
+	Clients    string     `json:"clients" db:"clients"`
+	InvitedBy  *string    `json:"invited_by" db:"invited_by"`
+	Expires    *time.Time `json:"expires" db:"expires"`
+	Created    *time.Time `json:"created" db:"created"`
+	Accepted   *time.Time `json:"accepted" db:"accepted"`
+	AcceptedBy *string    `json:"accepted_by" db:"accepted_by"`
+	Revoked    *time.Time `json:"revoked" db:"revoked"`
+}
+
+func (invitation *Invitation) pending() bool {
+	return invitation.Accepted == nil && invitation.Revoked == nil &&
+		(invitation.Expires == nil || invitation.Expires.After(time.Now()))
+}
+
+func CreateInvitation(invitation *Invitation) error {
+	now := time.Now()
+	invitation.Created = &now
+	_, err := gosqlcrud.Create(db, invitation, "invitation")
+	return err
+}
+
+func GetInvitationByID(id string) (*Invitation, error) {
+	invitation := &Invitation{ID: id}
+	if err := gosqlcrud.Retrieve(db, invitation, "invitation"); err != nil {
+		return nil, err
+	}
+	invitation.ID = id
+	return invitation, nil
+}
+
+func GetInvitationByTokenHash(tokenHash string) (*Invitation, error) {
+	invitations := []Invitation{}
+	err := gosqlcrud.QueryToStructs(db, &invitations, "SELECT * FROM invitation WHERE token_hash = ?", tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(invitations) == 0 {
+		return nil, fmt.Errorf("invitation not found")
+	}
+	return &invitations[0], nil
+}
+
+// GetPendingInvitations lists the realm's pending invitations, optionally only those of
+// one inviter.
+func GetPendingInvitations(realmID, invitedBy string) ([]Invitation, error) {
+	invitations := []Invitation{}
+	query := "SELECT * FROM invitation WHERE realm_id = ? AND accepted IS NULL AND revoked IS NULL AND (expires IS NULL OR expires > ?)"
+	args := []any{realmID, time.Now()}
+	if invitedBy != "" {
+		query += " AND invited_by = ?"
+		args = append(args, invitedBy)
+	}
+	err := gosqlcrud.QueryToStructs(db, &invitations, query+" ORDER BY created DESC", args...)
+	return invitations, err
+}
+
+var (
+	errInvitationNotPending = errors.New("invitation not pending")
+	errEmailTaken           = errors.New("email already has an account")
+)
+
+// AcceptInvitation marks the invitation accepted by user and, in the same transaction,
+// creates the user. The accept is a conditional update, so a link used twice at once creates
+// one account.
+func AcceptInvitation(invitation *Invitation, user *PasskeyUser) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	result, err := tx.Exec("UPDATE invitation SET accepted = ?, accepted_by = ? "+
+		"WHERE id = ? AND accepted IS NULL AND revoked IS NULL AND (expires IS NULL OR expires > ?)", now, user.ID, invitation.ID, now)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errInvitationNotPending
+	}
+	if _, err := gosqlcrud.Create(tx, user, "`user`"); err != nil {
+		// The email got an account since the registration began
+		tx.Rollback()
+		if _, lookupErr := repo.GetUserByEmail(invitation.RealmID, invitation.Email); lookupErr == nil {
+			return errEmailTaken
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func RevokeInvitation(realmID, id, invitedBy string) error {
+	query := "UPDATE invitation SET revoked = ? WHERE id = ? AND realm_id = ? AND accepted IS NULL AND revoked IS NULL"
+	args := []any{time.Now(), id, realmID}
+	if invitedBy != "" {
+		query += " AND invited_by = ?"
+		args = append(args, invitedBy)
+	}
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no rows affected")
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestInvitationPending(t *testing.T) {
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	cases := []struct {
+		invitation Invitation
+		want       bool
+	}{
+		{Invitation{}, true},
+		{Invitation{Expires: &future}, true},
+		{Invitation{Expires: &past}, false},
+		{Invitation{Accepted: &past}, false},
+		{Invitation{Revoked: &past, Expires: &future}, false},
+	}
+	for i, c := range cases {
+		if got := c.invitation.pending(); got != c.want {
+			t.Errorf("case %d: pending() = %v; want %v", i, got, c.want)
+		}
+	}
+}
+
+func TestMayUseClient(t *testing.T) {
+	if !(&PasskeyUser{}).mayUseClient("crm") {
+		t.Error("user without client list can't use a client")
+	}
+	user := &PasskeyUser{Clients: "crm, wiki"}
+	if !user.mayUseClient("wiki") || user.mayUseClient("billing") {
+		t.Errorf("client list %q not applied", user.Clients)
+	}
+}
+
+func TestAcceptInvitation(t *testing.T) {
+	initTestDB(t)
+	defer db.Close()
+	invite := func(email, roles string) *Invitation {
+		t.Helper()
+		invitation := &Invitation{ID: uuid.New().String(), RealmID: defaultRealmID, Email: email, TokenHash: uuid.New().String(), Roles: roles}
+		if err := CreateInvitation(invitation); err != nil {
+			t.Fatal(err)
+		}
+		return invitation
+	}
+
+	// Accepted once, the invitation creates the account
+	first := invite("invited@example.com", "editor")
+	if err := AcceptInvitation(first, newInvitedUser(first, uuid.New().String())); err != nil {
+		t.Fatalf("AcceptInvitation = %v", err)
+	}
+	user := mustGetUserByEmail(t, "invited@example.com")
+	if user.Roles != "editor" {
+		t.Errorf("roles = %q; want editor", user.Roles)
+	}
+
+	// Accepted twice, by a second registration that began before the first finished
+	if err := AcceptInvitation(first, newInvitedUser(first, uuid.New().String())); err != errInvitationNotPending {
+		t.Errorf("second AcceptInvitation = %v; want errInvitationNotPending", err)
+	}
+
+	// A new invitation for an email that got an account meanwhile is left pending
+	second := invite("invited@example.com", "admin")
+	if err := AcceptInvitation(second, newInvitedUser(second, uuid.New().String())); err != errEmailTaken {
+		t.Errorf("AcceptInvitation for a taken email = %v; want errEmailTaken", err)
+	}
+	if invitation, _ := GetInvitationByID(second.ID); !invitation.pending() {
+		t.Error("invitation accepted although the account wasn't created")
+	}
+}
+
+func TestBeginInvitationRegistration(t *testing.T) {
+	initTestDB(t)
+	defer db.Close()
+	initTestStore(t)
+	setTestConfig(t, func(c *Config) {
+		c.RelyingParty.ID, c.RelyingParty.Origins = "localhost", []string{"http://localhost"}
+	})
+	reloadPasskeyStore()
+	userID, cleanupUser := createTestUser(t)
+	defer cleanupUser()
+	user, _ := repo.GetUser(userID)
+
+	begin := func(email string) int {
+		t.Helper()
+		token := uuid.New().String()
+		invitation := &Invitation{ID: uuid.New().String(), RealmID: defaultRealmID, Email: email, TokenHash: hashToken(token)}
+		if err := CreateInvitation(invitation); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		BeginInvitationRegistration(w, httptest.NewRequest(http.MethodPost, "/api/pub/invitation/register_start", strings.NewReader(`{"token": "`+token+`"}`)))
+		return w.Code
+	}
+	if code := begin(uuid.New().String() + "@example.com"); code != http.StatusOK {
+		t.Errorf("invitation for a new email = %d; want 200", code)
+	}
+	// The invitation must not add a passkey to an account without its owner's step-up
+	if code := begin(user.Email); code != http.StatusConflict {
+		t.Errorf("invitation for an existing account = %d; want 409", code)
+	}
+}
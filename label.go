@@ -0,0 +1,81 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+// aaguidCatalogJSON maps AAGUIDs to authenticator names. The frontend uses the same file.
+//
+//go:embed web/src/resources/aaguids.json
+var aaguidCatalogJSON []byte
+
+var aaguidCatalog = map[string]struct {
+	Name string `json:"name"`
+}{}
+
+func init() {
+	if err := json.Unmarshal(aaguidCatalogJSON, &aaguidCatalog); err != nil {
+		log.Printf("[ERRO] can't parse AAGUID catalog: %s", err.Error())
+	}
+}
+
+// aaguidName returns the authenticator name for an AAGUID, or "" if it is not in the catalog.
+func aaguidName(aaguid string) string {
+	return aaguidCatalog[aaguid].Name
+}
+
+// parseUserAgent extracts a browser and OS name from a user agent string.
+// It is deliberately coarse and matches parseUserAgent in the dashboard.
+func parseUserAgent(ua string) (browser, os string) {
+	browser, os = "Unknown", "Unknown"
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		os = "iOS"
+	case strings.Contains(ua, "Macintosh"):
+		os = "macOS"
+	case strings.Contains(ua, "Windows"):
+		os = "Windows"
+	case strings.Contains(ua, "Android"):
+		os = "Android"
+	case strings.Contains(ua, "CrOS"):
+		os = "ChromeOS"
+	case strings.Contains(ua, "Linux"):
+		os = "Linux"
+	}
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"), strings.Contains(ua, "Opera"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"), strings.Contains(ua, "FxiOS/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"), strings.Contains(ua, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	}
+	return browser, os
+}
+
+// defaultCredentialLabel builds a friendly label for a new credential, e.g.
+// "iCloud Keychain (Safari on macOS)" or "Chrome on Windows" for unknown authenticators.
+func defaultCredentialLabel(aaguid, userAgent string) string {
+	browser, os := parseUserAgent(userAgent)
+	device := browser + " on " + os
+	if name := aaguidName(aaguid); name != "" {
+		return name + " (" + device + ")"
+	}
+	return device
+}
+
+// displayCredentialLabel returns the label to show for a stored credential. Credentials
+// registered before labels were derived carry the raw user agent, which is converted here.
+func displayCredentialLabel(label, aaguid string) string {
+	if label == "" || strings.HasPrefix(label, "Mozilla/") {
+		return defaultCredentialLabel(aaguid, label)
+	}
+	return label
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	cases := []struct {
+		ua, browser, os string
+	}{
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15", "Safari", "macOS"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.0.0", "Edge", "Windows"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36", "Chrome", "Android"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1", "Safari", "iOS"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0", "Firefox", "Linux"},
+		{"", "Unknown", "Unknown"},
+	}
+	for _, c := range cases {
+		browser, os := parseUserAgent(c.ua)
+		if browser != c.browser || os != c.os {
+			t.Errorf("parseUserAgent(%q) = %s, %s; want %s, %s", c.ua, browser, os, c.browser, c.os)
+		}
+	}
+}
+
+func TestDefaultCredentialLabel(t *testing.T) {
+	ua := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
+	if got := defaultCredentialLabel("08987058-cadc-4b81-b6e1-30de50dcbe96", ua); got != "Windows Hello (Chrome on Windows)" {
+		t.Errorf("known AAGUID: got %q", got)
+	}
+	if got := defaultCredentialLabel("00000000-0000-0000-0000-000000000000", ua); got != "Chrome on Windows" {
+		t.Errorf("zero AAGUID: got %q", got)
+	}
+	if got := displayCredentialLabel("Work laptop", ""); got != "Work laptop" {
+		t.Errorf("custom label should be kept, got %q", got)
+	}
+	if got := displayCredentialLabel(ua, ""); got != "Chrome on Windows" {
+		t.Errorf("legacy user agent label: got %q", got)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mail is a rendered email with a plain text and an optional HTML body.
+type Mail struct {
+	RealmID string
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends mail. mail.mailer selects the implementation: smtp, file or log.
+type Mailer interface {
+	Send(mail *Mail) error
+}
+
+var mailer Mailer
+
+const (
+	SMTPTLSStartTLS = "starttls" // upgrade a plain connection, usually port 587
+	SMTPTLSImplicit = "tls"      // TLS from the start, usually port 465
+	SMTPTLSNone     = "none"     // plain connection, only for local relays
+)
+
+// initMailer configures the mailer from the mail configuration. Without an SMTP host, a
+// mailer has to be chosen explicitly, except in development, where mail is only logged.
+func initMailer() {
+	kind, err := mailerKind(currentConfig())
+	if err != nil {
+		log.Fatalf("[FATA] %s", err.Error())
+	}
+	config := currentConfig().Mail
+	from := config.SMTPFrom
+	if from == "" {
+		from = config.SMTPUser
+	}
+	switch kind {
+	case "smtp":
+		mode := config.SMTPTLS
+		if mode == "" {
+			mode = SMTPTLSStartTLS
+			if config.SMTPPort == 465 {
+				mode = SMTPTLSImplicit
+			}
+		}
+		mailer = &SMTPMailer{
+			Host:     config.SMTPHost,
+			Port:     strconv.Itoa(config.SMTPPort),
+			Username: config.SMTPUser,
+			Password: config.SMTPPass,
+			From:     from,
+			TLS:      mode,
+		}
+	case "file":
+		mailer = &FileMailer{Dir: config.Dir, From: from}
+	default:
+		mailer = &LogMailer{}
+	}
+	log.Printf("[INFO] mailer: %s", kind)
+}
+
+// mailerKind returns the mailer to use. Falling back to the log mailer in production would
+// silently put live login links in the log instead of sending them.
+func mailerKind(config *Config) (string, error) {
+	switch {
+	case config.Mail.Mailer != "":
+		return config.Mail.Mailer, nil
+	case config.Mail.SMTPHost != "":
+		return "smtp", nil
+	case config.Server.Env == "dev":
+		return "log", nil
+	}
+	return "", errors.New("no mailer configured: set mail.smtp_host, or mail.mailer to file, or to log for development")
+}
+
+// Message returns the mail as a MIME message, multipart/alternative when it has an HTML body.
+func (mail *Mail) Message(from string) []byte {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.Trim(from[at+1:], "> ")
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	header("From", from)
+	header("To", strings.Join(mail.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", mail.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain))
+	header("MIME-Version", "1.0")
+
+	if mail.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		writeQuotedPrintable(&buf, mail.Text)
+		return buf.Bytes()
+	}
+
+	parts := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", mail.Text},
+		{"text/html; charset=utf-8", mail.HTML},
+	} {
+		w, _ := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		writeQuotedPrintable(w, part.body)
+	}
+	parts.Close()
+	return buf.Bytes()
+}
+
+func writeQuotedPrintable(w io.Writer, s string) {
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(s))
+	qp.Close()
+}
+
+////////////////////////////
+//                        //
+//    SMTPMailer          //
+//                        //
+////////////////////////////
+
+// SMTPMailer sends mail through an SMTP server, with STARTTLS or implicit TLS.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	TLS      string // SMTPTLSStartTLS, SMTPTLSImplicit or SMTPTLSNone
+}
+
+func (m *SMTPMailer) Send(mail *Mail) error {
+	addr := net.JoinHostPort(m.Host, m.Port)
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	tlsConfig := &tls.Config{ServerName: m.Host}
+
+	var conn net.Conn
+	var err error
+	if m.TLS == SMTPTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start SMTP session: %w", err)
+	}
+	defer c.Close()
+
+	if m.TLS == SMTPTLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return fmt.Errorf("SMTP auth failed: %w", err)
+		}
+	}
+	if err := c.Mail(m.From); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	for _, to := range mail.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("failed to send mail to %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	if _, err := w.Write(mail.Message(m.From)); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return c.Quit()
+}
+
+////////////////////////////
+//                        //
+//    FileMailer          //
+//                        //
+////////////////////////////
+
+// FileMailer writes each mail as an .eml file into Dir, for development and staging.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(mail *Mail) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.Dir, name), mail.Message(m.From), 0o600)
+}
+
+////////////////////////////
+//                        //
+//    LogMailer           //
+//                        //
+////////////////////////////
+
+// LogMailer only logs mail. It is meant for local development: only with server.env dev
+// does it log the body, since login links and codes would otherwise end up in the log.
+type LogMailer struct{}
+
+func (m *LogMailer) Send(mail *Mail) error {
+	if currentConfig().Server.Env != "dev" {
+		log.Printf("[INFO] mail to %s: %s (body not logged outside dev)", strings.Join(mail.To, ", "), mail.Subject)
+		return nil
+	}
+	log.Printf("[INFO] mail to %s: %s\n%s", strings.Join(mail.To, ", "), mail.Subject, mail.Text)
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMailer keeps sent mail in memory.
+type fakeMailer struct {
+	mu   sync.Mutex
+	sent []*Mail
+}
+
+func (m *fakeMailer) Send(mail *Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+func TestAcceptLanguages(t *testing.T) {
+	cases := map[string][]string{
+		"":                          nil,
+		"de-CH":                     {"de"},
+		"fr;q=0.5, de-DE, en;q=0.8": {"de", "en", "fr"},
+		"*, en;q=0":                 nil,
+	}
+	for header, want := range cases {
+		if got := acceptLanguages(header); !reflect.DeepEqual(got, want) {
+			t.Errorf("acceptLanguages(%q) = %v; want %v", header, got, want)
+		}
+	}
+}
+
+func TestRenderMail(t *testing.T) {
+	name := "Acme"
+	realm := &Realm{ID: "acme", Name: &name}
+	for _, name := range []string{MailLoginLink, MailLoginCode, MailNewPasskey, MailSecurityAlert, MailInvitation, MailEmailChange, MailEmailChangeNotice} {
+		for _, lang := range []string{"en", "de"} {
+			mail, err := renderMail(realm, []string{lang}, "a@example.com", name, map[string]any{
+				"Link": "https://login.example/?token=<x>", "Code": "123456", "Minutes": 10, "Kind": "clone_warning", "Inviter": "Ann", "Expires": "2026-01-31 00:00 UTC",
+				"OldEmail": "a@example.com", "NewEmail": "b@example.com", "Hours": 24, "Days": 7,
+			})
+			if err != nil {
+				t.Fatalf("%s/%s: %s", lang, name, err)
+			}
+			if mail.Subject == "" || strings.Contains(mail.Subject, "\n") || mail.Text == "" || mail.HTML == "" {
+				t.Errorf("%s/%s: incomplete mail %+v", lang, name, mail)
+			}
+		}
+	}
+
+	mail, _ := renderMail(realm, []string{"fr", "de"}, "a@example.com", MailLoginCode, map[string]any{"Code": "123456"})
+	if mail.Subject != "123456 ist dein Anmeldecode für Acme" {
+		t.Errorf("subject = %q; want the German one", mail.Subject)
+	}
+	mail, _ = renderMail(realm, []string{"fr"}, "a@example.com", MailLoginLink, map[string]any{"Link": "https://x/?a=1&b=<2>"})
+	if !strings.Contains(mail.HTML, "https://x/?a=1&amp;b=%3c2%3e") || !strings.Contains(mail.Text, "https://x/?a=1&b=<2>") {
+		t.Errorf("link not escaped for HTML only:\n%s\n%s", mail.Text, mail.HTML)
+	}
+}
+
+func TestRenderMailOverride(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "acme", "en"), 0o755)
+	os.WriteFile(filepath.Join(dir, "acme", "en", "login_code.txt"), []byte(`{{define "subject"}}Acme code {{.Code}}{{end}}Code: {{.Code}}`), 0o644)
+	setTestConfig(t, func(c *Config) { c.Mail.TemplateDir = dir })
+
+	name := "Acme"
+	mail, err := renderMail(&Realm{ID: "acme", Name: &name}, nil, "a@example.com", MailLoginCode, map[string]any{"Code": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mail.Subject != "Acme code 1" || mail.Text != "Code: 1\n" || mail.HTML != "" {
+		t.Errorf("override not used: %+v", mail)
+	}
+	mail, _ = renderMail(&Realm{ID: "beta", Name: &name}, nil, "a@example.com", MailLoginCode, map[string]any{"Code": "1"})
+	if mail.Subject == "Acme code 1" {
+		t.Error("override of realm acme used for realm beta")
+	}
+}
+
+func TestMailMessage(t *testing.T) {
+	m := &Mail{To: []string{"a@example.com"}, Subject: "Grüße", Text: "plain\n", HTML: "<p>html</p>"}
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Message("login@example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != "Grüße" {
+		t.Errorf("subject = %q", subject)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("content type = %q", mediaType)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	var bodies []string
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(part)
+		bodies = append(bodies, part.Header.Get("Content-Type")+": "+strings.TrimSpace(string(b)))
+	}
+	want := []string{"text/plain; charset=utf-8: plain", "text/html; charset=utf-8: <p>html</p>"}
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("parts = %q; want %q", bodies, want)
+	}
+}
+
+func TestDeliverOutboxMail(t *testing.T) {
+	fake := &fakeMailer{}
+	mailer = fake
+	defer func() { mailer = nil }()
+
+	name := "Acme"
+	mail, err := renderMail(&Realm{ID: "acme", Name: &name}, []string{"de"}, "a@example.com", MailLoginCode, map[string]any{"Code": "654321", "Minutes": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := strings.Join(mail.To, ",")
+	if err := deliverOutboxMail(&OutboxMail{RealmID: &mail.RealmID, Recipient: &to, Subject: &mail.Subject, Text: &mail.Text, HTML: &mail.HTML}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.sent) != 1 || !reflect.DeepEqual(fake.sent[0], mail) {
+		t.Errorf("sent = %+v; want %+v", fake.sent, mail)
+	}
+}
+
+func TestMailBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 4: 4 * time.Minute, 8: time.Hour, 100: time.Hour} {
+		got := mailBackoff(attempts)
+		if got < want || got > want+want/5 {
+			t.Errorf("mailBackoff(%d) = %s; want %s plus up to 20%%", attempts, got, want)
+		}
+	}
+}
+
+func TestMailDedupeKey(t *testing.T) {
+	if got := mailDedupeKey(0, "new_passkey", "abc"); got != "new_passkey:abc" {
+		t.Errorf("mailDedupeKey = %q", got)
+	}
+	if got := mailDedupeKey(time.Hour, "clone_warning", "abc"); !strings.HasPrefix(got, "clone_warning:abc:") {
+		t.Errorf("mailDedupeKey = %q; want a time bucket", got)
+	}
+}
+
+func TestMailerKind(t *testing.T) {
+	cases := []struct {
+		mailer, host, env string
+		want              string
+	}{
+		{"", "smtp.example.com", "", "smtp"},
+		{"file", "", "", "file"},
+		{"log", "", "", "log"},
+		{"", "", "dev", "log"},
+		{"", "", "", ""},
+	}
+	for _, c := range cases {
+		config := &Config{Server: ServerConfig{Env: c.env}, Mail: MailConfig{Mailer: c.mailer, SMTPHost: c.host}}
+		kind, err := mailerKind(config)
+		if kind != c.want || (err == nil) != (c.want != "") {
+			t.Errorf("mailerKind(%q, %q, %q) = %q, %v; want %q", c.mailer, c.host, c.env, kind, err, c.want)
+		}
+	}
+}
@@ -2,49 +2,38 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"embed"
 	"fmt"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
-	"strings"
-
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/go-webauthn/webauthn/webauthn"
-"github.com/redis/go-redis/v9"
 )
 
-var env = os.Getenv("ENV")
-var host = getEnv("HOST", "localhost")
-var port = getEnv("PORT", "8080")
-var rpName = getEnv("RP_NAME", "Webauthn")
-var rpId = getEnv("RP_ID", host)
-var origins = getEnv("ORIGINS", "")
-var redisURL = getEnv("REDIS_URL", "localhost:6379")
-var dbUser = getEnv("DB_USER", "root")
-var dbPassword = getEnv("DB_PASSWORD", "password")
-var dbHost = getEnv("DB_HOST", "localhost")
-var dbPort = getEnv("DB_PORT", "3306")
-var dbName = getEnv("DB_NAME", "appdb")
-
 var ctx = context.Background() // go's ugliest thing
 var err error
-var webAuthn *webauthn.WebAuthn
-var db *sql.DB
-var redisClient *redis.Client
+var db *sqlDB
+var repo Repository
+var store Store
 
 //go:embed web/dist
 var web embed.FS
 var staticFS fs.FS
 
 func main() {
-	initRedis()
-	defer redisClient.Close()
+	initConfig()
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 	initDB()
 	defer db.Close()
+	checkSchema()
+	initStore()
 	initPasskeyStore()
+	initRateLimits()
+	go watchConfig()
+	initMailer()
+	go runMailWorker()
 	initApiServer()
 }
 
@@ -52,7 +41,7 @@ func initApiServer() {
 
 	mux := http.NewServeMux()
 
-	if env == "dev" {
+	if currentConfig().Server.Env == "dev" {
 		staticFS = os.DirFS("web/build")
 		log.Println("Serving static files from disk (hot reload enabled)")
 	} else {
@@ -64,24 +53,59 @@ func initApiServer() {
 	}
 
 	mux.Handle("GET /", http.FileServer(http.FS(staticFS)))
+	mux.HandleFunc("GET /.well-known/webauthn", WellKnownWebAuthn)
+	mux.HandleFunc("GET /api/pub/realm", GetRealm)
 
 	mux.HandleFunc("POST /api/pub/login_start", BeginEmailLogin)
 	mux.HandleFunc("GET /api/pub/verify_login", VerifyLoginLink)
+	mux.HandleFunc("POST /api/pub/verify_code", VerifyLoginCode)
+	mux.HandleFunc("POST /api/pub/approve_login", ApproveLogin)
+	mux.HandleFunc("POST /api/pub/login_poll", LoginPoll)
 	mux.HandleFunc("POST /api/pub/passkey_register_start", BeginRegistration)
 	mux.HandleFunc("POST /api/pub/passkey_register_finish", FinishRegistration)
+	mux.HandleFunc("POST /api/pub/passkey_register_confirm", ConfirmRegistration)
 	mux.HandleFunc("POST /api/pub/passkey_login_start", BeginLogin)
 	mux.HandleFunc("POST /api/pub/passkey_login_finish", FinishLogin)
+	mux.HandleFunc("POST /api/pub/recovery_login", RecoveryLogin)
+	mux.HandleFunc("POST /api/pub/invitation", InvitationInfo)
+	mux.HandleFunc("POST /api/pub/invitation/register_start", BeginInvitationRegistration)
+	mux.HandleFunc("POST /api/pub/invitation/register_finish", FinishInvitationRegistration)
+	mux.HandleFunc("POST /api/pub/totp_login", TOTPLogin)
+	mux.HandleFunc("GET /api/pub/email_change/confirm", ConfirmEmailChange)
+	mux.HandleFunc("POST /api/pub/email_change/confirm", ConfirmEmailChange)
+	mux.HandleFunc("GET /api/pub/email_change/cancel", CancelEmailChangeLink)
+	mux.HandleFunc("POST /api/pub/email_change/cancel", CancelEmailChangeLink)
 
 	mux.HandleFunc("GET /api/pub/sso/authorize", SSOAuthorize)
 	mux.HandleFunc("POST /api/pub/sso/token", SSOToken)
 	mux.HandleFunc("GET /api/pub/sso/validate", SSOValidate)
 	mux.HandleFunc("POST /api/pub/sso/revoke", SSORevoke)
 	mux.HandleFunc("GET /api/pub/sso/logout", SSOLogout)
+	mux.HandleFunc("POST /api/pub/sso/confirm", SSOConfirmCreate)
+	mux.HandleFunc("POST /api/pub/sso/confirm/result", SSOConfirmResult)
+	mux.HandleFunc("GET /api/pub/sso/confirm/page", SSOConfirmPage)
+	mux.HandleFunc("POST /api/pub/sso/confirm/start", BeginSSOConfirm)
+	mux.HandleFunc("POST /api/pub/sso/confirm/finish", FinishSSOConfirm)
+	mux.HandleFunc("POST /api/pub/sso/confirm/decline", DeclineSSOConfirm)
+	mux.HandleFunc("GET /api/pub/sso/prf/page", SSOPRFPage)
+	mux.HandleFunc("POST /api/pub/sso/prf/start", BeginSSOPRF)
+	mux.HandleFunc("POST /api/pub/sso/prf/finish", FinishSSOPRF)
 
 	mux.HandleFunc("POST /api/logout", Logout)
+	mux.HandleFunc("POST /api/stepup_start", BeginStepUp)
+	mux.HandleFunc("POST /api/stepup_finish", FinishStepUp)
 	mux.HandleFunc("GET /api/credentials", GetUserCredentials)
 	mux.HandleFunc("DELETE /api/credentials", DeleteUserCredential)
+	mux.HandleFunc("PUT /api/credential", RenameUserCredential)
+	mux.HandleFunc("GET /api/credential/usage", GetCredentialUsageHistory)
 	mux.HandleFunc("PUT /api/profile", UpdateProfile)
+	mux.HandleFunc("GET /api/email_change", GetEmailChange)
+	mux.HandleFunc("POST /api/email_change", RequestEmailChange)
+	mux.HandleFunc("DELETE /api/email_change", CancelEmailChange)
+	mux.HandleFunc("GET /api/recovery_codes", GetRecoveryCodes)
+	mux.HandleFunc("POST /api/recovery_codes", RegenerateRecoveryCodes)
+	mux.HandleFunc("POST /api/totp_start", BeginTOTPEnrolment)
+	mux.HandleFunc("POST /api/totp_finish", FinishTOTPEnrolment)
 	mux.HandleFunc("GET /api/me", Me)
 	mux.HandleFunc("GET /api/sso/sessions", SSOSessions)
 	mux.HandleFunc("DELETE /api/sso/session", SSORevokeSession)
@@ -93,48 +117,50 @@ func initApiServer() {
 	mux.HandleFunc("GET /api/admin/users", AdminListUsers)
 	mux.HandleFunc("PUT /api/admin/user", AdminUpdateUser)
 	mux.HandleFunc("DELETE /api/admin/user", AdminDeleteUser)
-
-	handler := CORS(Auth(mux))
-	addr := fmt.Sprintf("%s:%s", host, port)
+	mux.HandleFunc("GET /api/admin/user/credentials", AdminListUserCredentials)
+	mux.HandleFunc("PUT /api/admin/credential", AdminRenameCredential)
+	mux.HandleFunc("GET /api/admin/settings", AdminListSettings)
+	mux.HandleFunc("PUT /api/admin/setting", AdminUpdateSetting)
+	mux.HandleFunc("GET /api/admin/security_events", AdminListSecurityEvents)
+	mux.HandleFunc("GET /api/admin/invitations", AdminListInvitations)
+	mux.HandleFunc("POST /api/admin/invitations", AdminCreateInvitation)
+	mux.HandleFunc("DELETE /api/admin/invitation", AdminRevokeInvitation)
+	mux.HandleFunc("GET /api/admin/mail", AdminListOutboxMail)
+	mux.HandleFunc("POST /api/admin/mail/resend", AdminResendOutboxMail)
+	mux.HandleFunc("GET /api/admin/realms", AdminListRealms)
+	mux.HandleFunc("POST /api/admin/realms", AdminCreateRealm)
+	mux.HandleFunc("PUT /api/admin/realm", AdminUpdateRealm)
+	mux.HandleFunc("DELETE /api/admin/realm", AdminDeleteRealm)
+
+	handler := CORS(Realms(RateLimit(Auth(mux))))
+	addr := fmt.Sprintf("%s:%d", currentConfig().Server.Host, currentConfig().Server.Port)
 	log.Printf("Listening on http://%s\n", addr)
 	if err := http.ListenAndServe(addr, handler); err != nil {
 		log.Println(err)
 	}
 }
 
-func initPasskeyStore() {
-	wconfig := &webauthn.Config{
-		RPDisplayName: rpName,                      // Display Name for your site
-		RPID:          rpId,                        // Generally the FQDN for your site
-		RPOrigins:     strings.Split(origins, ","), // The origin URLs allowed for WebAuthn
-	}
-	webAuthn, err = webauthn.New(wconfig)
+func initDB() {
+	var err error
+	driver := currentConfig().Database.Driver
+	db, err = openDB(driver, dataSourceName(currentConfig().Database))
 	if err != nil {
 		fmt.Printf("[FATA] %s", err.Error())
 		os.Exit(1)
 	}
+	repo = newSQLRepository(db)
+
+	fmt.Printf("[INFO] connected to %s database\n", driver)
 }
 
-func initDB() {
+func initStore() {
 	var err error
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true", dbUser, dbPassword, dbHost, dbPort, dbName)
-	db, err = sql.Open("mysql", dsn)
+	kind := currentConfig().SessionStore.Kind
+	store, err = newStore(kind)
 	if err != nil {
 		fmt.Printf("[FATA] %s", err.Error())
 		os.Exit(1)
 	}
 
-	if err = db.Ping(); err != nil {
-		fmt.Printf("[FATA] %s", err.Error())
-		os.Exit(1)
-	}
-
-	fmt.Println("[INFO] connected to database")
-}
-
-func initRedis() {
-	redisOpts := &redis.Options{
-		Addr: redisURL,
-	}
-	redisClient = redis.NewClient(redisOpts)
+	fmt.Printf("[INFO] keeping sessions in %s store\n", kind)
 }
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Migrations are SQL scripts embedded from migrations/<DB_DRIVER>/, named
+// <version>_<name>.up.sql and <version>_<name>.down.sql. Statements end with a semicolon at the
+// end of a line; lines starting with -- are comments. Applied migrations are recorded in
+// schema_migration with the checksum of their up script, so a script changed after it was
+// applied is noticed. Migrations run while holding an advisory lock, so replicas starting
+// together apply each migration once.
+//
+// A migration runs in a transaction. MySQL commits DDL statements immediately, so a failing
+// migration can leave some of its statements applied there.
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+const migrationLockName = "gopasskey_migrate"
+
+// migrationLockKey is the PostgreSQL advisory lock key of migrations.
+const migrationLockKey = 7220130412
+
+type migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+type appliedMigration struct {
+	Version  int
+	Name     string
+	Checksum string
+	Applied  time.Time
+}
+
+// loadMigrations returns the migrations of the dialect, ordered by version.
+func loadMigrations(d dialect) ([]migration, error) {
+	dir := path.Join("migrations", string(d))
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		file := entry.Name()
+		base, direction := strings.TrimSuffix(file, ".sql"), ""
+		for _, suffix := range []string{".up", ".down"} {
+			if strings.HasSuffix(base, suffix) {
+				base, direction = strings.TrimSuffix(base, suffix), suffix
+			}
+		}
+		prefix, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || direction == "" || !strings.HasSuffix(file, ".sql") {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.up.sql or .down.sql", file)
+		}
+		script, err := fs.ReadFile(migrationFiles, path.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", m.Name, name)
+		}
+		if direction == ".up" {
+			m.Up = string(script)
+			sum := sha256.Sum256(script)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(script)
+		}
+	}
+	var migrations []migration
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// splitStatements splits a script into its statements.
+func splitStatements(script string) []string {
+	var statements []string
+	var statement strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		statement.WriteString(line)
+		statement.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSpace(statement.String()))
+			statement.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(statement.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+type migrator struct {
+	db         *sqlDB
+	migrations []migration
+}
+
+func newMigrator(db *sqlDB) (*migrator, error) {
+	migrations, err := loadMigrations(db.dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{db: db, migrations: migrations}, nil
+}
+
+func (m *migrator) createTable() error {
+	timestamp := "datetime"
+	if m.db.dialect == DriverPostgres {
+		timestamp = "timestamptz"
+	}
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migration (
+  version integer NOT NULL,
+  name varchar(255) NOT NULL,
+  checksum varchar(64) NOT NULL,
+  applied ` + timestamp + ` NOT NULL,
+  PRIMARY KEY (version)
+)`)
+	return err
+}
+
+func (m *migrator) applied() ([]appliedMigration, error) {
+	if err := m.createTable(); err != nil {
+		return nil, err
+	}
+	rows, err := m.db.Query("SELECT version, name, checksum, applied FROM schema_migration ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var applied []appliedMigration
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.Version, &a.Name, &a.Checksum, &a.Applied); err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+func (m *migrator) find(version int) *migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+// verify returns an error if an applied migration was changed since. Applied migrations
+// this build doesn't know, from a newer build, are skipped.
+func (m *migrator) verify(applied []appliedMigration) error {
+	for _, a := range applied {
+		if known := m.find(a.Version); known != nil && known.Checksum != a.Checksum {
+			return fmt.Errorf("migration %d_%s was changed after it was applied", a.Version, a.Name)
+		}
+	}
+	return nil
+}
+
+// pending returns the migrations that aren't applied.
+func (m *migrator) pending(applied []appliedMigration) []migration {
+	done := map[int]bool{}
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+	var pending []migration
+	for _, migration := range m.migrations {
+		if !done[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+// lock takes the migration lock and returns the function that releases it. SQLite needs no
+// lock: its transactions take the database write lock when they begin.
+func (m *migrator) lock() (func(), error) {
+	var acquire, release string
+	switch m.db.dialect {
+	case DriverMySQL:
+		acquire = fmt.Sprintf("SELECT GET_LOCK('%s', 600)", migrationLockName)
+		release = fmt.Sprintf("SELECT RELEASE_LOCK('%s')", migrationLockName)
+	case DriverPostgres:
+		acquire = fmt.Sprintf("SELECT pg_advisory_lock(%d)", migrationLockKey)
+		release = fmt.Sprintf("SELECT pg_advisory_unlock(%d)", migrationLockKey)
+	default:
+		return func() {}, nil
+	}
+	// The lock belongs to the connection, so it is taken and released on the same one
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var got sql.NullInt64
+	if m.db.dialect == DriverMySQL {
+		err = conn.QueryRowContext(ctx, acquire).Scan(&got)
+	} else {
+		_, err = conn.ExecContext(ctx, acquire)
+		got.Int64 = 1
+	}
+	if err == nil && got.Int64 != 1 {
+		err = fmt.Errorf("timed out waiting for the migration lock")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		conn.ExecContext(ctx, release)
+		conn.Close()
+	}, nil
+}
+
+// isApplied reports whether version is recorded, within the transaction of a migration.
+func isApplied(tx *sqlTx, version int) (bool, error) {
+	var n int
+	err := tx.QueryRow("SELECT COUNT(*) FROM schema_migration WHERE version = ?", version).Scan(&n)
+	return n > 0, err
+}
+
+// run executes script and records the migration in one transaction. A migration another
+// replica applied or rolled back in the meantime is skipped.
+func (m *migrator) run(migration migration, script string, up bool) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	applied, err := isApplied(tx, migration.Version)
+	if err != nil || applied == up {
+		return err
+	}
+	for _, statement := range splitStatements(script) {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_migration (version, name, checksum, applied) VALUES (?, ?, ?, ?)",
+			migration.Version, migration.Name, migration.Checksum, time.Now())
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_migration WHERE version = ?", migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Up applies the pending migrations and returns how many it applied.
+func (m *migrator) Up() (int, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	if err := m.verify(applied); err != nil {
+		return 0, err
+	}
+	pending := m.pending(applied)
+	for i, migration := range pending {
+		if err := m.run(migration, migration.Up, true); err != nil {
+			return i, err
+		}
+		fmt.Printf("[INFO] applied migration %d_%s\n", migration.Version, migration.Name)
+	}
+	return len(pending), nil
+}
+
+// Down rolls back the latest applied migration.
+func (m *migrator) Down() error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+	if err := m.verify(applied); err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		return fmt.Errorf("no migration is applied")
+	}
+	latest := applied[len(applied)-1]
+	migration := m.find(latest.Version)
+	if migration == nil || migration.Down == "" {
+		return fmt.Errorf("migration %d_%s can't be rolled back by this build", latest.Version, latest.Name)
+	}
+	if err := m.run(*migration, migration.Down, false); err != nil {
+		return err
+	}
+	fmt.Printf("[INFO] rolled back migration %d_%s\n", migration.Version, migration.Name)
+	return nil
+}
+
+// Status prints the migrations and whether they are applied.
+func (m *migrator) Status() error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, a := range applied {
+		state := a.Applied.Local().Format("2006-01-02 15:04:05")
+		if known := m.find(a.Version); known == nil {
+			state += " (unknown to this build)"
+		} else if known.Checksum != a.Checksum {
+			state += " (changed since)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", a.Version, a.Name, state)
+	}
+	for _, migration := range m.pending(applied) {
+		fmt.Fprintf(w, "%d\t%s\tpending\n", migration.Version, migration.Name)
+	}
+	return w.Flush()
+}
+
+// checkSchema exits if the database is missing migrations of this build, or if an applied
+// one was changed.
+func checkSchema() {
+	m, err := newMigrator(db)
+	if err == nil {
+		var applied []appliedMigration
+		if applied, err = m.applied(); err == nil {
+			err = m.verify(applied)
+		}
+		if pending := m.pending(applied); err == nil && len(pending) > 0 {
+			err = fmt.Errorf("database schema is behind: %d pending migration(s), run: gopasskey migrate up", len(pending))
+		}
+	}
+	if err != nil {
+		log.Fatalf("[FATA] %s", err.Error())
+	}
+}
+
+// migrateCommand runs gopasskey migrate up|down|status.
+func migrateCommand(args []string) int {
+	if len(args) != 1 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		fmt.Fprintln(os.Stderr, "usage: gopasskey migrate up|down|status")
+		return 2
+	}
+	initDB()
+	defer db.Close()
+	m, err := newMigrator(db)
+	if err == nil {
+		switch args[0] {
+		case "up":
+			var n int
+			if n, err = m.Up(); err == nil && n == 0 {
+				fmt.Println("[INFO] database schema is up to date")
+			}
+		case "down":
+			err = m.Down()
+		case "status":
+			err = m.Status()
+		}
+	}
+	if err != nil {
+		log.Printf("[ERRO] %s", err.Error())
+		return 1
+	}
+	return 0
+}
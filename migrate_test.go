@@ -0,0 +1,153 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- comment; not a statement
+CREATE TABLE a (
+  id int -- trailing comment
+);
+
+INSERT INTO a VALUES (1);
+SELECT 1`
+	got := splitStatements(script)
+	want := []string{"CREATE TABLE a (\n  id int -- trailing comment\n);", "INSERT INTO a VALUES (1);", "SELECT 1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("splitStatements = %q; want %q", got, want)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	var versions [][]int
+	for _, driver := range dbDrivers {
+		migrations, err := loadMigrations(dialect(driver))
+		if err != nil {
+			t.Fatalf("%s: %v", driver, err)
+		}
+		var v []int
+		for _, m := range migrations {
+			if m.Down == "" {
+				t.Errorf("%s: migration %d_%s has no down script", driver, m.Version, m.Name)
+			}
+			v = append(v, m.Version)
+		}
+		versions = append(versions, v)
+	}
+	for i := range versions[1:] {
+		if !slices.Equal(versions[0], versions[i+1]) {
+			t.Errorf("%s has migrations %v, %s has %v", dbDrivers[0], versions[0], dbDrivers[i+1], versions[i+1])
+		}
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	conn, err := openDB(DriverSQLite, filepath.Join(t.TempDir(), "appdb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m, err := newMigrator(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := m.Up(); err != nil || n != len(m.migrations) {
+		t.Fatalf("Up = %d, %v; want %d", n, err, len(m.migrations))
+	}
+	if n, err := m.Up(); err != nil || n != 0 {
+		t.Errorf("second Up = %d, %v; want nothing to do", n, err)
+	}
+	if _, err := conn.Exec("SELECT COUNT(*) FROM store_entry"); err != nil {
+		t.Errorf("schema not created: %v", err)
+	}
+
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := m.applied()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending := m.pending(applied); len(pending) != 1 || pending[0].Version != m.migrations[len(m.migrations)-1].Version {
+		t.Errorf("pending after Down = %v; want the latest migration", pending)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Exec("UPDATE schema_migration SET checksum = 'changed'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err == nil {
+		t.Error("Up accepted a migration changed after it was applied")
+	}
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	conn, err := openDB(DriverSQLite, filepath.Join(t.TempDir(), "appdb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A database set up from the former appdb.sql, with a user and a pending magic link
+	for _, statement := range []string{
+		`CREATE TABLE "user" (id varchar(36) NOT NULL, email varchar(255) COLLATE NOCASE NOT NULL, name varchar(255) DEFAULT NULL,
+			display_name varchar(255) DEFAULT NULL, balance decimal(14,4) DEFAULT 0.0000, created datetime DEFAULT current_timestamp,
+			status varchar(255) DEFAULT NULL, is_active boolean DEFAULT NULL, is_deleted boolean DEFAULT NULL, is_admin boolean DEFAULT false,
+			PRIMARY KEY (id), UNIQUE (email))`,
+		`CREATE TABLE user_credential (id varchar(255) NOT NULL, user_id varchar(36) NOT NULL, aaguid varchar(255) DEFAULT NULL,
+			label varchar(255) DEFAULT NULL, credential text DEFAULT NULL, created datetime DEFAULT NULL, updated datetime DEFAULT NULL, PRIMARY KEY (id))`,
+		`CREATE TABLE user_login (id varchar(36) NOT NULL, email varchar(255) NOT NULL, token varchar(255) NOT NULL, expires datetime NOT NULL,
+			used boolean DEFAULT false, created datetime DEFAULT current_timestamp, PRIMARY KEY (id), UNIQUE (token))`,
+		`CREATE TABLE sso_client (id varchar(255) NOT NULL, client_secret varchar(255) NOT NULL, redirect_uri varchar(1024) NOT NULL,
+			name varchar(255) DEFAULT NULL, created datetime DEFAULT current_timestamp, PRIMARY KEY (id))`,
+		`INSERT INTO "user" (id, email, name, is_admin) VALUES ('u1', 'ann@example.com', 'Ann', true)`,
+		`INSERT INTO user_login (id, email, token, expires) VALUES ('l1', 'ann@example.com', 't1', '2030-01-01 00:00:00')`,
+	} {
+		if _, err := conn.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := newMigrator(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := m.Up(); err != nil || n != len(m.migrations) {
+		t.Fatalf("Up = %d, %v; want %d", n, err, len(m.migrations))
+	}
+	var realmID, name, roles string
+	var isAdmin bool
+	if err := conn.QueryRow(`SELECT realm_id, name, is_admin, roles FROM "user" WHERE id = 'u1'`).Scan(&realmID, &name, &isAdmin, &roles); err != nil ||
+		realmID != defaultRealmID || name != "Ann" || !isAdmin || roles != "" {
+		t.Errorf("user after Up = %q, %q, %v, %q, %v; want ann kept in the default realm", realmID, name, isAdmin, roles, err)
+	}
+	var attempts int
+	var approved bool
+	if err := conn.QueryRow(`SELECT attempts, approved FROM user_login WHERE id = 'l1'`).Scan(&attempts, &approved); err != nil || attempts != 0 || approved {
+		t.Errorf("user_login after Up = %d, %v, %v", attempts, approved, err)
+	}
+	for _, query := range []string{
+		"SELECT realm_id FROM sso_client",
+		"SELECT sign_count, disabled, prf_salt FROM user_credential",
+		"SELECT code_hash, binding_hash, sso_request FROM user_login",
+		"SELECT COUNT(*) FROM realm",
+		"SELECT COUNT(*) FROM email_change",
+		"SELECT COUNT(*) FROM store_entry",
+	} {
+		if _, err := conn.Exec(query); err != nil {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+	// The email is unique per realm, no longer across realms
+	if _, err := conn.Exec(`INSERT INTO "user" (id, realm_id, email) VALUES ('u2', 'acme', 'ann@example.com')`); err != nil {
+		t.Errorf("same email in another realm: %v", err)
+	}
+	if _, err := conn.Exec(`INSERT INTO "user" (id, email) VALUES ('u3', 'ANN@example.com')`); err == nil {
+		t.Error("same email accepted twice in a realm")
+	}
+}
@@ -1,11 +1,11 @@
-SET NAMES utf8mb4;
-SET FOREIGN_KEY_CHECKS = 0;
+-- Initial schema for MySQL/MariaDB, DB_DRIVER=mysql: the tables of the former appdb.sql. Tables
+-- that exist, e.g. created by that appdb.sql, are kept and brought up to date by the next
+-- migrations.
 
 -- ----------------------------
 -- Table structure for user
 -- ----------------------------
-DROP TABLE IF EXISTS `user`;
-CREATE TABLE `user` (
+CREATE TABLE IF NOT EXISTS `user` (
   `id` uuid NOT NULL,
   `email` varchar(255) NOT NULL,
   `name` varchar(255) DEFAULT NULL,
@@ -23,8 +23,7 @@ CREATE TABLE `user` (
 -- ----------------------------
 -- Table structure for user_credential
 -- ----------------------------
-DROP TABLE IF EXISTS `user_credential`;
-CREATE TABLE `user_credential` (
+CREATE TABLE IF NOT EXISTS `user_credential` (
   `id` varchar(255) NOT NULL,
   `user_id` uuid NOT NULL,
   `aaguid` varchar(255) DEFAULT NULL,
@@ -39,8 +38,7 @@ CREATE TABLE `user_credential` (
 -- ----------------------------
 -- Table structure for user_login
 -- ----------------------------
-DROP TABLE IF EXISTS `user_login`;
-CREATE TABLE `user_login` (
+CREATE TABLE IF NOT EXISTS `user_login` (
   `id` uuid NOT NULL,
   `email` varchar(255) NOT NULL,
   `token` varchar(255) NOT NULL,
@@ -55,8 +53,7 @@ CREATE TABLE `user_login` (
 -- ----------------------------
 -- Table structure for sso_client
 -- ----------------------------
-DROP TABLE IF EXISTS `sso_client`;
-CREATE TABLE `sso_client` (
+CREATE TABLE IF NOT EXISTS `sso_client` (
   `id` varchar(255) NOT NULL,
   `client_secret` varchar(255) NOT NULL,
   `redirect_uri` varchar(1024) NOT NULL,
@@ -64,5 +61,3 @@ CREATE TABLE `sso_client` (
   `created` datetime DEFAULT current_timestamp(),
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
-
-SET FOREIGN_KEY_CHECKS = 1;
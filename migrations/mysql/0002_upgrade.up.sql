@@ -0,0 +1,212 @@
+-- Realms, roles, login codes and browser binding, passkey state, and the tables added since the
+-- former appdb.sql.
+
+ALTER TABLE `user`
+  ADD COLUMN `realm_id` varchar(32) NOT NULL DEFAULT 'default' AFTER `id`,
+  ADD COLUMN `roles` text NOT NULL DEFAULT '',
+  ADD COLUMN `user_groups` text NOT NULL DEFAULT '',
+  ADD COLUMN `clients` text NOT NULL DEFAULT '',
+  DROP INDEX `email`,
+  ADD UNIQUE KEY `realm_email` (`realm_id`,`email`);
+
+ALTER TABLE `user_credential`
+  ADD COLUMN `last_used` datetime DEFAULT NULL,
+  ADD COLUMN `last_used_ip` varchar(64) DEFAULT NULL,
+  ADD COLUMN `last_used_user_agent` varchar(1024) DEFAULT NULL,
+  ADD COLUMN `backup_eligible` tinyint(1) DEFAULT NULL,
+  ADD COLUMN `backup_state` tinyint(1) DEFAULT NULL,
+  ADD COLUMN `sign_count` bigint(20) DEFAULT NULL,
+  ADD COLUMN `suspect` tinyint(1) DEFAULT 0,
+  ADD COLUMN `disabled` tinyint(1) DEFAULT 0,
+  ADD COLUMN `prf_salt` varchar(64) DEFAULT NULL;
+
+ALTER TABLE `user_login`
+  ADD COLUMN `realm_id` varchar(32) NOT NULL DEFAULT 'default' AFTER `id`,
+  ADD COLUMN `code_hash` char(64) DEFAULT NULL AFTER `token`,
+  ADD COLUMN `attempts` int(11) NOT NULL DEFAULT 0 AFTER `code_hash`,
+  ADD COLUMN `binding_hash` char(64) DEFAULT NULL,
+  ADD COLUMN `request_ip` varchar(64) DEFAULT NULL,
+  ADD COLUMN `request_user_agent` varchar(512) DEFAULT NULL,
+  ADD COLUMN `approved` tinyint(1) NOT NULL DEFAULT 0,
+  ADD COLUMN `sso_request` varchar(64) DEFAULT NULL,
+  ADD KEY `binding_hash` (`binding_hash`);
+
+ALTER TABLE `sso_client`
+  ADD COLUMN `realm_id` varchar(32) NOT NULL DEFAULT 'default' AFTER `id`,
+  ADD KEY `realm_id` (`realm_id`);
+
+-- ----------------------------
+-- Table structure for user_credential_usage
+-- ----------------------------
+CREATE TABLE `user_credential_usage` (
+  `id` uuid NOT NULL,
+  `credential_id` varchar(255) NOT NULL,
+  `user_id` uuid NOT NULL,
+  `ip` varchar(64) DEFAULT NULL,
+  `user_agent` varchar(1024) DEFAULT NULL,
+  `sign_count` bigint(20) DEFAULT NULL,
+  `prev_sign_count` bigint(20) DEFAULT NULL,
+  `backup_state` tinyint(1) DEFAULT NULL,
+  `created` datetime DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `credential_id` (`credential_id`, `created`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- ----------------------------
+-- Table structure for user_recovery_code
+-- ----------------------------
+CREATE TABLE `user_recovery_code` (
+  `id` uuid NOT NULL,
+  `user_id` uuid NOT NULL,
+  `code_hash` char(64) NOT NULL,
+  `used` datetime DEFAULT NULL,
+  `created` datetime DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_code` (`user_id`, `code_hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- ----------------------------
+-- Table structure for user_totp
+-- ----------------------------
+CREATE TABLE `user_totp` (
+  `id` uuid NOT NULL,
+  `user_id` uuid NOT NULL,
+  `label` varchar(255) DEFAULT NULL,
+  `secret` varchar(64) NOT NULL,
+  `last_step` bigint(20) DEFAULT NULL,
+  `created` datetime DEFAULT current_timestamp(),
+  `last_used` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- ----------------------------
+-- Table structure for realm
+-- ----------------------------
+CREATE TABLE `realm` (
+  `id` varchar(32) NOT NULL,
+  `name` varchar(255) DEFAULT NULL,
+  `rp_id` varchar(255) NOT NULL,
+  `origins` text NOT NULL,
+  `hostnames` text DEFAULT NULL,
+  `branding` longtext CHARACTER SET utf8mb4 COLLATE utf8mb4_bin DEFAULT NULL CHECK (json_valid(`branding`)),
+  `totp_mode` varchar(32) DEFAULT NULL,
+  `signup_policy` varchar(32) DEFAULT NULL,
+  `signup_domains` text DEFAULT NULL,
+  `created` datetime DEFAULT current_timestamp(),
+  `updated` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- ----------------------------
+-- Table structure for setting
+-- ----------------------------
+CREATE TABLE `setting` (
+  `name` varchar(255) NOT NULL,
+  `value` text DEFAULT NULL,
+  `updated` datetime DEFAULT current_timestamp(),
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- ----------------------------
+-- Table structure for security_event
+-- ----------------------------
+CREATE TABLE `security_event` (
+  `id` uuid NOT NULL,
+  `user_id` uuid DEFAULT NULL,
+  `credential_id` varchar(255) DEFAULT NULL,
+  `type` varchar(64) NOT NULL,
+  `detail` text DEFAULT NULL,
+  `ip` varchar(64) DEFAULT NULL,
+  `user_agent` varchar(1024) DEFAULT NULL,
+  `created` datetime DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`),
+  KEY `created` (`created`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- ----------------------------
+-- Table structure for mail_outbox
+-- ----------------------------
+CREATE TABLE `mail_outbox` (
+  `id` uuid NOT NULL,
+  `realm_id` varchar(32) NOT NULL DEFAULT 'default',
+  `dedupe_key` varchar(255) DEFAULT NULL,
+  `recipient` varchar(1024) NOT NULL,
+  `subject` varchar(1024) NOT NULL,
+  `text_body` mediumtext NOT NULL,
+  `html_body` mediumtext DEFAULT NULL,
+  `status` varchar(16) NOT NULL DEFAULT 'pending',
+  `attempts` int(11) NOT NULL DEFAULT 0,
+  `next_attempt` datetime NOT NULL DEFAULT current_timestamp(),
+  `expires` datetime DEFAULT NULL,
+  `locked_by` varchar(255) DEFAULT NULL,
+  `locked_until` datetime DEFAULT NULL,
+  `last_error` text DEFAULT NULL,
+  `created` datetime DEFAULT current_timestamp(),
+  `sent` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `dedupe_key` (`dedupe_key`),
+  KEY `status_next_attempt` (`status`, `next_attempt`),
+  KEY `realm_created` (`realm_id`, `created`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- ----------------------------
+-- Table structure for invitation
+-- ----------------------------
+CREATE TABLE `invitation` (
+  `id` uuid NOT NULL,
+  `realm_id` varchar(32) NOT NULL DEFAULT 'default',
+  `email` varchar(255) NOT NULL,
+  `token_hash` varchar(64) NOT NULL,
+  `roles` text NOT NULL DEFAULT '',
+  `user_groups` text NOT NULL DEFAULT '',
+  `clients` text NOT NULL DEFAULT '',
+  `invited_by` uuid DEFAULT NULL,
+  `expires` datetime DEFAULT NULL,
+  `created` datetime DEFAULT current_timestamp(),
+  `accepted` datetime DEFAULT NULL,
+  `accepted_by` uuid DEFAULT NULL,
+  `revoked` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash` (`token_hash`),
+  KEY `realm_created` (`realm_id`, `created`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- ----------------------------
+-- Table structure for email_change
+-- ----------------------------
+CREATE TABLE `email_change` (
+  `id` uuid NOT NULL,
+  `realm_id` varchar(32) NOT NULL DEFAULT 'default',
+  `user_id` uuid NOT NULL,
+  `old_email` varchar(255) NOT NULL,
+  `new_email` varchar(255) NOT NULL,
+  `confirm_hash` varchar(64) NOT NULL,
+  `cancel_hash` varchar(64) NOT NULL,
+  `expires` datetime NOT NULL,
+  `created` datetime DEFAULT current_timestamp(),
+  `confirmed` datetime DEFAULT NULL,
+  `cancelled` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `confirm_hash` (`confirm_hash`),
+  UNIQUE KEY `cancel_hash` (`cancel_hash`),
+  KEY `user_created` (`user_id`, `created`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- ----------------------------
+-- Table structure for store_entry, store_member (SESSION_STORE=sql)
+-- ----------------------------
+CREATE TABLE `store_entry` (
+  `id` varchar(255) NOT NULL,
+  `value` mediumtext NOT NULL,
+  `expires` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `expires` (`expires`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+CREATE TABLE `store_member` (
+  `id` varchar(255) NOT NULL,
+  `member` varchar(255) NOT NULL,
+  PRIMARY KEY (`id`, `member`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
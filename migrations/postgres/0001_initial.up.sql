@@ -0,0 +1,65 @@
+-- Initial schema for PostgreSQL 12 or later, DB_DRIVER=postgres: the tables of the former
+-- appdb.sql. Tables that exist are kept and brought up to date by the next migrations.
+
+-- Emails compare case-insensitively, like the utf8mb4_unicode_ci collation of MySQL
+CREATE COLLATION IF NOT EXISTS case_insensitive (provider = icu, locale = 'und-u-ks-level2', deterministic = false);
+
+-- ----------------------------
+-- Table structure for user
+-- ----------------------------
+CREATE TABLE IF NOT EXISTS "user" (
+  id uuid NOT NULL,
+  email varchar(255) COLLATE case_insensitive NOT NULL,
+  name varchar(255) DEFAULT NULL,
+  display_name varchar(255) DEFAULT NULL,
+  balance numeric(14,4) DEFAULT 0.0000,
+  created timestamptz DEFAULT current_timestamp,
+  status varchar(255) DEFAULT NULL,
+  is_active boolean DEFAULT NULL,
+  is_deleted boolean DEFAULT NULL,
+  is_admin boolean DEFAULT false,
+  PRIMARY KEY (id),
+  CONSTRAINT user_email UNIQUE (email)
+);
+
+-- ----------------------------
+-- Table structure for user_credential
+-- ----------------------------
+CREATE TABLE IF NOT EXISTS user_credential (
+  id varchar(255) NOT NULL,
+  user_id uuid NOT NULL,
+  aaguid varchar(255) DEFAULT NULL,
+  label varchar(255) DEFAULT NULL,
+  credential text DEFAULT NULL,
+  created timestamptz DEFAULT NULL,
+  updated timestamptz DEFAULT NULL,
+  PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS user_credential_user_id ON user_credential (user_id);
+
+-- ----------------------------
+-- Table structure for user_login
+-- ----------------------------
+CREATE TABLE IF NOT EXISTS user_login (
+  id uuid NOT NULL,
+  email varchar(255) COLLATE case_insensitive NOT NULL,
+  token varchar(255) NOT NULL,
+  expires timestamptz NOT NULL,
+  used boolean DEFAULT false,
+  created timestamptz DEFAULT current_timestamp,
+  PRIMARY KEY (id),
+  CONSTRAINT user_login_token UNIQUE (token)
+);
+CREATE INDEX IF NOT EXISTS user_login_email ON user_login (email);
+
+-- ----------------------------
+-- Table structure for sso_client
+-- ----------------------------
+CREATE TABLE IF NOT EXISTS sso_client (
+  id varchar(255) NOT NULL,
+  client_secret varchar(255) NOT NULL,
+  redirect_uri varchar(1024) NOT NULL,
+  name varchar(255) DEFAULT NULL,
+  created timestamptz DEFAULT current_timestamp,
+  PRIMARY KEY (id)
+);
@@ -0,0 +1,43 @@
+DROP TABLE IF EXISTS store_member;
+DROP TABLE IF EXISTS store_entry;
+DROP TABLE IF EXISTS email_change;
+DROP TABLE IF EXISTS invitation;
+DROP TABLE IF EXISTS mail_outbox;
+DROP TABLE IF EXISTS security_event;
+DROP TABLE IF EXISTS setting;
+DROP TABLE IF EXISTS realm;
+DROP TABLE IF EXISTS user_totp;
+DROP TABLE IF EXISTS user_recovery_code;
+DROP TABLE IF EXISTS user_credential_usage;
+
+ALTER TABLE sso_client
+  DROP COLUMN realm_id;
+
+ALTER TABLE user_login
+  DROP COLUMN realm_id,
+  DROP COLUMN code_hash,
+  DROP COLUMN attempts,
+  DROP COLUMN binding_hash,
+  DROP COLUMN request_ip,
+  DROP COLUMN request_user_agent,
+  DROP COLUMN approved,
+  DROP COLUMN sso_request;
+
+ALTER TABLE user_credential
+  DROP COLUMN last_used,
+  DROP COLUMN last_used_ip,
+  DROP COLUMN last_used_user_agent,
+  DROP COLUMN backup_eligible,
+  DROP COLUMN backup_state,
+  DROP COLUMN sign_count,
+  DROP COLUMN suspect,
+  DROP COLUMN disabled,
+  DROP COLUMN prf_salt;
+
+ALTER TABLE "user"
+  DROP CONSTRAINT realm_email,
+  ADD CONSTRAINT user_email UNIQUE (email),
+  DROP COLUMN realm_id,
+  DROP COLUMN roles,
+  DROP COLUMN user_groups,
+  DROP COLUMN clients;
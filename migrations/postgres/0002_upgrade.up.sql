@@ -0,0 +1,212 @@
+-- Realms, roles, login codes and browser binding, passkey state, and the tables added since the
+-- former appdb.sql.
+
+ALTER TABLE "user"
+  ADD COLUMN realm_id varchar(32) NOT NULL DEFAULT 'default',
+  ADD COLUMN roles text NOT NULL DEFAULT '',
+  ADD COLUMN user_groups text NOT NULL DEFAULT '',
+  ADD COLUMN clients text NOT NULL DEFAULT '',
+  DROP CONSTRAINT user_email,
+  ADD CONSTRAINT realm_email UNIQUE (realm_id, email);
+
+ALTER TABLE user_credential
+  ADD COLUMN last_used timestamptz DEFAULT NULL,
+  ADD COLUMN last_used_ip varchar(64) DEFAULT NULL,
+  ADD COLUMN last_used_user_agent varchar(1024) DEFAULT NULL,
+  ADD COLUMN backup_eligible boolean DEFAULT NULL,
+  ADD COLUMN backup_state boolean DEFAULT NULL,
+  ADD COLUMN sign_count bigint DEFAULT NULL,
+  ADD COLUMN suspect boolean DEFAULT false,
+  ADD COLUMN disabled boolean DEFAULT false,
+  ADD COLUMN prf_salt varchar(64) DEFAULT NULL;
+
+ALTER TABLE user_login
+  ADD COLUMN realm_id varchar(32) NOT NULL DEFAULT 'default',
+  ADD COLUMN code_hash char(64) DEFAULT NULL,
+  ADD COLUMN attempts integer NOT NULL DEFAULT 0,
+  ADD COLUMN binding_hash char(64) DEFAULT NULL,
+  ADD COLUMN request_ip varchar(64) DEFAULT NULL,
+  ADD COLUMN request_user_agent varchar(512) DEFAULT NULL,
+  ADD COLUMN approved boolean NOT NULL DEFAULT false,
+  ADD COLUMN sso_request varchar(64) DEFAULT NULL;
+CREATE INDEX user_login_binding_hash ON user_login (binding_hash);
+
+ALTER TABLE sso_client
+  ADD COLUMN realm_id varchar(32) NOT NULL DEFAULT 'default';
+CREATE INDEX sso_client_realm_id ON sso_client (realm_id);
+
+-- ----------------------------
+-- Table structure for user_credential_usage
+-- ----------------------------
+CREATE TABLE user_credential_usage (
+  id uuid NOT NULL,
+  credential_id varchar(255) NOT NULL,
+  user_id uuid NOT NULL,
+  ip varchar(64) DEFAULT NULL,
+  user_agent varchar(1024) DEFAULT NULL,
+  sign_count bigint DEFAULT NULL,
+  prev_sign_count bigint DEFAULT NULL,
+  backup_state boolean DEFAULT NULL,
+  created timestamptz DEFAULT current_timestamp,
+  PRIMARY KEY (id)
+);
+CREATE INDEX user_credential_usage_credential_id ON user_credential_usage (credential_id, created);
+
+-- ----------------------------
+-- Table structure for user_recovery_code
+-- ----------------------------
+CREATE TABLE user_recovery_code (
+  id uuid NOT NULL,
+  user_id uuid NOT NULL,
+  code_hash char(64) NOT NULL,
+  used timestamptz DEFAULT NULL,
+  created timestamptz DEFAULT current_timestamp,
+  PRIMARY KEY (id),
+  CONSTRAINT user_code UNIQUE (user_id, code_hash)
+);
+
+-- ----------------------------
+-- Table structure for user_totp
+-- ----------------------------
+CREATE TABLE user_totp (
+  id uuid NOT NULL,
+  user_id uuid NOT NULL,
+  label varchar(255) DEFAULT NULL,
+  secret varchar(64) NOT NULL,
+  last_step bigint DEFAULT NULL,
+  created timestamptz DEFAULT current_timestamp,
+  last_used timestamptz DEFAULT NULL,
+  PRIMARY KEY (id)
+);
+CREATE INDEX user_totp_user_id ON user_totp (user_id);
+
+-- ----------------------------
+-- Table structure for realm
+-- ----------------------------
+CREATE TABLE realm (
+  id varchar(32) NOT NULL,
+  name varchar(255) DEFAULT NULL,
+  rp_id varchar(255) NOT NULL,
+  origins text NOT NULL,
+  hostnames text DEFAULT NULL,
+  branding text DEFAULT NULL,
+  totp_mode varchar(32) DEFAULT NULL,
+  signup_policy varchar(32) DEFAULT NULL,
+  signup_domains text DEFAULT NULL,
+  created timestamptz DEFAULT current_timestamp,
+  updated timestamptz DEFAULT NULL,
+  PRIMARY KEY (id)
+);
+
+-- ----------------------------
+-- Table structure for setting
+-- ----------------------------
+CREATE TABLE setting (
+  name varchar(255) NOT NULL,
+  value text DEFAULT NULL,
+  updated timestamptz DEFAULT current_timestamp,
+  PRIMARY KEY (name)
+);
+
+-- ----------------------------
+-- Table structure for security_event
+-- ----------------------------
+CREATE TABLE security_event (
+  id uuid NOT NULL,
+  user_id uuid DEFAULT NULL,
+  credential_id varchar(255) DEFAULT NULL,
+  type varchar(64) NOT NULL,
+  detail text DEFAULT NULL,
+  ip varchar(64) DEFAULT NULL,
+  user_agent varchar(1024) DEFAULT NULL,
+  created timestamptz DEFAULT current_timestamp,
+  PRIMARY KEY (id)
+);
+CREATE INDEX security_event_user_id ON security_event (user_id);
+CREATE INDEX security_event_created ON security_event (created);
+
+-- ----------------------------
+-- Table structure for mail_outbox
+-- ----------------------------
+CREATE TABLE mail_outbox (
+  id uuid NOT NULL,
+  realm_id varchar(32) NOT NULL DEFAULT 'default',
+  dedupe_key varchar(255) DEFAULT NULL,
+  recipient varchar(1024) NOT NULL,
+  subject varchar(1024) NOT NULL,
+  text_body text NOT NULL,
+  html_body text DEFAULT NULL,
+  status varchar(16) NOT NULL DEFAULT 'pending',
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt timestamptz NOT NULL DEFAULT current_timestamp,
+  expires timestamptz DEFAULT NULL,
+  locked_by varchar(255) DEFAULT NULL,
+  locked_until timestamptz DEFAULT NULL,
+  last_error text DEFAULT NULL,
+  created timestamptz DEFAULT current_timestamp,
+  sent timestamptz DEFAULT NULL,
+  PRIMARY KEY (id),
+  CONSTRAINT mail_outbox_dedupe_key UNIQUE (dedupe_key)
+);
+CREATE INDEX mail_outbox_status_next_attempt ON mail_outbox (status, next_attempt);
+CREATE INDEX mail_outbox_realm_created ON mail_outbox (realm_id, created);
+
+-- ----------------------------
+-- Table structure for invitation
+-- ----------------------------
+CREATE TABLE invitation (
+  id uuid NOT NULL,
+  realm_id varchar(32) NOT NULL DEFAULT 'default',
+  email varchar(255) COLLATE case_insensitive NOT NULL,
+  token_hash varchar(64) NOT NULL,
+  roles text NOT NULL DEFAULT '',
+  user_groups text NOT NULL DEFAULT '',
+  clients text NOT NULL DEFAULT '',
+  invited_by uuid DEFAULT NULL,
+  expires timestamptz DEFAULT NULL,
+  created timestamptz DEFAULT current_timestamp,
+  accepted timestamptz DEFAULT NULL,
+  accepted_by uuid DEFAULT NULL,
+  revoked timestamptz DEFAULT NULL,
+  PRIMARY KEY (id),
+  CONSTRAINT invitation_token_hash UNIQUE (token_hash)
+);
+CREATE INDEX invitation_realm_created ON invitation (realm_id, created);
+
+-- ----------------------------
+-- Table structure for email_change
+-- ----------------------------
+CREATE TABLE email_change (
+  id uuid NOT NULL,
+  realm_id varchar(32) NOT NULL DEFAULT 'default',
+  user_id uuid NOT NULL,
+  old_email varchar(255) COLLATE case_insensitive NOT NULL,
+  new_email varchar(255) COLLATE case_insensitive NOT NULL,
+  confirm_hash varchar(64) NOT NULL,
+  cancel_hash varchar(64) NOT NULL,
+  expires timestamptz NOT NULL,
+  created timestamptz DEFAULT current_timestamp,
+  confirmed timestamptz DEFAULT NULL,
+  cancelled timestamptz DEFAULT NULL,
+  PRIMARY KEY (id),
+  CONSTRAINT email_change_confirm_hash UNIQUE (confirm_hash),
+  CONSTRAINT email_change_cancel_hash UNIQUE (cancel_hash)
+);
+CREATE INDEX email_change_user_created ON email_change (user_id, created);
+
+-- ----------------------------
+-- Table structure for store_entry, store_member (SESSION_STORE=sql)
+-- ----------------------------
+CREATE TABLE store_entry (
+  id varchar(255) NOT NULL,
+  value text NOT NULL,
+  expires timestamptz DEFAULT NULL,
+  PRIMARY KEY (id)
+);
+CREATE INDEX store_entry_expires ON store_entry (expires);
+
+CREATE TABLE store_member (
+  id varchar(255) NOT NULL,
+  member varchar(255) NOT NULL,
+  PRIMARY KEY (id, member)
+);
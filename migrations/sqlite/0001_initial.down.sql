@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS sso_client;
+DROP TABLE IF EXISTS user_login;
+DROP TABLE IF EXISTS user_credential;
+DROP TABLE IF EXISTS "user";
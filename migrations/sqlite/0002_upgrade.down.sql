@@ -0,0 +1,53 @@
+DROP TABLE IF EXISTS store_member;
+DROP TABLE IF EXISTS store_entry;
+DROP TABLE IF EXISTS email_change;
+DROP TABLE IF EXISTS invitation;
+DROP TABLE IF EXISTS mail_outbox;
+DROP TABLE IF EXISTS security_event;
+DROP TABLE IF EXISTS setting;
+DROP TABLE IF EXISTS realm;
+DROP TABLE IF EXISTS user_totp;
+DROP TABLE IF EXISTS user_recovery_code;
+DROP TABLE IF EXISTS user_credential_usage;
+
+DROP INDEX IF EXISTS sso_client_realm_id;
+ALTER TABLE sso_client DROP COLUMN realm_id;
+
+DROP INDEX IF EXISTS user_login_binding_hash;
+ALTER TABLE user_login DROP COLUMN realm_id;
+ALTER TABLE user_login DROP COLUMN code_hash;
+ALTER TABLE user_login DROP COLUMN attempts;
+ALTER TABLE user_login DROP COLUMN binding_hash;
+ALTER TABLE user_login DROP COLUMN request_ip;
+ALTER TABLE user_login DROP COLUMN request_user_agent;
+ALTER TABLE user_login DROP COLUMN approved;
+ALTER TABLE user_login DROP COLUMN sso_request;
+
+ALTER TABLE user_credential DROP COLUMN last_used;
+ALTER TABLE user_credential DROP COLUMN last_used_ip;
+ALTER TABLE user_credential DROP COLUMN last_used_user_agent;
+ALTER TABLE user_credential DROP COLUMN backup_eligible;
+ALTER TABLE user_credential DROP COLUMN backup_state;
+ALTER TABLE user_credential DROP COLUMN sign_count;
+ALTER TABLE user_credential DROP COLUMN suspect;
+ALTER TABLE user_credential DROP COLUMN disabled;
+ALTER TABLE user_credential DROP COLUMN prf_salt;
+
+CREATE TABLE user_downgrade (
+  id varchar(36) NOT NULL,
+  email varchar(255) COLLATE NOCASE NOT NULL,
+  name varchar(255) DEFAULT NULL,
+  display_name varchar(255) DEFAULT NULL,
+  balance decimal(14,4) DEFAULT 0.0000,
+  created datetime DEFAULT current_timestamp,
+  status varchar(255) DEFAULT NULL,
+  is_active boolean DEFAULT NULL,
+  is_deleted boolean DEFAULT NULL,
+  is_admin boolean DEFAULT false,
+  PRIMARY KEY (id),
+  CONSTRAINT user_email UNIQUE (email)
+);
+INSERT INTO user_downgrade (id, email, name, display_name, balance, created, status, is_active, is_deleted, is_admin)
+  SELECT id, email, name, display_name, balance, created, status, is_active, is_deleted, is_admin FROM "user";
+DROP TABLE "user";
+ALTER TABLE user_downgrade RENAME TO "user";
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/elgs/gosqlcrud"
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/google/uuid"
 )
@@ -20,6 +25,7 @@ import (
 type PasskeyUser struct { // implements webauthn.User
 	// ID          []byte
 	ID          string    `json:"id" db:"id" pk:"true"`
+	RealmID     string    `json:"realm_id" db:"realm_id"`
 	DisplayName string    `json:"display_name" db:"display_name"`
 	Name        string    `json:"name" db:"name"`
 	Email       string    `json:"email" db:"email"`
@@ -29,6 +35,9 @@ type PasskeyUser struct { // implements webauthn.User
 	IsActive    bool      `json:"is_active" db:"is_active"`
 	IsDeleted   bool      `json:"is_deleted" db:"is_deleted"`
 	IsAdmin     bool      `json:"is_admin" db:"is_admin"`
+	Roles       string    `json:"roles" db:"roles"`        // comma-separated, passed on to SSO clients
+	Groups      string    `json:"groups" db:"user_groups"` // comma-separated, passed on to SSO clients
+	Clients     string    `json:"clients" db:"clients"`    // comma-separated SSO clients the user may use, empty for all
 }
 
 func (this *PasskeyUser) WebAuthnID() []byte {
@@ -48,8 +57,7 @@ func (this *PasskeyUser) WebAuthnDisplayName() string {
 }
 
 func (this *PasskeyUser) Credentials() []*PasskeyUserCredential {
-	creds := []*PasskeyUserCredential{}
-	err := gosqlcrud.QueryToStructs(db, &creds, "SELECT * FROM user_credential WHERE user_id = ?", this.ID)
+	creds, err := repo.GetCredentials(this.ID)
 	if err != nil {
 		log.Printf("Error retrieving credentials: %s", err.Error())
 		return nil
@@ -66,61 +74,151 @@ func (this *PasskeyUser) WebAuthnCredentials() []webauthn.Credential {
 	return webAuthnCreds
 }
 
+// Credential returns the stored credential with the given hex ID, or nil if the user has none.
+func (this *PasskeyUser) Credential(id string) *PasskeyUserCredential {
+	for _, c := range this.Credentials() {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// LoginCredentialDescriptors returns the allowCredentials list for a login, leaving out
+// credentials that were disabled after a clone warning.
+func (this *PasskeyUser) LoginCredentialDescriptors() []protocol.CredentialDescriptor {
+	descriptors := []protocol.CredentialDescriptor{}
+	for _, c := range this.Credentials() {
+		if c.Credential == nil || (c.Disabled != nil && *c.Disabled) {
+			continue
+		}
+		descriptors = append(descriptors, c.Credential.Descriptor())
+	}
+	return descriptors
+}
+
+// CredentialDescriptors returns descriptors for the user's existing credentials, used as the
+// excludeCredentials list so that authenticators refuse to register the same credential twice.
+// When skipPlatform is set, platform credentials are left out so they can be replaced.
+func (this *PasskeyUser) CredentialDescriptors(skipPlatform bool) []protocol.CredentialDescriptor {
+	descriptors := []protocol.CredentialDescriptor{}
+	for _, c := range this.WebAuthnCredentials() {
+		if skipPlatform && isPlatformCredential(&c) {
+			continue
+		}
+		descriptors = append(descriptors, c.Descriptor())
+	}
+	return descriptors
+}
+
 func (this *PasskeyUser) AddCredential(credential *webauthn.Credential, label string) {
 	now := time.Now()
-	aaguid := credential.Authenticator.AAGUID
-	aaguidStr := fmt.Sprintf("%08x-%04x-%04x-%04x-%012x", aaguid[0:4], aaguid[4:6], aaguid[6:8], aaguid[8:10], aaguid[10:16])
+	aaguidStr := formatAAGUID(credential.Authenticator.AAGUID)
+	signCount := int64(credential.Authenticator.SignCount)
 	cred := &PasskeyUserCredential{
-		ID:         fmt.Sprintf("%x", credential.ID),
-		UserID:     &this.ID,
-		AAGUID:     &aaguidStr,
-		Label:      &label,
-		Credential: credential,
-		Created:    &now,
-	}
-	result, err := gosqlcrud.Create(db, cred, "user_credential")
-	if err != nil {
+		ID:             fmt.Sprintf("%x", credential.ID),
+		UserID:         &this.ID,
+		AAGUID:         &aaguidStr,
+		Label:          &label,
+		Credential:     credential,
+		Created:        &now,
+		BackupEligible: &credential.Flags.BackupEligible,
+		BackupState:    &credential.Flags.BackupState,
+		SignCount:      &signCount,
+	}
+	if err := repo.CreateCredential(cred); err != nil {
 		log.Printf("Error adding credential: %s", err.Error())
-		return
 	}
-	if result.RowsAffected == 0 {
-		log.Printf("Error adding credential: no rows affected")
+}
+
+// formatAAGUID renders a raw AAGUID in the canonical 8-4-4-4-12 form.
+func formatAAGUID(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return ""
 	}
+	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x", aaguid[0:4], aaguid[4:6], aaguid[6:8], aaguid[8:10], aaguid[10:16])
+}
+
+// isZeroAAGUID reports whether the authenticator did not identify its model, which is the
+// case for most software and privacy-preserving authenticators.
+func isZeroAAGUID(aaguid string) bool {
+	return aaguid == "" || aaguid == "00000000-0000-0000-0000-000000000000"
 }
 
-func (this *PasskeyUser) UpdateCredential(credential *webauthn.Credential) {
+// isPlatformCredential reports whether the credential lives on a platform authenticator
+// (Touch ID, Windows Hello, Android screen lock) rather than a roaming security key.
+func isPlatformCredential(credential *webauthn.Credential) bool {
+	if credential.Authenticator.Attachment == protocol.Platform {
+		return true
+	}
+	for _, t := range credential.Transport {
+		if t == protocol.Internal {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateCredential stores the credential after a successful login together with when,
+// from where and in which backup state it was used.
+func (this *PasskeyUser) UpdateCredential(credential *webauthn.Credential, ip, userAgent string) {
 	now := time.Now()
-	cred := &PasskeyUserCredential{
-		ID:         fmt.Sprintf("%x", credential.ID),
-		Credential: credential,
-		Updated:    &now,
+	id := fmt.Sprintf("%x", credential.ID)
+	signCount := int64(credential.Authenticator.SignCount)
+
+	var prevSignCount *int64
+	for _, existing := range this.Credentials() {
+		if existing.ID == id {
+			prevSignCount = existing.SignCount
+			break
+		}
 	}
-	result, err := gosqlcrud.Update(db, cred, "user_credential")
-	if err != nil {
+
+	cred := &PasskeyUserCredential{
+		ID:                id,
+		Credential:        credential,
+		Updated:           &now,
+		LastUsed:          &now,
+		LastUsedIP:        &ip,
+		LastUsedUserAgent: &userAgent,
+		BackupEligible:    &credential.Flags.BackupEligible,
+		BackupState:       &credential.Flags.BackupState,
+		SignCount:         &signCount,
+	}
+	if err := repo.UpdateCredential(cred); err != nil {
 		log.Printf("Error updating credential: %s", err.Error())
 		return
 	}
-	if result.RowsAffected == 0 {
-		log.Printf("Error updating credential: no rows affected")
+
+	if !currentConfig().Policies.CredentialUsageHistory {
+		return
+	}
+	err := repo.CreateCredentialUsage(&CredentialUsage{
+		CredentialID:  &id,
+		UserID:        &this.ID,
+		IP:            &ip,
+		UserAgent:     &userAgent,
+		SignCount:     &signCount,
+		PrevSignCount: prevSignCount,
+		BackupState:   &credential.Flags.BackupState,
+		Created:       &now,
+	})
+	if err != nil {
+		log.Printf("Error recording credential usage: %s", err.Error())
 	}
 }
 
 func (this *PasskeyUser) RemoveCredential(credentialID []byte) {
-	result, err := gosqlcrud.Delete(db, &PasskeyUserCredential{
-		ID: string(credentialID),
-	}, "user_credential")
-	if err != nil {
+	if err := repo.DeleteCredential(string(credentialID)); err != nil {
 		log.Printf("Error removing credential: %s", err.Error())
-		return
-	}
-	if result.RowsAffected == 0 {
-		log.Printf("Error removing credential: no rows affected")
 	}
 }
 
 type Req struct {
-	Email string `json:"email"`
-	Code  string `json:"code"`
+	Email  string      `json:"email"`
+	Code   string      `json:"code"`
+	Method string      `json:"method"` // email login: link (default) or code
+	SSO    *PendingSSO `json:"sso"`    // email login started by SSOAuthorize
 }
 
 ////////////////////////
@@ -130,27 +228,45 @@ type Req struct {
 ////////////////////////
 
 type UserLogin struct {
-	ID      string     `json:"id" db:"id" pk:"true"`
-	Email   *string    `json:"email" db:"email"`
-	Token   *string    `json:"token" db:"token"`
-	Expires *time.Time `json:"expires" db:"expires"`
-	Used    *bool      `json:"used" db:"used"`
-	Created *time.Time `json:"created" db:"created"`
+	ID       string     `json:"id" db:"id" pk:"true"`
+	RealmID  *string    `json:"realm_id" db:"realm_id"`
+	Email    *string    `json:"email" db:"email"`
+	Token    *string    `json:"token" db:"token"`
+	CodeHash *string    `json:"-" db:"code_hash"`
+	Attempts *int       `json:"attempts" db:"attempts"`
+	Expires  *time.Time `json:"expires" db:"expires"`
+	Used     *bool      `json:"used" db:"used"`
+	Created  *time.Time `json:"created" db:"created"`
+
+	BindingHash      *string `json:"-" db:"binding_hash"`
+	RequestIP        *string `json:"request_ip" db:"request_ip"`
+	RequestUserAgent *string `json:"request_user_agent" db:"request_user_agent"`
+	Approved         *bool   `json:"approved" db:"approved"`
+	SSORequest       *string `json:"sso_request" db:"sso_request"`
 }
 
-func CreateUserLogin(email, token string, expires time.Time) (*UserLogin, error) {
+// CreateUserLogin stores a magic-link token. With a code, the row is for a code login and
+// stores the code's hash.
+func (s *sqlRepository) CreateUserLogin(realmID, email, token, code string, expires time.Time) (*UserLogin, error) {
 	id := uuid.New().String()
 	used := false
 	now := time.Now()
 	login := &UserLogin{
 		ID:      id,
+		RealmID: &realmID,
 		Email:   &email,
 		Token:   &token,
 		Expires: &expires,
 		Used:    &used,
 		Created: &now,
 	}
-	result, err := gosqlcrud.Create(db, login, "user_login")
+	if code != "" {
+		codeHash := hashLoginCode(id, code)
+		attempts := 0
+		login.CodeHash = &codeHash
+		login.Attempts = &attempts
+	}
+	result, err := gosqlcrud.Create(s.db, login, "user_login")
 	if err != nil {
 		return nil, err
 	}
@@ -160,9 +276,9 @@ func CreateUserLogin(email, token string, expires time.Time) (*UserLogin, error)
 	return login, nil
 }
 
-func GetUserLoginByToken(token string) (*UserLogin, error) {
+func (s *sqlRepository) GetUserLoginByToken(token string) (*UserLogin, error) {
 	logins := []UserLogin{}
-	err := gosqlcrud.QueryToStructs(db, &logins, "SELECT * FROM user_login WHERE token = ? AND used = 0 AND expires > NOW()", token)
+	err := gosqlcrud.QueryToStructs(s.db, &logins, "SELECT * FROM user_login WHERE token = ? AND code_hash IS NULL AND used = FALSE AND expires > ?", token, time.Now())
 	if err != nil {
 		return nil, err
 	}
@@ -172,13 +288,68 @@ func GetUserLoginByToken(token string) (*UserLogin, error) {
 	return &logins[0], nil
 }
 
-func MarkUserLoginUsed(id string) error {
-	used := true
+// GetUserLoginByCode returns the newest unused code login of an email.
+func (s *sqlRepository) GetUserLoginByCode(realmID, email string) (*UserLogin, error) {
+	logins := []UserLogin{}
+	err := gosqlcrud.QueryToStructs(s.db, &logins, "SELECT * FROM user_login WHERE realm_id = ? AND email = ? AND code_hash IS NOT NULL "+
+		"AND used = FALSE AND expires > ? ORDER BY created DESC LIMIT 1", realmID, email, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(logins) == 0 {
+		return nil, fmt.Errorf("login code not found or expired")
+	}
+	return &logins[0], nil
+}
+
+// CountUserLoginAttempt counts a wrong code. The code is used up after maxAttempts. used
+// is set first and from attempts + 1, since MySQL evaluates the assignments left to right
+// and the others from the old row; a login already used stays used.
+func (s *sqlRepository) CountUserLoginAttempt(id string, maxAttempts int) error {
+	_, err := s.db.Exec("UPDATE user_login SET used = used OR attempts + 1 >= ?, attempts = attempts + 1 WHERE id = ?", maxAttempts, id)
+	return err
+}
+
+// UseUserLogin marks an unused login as used. It fails if another request used it first.
+func (s *sqlRepository) UseUserLogin(id string) error {
+	result, err := s.db.Exec("UPDATE user_login SET used = TRUE WHERE id = ? AND used = FALSE", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("login already used")
+	}
+	return nil
+}
+
+// BindUserLogin binds a magic link to the browser holding the nonce behind bindingHash,
+// and records where it was requested for the approval page.
+func (s *sqlRepository) BindUserLogin(id, bindingHash, ip, userAgent string) error {
+	approved := false
+	login := &UserLogin{
+		ID:               id,
+		BindingHash:      &bindingHash,
+		RequestIP:        &ip,
+		RequestUserAgent: &userAgent,
+		Approved:         &approved,
+	}
+	result, err := gosqlcrud.Update(s.db, login, "user_login")
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no rows affected")
+	}
+	return nil
+}
+
+// SetUserLoginSSORequest references the pending SSO authorization a magic link continues.
+func (s *sqlRepository) SetUserLoginSSORequest(id, ssoRequest string) error {
 	login := &UserLogin{
-		ID:   id,
-		Used: &used,
+		ID:         id,
+		SSORequest: &ssoRequest,
 	}
-	result, err := gosqlcrud.Update(db, login, "user_login")
+	result, err := gosqlcrud.Update(s.db, login, "user_login")
 	if err != nil {
 		return err
 	}
@@ -188,6 +359,39 @@ func MarkUserLoginUsed(id string) error {
 	return nil
 }
 
+// GetUserLoginByBinding returns the newest unexpired magic link bound to a browser, used or not.
+func (s *sqlRepository) GetUserLoginByBinding(realmID, bindingHash string) (*UserLogin, error) {
+	logins := []UserLogin{}
+	err := gosqlcrud.QueryToStructs(s.db, &logins, "SELECT * FROM user_login WHERE realm_id = ? AND binding_hash = ? "+
+		"AND expires > ? ORDER BY created DESC LIMIT 1", realmID, bindingHash, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(logins) == 0 {
+		return nil, fmt.Errorf("login binding not found or expired")
+	}
+	return &logins[0], nil
+}
+
+// ApproveUserLogin lets the browser a magic link is bound to log in without opening it.
+// Approving twice is fine; MySQL counts no affected rows the second time, so the row is
+// checked again rather than trusting RowsAffected.
+func (s *sqlRepository) ApproveUserLogin(id string) error {
+	now := time.Now()
+	if _, err := s.db.Exec("UPDATE user_login SET approved = TRUE WHERE id = ? AND used = FALSE AND expires > ?", id, now); err != nil {
+		return err
+	}
+	logins := []UserLogin{}
+	err := gosqlcrud.QueryToStructs(s.db, &logins, "SELECT * FROM user_login WHERE id = ? AND approved = TRUE AND used = FALSE AND expires > ?", id, now)
+	if err != nil {
+		return err
+	}
+	if len(logins) == 0 {
+		return fmt.Errorf("login already used or expired")
+	}
+	return nil
+}
+
 /////////////////////////////////
 //                             //
 //    PasskeyUserCredential    //
@@ -202,6 +406,138 @@ type PasskeyUserCredential struct {
 	Credential *webauthn.Credential `json:"credential" db:"credential"`
 	Created    *time.Time           `json:"created" db:"created"`
 	Updated    *time.Time           `json:"updated" db:"updated"`
+
+	LastUsed          *time.Time `json:"last_used" db:"last_used"`
+	LastUsedIP        *string    `json:"last_used_ip" db:"last_used_ip"`
+	LastUsedUserAgent *string    `json:"last_used_user_agent" db:"last_used_user_agent"`
+	BackupEligible    *bool      `json:"backup_eligible" db:"backup_eligible"`
+	BackupState       *bool      `json:"backup_state" db:"backup_state"`
+	SignCount         *int64     `json:"sign_count" db:"sign_count"`
+	Suspect           *bool      `json:"suspect" db:"suspect"`
+	Disabled          *bool      `json:"disabled" db:"disabled"`
+	PRFSalt           *string    `json:"-" db:"prf_salt"`
+}
+
+func (s *sqlRepository) GetCredentials(userID string) ([]*PasskeyUserCredential, error) {
+	creds := []*PasskeyUserCredential{}
+	err := gosqlcrud.QueryToStructs(s.db, &creds, "SELECT * FROM user_credential WHERE user_id = ?", userID)
+	return creds, err
+}
+
+func (s *sqlRepository) CreateCredential(cred *PasskeyUserCredential) error {
+	result, err := gosqlcrud.Create(s.db, cred, "user_credential")
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no rows affected")
+	}
+	return nil
+}
+
+func (s *sqlRepository) UpdateCredential(cred *PasskeyUserCredential) error {
+	result, err := gosqlcrud.Update(s.db, cred, "user_credential")
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no rows affected")
+	}
+	return nil
+}
+
+// DeleteCredential deletes a credential and its usage history.
+func (s *sqlRepository) DeleteCredential(id string) error {
+	result, err := gosqlcrud.Delete(s.db, &PasskeyUserCredential{ID: id}, "user_credential")
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no rows affected")
+	}
+	_, err = s.db.Exec("DELETE FROM user_credential_usage WHERE credential_id = ?", id)
+	return err
+}
+
+func (s *sqlRepository) GetCredential(id string) (*PasskeyUserCredential, error) {
+	creds := []*PasskeyUserCredential{}
+	err := gosqlcrud.QueryToStructs(s.db, &creds, "SELECT * FROM user_credential WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("credential not found")
+	}
+	return creds[0], nil
+}
+
+// UpdateCredentialLabel renames a credential. Callers check that it exists: MySQL counts
+// no affected rows when the label doesn't change.
+func (s *sqlRepository) UpdateCredentialLabel(id, label string) error {
+	_, err := gosqlcrud.Update(s.db, &PasskeyUserCredential{ID: id, Label: &label}, "user_credential")
+	return err
+}
+
+// MarkCredentialSuspect flags a credential after a clone warning and optionally disables it.
+func (s *sqlRepository) MarkCredentialSuspect(id string, disable bool) error {
+	suspect := true
+	cred := &PasskeyUserCredential{
+		ID:       id,
+		Suspect:  &suspect,
+		Disabled: &disable,
+	}
+	_, err := gosqlcrud.Update(s.db, cred, "user_credential")
+	return err
+}
+
+// SetCredentialPRFSalt stores a new random PRF salt for a credential whose authenticator
+// reported PRF support at registration.
+func (s *sqlRepository) SetCredentialPRFSalt(id string) error {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	saltStr := base64.RawURLEncoding.EncodeToString(salt)
+	_, err := gosqlcrud.Update(s.db, &PasskeyUserCredential{ID: id, PRFSalt: &saltStr}, "user_credential")
+	return err
+}
+
+////////////////////////////
+//                        //
+//    CredentialUsage     //
+//                        //
+////////////////////////////
+
+// CredentialUsage is one entry of a credential's usage history, written on every passkey
+// login when CREDENTIAL_USAGE_HISTORY is enabled.
+type CredentialUsage struct {
+	ID            string     `json:"id" db:"id" pk:"true"`
+	CredentialID  *string    `json:"credential_id" db:"credential_id"`
+	UserID        *string    `json:"user_id" db:"user_id"`
+	IP            *string    `json:"ip" db:"ip"`
+	UserAgent     *string    `json:"user_agent" db:"user_agent"`
+	SignCount     *int64     `json:"sign_count" db:"sign_count"`
+	PrevSignCount *int64     `json:"prev_sign_count" db:"prev_sign_count"`
+	BackupState   *bool      `json:"backup_state" db:"backup_state"`
+	Created       *time.Time `json:"created" db:"created"`
+}
+
+func (s *sqlRepository) CreateCredentialUsage(usage *CredentialUsage) error {
+	usage.ID = uuid.New().String()
+	result, err := gosqlcrud.Create(s.db, usage, "user_credential_usage")
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no rows affected")
+	}
+	return nil
+}
+
+func (s *sqlRepository) GetCredentialUsage(credentialID string, limit int) ([]CredentialUsage, error) {
+	usage := []CredentialUsage{}
+	err := gosqlcrud.QueryToStructs(s.db, &usage, "SELECT * FROM user_credential_usage WHERE credential_id = ? ORDER BY created DESC LIMIT ?", credentialID, limit)
+	return usage, err
 }
 
 ////////////////////////
@@ -210,8 +546,92 @@ type PasskeyUserCredential struct {
 //                    //
 ////////////////////////
 
+// Session is a logged-in session. It is stored under the same key as WebAuthn ceremony data
+// and embeds it, so GetSession works for both.
+type Session struct {
+	webauthn.SessionData
+	AuthTime time.Time `json:"auth_time"` // when the user last authenticated or stepped up
+	AMR      []string  `json:"amr"`       // authentication methods used at AuthTime
+}
+
+// Authentication method references recorded in Session.AMR (RFC 8176 where one exists).
+const (
+	AMRPasskey = "hwk"   // proof of possession of a passkey
+	AMRMFA     = "mfa"   // passkey with user verification (biometric or PIN)
+	AMREmail   = "email" // magic link
+	AMROTP     = "otp"   // TOTP code from an authenticator app
+)
+
+func GetLoginSession(sessionID string) (*Session, error) {
+	val, err := store.Get(fmt.Sprintf("passkey_session:%s", sessionID))
+	if err != nil {
+		return nil, err
+	}
+	var data Session
+	if err := json.Unmarshal([]byte(val), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// SaveLoginSession stores a logged-in session and adds it to the sessions of its user.
+func SaveLoginSession(sessionID string, data *Session, ttl time.Duration) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := store.Set(fmt.Sprintf("passkey_session:%s", sessionID), string(dataJSON), ttl); err != nil {
+		return err
+	}
+	return store.SAdd(fmt.Sprintf("user_sessions:%s", data.UserID), sessionID)
+}
+
+// GetUserLoginSessions returns the logged-in sessions of a user by session ID. Sessions
+// that ended are removed from the user's sessions.
+func GetUserLoginSessions(userID string) (map[string]*Session, error) {
+	key := fmt.Sprintf("user_sessions:%s", userID)
+	ids, err := store.SMembers(key)
+	if err != nil {
+		return nil, err
+	}
+	sessions := map[string]*Session{}
+	for _, id := range ids {
+		session, err := GetLoginSession(id)
+		if err != nil || string(session.UserID) != userID {
+			store.SRem(key, id)
+			continue
+		}
+		sessions[id] = session
+	}
+	return sessions, nil
+}
+
+// DeleteUserLoginSessions ends all logged-in sessions of a user.
+func DeleteUserLoginSessions(userID string) error {
+	key := fmt.Sprintf("user_sessions:%s", userID)
+	ids, err := store.SMembers(key)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := DeleteSession(id); err != nil {
+			return err
+		}
+	}
+	return store.Del(key)
+}
+
+// UpdateLoginSession rewrites a logged-in session without changing its remaining TTL.
+func UpdateLoginSession(sessionID string, data *Session) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return store.Update(fmt.Sprintf("passkey_session:%s", sessionID), string(dataJSON))
+}
+
 func GetSession(sessionID string) (*webauthn.SessionData, error) {
-	val, err := redisClient.Get(ctx, fmt.Sprintf("passkey_session:%s", sessionID)).Result()
+	val, err := store.Get(fmt.Sprintf("passkey_session:%s", sessionID))
 	if err != nil {
 		return nil, err
 	}
@@ -232,27 +652,74 @@ func SaveSession(sessionID string, data *webauthn.SessionData, ttl time.Duration
 	if err != nil {
 		return err
 	}
-	val, err := redisClient.Set(ctx, fmt.Sprintf("passkey_session:%s", sessionID), dataJSON, ttl).Result()
+	return store.Set(fmt.Sprintf("passkey_session:%s", sessionID), string(dataJSON), ttl)
+}
+
+func DeleteSession(sessionID string) error {
+	return store.Del(fmt.Sprintf("passkey_session:%s", sessionID))
+}
+
+// pendingCredential is a verified but not yet stored credential, held while the user
+// confirms that it should replace an existing one.
+type pendingCredential struct {
+	UserID     string               `json:"user_id"`
+	Credential *webauthn.Credential `json:"credential"`
+	PRF        bool                 `json:"prf,omitempty"`
+}
+
+func SavePendingCredential(sessionID, userID string, credential *webauthn.Credential, prf bool, ttl time.Duration) error {
+	dataJSON, err := json.Marshal(pendingCredential{UserID: userID, Credential: credential, PRF: prf})
 	if err != nil {
 		return err
 	}
-	log.Printf("Save session result: %s", val)
-	return nil
+	return store.Set(fmt.Sprintf("passkey_pending:%s", sessionID), string(dataJSON), ttl)
 }
 
-func DeleteSession(sessionID string) error {
-	val, err := redisClient.Del(ctx, fmt.Sprintf("passkey_session:%s", sessionID)).Result()
+func GetPendingCredential(sessionID string) (*pendingCredential, error) {
+	val, err := store.Get(fmt.Sprintf("passkey_pending:%s", sessionID))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Printf("Delete session result: %d", val)
-	return nil
+	var data pendingCredential
+	if err := json.Unmarshal([]byte(val), &data); err != nil {
+		return nil, err
+	}
+	if data.Credential == nil {
+		return nil, fmt.Errorf("pending credential not found")
+	}
+	return &data, nil
 }
 
-func CreateUser(email, name, displayName string) (*PasskeyUser, error) {
+func DeletePendingCredential(sessionID string) error {
+	return store.Del(fmt.Sprintf("passkey_pending:%s", sessionID))
+}
+
+// GetFailures returns the number of recent failed attempts counted under key.
+func GetFailures(key string) int {
+	val, _ := store.Get(key)
+	n, _ := strconv.Atoi(val)
+	return n
+}
+
+// CountFailure counts a failed attempt under key. The counter expires lockout after the
+// first failure.
+func CountFailure(key string, lockout time.Duration) int {
+	n, err := store.Incr(key, lockout)
+	if err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func ResetFailures(key string) error {
+	return store.Del(key)
+}
+
+func (s *sqlRepository) CreateUser(realmID, email, name, displayName string) (*PasskeyUser, error) {
 	id := uuid.New().String()
 	user := &PasskeyUser{
 		ID:          id,
+		RealmID:     realmID,
 		DisplayName: displayName,
 		Name:        name,
 		Email:       email,
@@ -263,22 +730,29 @@ func CreateUser(email, name, displayName string) (*PasskeyUser, error) {
 		IsDeleted:   false,
 		IsAdmin:     false,
 	}
-	result, err := gosqlcrud.Create(db, user, "user")
-	if err != nil {
+	if err := s.InsertUser(user); err != nil {
 		return nil, err
 	}
+	return user, nil
+}
+
+func (s *sqlRepository) InsertUser(user *PasskeyUser) error {
+	result, err := gosqlcrud.Create(s.db, user, "`user`")
+	if err != nil {
+		return err
+	}
 	if result.RowsAffected == 0 {
-		return nil, fmt.Errorf("no rows affected")
+		return fmt.Errorf("no rows affected")
 	}
-	return user, nil
+	return nil
 }
 
-func GetUser(id string) (*PasskeyUser, error) {
+func (s *sqlRepository) GetUser(id string) (*PasskeyUser, error) {
 	log.Printf("Getting user with ID: %s", id)
 	user := &PasskeyUser{
 		ID: id,
 	}
-	err := gosqlcrud.Retrieve(db, user, "user")
+	err := gosqlcrud.Retrieve(s.db, user, "`user`")
 	if err != nil {
 		return nil, err
 	}
@@ -286,9 +760,9 @@ func GetUser(id string) (*PasskeyUser, error) {
 	return user, nil
 }
 
-func GetUserByEmail(email string) (*PasskeyUser, error) {
+func (s *sqlRepository) GetUserByEmail(realmID, email string) (*PasskeyUser, error) {
 	users := []PasskeyUser{}
-	err := gosqlcrud.QueryToStructs(db, &users, "SELECT * FROM user WHERE email = ?", email)
+	err := gosqlcrud.QueryToStructs(s.db, &users, "SELECT * FROM `user` WHERE realm_id = ? AND email = ?", realmID, email)
 	if err != nil {
 		log.Printf("Error looking up user by email: %s", err.Error())
 		return nil, err
@@ -300,22 +774,108 @@ func GetUserByEmail(email string) (*PasskeyUser, error) {
 	return nil, fmt.Errorf("user not found")
 }
 
-func SaveUser(user *PasskeyUser) error {
-	_, err := gosqlcrud.Update(db, user, "user")
+func (s *sqlRepository) SaveUser(user *PasskeyUser) error {
+	_, err := gosqlcrud.Update(s.db, user, "`user`")
 	return err
 }
 
-func GetAllUsers() ([]PasskeyUser, error) {
+func (s *sqlRepository) GetAllUsers(realmID string) ([]PasskeyUser, error) {
 	users := []PasskeyUser{}
-	err := gosqlcrud.QueryToStructs(db, &users, "SELECT * FROM user WHERE is_deleted = 0 ORDER BY created DESC")
+	err := gosqlcrud.QueryToStructs(s.db, &users, "SELECT * FROM `user` WHERE realm_id = ? AND is_deleted = FALSE ORDER BY created DESC", realmID)
 	return users, err
 }
 
-func DeleteUser(id string) error {
-	_, err := db.Exec("UPDATE user SET is_deleted = 1 WHERE id = ?", id)
+func (s *sqlRepository) DeleteUser(id string) error {
+	_, err := s.db.Exec("UPDATE `user` SET is_deleted = TRUE WHERE id = ?", id)
+	return err
+}
+
+////////////////////////
+//                    //
+//    Setting         //
+//                    //
+////////////////////////
+
+// Setting is an admin-editable runtime setting. Settings override their defaults in the
+// configuration and take effect without a restart.
+type Setting struct {
+	Name    string     `json:"name" db:"name" pk:"true"`
+	Value   *string    `json:"value" db:"value"`
+	Updated *time.Time `json:"updated" db:"updated"`
+}
+
+// GetSetting returns the stored value of a setting, or def if it was never set.
+func GetSetting(name, def string) string {
+	setting := &Setting{Name: name}
+	if err := gosqlcrud.Retrieve(db, setting, "setting"); err != nil || setting.Value == nil {
+		return def
+	}
+	return *setting.Value
+}
+
+// secretSettings are settings the server keeps for itself, like the key of the decoy
+// passkey logins. Admins don't see them and gopasskey config masks them.
+var secretSettings = []string{"login_decoy_key"}
+
+func isSecretSetting(name string) bool {
+	return slices.Contains(secretSettings, name)
+}
+
+func GetAllSettings() ([]Setting, error) {
+	settings := []Setting{}
+	err := gosqlcrud.QueryToStructs(db, &settings, "SELECT * FROM setting ORDER BY name")
+	return settings, err
+}
+
+func SaveSetting(name, value string) error {
+	_, err := db.Exec(db.dialect.upsert("setting", "name", "value", "updated"), name, value, time.Now())
 	return err
 }
 
+////////////////////////
+//                    //
+//    SecurityEvent   //
+//                    //
+////////////////////////
+
+type SecurityEvent struct {
+	ID           string     `json:"id" db:"id" pk:"true"`
+	UserID       *string    `json:"user_id" db:"user_id"`
+	CredentialID *string    `json:"credential_id" db:"credential_id"`
+	Type         *string    `json:"type" db:"type"`
+	Detail       *string    `json:"detail" db:"detail"`
+	IP           *string    `json:"ip" db:"ip"`
+	UserAgent    *string    `json:"user_agent" db:"user_agent"`
+	Created      *time.Time `json:"created" db:"created"`
+}
+
+func CreateSecurityEvent(event *SecurityEvent) error {
+	now := time.Now()
+	event.ID = uuid.New().String()
+	event.Created = &now
+	result, err := gosqlcrud.Create(db, event, "security_event")
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no rows affected")
+	}
+	return nil
+}
+
+func GetSecurityEvents(realmID string, limit int) ([]SecurityEvent, error) {
+	events := []SecurityEvent{}
+	err := gosqlcrud.QueryToStructs(db, &events, "SELECT security_event.* FROM security_event JOIN `user` ON `user`.id = security_event.user_id "+
+		"WHERE `user`.realm_id = ? ORDER BY security_event.created DESC LIMIT ?", realmID, limit)
+	return events, err
+}
+
+func (s *sqlRepository) GetAdminUsers(realmID string) ([]PasskeyUser, error) {
+	users := []PasskeyUser{}
+	err := gosqlcrud.QueryToStructs(s.db, &users, "SELECT * FROM `user` WHERE realm_id = ? AND is_admin = TRUE AND is_deleted = FALSE", realmID)
+	return users, err
+}
+
 ////////////////////////
 //                    //
 //    SSOClient       //
@@ -324,15 +884,16 @@ func DeleteUser(id string) error {
 
 type SSOClient struct {
 	ID           string  `json:"id" db:"id" pk:"true"`
+	RealmID      string  `json:"realm_id" db:"realm_id"`
 	ClientSecret string  `json:"client_secret" db:"client_secret"`
 	RedirectURI  string  `json:"redirect_uri" db:"redirect_uri"`
 	Name         *string `json:"name" db:"name"`
 	Created      *string `json:"created" db:"created"`
 }
 
-func GetSSOClient(clientID string) (*SSOClient, error) {
+func (s *sqlRepository) GetSSOClient(clientID string) (*SSOClient, error) {
 	client := &SSOClient{ID: clientID}
-	err := gosqlcrud.Retrieve(db, client, "sso_client")
+	err := gosqlcrud.Retrieve(s.db, client, "sso_client")
 	if err != nil {
 		return nil, err
 	}
@@ -340,28 +901,61 @@ func GetSSOClient(clientID string) (*SSOClient, error) {
 	return client, nil
 }
 
-func GetAllSSOClients() ([]*SSOClient, error) {
+func (s *sqlRepository) GetAllSSOClients(realmID string) ([]*SSOClient, error) {
 	clients := []*SSOClient{}
-	err := gosqlcrud.QueryToStructs(db, &clients, "SELECT * FROM sso_client ORDER BY id")
+	err := gosqlcrud.QueryToStructs(s.db, &clients, "SELECT * FROM sso_client WHERE realm_id = ? ORDER BY id", realmID)
 	if err != nil {
 		return nil, err
 	}
 	return clients, nil
 }
 
-func CreateSSOClient(client *SSOClient) error {
-	_, err := db.Exec("INSERT INTO sso_client (id, client_secret, redirect_uri, name) VALUES (?, ?, ?, ?)",
-		client.ID, client.ClientSecret, client.RedirectURI, client.Name)
+func (s *sqlRepository) CreateSSOClient(client *SSOClient) error {
+	_, err := s.db.Exec("INSERT INTO sso_client (id, realm_id, client_secret, redirect_uri, name) VALUES (?, ?, ?, ?, ?)",
+		client.ID, client.RealmID, client.ClientSecret, client.RedirectURI, client.Name)
 	return err
 }
 
-func UpdateSSOClient(client *SSOClient) error {
-	_, err := db.Exec("UPDATE sso_client SET client_secret = ?, redirect_uri = ?, name = ? WHERE id = ?",
-		client.ClientSecret, client.RedirectURI, client.Name, client.ID)
+func (s *sqlRepository) UpdateSSOClient(client *SSOClient) error {
+	_, err := s.db.Exec("UPDATE sso_client SET client_secret = ?, redirect_uri = ?, name = ? WHERE id = ? AND realm_id = ?",
+		client.ClientSecret, client.RedirectURI, client.Name, client.ID, client.RealmID)
 	return err
 }
 
-func DeleteSSOClient(id string) error {
-	_, err := db.Exec("DELETE FROM sso_client WHERE id = ?", id)
+func (s *sqlRepository) DeleteSSOClient(realmID, id string) error {
+	_, err := s.db.Exec("DELETE FROM sso_client WHERE id = ? AND realm_id = ?", id, realmID)
 	return err
 }
+
+// PendingSSO is an SSO authorization request waiting for an email login to finish.
+type PendingSSO struct {
+	ClientID    string `json:"client_id"`
+	RedirectURI string `json:"redirect_uri"`
+	State       string `json:"state"`
+	PRF         bool   `json:"prf,omitempty"`
+	AuthAfter   int64  `json:"auth_after,omitempty"` // Unix time a new login must be newer than
+}
+
+func SavePendingSSO(id string, data *PendingSSO, ttl time.Duration) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return store.Set(fmt.Sprintf("sso_pending:%s", id), string(dataJSON), ttl)
+}
+
+func GetPendingSSO(id string) (*PendingSSO, error) {
+	val, err := store.Get(fmt.Sprintf("sso_pending:%s", id))
+	if err != nil {
+		return nil, err
+	}
+	var data PendingSSO
+	if err := json.Unmarshal([]byte(val), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func DeletePendingSSO(id string) error {
+	return store.Del(fmt.Sprintf("sso_pending:%s", id))
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/elgs/gosqlcrud"
+	"github.com/google/uuid"
+)
+
+// Mail is not sent from the request but queued in the mail_outbox table. A background
+// worker in every replica claims due messages with a conditional UPDATE, so each message is
+// sent by one worker at a time; a claim that isn't finished within mailClaimTTL (crashed
+// replica) is picked up again. Failed sends are retried with exponential backoff and end up
+// dead after mailMaxAttempts, where admins can see and resend them.
+
+const (
+	MailStatusPending = "pending"
+	MailStatusSending = "sending"
+	MailStatusSent    = "sent"
+	MailStatusDead    = "dead"
+)
+
+const (
+	mailMaxAttempts   = 8
+	mailBackoffBase   = 30 * time.Second
+	mailBackoffMax    = time.Hour
+	mailClaimTTL      = 2 * time.Minute
+	mailBatchSize     = 10
+	mailPollInterval  = 5 * time.Second
+	mailSentRetention = 7 * 24 * time.Hour
+)
+
+// mailWake wakes the local worker when mail is queued, so it doesn't wait for the next poll.
+var mailWake = make(chan struct{}, 1)
+
+// QueueMail stores a mail in the outbox. Mail with a dedupeKey that is already queued is
+// dropped. Mail not sent by expires (if set) is given up, for links and codes that are
+// useless by then.
+func QueueMail(mail *Mail, dedupeKey string, expires time.Time) error {
+	if err := EnqueueOutboxMail(mail, dedupeKey, expires); err != nil {
+		return fmt.Errorf("can't queue mail: %w", err)
+	}
+	select {
+	case mailWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// mailDedupeKey joins the parts of a dedupe key. With a window, the current time bucket is
+// added, so the same alert is sent at most once per window.
+func mailDedupeKey(window time.Duration, parts ...string) string {
+	if window > 0 {
+		parts = append(parts, fmt.Sprint(time.Now().Unix()/int64(window.Seconds())))
+	}
+	return strings.Join(parts, ":")
+}
+
+// mailBackoff returns how long to wait before the next attempt after the given number of
+// attempts: mailBackoffBase doubled per attempt up to mailBackoffMax, plus up to 20% jitter
+// so that replicas don't retry in lockstep.
+func mailBackoff(attempts int) time.Duration {
+	d := mailBackoffMax
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts <= 20 {
+		d = min(mailBackoffBase<<(attempts-1), mailBackoffMax)
+	}
+	jitter, _ := rand.Int(rand.Reader, big.NewInt(int64(d/5)+1))
+	return d + time.Duration(jitter.Int64())
+}
+
+// runMailWorker sends queued mail until the process exits.
+func runMailWorker() {
+	host, _ := os.Hostname()
+	lastPurge := time.Time{}
+	for {
+		for {
+			// After a full batch there may be more due
+			if sendMailBatch(host) < mailBatchSize {
+				break
+			}
+		}
+		if time.Since(lastPurge) > time.Hour {
+			if err := PurgeSentOutboxMail(mailSentRetention); err != nil {
+				log.Printf("[ERRO] can't purge sent mail: %s", err.Error())
+			}
+			lastPurge = time.Now()
+		}
+		select {
+		case <-mailWake:
+		case <-time.After(mailPollInterval):
+		}
+	}
+}
+
+// sendMailBatch claims and sends due mail. It returns the number of messages claimed.
+func sendMailBatch(host string) int {
+	b := make([]byte, 8)
+	rand.Read(b)
+	claim := host + ":" + hex.EncodeToString(b)
+	messages, err := ClaimOutboxMail(claim, mailBatchSize, mailClaimTTL)
+	if err != nil {
+		log.Printf("[ERRO] can't claim queued mail: %s", err.Error())
+		return 0
+	}
+	for _, m := range messages {
+		if m.Expires != nil && m.Expires.Before(time.Now()) {
+			if err := FailOutboxMail(m.ID, claim, "expired before it could be sent", true, 0); err != nil {
+				log.Printf("[ERRO] can't update queued mail %s: %s", m.ID, err.Error())
+			}
+			continue
+		}
+		if err := deliverOutboxMail(&m); err != nil {
+			attempts := 0
+			if m.Attempts != nil {
+				attempts = *m.Attempts
+			}
+			dead := attempts >= mailMaxAttempts
+			log.Printf("[WARN] sending mail %s to %s failed (attempt %d): %s", m.ID, deref(m.Recipient), attempts, err.Error())
+			if err := FailOutboxMail(m.ID, claim, err.Error(), dead, mailBackoff(attempts)); err != nil {
+				log.Printf("[ERRO] can't update queued mail %s: %s", m.ID, err.Error())
+			}
+			continue
+		}
+		if err := MarkOutboxMailSent(m.ID, claim); err != nil {
+			log.Printf("[ERRO] can't update queued mail %s: %s", m.ID, err.Error())
+		}
+	}
+	return len(messages)
+}
+
+// deliverOutboxMail sends a queued message with the configured mailer.
+func deliverOutboxMail(m *OutboxMail) error {
+	return mailer.Send(&Mail{
+		RealmID: deref(m.RealmID),
+		To:      strings.Split(deref(m.Recipient), ","),
+		Subject: deref(m.Subject),
+		Text:    deref(m.Text),
+		HTML:    deref(m.HTML),
+	})
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+////////////////////////////
+//                        //
+//    Outbox Admin        //
+//                        //
+////////////////////////////
+
+// AdminListOutboxMail lists the realm's queued, failed and recently sent mail, newest first.
+// GET /api/admin/mail?status=dead
+func AdminListOutboxMail(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != MailStatusPending && status != MailStatusSending && status != MailStatusSent && status != MailStatusDead {
+		JSONResponse(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	messages, err := GetOutboxMail(realmOf(r).ID, status, 200)
+	if err != nil {
+		JSONResponse(w, "Failed to list mail", http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, messages, http.StatusOK)
+}
+
+// AdminResendOutboxMail queues a dead message again with fresh attempts.
+// POST /api/admin/mail/resend?id=...
+func AdminResendOutboxMail(w http.ResponseWriter, r *http.Request) {
+	if requireAdmin(w, r) == nil {
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if err := RequeueOutboxMail(realmOf(r).ID, id); err != nil {
+		JSONResponse(w, "Mail not found, not failed, or expired", http.StatusBadRequest)
+		return
+	}
+	select {
+	case mailWake <- struct{}{}:
+	default:
+	}
+	JSONResponse(w, "Mail queued", http.StatusOK)
+}
+
+////////////////////////////
+//                        //
+//    Outbox Model        //
+//                        //
+////////////////////////////
+
+type OutboxMail struct {
+	ID          string     `json:"id" db:"id" pk:"true"`
+	RealmID     *string    `json:"realm_id" db:"realm_id"`
+	DedupeKey   *string    `json:"dedupe_key" db:"dedupe_key"`
+	Recipient   *string    `json:"recipient" db:"recipient"`
+	Subject     *string    `json:"subject" db:"subject"`
+	Text        *string    `json:"-" db:"text_body"`
+	HTML        *string    `json:"-" db:"html_body"`
+	Status      *string    `json:"status" db:"status"`
+	Attempts    *int       `json:"attempts" db:"attempts"`
+	NextAttempt *time.Time `json:"next_attempt" db:"next_attempt"`
+	Expires     *time.Time `json:"expires" db:"expires"`
+	LockedBy    *string    `json:"-" db:"locked_by"`
+	LockedUntil *time.Time `json:"-" db:"locked_until"`
+	LastError   *string    `json:"last_error" db:"last_error"`
+	Created     *time.Time `json:"created" db:"created"`
+	Sent        *time.Time `json:"sent" db:"sent"`
+}
+
+func EnqueueOutboxMail(mail *Mail, dedupeKey string, expires time.Time) error {
+	var key, html any
+	var expiry any
+	if dedupeKey != "" {
+		key = dedupeKey
+	}
+	if mail.HTML != "" {
+		html = mail.HTML
+	}
+	if !expires.IsZero() {
+		expiry = expires
+	}
+	_, err := db.Exec("INSERT INTO mail_outbox (id, realm_id, dedupe_key, recipient, subject, text_body, html_body, status, next_attempt, expires) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) "+db.dialect.ignoreDuplicate("id"),
+		uuid.New().String(), mail.RealmID, key, strings.Join(mail.To, ","), mail.Subject, mail.Text, html, MailStatusPending, time.Now(), expiry)
+	return err
+}
+
+// ClaimOutboxMail marks up to limit due messages, including ones whose claim ran out, as
+// sending under claim and returns them. The due condition is checked again on the rows
+// being updated, so two workers never claim the same message.
+func ClaimOutboxMail(claim string, limit int, ttl time.Duration) ([]OutboxMail, error) {
+	const due = "((status = ? AND next_attempt <= ?) OR (status = ? AND locked_until < ?))"
+	now := time.Now()
+	_, err := db.Exec("UPDATE mail_outbox SET status = ?, locked_by = ?, locked_until = ?, attempts = attempts + 1 "+
+		"WHERE "+due+" AND id IN (SELECT id FROM (SELECT id FROM mail_outbox WHERE "+due+" ORDER BY next_attempt LIMIT ?) AS claimable)",
+		MailStatusSending, claim, now.Add(ttl),
+		MailStatusPending, now, MailStatusSending, now,
+		MailStatusPending, now, MailStatusSending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	messages := []OutboxMail{}
+	err = gosqlcrud.QueryToStructs(db, &messages, "SELECT * FROM mail_outbox WHERE status = ? AND locked_by = ?", MailStatusSending, claim)
+	return messages, err
+}
+
+func MarkOutboxMailSent(id, claim string) error {
+	_, err := db.Exec("UPDATE mail_outbox SET status = ?, sent = ?, text_body = '', html_body = NULL, locked_by = NULL, locked_until = NULL "+
+		"WHERE id = ? AND locked_by = ?", MailStatusSent, time.Now(), id, claim)
+	return err
+}
+
+// FailOutboxMail records a failed attempt. The message is retried after backoff, or is dead.
+func FailOutboxMail(id, claim, reason string, dead bool, backoff time.Duration) error {
+	status := MailStatusPending
+	if dead {
+		status = MailStatusDead
+	}
+	_, err := db.Exec("UPDATE mail_outbox SET status = ?, next_attempt = ?, last_error = ?, locked_by = NULL, locked_until = NULL "+
+		"WHERE id = ? AND locked_by = ?", status, time.Now().Add(backoff), reason, id, claim)
+	return err
+}
+
+func GetOutboxMail(realmID, status string, limit int) ([]OutboxMail, error) {
+	messages := []OutboxMail{}
+	query := "SELECT * FROM mail_outbox WHERE realm_id = ?"
+	args := []any{realmID}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	err := gosqlcrud.QueryToStructs(db, &messages, query+" ORDER BY created DESC LIMIT ?", append(args, limit)...)
+	return messages, err
+}
+
+// RequeueOutboxMail resets a dead message of the realm unless it has expired.
+func RequeueOutboxMail(realmID, id string) error {
+	now := time.Now()
+	result, err := db.Exec("UPDATE mail_outbox SET status = ?, attempts = 0, next_attempt = ?, last_error = NULL "+
+		"WHERE id = ? AND realm_id = ? AND status = ? AND (expires IS NULL OR expires > ?)", MailStatusPending, now, id, realmID, MailStatusDead, now)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no rows affected")
+	}
+	return nil
+}
+
+func PurgeSentOutboxMail(retention time.Duration) error {
+	_, err := db.Exec("DELETE FROM mail_outbox WHERE status = ? AND sent < ?", MailStatusSent, time.Now().Add(-retention))
+	return err
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// The WebAuthn PRF extension lets an authenticator derive a secret from a salt. Relying
+// parties use the output as an end-to-end encryption key. The server only hands out salts:
+// the browser evaluates the PRF and the output never leaves the client.
+//
+// Each PRF-capable credential gets a random salt at registration. The salt sent to the
+// authenticator is SHA-256 over the credential salt and a context, so every SSO client
+// derives its own key from the same passkey.
+
+// prfContextSelf is the context for PRF evaluations requested by gopasskey's own frontend.
+const prfContextSelf = "self"
+
+// prfRegistrationExtensions asks the authenticator whether it supports PRF.
+func prfRegistrationExtensions() protocol.AuthenticationExtensions {
+	return protocol.AuthenticationExtensions{"prf": map[string]any{}}
+}
+
+// prfEnabled reports whether the client extension results of a registration say that the
+// new credential supports PRF.
+func prfEnabled(results protocol.AuthenticationExtensionsClientOutputs) bool {
+	prf, ok := results["prf"].(map[string]any)
+	if !ok {
+		return false
+	}
+	enabled, _ := prf["enabled"].(bool)
+	return enabled
+}
+
+// prfEvalSalt derives the salt evaluated for a credential in the given context.
+func prfEvalSalt(credSalt, context string) string {
+	sum := sha256.Sum256([]byte("gopasskey-prf\x00" + context + "\x00" + credSalt))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// prfLoginExtensions returns the prf extension input for an assertion, with one salt per
+// PRF-capable credential of the user, and whether there was any such credential.
+func prfLoginExtensions(user *PasskeyUser, context string) (protocol.AuthenticationExtensions, bool) {
+	evalByCredential := map[string]any{}
+	for _, c := range user.Credentials() {
+		if c.PRFSalt == nil || c.Credential == nil || (c.Disabled != nil && *c.Disabled) {
+			continue
+		}
+		credID := base64.RawURLEncoding.EncodeToString(c.Credential.ID)
+		evalByCredential[credID] = map[string]any{"first": prfEvalSalt(*c.PRFSalt, context)}
+	}
+	if len(evalByCredential) == 0 {
+		return nil, false
+	}
+	return protocol.AuthenticationExtensions{
+		"prf": map[string]any{"evalByCredential": evalByCredential},
+	}, true
+}
+
+// prfCredentialDescriptors returns the allowCredentials list for a PRF evaluation.
+func prfCredentialDescriptors(user *PasskeyUser) []protocol.CredentialDescriptor {
+	descriptors := []protocol.CredentialDescriptor{}
+	for _, c := range user.Credentials() {
+		if c.PRFSalt == nil || c.Credential == nil || (c.Disabled != nil && *c.Disabled) {
+			continue
+		}
+		descriptors = append(descriptors, c.Credential.Descriptor())
+	}
+	return descriptors
+}
+
+// dropPRFResults removes PRF outputs from an assertion in case a client sent them anyway,
+// so they are never stored or logged.
+func dropPRFResults(parsed *protocol.ParsedCredentialAssertionData) {
+	delete(parsed.ClientExtensionResults, "prf")
+}
+
+// redirectToPRF sends the browser to the page that evaluates the PRF for an SSO client.
+func redirectToPRF(w http.ResponseWriter, r *http.Request, clientID, redirectURI, state string) {
+	prfURL := realmPath(r, "/api/pub/sso/prf/page") + fmt.Sprintf("?client_id=%s&redirect_uri=%s&state=%s",
+		url.QueryEscape(clientID),
+		url.QueryEscape(redirectURI),
+		url.QueryEscape(state))
+	http.Redirect(w, r, prfURL, http.StatusFound)
+}
+
+// SSOPRFPage renders the page on which the logged-in user evaluates the PRF for an SSO client.
+// GET /api/pub/sso/prf/page?client_id=X&redirect_uri=URI&state=STATE
+func SSOPRFPage(w http.ResponseWriter, r *http.Request) {
+	clientID := r.URL.Query().Get("client_id")
+	redirectURI := r.URL.Query().Get("redirect_uri")
+	client, err := getRealmClient(r, clientID)
+	if err != nil || redirectURI != client.RedirectURI {
+		http.Error(w, "Invalid client_id or redirect_uri", http.StatusBadRequest)
+		return
+	}
+	clientName := clientID
+	if client.Name != nil {
+		clientName = *client.Name
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = prfPageTemplate.Execute(w, map[string]any{
+		"Base":        realmPath(r, ""),
+		"ClientID":    clientID,
+		"ClientName":  clientName,
+		"RedirectURI": redirectURI,
+		"State":       r.URL.Query().Get("state"),
+	})
+	if err != nil {
+		log.Printf("[ERRO] can't render PRF page: %s", err.Error())
+	}
+}
+
+// BeginSSOPRF starts an assertion for the logged-in user that evaluates the PRF with the
+// salts of the given SSO client.
+// POST /api/pub/sso/prf/start {"client_id"}
+func BeginSSOPRF(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ClientID string `json:"client_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if _, err := getRealmClient(r, req.ClientID); err != nil {
+		JSONResponse(w, "Invalid client_id", http.StatusBadRequest)
+		return
+	}
+	session, err := GetLoginSession(getSessionID(r))
+	if err != nil {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, err := repo.GetUser(string(session.UserID))
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	extensions, ok := prfLoginExtensions(user, req.ClientID)
+	if !ok {
+		JSONResponse(w, "None of your passkeys supports encryption keys", http.StatusBadRequest)
+		return
+	}
+	options, ceremony, err := getWebAuthn(r).BeginLogin(user,
+		webauthn.WithAllowedCredentials(prfCredentialDescriptors(user)),
+		webauthn.WithAssertionExtensions(extensions),
+		webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		msg := fmt.Sprintf("can't begin PRF evaluation: %s", err.Error())
+		log.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	prfSid := realmOf(r).newID()
+	if err := SaveSession(prfSid, ceremony, currentConfig().TTL.Ceremony); err != nil {
+		log.Printf("[ERRO] can't save session: %s", err.Error())
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Access-Control-Expose-Headers", "prf_sid")
+	w.Header().Set("prf_sid", prfSid)
+	JSONResponse(w, options, http.StatusOK)
+}
+
+// FinishSSOPRF verifies the assertion and issues an SSO auth code. The PRF output stays in
+// the browser, which passes it to the client in the redirect URI fragment.
+// POST /api/pub/sso/prf/finish?client_id=X&redirect_uri=URI&state=STATE (header prf_sid)
+func FinishSSOPRF(w http.ResponseWriter, r *http.Request) {
+	prfSid := realmHeader(r, "prf_sid")
+	if prfSid == "" {
+		JSONResponse(w, "missing prf_sid header", http.StatusBadRequest)
+		return
+	}
+	clientID := r.URL.Query().Get("client_id")
+	redirectURI := r.URL.Query().Get("redirect_uri")
+	client, err := getRealmClient(r, clientID)
+	if err != nil || redirectURI != client.RedirectURI {
+		JSONResponse(w, "Invalid client_id or redirect_uri", http.StatusBadRequest)
+		return
+	}
+	sid := getSessionID(r)
+	session, err := GetLoginSession(sid)
+	if err != nil {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ceremony, err := GetSession(prfSid)
+	if err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	DeleteSession(prfSid)
+	if string(ceremony.UserID) != string(session.UserID) {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, err := repo.GetUser(string(session.UserID))
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+	// The salts must be the ones of this client, or the page would hand another client's key over
+	expected, _ := prfLoginExtensions(user, clientID)
+	expectedJSON, _ := json.Marshal(expected)
+	ceremonyJSON, _ := json.Marshal(ceremony.Extensions)
+	if string(expectedJSON) != string(ceremonyJSON) {
+		JSONResponse(w, "PRF evaluation was started for another client", http.StatusBadRequest)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dropPRFResults(parsed)
+	credential, err := getWebAuthn(r).ValidateLogin(user, *ceremony, parsed)
+	if err != nil {
+		log.Printf("[ERRO] can't finish PRF evaluation: %s", err.Error())
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !credential.Flags.UserVerified {
+		JSONResponse(w, "User verification is required", http.StatusBadRequest)
+		return
+	}
+	if credential.Authenticator.CloneWarning && !handleCloneWarning(w, r, user, credential) {
+		return
+	}
+	user.UpdateCredential(credential, clientIP(r), r.UserAgent())
+
+	// The assertion is a fresh passkey login
+	session.AuthTime = time.Now()
+	session.AMR = passkeyAMR(credential)
+	if err := UpdateLoginSession(sid, session); err != nil {
+		log.Printf("[ERRO] can't update session: %s", err.Error())
+	}
+
+	log.Printf("[INFO] PRF evaluation for client %s by user %s", clientID, user.ID)
+	JSONResponse(w, map[string]any{
+		"redirect": ssoCodeRedirect(r, user.ID, sid, redirectURI, r.URL.Query().Get("state")),
+	}, http.StatusOK)
+}
+
+var prfPageTemplate = template.Must(template.New("prf").Parse(`<!DOCTYPE html>
+<html data-ui-theme="nord">
+<head>
+  <meta charset="UTF-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Unlock</title>
+  <link rel="stylesheet" href="https://cdn.jsdelivr.net/gh/az-code-lab/ui/src/ui.css">
+  <link rel="stylesheet" href="https://cdn.jsdelivr.net/gh/az-code-lab/ui/src/themes/nord.css">
+  <script src="https://unpkg.com/@simplewebauthn/browser/dist/bundle/index.umd.min.js"></script>
+  <style>body { display: flex; align-items: center; justify-content: center; min-height: 100vh; } .ui-panel { max-width: 420px; width: 100%; }</style>
+</head>
+<body>
+  <div class="ui-panel raised">
+    <div class="ui-panel-header"><h2 class="ui-panel-title">Unlock with your passkey</h2></div>
+    <div class="ui-panel-body">
+      <div class="ui-stack">
+        <p><strong>{{.ClientName}}</strong> needs your passkey to unlock your encrypted data.</p>
+        <div id="message" class="ui-alert" hidden></div>
+        <button id="unlock" class="ui-btn block">Unlock</button>
+      </div>
+    </div>
+  </div>
+  <script>
+    const base = {{.Base}};
+    const clientId = {{.ClientID}};
+    const query = new URLSearchParams({ client_id: clientId, redirect_uri: {{.RedirectURI}}, state: {{.State}} });
+    const message = document.getElementById('message');
+    const b64url = {
+      decode: s => Uint8Array.from(atob(s.replace(/-/g, '+').replace(/_/g, '/')), c => c.charCodeAt(0)),
+      encode: buf => btoa(String.fromCharCode(...new Uint8Array(buf))).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, ''),
+    };
+    function fail(msg) {
+      message.hidden = false;
+      message.classList.add('danger');
+      message.textContent = msg;
+    }
+    document.getElementById('unlock').addEventListener('click', async () => {
+      try {
+        const response = await fetch(base + '/api/pub/sso/prf/start', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ client_id: clientId }) });
+        if (!response.ok) return fail(await response.json());
+        const prfSid = response.headers.get('prf_sid');
+        const options = await response.json();
+        // The authenticator expects the salts as binary
+        const evalByCredential = options.publicKey.extensions.prf.evalByCredential;
+        for (const id in evalByCredential) evalByCredential[id] = { first: b64url.decode(evalByCredential[id].first) };
+        const assertion = await SimpleWebAuthnBrowser.startAuthentication({ optionsJSON: options.publicKey });
+        // Keep the PRF output in the browser; the server must never see it
+        const first = assertion.clientExtensionResults?.prf?.results?.first;
+        delete assertion.clientExtensionResults?.prf;
+        if (!first) return fail('This passkey did not return an encryption key.');
+        const finish = await fetch(base + '/api/pub/sso/prf/finish?' + query.toString(), { method: 'POST', headers: { 'Content-Type': 'application/json', 'prf_sid': prfSid }, body: JSON.stringify(assertion) });
+        const result = await finish.json();
+        if (!finish.ok) return fail(result);
+        window.location.href = result.redirect + '#prf=' + b64url.encode(first);
+      } catch (e) { fail(e.message); }
+    });
+  </script>
+</body>
+</html>
+`))
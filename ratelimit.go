@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit counts the requests to /api/pub/* in the session store, in fixed windows shared
+// by all replicas. The rate_limits setting (default from RATE_LIMITS) sets the limits:
+//
+//	ip     all public requests of an IP
+//	auth   requests of an IP to the endpoints that log in or send mail
+//	email  requests naming the same email in a realm: login_start, verify_code, ...
+//	realm  login_start requests of a realm, i.e. mail sent on its behalf
+//
+// Failed logins of an IP add a growing delay on top. Networks in the
+// rate_limit_allowlist setting are not limited.
+
+// rateLimit allows Limit requests per Window. A zero Limit disables it.
+type rateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+type rateLimits struct {
+	IP    rateLimit
+	Auth  rateLimit
+	Email rateLimit
+	Realm rateLimit
+}
+
+type rateLimitConfig struct {
+	limits    rateLimits
+	allowlist []*net.IPNet
+}
+
+var defaultRateLimits = rateLimits{
+	IP:    rateLimit{600, time.Minute},
+	Auth:  rateLimit{30, time.Minute},
+	Email: rateLimit{5, 15 * time.Minute},
+	Realm: rateLimit{1000, time.Hour},
+}
+
+type rateCheck struct {
+	key   string
+	limit rateLimit
+}
+
+const (
+	rateLimitFreeFailures = 3                // failures before delays start
+	rateLimitDelayBase    = time.Second      // delay after the first counted failure
+	rateLimitDelayMax     = time.Minute      // longest delay
+	rateLimitFailureTTL   = 15 * time.Minute // how long failures are remembered
+)
+
+// rateLimitedAuth are the endpoints that log in or send mail.
+var rateLimitedAuth = map[string]bool{
+	"/api/pub/login_start":            true,
+	"/api/pub/verify_login":           true,
+	"/api/pub/verify_code":            true,
+	"/api/pub/approve_login":          true,
+	"/api/pub/passkey_login_start":    true,
+	"/api/pub/passkey_login_finish":   true,
+	"/api/pub/passkey_register_start": true,
+	"/api/pub/recovery_login":         true,
+	"/api/pub/totp_login":             true,
+}
+
+// rateLimitedEmail are the endpoints with an email in their JSON body.
+var rateLimitedEmail = map[string]bool{
+	"/api/pub/login_start":    true,
+	"/api/pub/verify_code":    true,
+	"/api/pub/recovery_login": true,
+	"/api/pub/totp_login":     true,
+}
+
+// rateLimitedFailures are the endpoints whose 4xx responses count as failed logins.
+var rateLimitedFailures = map[string]bool{
+	"/api/pub/verify_login":         true,
+	"/api/pub/verify_code":          true,
+	"/api/pub/approve_login":        true,
+	"/api/pub/passkey_login_finish": true,
+	"/api/pub/recovery_login":       true,
+	"/api/pub/totp_login":           true,
+}
+
+var rateLimitStore atomic.Pointer[rateLimitConfig]
+
+// parseRateLimits parses limits like "ip=600/1m,email=5/15m". Scopes not named keep their
+// default.
+func parseRateLimits(s string) (rateLimits, error) {
+	limits := defaultRateLimits
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		scope, spec, ok := strings.Cut(part, "=")
+		limit, window, ok2 := strings.Cut(spec, "/")
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		d, err2 := time.ParseDuration(strings.TrimSpace(window))
+		if !ok || !ok2 || err != nil || err2 != nil || n < 0 || d < time.Second {
+			return limits, fmt.Errorf("invalid rate limit %q, use scope=limit/window like ip=600/1m", part)
+		}
+		l := rateLimit{Limit: n, Window: d}
+		switch strings.TrimSpace(scope) {
+		case "ip":
+			limits.IP = l
+		case "auth":
+			limits.Auth = l
+		case "email":
+			limits.Email = l
+		case "realm":
+			limits.Realm = l
+		default:
+			return limits, fmt.Errorf("unknown rate limit scope %q, use ip, auth, email or realm", scope)
+		}
+	}
+	return limits, nil
+}
+
+func validateRateLimits(s string) error {
+	_, err := parseRateLimits(s)
+	return err
+}
+
+// parseNetworks parses a comma-separated list of CIDRs and single IPs.
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network: %s", part)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			part = fmt.Sprintf("%s/%d", part, bits)
+		}
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", part)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func validateNetworks(s string) error {
+	_, err := parseNetworks(s)
+	return err
+}
+
+func inNetworks(ip string, networks []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadRateLimits reads the rate limit settings, keeping the old ones on error.
+func reloadRateLimits() {
+	limits, err := parseRateLimits(GetSetting("rate_limits", currentConfig().Limits.RateLimits))
+	if err != nil {
+		log.Printf("[ERRO] can't load rate limits: %s", err.Error())
+		if rateLimitStore.Load() != nil {
+			return
+		}
+		limits = defaultRateLimits
+	}
+	allowlist, err := parseNetworks(GetSetting("rate_limit_allowlist", strings.Join(currentConfig().Limits.RateLimitAllowlist, ",")))
+	if err != nil {
+		log.Printf("[ERRO] can't load rate limit allowlist: %s", err.Error())
+	}
+	rateLimitStore.Store(&rateLimitConfig{limits: limits, allowlist: allowlist})
+}
+
+func initRateLimits() {
+	reloadRateLimits()
+	go func() {
+		for range time.Tick(realmsRefresh) {
+			reloadRateLimits()
+		}
+	}()
+}
+
+// rateDelay returns the delay after a number of failures.
+func rateDelay(failures int) time.Duration {
+	n := failures - rateLimitFreeFailures
+	if n <= 0 {
+		return 0
+	}
+	if n > 10 {
+		return rateLimitDelayMax
+	}
+	return min(rateLimitDelayBase<<(n-1), rateLimitDelayMax)
+}
+
+// hitRateLimit counts a request against a limit. It returns how long to wait if the limit
+// is exceeded. Store errors let the request through.
+func hitRateLimit(key string, limit rateLimit) time.Duration {
+	if limit.Limit == 0 {
+		return 0
+	}
+	now := time.Now()
+	window := now.UnixNano() / int64(limit.Window)
+	windowKey := fmt.Sprintf("ratelimit:%s:%d", key, window)
+	n, err := store.Incr(windowKey, limit.Window)
+	if err != nil {
+		log.Printf("[ERRO] rate limiter: %s", err.Error())
+		return 0
+	}
+	if int(n) <= limit.Limit {
+		return 0
+	}
+	return time.Unix(0, (window+1)*int64(limit.Window)).Sub(now)
+}
+
+// emailOf returns the email in a JSON request body and restores the body for the handler.
+func emailOf(r *http.Request) string {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var req struct {
+		Email string `json:"email"`
+	}
+	json.Unmarshal(body, &req)
+	return strings.ToLower(strings.TrimSpace(req.Email))
+}
+
+// tooManyRequests writes a 429 with the seconds to wait in Retry-After.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	JSONResponse(w, "Too many requests, try again later", http.StatusTooManyRequests)
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// RateLimit applies the rate limits to /api/pub/* requests.
+func RateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := rateLimitStore.Load()
+		if config == nil || !strings.HasPrefix(r.URL.Path, "/api/pub/") || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r)
+		if inNetworks(ip, config.allowlist) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		realmID := realmOf(r).ID
+		path := r.URL.Path
+
+		failureKey := fmt.Sprintf("auth_failures:%s", ip)
+		if rateLimitedFailures[path] {
+			if delay, err := store.TTL("auth_delay:" + ip); err == nil && delay > 0 {
+				tooManyRequests(w, delay)
+				return
+			}
+		}
+
+		checks := []rateCheck{{"ip:" + ip, config.limits.IP}}
+		if rateLimitedAuth[path] {
+			checks = append(checks, rateCheck{"auth:" + ip, config.limits.Auth})
+		}
+		if rateLimitedEmail[path] {
+			if email := emailOf(r); email != "" {
+				checks = append(checks, rateCheck{"email:" + realmID + ":" + email, config.limits.Email})
+			}
+		}
+		if path == "/api/pub/login_start" {
+			checks = append(checks, rateCheck{"realm:" + realmID, config.limits.Realm})
+		}
+		for _, check := range checks {
+			if wait := hitRateLimit(check.key, check.limit); wait > 0 {
+				log.Printf("[WARN] rate limit %s exceeded on %s", check.key, path)
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+
+		if !rateLimitedFailures[path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.status >= 400 && rec.status < 500 {
+			if delay := rateDelay(CountFailure(failureKey, rateLimitFailureTTL)); delay > 0 {
+				store.Set("auth_delay:"+ip, "1", delay)
+			}
+		}
+	})
+}
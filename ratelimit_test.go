@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := parseRateLimits("email=3/10m, realm=0/1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.Email != (rateLimit{3, 10 * time.Minute}) || limits.Realm.Limit != 0 || limits.IP != defaultRateLimits.IP {
+		t.Errorf("parseRateLimits = %+v", limits)
+	}
+	for _, s := range []string{"ip=600", "ip=x/1m", "ip=1/1ms", "ip=-1/1m", "user=1/1m"} {
+		if _, err := parseRateLimits(s); err == nil {
+			t.Errorf("parseRateLimits(%q) accepted", s)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks("10.1.0.0/16, 203.0.113.7,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{"10.1.2.3": true, "10.2.0.1": false, "203.0.113.7": true, "203.0.113.8": false, "2001:db8::1": true, "x": false} {
+		if inNetworks(ip, networks) != want {
+			t.Errorf("inNetworks(%q) = %v", ip, !want)
+		}
+	}
+	if _, err := parseNetworks("10.0.0.0/33"); err == nil {
+		t.Error("parseNetworks accepted an invalid CIDR")
+	}
+}
+
+func TestRateDelay(t *testing.T) {
+	for failures, want := range map[int]time.Duration{0: 0, 3: 0, 4: time.Second, 6: 4 * time.Second, 10: time.Minute, 1000: time.Minute} {
+		if got := rateDelay(failures); got != want {
+			t.Errorf("rateDelay(%d) = %s; want %s", failures, got, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	// By default only loopback proxies are trusted
+	r := httptest.NewRequest(http.MethodGet, "/api/pub/login_start", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if got := clientIP(r); got != "10.0.0.2" {
+		t.Errorf("clientIP behind an unlisted private proxy = %s; want 10.0.0.2", got)
+	}
+
+	networks, _ := parseNetworks("127.0.0.0/8, ::1, 10.0.0.0/8")
+	setTestConfig(t, func(c *Config) { c.trustedProxies = networks })
+	cases := []struct {
+		remote, forwarded, want string
+	}{
+		{"198.51.100.1:1234", "", "198.51.100.1"},
+		{"198.51.100.1:1234", "203.0.113.7", "198.51.100.1"},               // untrusted peer can't pick its IP
+		{"10.0.0.2:1234", "203.0.113.7", "203.0.113.7"},                    // behind a trusted proxy
+		{"10.0.0.2:1234", "1.2.3.4, 203.0.113.7, 10.0.0.3", "203.0.113.7"}, // spoofed first hop ignored
+		{"10.0.0.2:1234", "10.0.0.4", "10.0.0.4"},                          // only trusted hops
+		{"[::1]:1234", "2001:db8::1", "2001:db8::1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/api/pub/login_start", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := clientIP(r); got != c.want {
+			t.Errorf("clientIP(%s, %q) = %s; want %s", c.remote, c.forwarded, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/elgs/gosqlcrud"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// Realms are independent tenants. Each has its own RP ID, origins, branding, users,
+// credentials and SSO clients. A request belongs to the realm whose hostnames contain the
+// request host, or to the realm named by a /r/{realm} path prefix. Everything else belongs
+// to the default realm, which is configured by the relying_party configuration and related_origins.
+//
+// Redis keys are isolated by prefixing every session ID, code and token minted for a realm
+// with "{realm}.". IDs of the default realm have no prefix, so existing sessions stay valid.
+
+const defaultRealmID = "default"
+
+var realmIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// RealmBranding is shown on the login page and in emails of a realm.
+type RealmBranding struct {
+	Title        string `json:"title,omitempty"`
+	LogoURL      string `json:"logo_url,omitempty"`
+	PrimaryColor string `json:"primary_color,omitempty"`
+}
+
+type Realm struct {
+	ID        string         `json:"id" db:"id" pk:"true"`
+	Name      *string        `json:"name" db:"name"`
+	RPID      *string        `json:"rp_id" db:"rp_id"`
+	Origins   *string        `json:"origins" db:"origins"`
+	Hostnames *string        `json:"hostnames" db:"hostnames"`
+	Branding  *RealmBranding `json:"branding" db:"branding"`
+	TOTPMode  *string        `json:"totp_mode" db:"totp_mode"`
+	// SignupPolicy decides whether unknown emails may create an account, see signup.go
+	SignupPolicy  *string    `json:"signup_policy" db:"signup_policy"`
+	SignupDomains *string    `json:"signup_domains" db:"signup_domains"`
+	Created       *time.Time `json:"created" db:"created"`
+	Updated       *time.Time `json:"updated" db:"updated"`
+}
+
+// defaultRealm returns the realm of the relying_party and policies configuration.
+func defaultRealm() *Realm {
+	config := currentConfig()
+	name, rpID := config.RelyingParty.Name, config.RelyingParty.ID
+	origins := strings.Join(allowedOrigins(), ",")
+	totpMode := GetSetting("totp_mode", config.Policies.TOTPMode)
+	signupPolicy := GetSetting("signup_policy", config.Policies.Signup)
+	signupDomains := GetSetting("signup_domains", strings.Join(config.Policies.SignupDomains, ","))
+	return &Realm{
+		ID:            defaultRealmID,
+		Name:          &name,
+		RPID:          &rpID,
+		Origins:       &origins,
+		Branding:      &RealmBranding{Title: name},
+		TOTPMode:      &totpMode,
+		SignupPolicy:  &signupPolicy,
+		SignupDomains: &signupDomains,
+	}
+}
+
+// DisplayName returns the realm's branded title, falling back to its name.
+func (realm *Realm) DisplayName() string {
+	if realm.Branding != nil && realm.Branding.Title != "" {
+		return realm.Branding.Title
+	}
+	if realm.Name != nil && *realm.Name != "" {
+		return *realm.Name
+	}
+	return realm.ID
+}
+
+func (realm *Realm) origins() []string {
+	if realm.Origins == nil {
+		return nil
+	}
+	return parseOrigins(*realm.Origins)
+}
+
+func (realm *Realm) totpMode() string {
+	if realm.TOTPMode == nil || *realm.TOTPMode == "" {
+		return TOTPModeOff
+	}
+	return *realm.TOTPMode
+}
+
+func (realm *Realm) hostnames() []string {
+	if realm.Hostnames == nil {
+		return nil
+	}
+	var result []string
+	for _, h := range strings.Split(*realm.Hostnames, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			result = append(result, h)
+		}
+	}
+	return result
+}
+
+// scope prefixes an ID minted for this realm.
+func (realm *Realm) scope(id string) string {
+	if realm.ID == defaultRealmID {
+		return id
+	}
+	return realm.ID + "." + id
+}
+
+// owns reports whether an ID presented by a client was minted for this realm.
+func (realm *Realm) owns(id string) bool {
+	i := strings.IndexByte(id, '.')
+	if realm.ID == defaultRealmID {
+		return i < 0
+	}
+	return i > 0 && id[:i] == realm.ID
+}
+
+// newID returns a random session ID in this realm.
+func (realm *Realm) newID() string {
+	return realm.scope(uuid.New().String())
+}
+
+// newCode returns a random code or token in this realm.
+func (realm *Realm) newCode() string {
+	return realm.scope(generateCode())
+}
+
+func validateRealm(realm *Realm) error {
+	if !realmIDPattern.MatchString(realm.ID) || realm.ID == defaultRealmID {
+		return fmt.Errorf("invalid realm id: %s", realm.ID)
+	}
+	if realm.RPID == nil || *realm.RPID == "" {
+		return fmt.Errorf("rp_id is required")
+	}
+	if realm.Origins == nil || len(realm.origins()) == 0 {
+		return fmt.Errorf("origins are required")
+	}
+	if !slices.Contains(totpModes, realm.totpMode()) {
+		return fmt.Errorf("invalid totp_mode: %s", realm.totpMode())
+	}
+	if !slices.Contains(signupPolicies, realm.signupPolicy()) {
+		return fmt.Errorf("invalid signup_policy: %s", realm.signupPolicy())
+	}
+	if realm.SignupDomains != nil {
+		if err := validateDomains(*realm.SignupDomains); err != nil {
+			return err
+		}
+	}
+	if realm.signupPolicy() == SignupAllowedDomains && len(realm.signupDomains()) == 0 {
+		return fmt.Errorf("signup_domains are required for the allowed_domains policy")
+	}
+	return validateOrigins(*realm.Origins)
+}
+
+////////////////////////////
+//                        //
+//    Realm Store         //
+//                        //
+////////////////////////////
+
+// realmTable is an immutable snapshot of all realms and their WebAuthn instances.
+type realmTable struct {
+	realms   map[string]*Realm
+	webAuthn map[string]*webauthn.WebAuthn
+}
+
+var realmStore atomic.Pointer[realmTable]
+
+// realmsRefresh is how often each instance reloads the realms, so that a change made
+// through another replica takes effect everywhere.
+const realmsRefresh = time.Minute
+
+func newWebAuthn(realm *Realm) (*webauthn.WebAuthn, error) {
+	wconfig := &webauthn.Config{
+		RPDisplayName: realm.DisplayName(), // Display Name for your site
+		RPID:          *realm.RPID,         // Generally the FQDN for your site
+		RPOrigins:     realm.origins(),     // The origin URLs allowed for WebAuthn, including related origins
+	}
+	return webauthn.New(wconfig)
+}
+
+// loadRealms builds a realm table from the configuration and the realm table. A realm with
+// an invalid configuration is skipped; the default realm must be valid.
+func loadRealms() (*realmTable, error) {
+	table := &realmTable{
+		realms:   map[string]*Realm{},
+		webAuthn: map[string]*webauthn.WebAuthn{},
+	}
+	realm := defaultRealm()
+	wa, err := newWebAuthn(realm)
+	if err != nil {
+		return nil, err
+	}
+	table.realms[realm.ID] = realm
+	table.webAuthn[realm.ID] = wa
+
+	realms, err := GetAllRealms()
+	if err != nil {
+		return nil, err
+	}
+	for _, realm := range realms {
+		if realm.ID == defaultRealmID || realm.RPID == nil {
+			continue
+		}
+		wa, err := newWebAuthn(realm)
+		if err != nil {
+			log.Printf("[ERRO] can't load realm %s: %s", realm.ID, err.Error())
+			continue
+		}
+		table.realms[realm.ID] = realm
+		table.webAuthn[realm.ID] = wa
+	}
+	return table, nil
+}
+
+func initPasskeyStore() {
+	table, err := loadRealms()
+	if err != nil {
+		fmt.Printf("[FATA] %s", err.Error())
+		os.Exit(1)
+	}
+	realmStore.Store(table)
+	go watchRealms()
+}
+
+// reloadPasskeyStore reloads the realms and their WebAuthn configuration, keeping the old
+// ones on error.
+func reloadPasskeyStore() {
+	table, err := loadRealms()
+	if err != nil {
+		log.Printf("[ERRO] can't reload realms: %s", err.Error())
+		return
+	}
+	realmStore.Store(table)
+}
+
+func watchRealms() {
+	for range time.Tick(realmsRefresh) {
+		reloadPasskeyStore()
+	}
+}
+
+// resolve returns the realm of a request and the path prefix that selected it, or nil if
+// the path names an unknown realm.
+func (table *realmTable) resolve(r *http.Request) (*Realm, string) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/r/"); ok {
+		id, _, _ := strings.Cut(rest, "/")
+		realm := table.realms[id]
+		if realm == nil || id == defaultRealmID {
+			return nil, ""
+		}
+		return realm, "/r/" + id
+	}
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, realm := range table.realms {
+		if slices.Contains(realm.hostnames(), host) {
+			return realm, ""
+		}
+	}
+	return table.realms[defaultRealmID], ""
+}
+
+type realmContextKey struct{}
+
+type realmContext struct {
+	realm  *Realm
+	prefix string
+}
+
+// Realms resolves the realm of each request and strips its path prefix.
+func Realms(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		table := realmStore.Load()
+		realm, prefix := table.resolve(r)
+		if realm == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if prefix != "" && r.URL.Path == prefix {
+			http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), realmContextKey{}, &realmContext{realm: realm, prefix: prefix}))
+		if prefix != "" {
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// realmOf returns the realm of a request. Requests that didn't pass through Realms belong
+// to the default realm.
+func realmOf(r *http.Request) *Realm {
+	if rc, ok := r.Context().Value(realmContextKey{}).(*realmContext); ok {
+		return rc.realm
+	}
+	if table := realmStore.Load(); table != nil {
+		return table.realms[defaultRealmID]
+	}
+	return defaultRealm()
+}
+
+// realmPath prefixes an absolute path with the realm's path prefix, if the request used one.
+func realmPath(r *http.Request, path string) string {
+	if rc, ok := r.Context().Value(realmContextKey{}).(*realmContext); ok {
+		return rc.prefix + path
+	}
+	return path
+}
+
+// getWebAuthn returns the WebAuthn instance of the request's realm.
+func getWebAuthn(r *http.Request) *webauthn.WebAuthn {
+	return realmStore.Load().webAuthn[realmOf(r).ID]
+}
+
+// realmHeader returns a ceremony session ID from a request header, or "" if it belongs to
+// another realm.
+func realmHeader(r *http.Request, name string) string {
+	sid := r.Header.Get(name)
+	if !realmOf(r).owns(sid) {
+		return ""
+	}
+	return sid
+}
+
+// getRealmUser returns a user of the request's realm.
+func getRealmUser(r *http.Request, id string) (*PasskeyUser, error) {
+	user, err := repo.GetUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if user.RealmID != realmOf(r).ID {
+		return nil, fmt.Errorf("user not found")
+	}
+	return user, nil
+}
+
+// getRealmClient returns an SSO client of the request's realm.
+func getRealmClient(r *http.Request, id string) (*SSOClient, error) {
+	client, err := repo.GetSSOClient(id)
+	if err != nil {
+		return nil, err
+	}
+	if client.RealmID != realmOf(r).ID {
+		return nil, fmt.Errorf("client not found")
+	}
+	return client, nil
+}
+
+// GetRealm returns the public view of the current realm for the frontend.
+// GET /api/pub/realm
+func GetRealm(w http.ResponseWriter, r *http.Request) {
+	realm := realmOf(r)
+	JSONResponse(w, map[string]any{
+		"id":        realm.ID,
+		"name":      realm.DisplayName(),
+		"branding":  realm.Branding,
+		"totp_mode": realm.totpMode(),
+	}, http.StatusOK)
+}
+
+////////////////////////////
+//                        //
+//    Realm Model         //
+//                        //
+////////////////////////////
+
+func GetAllRealms() ([]*Realm, error) {
+	realms := []*Realm{}
+	err := gosqlcrud.QueryToStructs(db, &realms, "SELECT * FROM realm ORDER BY id")
+	return realms, err
+}
+
+func GetRealmByID(id string) (*Realm, error) {
+	realm := &Realm{ID: id}
+	if err := gosqlcrud.Retrieve(db, realm, "realm"); err != nil {
+		return nil, err
+	}
+	realm.ID = id
+	return realm, nil
+}
+
+func CreateRealm(realm *Realm) error {
+	now := time.Now()
+	realm.Created = &now
+	realm.Updated = &now
+	result, err := gosqlcrud.Create(db, realm, "realm")
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no rows affected")
+	}
+	return nil
+}
+
+func UpdateRealm(realm *Realm) error {
+	now := time.Now()
+	realm.Created = nil
+	realm.Updated = &now
+	_, err := gosqlcrud.Update(db, realm, "realm")
+	return err
+}
+
+func DeleteRealm(id string) error {
+	_, err := db.Exec("DELETE FROM realm WHERE id = ?", id)
+	return err
+}
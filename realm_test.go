@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func testRealmTable() *realmTable {
+	hostnames := "login.acme.example, ACME.example"
+	return &realmTable{
+		realms: map[string]*Realm{
+			defaultRealmID: {ID: defaultRealmID},
+			"acme":         {ID: "acme", Hostnames: &hostnames},
+			"beta":         {ID: "beta"},
+		},
+		webAuthn: map[string]*webauthn.WebAuthn{},
+	}
+}
+
+func TestRealmResolve(t *testing.T) {
+	table := testRealmTable()
+	cases := []struct {
+		url, realm, prefix string
+	}{
+		{"http://login.acme.example/api/pub/realm", "acme", ""},
+		{"http://acme.example:8443/", "acme", ""},
+		{"http://other.example/r/beta/api/pub/realm", "beta", "/r/beta"},
+		{"http://other.example/", defaultRealmID, ""},
+		{"http://other.example/r/missing/", "", ""},
+		{"http://other.example/r/default/", "", ""},
+	}
+	for _, c := range cases {
+		realm, prefix := table.resolve(httptest.NewRequest("GET", c.url, nil))
+		got := ""
+		if realm != nil {
+			got = realm.ID
+		}
+		if got != c.realm || prefix != c.prefix {
+			t.Errorf("resolve(%s) = %q, %q; want %q, %q", c.url, got, prefix, c.realm, c.prefix)
+		}
+	}
+}
+
+func TestRealmOwns(t *testing.T) {
+	def := &Realm{ID: defaultRealmID}
+	acme := &Realm{ID: "acme"}
+
+	id := acme.newID()
+	if !acme.owns(id) || def.owns(id) {
+		t.Errorf("acme ID %q: acme.owns = %t, default.owns = %t", id, acme.owns(id), def.owns(id))
+	}
+	code := def.newCode()
+	if !def.owns(code) || acme.owns(code) {
+		t.Errorf("default code %q: default.owns = %t, acme.owns = %t", code, def.owns(code), acme.owns(code))
+	}
+	if acme.owns("acmex.123") || acme.owns(".123") {
+		t.Error("acme owns IDs of other realms")
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elgs/gosqlcrud"
+	"github.com/google/uuid"
+)
+
+// Recovery codes let a user who lost all passkeys back in without the magic link. A code is
+// shown once when generated and only its hash is stored. Using one starts a recovery session
+// in its own cookie, which none of the logged-in endpoints accept; it only lets the user
+// register a new passkey, and ends when they do.
+
+const recoveryCodeCount = 10
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCode returns a random code of 20 base32 characters (100 bits), formatted as
+// xxxxx-xxxxx-xxxxx-xxxxx. That is too long to guess, so a fast hash is enough to store it.
+func newRecoveryCode() string {
+	b := make([]byte, 13)
+	rand.Read(b)
+	code := strings.ToLower(recoveryEncoding.EncodeToString(b))[:20]
+	return code[:5] + "-" + code[5:10] + "-" + code[10:15] + "-" + code[15:]
+}
+
+// normalizeRecoveryCode removes the separator and whitespace a user may have typed.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+}
+
+// hashRecoveryCode hashes a code for storage. The user ID is mixed in, so the same code
+// issued to two users doesn't hash the same.
+func hashRecoveryCode(userID, code string) string {
+	sum := sha256.Sum256([]byte(userID + ":" + normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+////////////////////////////
+//                        //
+//    Recovery Codes      //
+//                        //
+////////////////////////////
+
+// GetRecoveryCodes returns how many unused recovery codes the user has.
+// GET /api/recovery_codes
+func GetRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	session, err := GetLoginSession(getSessionID(r))
+	if err != nil {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	remaining, created, err := CountRecoveryCodes(string(session.UserID))
+	if err != nil {
+		log.Printf("[ERRO] can't count recovery codes: %s", err.Error())
+		JSONResponse(w, "Failed to get recovery codes", http.StatusInternalServerError)
+		return
+	}
+	result := map[string]any{"remaining": remaining}
+	if created != nil {
+		result["created"] = created.Format("2006-01-02 15:04")
+	}
+	JSONResponse(w, result, http.StatusOK)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes and returns the new ones. They
+// are not shown again. Requires a recent step-up.
+// POST /api/recovery_codes
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	session := requireStepUp(w, r)
+	if session == nil {
+		return
+	}
+	userID := string(session.UserID)
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+	}
+	if err := ReplaceRecoveryCodes(userID, codes); err != nil {
+		log.Printf("[ERRO] can't save recovery codes: %s", err.Error())
+		JSONResponse(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+	recordSecurityEvent(r, userID, "recovery_codes_generated", fmt.Sprintf("%d codes", len(codes)))
+	log.Printf("[INFO] regenerated recovery codes for user %s", userID)
+	JSONResponse(w, codes, http.StatusOK)
+}
+
+////////////////////////////
+//                        //
+//    RecoveryLogin       //
+//                        //
+////////////////////////////
+
+// RecoveryLogin redeems a recovery code and starts a recovery session in which the user can
+// register a new passkey.
+// POST /api/pub/recovery_login {"email": "...", "code": "..."}
+func RecoveryLogin(w http.ResponseWriter, r *http.Request) {
+	var req Req
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Email == "" || req.Code == "" {
+		JSONResponse(w, "Email and recovery code are required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := repo.GetUserByEmail(realmOf(r).ID, req.Email)
+	if err != nil {
+		JSONResponse(w, "Invalid recovery code", http.StatusBadRequest)
+		return
+	}
+	if err := UseRecoveryCode(user.ID, req.Code); err != nil {
+		log.Printf("[WARN] recovery code rejected for user %s: %s", user.ID, err.Error())
+		JSONResponse(w, "Invalid recovery code", http.StatusBadRequest)
+		return
+	}
+
+	sid := realmOf(r).newID()
+	ttl := currentConfig().TTL.RecoverySession
+	if err := SaveRecoverySession(sid, user.ID, ttl); err != nil {
+		log.Printf("[ERRO] can't save recovery session: %s", err.Error())
+		JSONResponse(w, "Failed to start recovery", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "recovery_session",
+		Value:    sid,
+		Path:     realmPath(r, "/"),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(ttl.Seconds()),
+	})
+
+	ip := clientIP(r)
+	recordSecurityEvent(r, user.ID, "recovery_code_used", "")
+	notifyRecoveryCodeUsed(r, user, ip, r.UserAgent())
+	log.Printf("[INFO] recovery session started for user %s", user.ID)
+	JSONResponse(w, map[string]any{"email": user.Email}, http.StatusOK)
+}
+
+// getRecoveryUserID returns the recovery session ID and its user, or "" if the request has none.
+func getRecoveryUserID(r *http.Request) (string, string) {
+	cookie, err := r.Cookie("recovery_session")
+	if err != nil || !realmOf(r).owns(cookie.Value) {
+		return "", ""
+	}
+	userID, err := GetRecoverySession(cookie.Value)
+	if err != nil {
+		return "", ""
+	}
+	return cookie.Value, userID
+}
+
+// endRecoverySession ends the recovery session once the user registered a passkey.
+func endRecoverySession(w http.ResponseWriter, r *http.Request, sid string) {
+	DeleteRecoverySession(sid)
+	http.SetCookie(w, &http.Cookie{Name: "recovery_session", Value: "", Path: realmPath(r, "/"), HttpOnly: true, SameSite: http.SameSiteStrictMode, MaxAge: -1})
+}
+
+// recordSecurityEvent stores a security event for the user with the request's IP and browser.
+func recordSecurityEvent(r *http.Request, userID, eventType, detail string) {
+	ip := clientIP(r)
+	userAgent := r.UserAgent()
+	event := &SecurityEvent{
+		UserID:    &userID,
+		Type:      &eventType,
+		IP:        &ip,
+		UserAgent: &userAgent,
+	}
+	if detail != "" {
+		event.Detail = &detail
+	}
+	if err := CreateSecurityEvent(event); err != nil {
+		log.Printf("[ERRO] can't record security event: %s", err.Error())
+	}
+}
+
+// notifyRecoveryCodeUsed emails the user that one of their recovery codes was used.
+func notifyRecoveryCodeUsed(r *http.Request, user *PasskeyUser, ip, userAgent string) {
+	remaining, _, _ := CountRecoveryCodes(user.ID)
+	err := SendMail(r, user.Email, MailSecurityAlert, mailDedupeKey(time.Hour, "recovery_code_used", user.ID, fmt.Sprint(remaining)), time.Time{}, map[string]any{
+		"Kind":      "recovery_code_used",
+		"IP":        ip,
+		"Browser":   userAgent,
+		"Remaining": remaining,
+	})
+	if err != nil {
+		log.Printf("[ERRO] can't send recovery notification: %s", err.Error())
+	}
+}
+
+////////////////////////////
+//                        //
+//    Recovery Model      //
+//                        //
+////////////////////////////
+
+type RecoveryCode struct {
+	ID       string     `json:"id" db:"id" pk:"true"`
+	UserID   *string    `json:"user_id" db:"user_id"`
+	CodeHash *string    `json:"-" db:"code_hash"`
+	Used     *time.Time `json:"used" db:"used"`
+	Created  *time.Time `json:"created" db:"created"`
+}
+
+// ReplaceRecoveryCodes deletes all recovery codes of the user and stores the hashes of codes.
+func ReplaceRecoveryCodes(userID string, codes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM user_recovery_code WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, code := range codes {
+		_, err := tx.Exec("INSERT INTO user_recovery_code (id, user_id, code_hash, created) VALUES (?, ?, ?, ?)",
+			uuid.New().String(), userID, hashRecoveryCode(userID, code), now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks an unused code of the user as used. The update is conditional, so
+// a code redeemed by two concurrent requests only works once.
+func UseRecoveryCode(userID, code string) error {
+	result, err := db.Exec("UPDATE user_recovery_code SET used = ? WHERE user_id = ? AND code_hash = ? AND used IS NULL",
+		time.Now(), userID, hashRecoveryCode(userID, code))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("recovery code not found or already used")
+	}
+	return nil
+}
+
+// CountRecoveryCodes returns the number of unused codes and when the current set was created.
+func CountRecoveryCodes(userID string) (int, *time.Time, error) {
+	codes := []RecoveryCode{}
+	err := gosqlcrud.QueryToStructs(db, &codes, "SELECT * FROM user_recovery_code WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, nil, err
+	}
+	remaining := 0
+	var created *time.Time
+	for _, c := range codes {
+		if c.Used == nil {
+			remaining++
+		}
+		created = c.Created
+	}
+	return remaining, created, nil
+}
+
+func SaveRecoverySession(sessionID, userID string, ttl time.Duration) error {
+	if err := store.Set(fmt.Sprintf("recovery_session:%s", sessionID), userID, ttl); err != nil {
+		return err
+	}
+	return store.SAdd(fmt.Sprintf("user_recovery_sessions:%s", userID), sessionID)
+}
+
+func GetRecoverySession(sessionID string) (string, error) {
+	return store.Get(fmt.Sprintf("recovery_session:%s", sessionID))
+}
+
+func DeleteRecoverySession(sessionID string) error {
+	return store.Del(fmt.Sprintf("recovery_session:%s", sessionID))
+}
+
+// DeleteUserRecoverySessions ends all recovery sessions of a user.
+func DeleteUserRecoverySessions(userID string) error {
+	key := fmt.Sprintf("user_recovery_sessions:%s", userID)
+	ids, err := store.SMembers(key)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := DeleteRecoverySession(id); err != nil {
+			return err
+		}
+	}
+	return store.Del(key)
+}
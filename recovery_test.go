@@ -0,0 +1,33 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNewRecoveryCode(t *testing.T) {
+	pattern := regexp.MustCompile(`^[a-z2-7]{5}(-[a-z2-7]{5}){3}$`)
+	seen := map[string]bool{}
+	for range 100 {
+		code := newRecoveryCode()
+		if !pattern.MatchString(code) {
+			t.Fatalf("newRecoveryCode = %q; want xxxxx-xxxxx-xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Fatalf("newRecoveryCode repeated %q", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := hashRecoveryCode("user-1", "abcde-fghij")
+	for _, typed := range []string{"ABCDE-FGHIJ", " abcdefghij ", "abcde fghij"} {
+		if got := hashRecoveryCode("user-1", typed); got != want {
+			t.Errorf("hashRecoveryCode(%q) differs from the generated code", typed)
+		}
+	}
+	if hashRecoveryCode("user-2", "abcde-fghij") == want {
+		t.Error("hashRecoveryCode is the same for two users")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Related origins let passkeys created for the RP ID be used on other domains. Browsers that
+// support WebAuthn Related Origin Requests fetch https://{rp_id}/.well-known/webauthn and
+// allow the ceremony if the calling origin is listed. For the default realm the list comes
+// from the related_origins setting (default relying_party.related_origins), so admins can
+// change it without a restart. Other realms list them in their origins.
+
+// parseOrigins splits a comma or newline separated list of origins.
+func parseOrigins(s string) []string {
+	var result []string
+	for _, o := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		o = strings.TrimRight(strings.TrimSpace(o), "/")
+		if o != "" && !slices.Contains(result, o) {
+			result = append(result, o)
+		}
+	}
+	return result
+}
+
+// validateOrigins checks that every entry is a bare https origin, or http on localhost.
+func validateOrigins(s string) error {
+	for _, o := range parseOrigins(s) {
+		u, err := url.Parse(o)
+		if err != nil || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("invalid origin: %s", o)
+		}
+		if u.Scheme != "https" && !(u.Scheme == "http" && u.Hostname() == "localhost") {
+			return fmt.Errorf("origin must use https: %s", o)
+		}
+	}
+	return nil
+}
+
+// relatedOrigins returns the admin-managed related origins.
+func relatedOrigins() []string {
+	return parseOrigins(GetSetting("related_origins", strings.Join(currentConfig().RelyingParty.RelatedOrigins, ",")))
+}
+
+// allowedOrigins returns the configured origins followed by the related origins.
+func allowedOrigins() []string {
+	result := parseOrigins(strings.Join(currentConfig().RelyingParty.Origins, ","))
+	for _, o := range relatedOrigins() {
+		if !slices.Contains(result, o) {
+			result = append(result, o)
+		}
+	}
+	return result
+}
+
+// WellKnownWebAuthn serves the related origins document of the request's realm.
+// GET /.well-known/webauthn
+func WellKnownWebAuthn(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(realmsRefresh.Seconds())))
+	JSONResponse(w, map[string]any{"origins": realmOf(r).origins()}, http.StatusOK)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseOrigins(t *testing.T) {
+	got := parseOrigins(" https://a.example.com/,https://b.example.com\nhttps://a.example.com\r\n\n")
+	want := []string{"https://a.example.com", "https://b.example.com"}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseOrigins = %v; want %v", got, want)
+	}
+}
+
+func TestValidateOrigins(t *testing.T) {
+	valid := []string{"", "https://a.example.com", "https://a.example.com:8443,https://b.example.org", "http://localhost:8080"}
+	for _, v := range valid {
+		if err := validateOrigins(v); err != nil {
+			t.Errorf("validateOrigins(%q) = %v; want nil", v, err)
+		}
+	}
+	invalid := []string{"http://a.example.com", "https://a.example.com/path", "a.example.com", "https://a.example.com?x=1"}
+	for _, v := range invalid {
+		if err := validateOrigins(v); err == nil {
+			t.Errorf("validateOrigins(%q) = nil; want error", v)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import "time"
+
+// Repository is where users, their credentials, login tokens and SSO clients are stored.
+// The implementation is sqlRepository, over the database chosen by DB_DRIVER, see db.go.
+type Repository interface {
+	UserRepository
+	CredentialRepository
+	LoginRepository
+	ClientRepository
+}
+
+type UserRepository interface {
+	CreateUser(realmID, email, name, displayName string) (*PasskeyUser, error)
+	InsertUser(user *PasskeyUser) error
+	GetUser(id string) (*PasskeyUser, error)
+	GetUserByEmail(realmID, email string) (*PasskeyUser, error)
+	SaveUser(user *PasskeyUser) error
+	GetAllUsers(realmID string) ([]PasskeyUser, error)
+	GetAdminUsers(realmID string) ([]PasskeyUser, error)
+	DeleteUser(id string) error
+}
+
+type CredentialRepository interface {
+	GetCredentials(userID string) ([]*PasskeyUserCredential, error)
+	GetCredential(id string) (*PasskeyUserCredential, error)
+	CreateCredential(cred *PasskeyUserCredential) error
+	UpdateCredential(cred *PasskeyUserCredential) error
+	DeleteCredential(id string) error
+	UpdateCredentialLabel(id, label string) error
+	MarkCredentialSuspect(id string, disable bool) error
+	SetCredentialPRFSalt(id string) error
+	CreateCredentialUsage(usage *CredentialUsage) error
+	GetCredentialUsage(credentialID string, limit int) ([]CredentialUsage, error)
+}
+
+type LoginRepository interface {
+	CreateUserLogin(realmID, email, token, code string, expires time.Time) (*UserLogin, error)
+	GetUserLoginByToken(token string) (*UserLogin, error)
+	GetUserLoginByCode(realmID, email string) (*UserLogin, error)
+	GetUserLoginByBinding(realmID, bindingHash string) (*UserLogin, error)
+	CountUserLoginAttempt(id string, maxAttempts int) error
+	UseUserLogin(id string) error
+	BindUserLogin(id, bindingHash, ip, userAgent string) error
+	SetUserLoginSSORequest(id, ssoRequest string) error
+	ApproveUserLogin(id string) error
+}
+
+type ClientRepository interface {
+	GetSSOClient(clientID string) (*SSOClient, error)
+	GetAllSSOClients(realmID string) ([]*SSOClient, error)
+	CreateSSOClient(client *SSOClient) error
+	UpdateSSOClient(client *SSOClient) error
+	DeleteSSOClient(realmID, id string) error
+}
+
+// sqlRepository stores in MySQL/MariaDB, PostgreSQL or SQLite. Its queries are portable
+// and rewritten for the database by db.
+type sqlRepository struct {
+	db *sqlDB
+}
+
+func newSQLRepository(db *sqlDB) *sqlRepository {
+	return &sqlRepository{db: db}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// An account is created when an unknown email first verifies a magic link or login code,
+// never when the link is requested. Whether an unknown email may sign up at all is decided
+// by the realm's sign-up policy, from Realm.SignupPolicy or, for the default realm, the
+// signup_policy setting.
+
+const (
+	SignupOpen            = "open"             // any email
+	SignupInviteOnly      = "invite_only"      // no sign-up, accounts are created by invitations
+	SignupAllowedDomains  = "allowed_domains"  // emails of the domains in signup_domains
+	SignupBlockDisposable = "block_disposable" // any email except disposable ones
+)
+
+var signupPolicies = []string{SignupOpen, SignupInviteOnly, SignupAllowedDomains, SignupBlockDisposable}
+
+//go:embed disposable_domains.txt
+var builtinDisposableDomains string
+
+// loadDisposableDomains returns the domains of throwaway mail services, from file or the
+// built-in list.
+func loadDisposableDomains(file string) (map[string]bool, error) {
+	list := builtinDisposableDomains
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		list = string(b)
+	}
+	domains := map[string]bool{}
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains[line] = true
+		}
+	}
+	return domains, nil
+}
+
+func (realm *Realm) signupPolicy() string {
+	if realm.SignupPolicy == nil || *realm.SignupPolicy == "" {
+		return SignupOpen
+	}
+	return *realm.SignupPolicy
+}
+
+func (realm *Realm) signupDomains() []string {
+	if realm.SignupDomains == nil {
+		return nil
+	}
+	return parseDomains(*realm.SignupDomains)
+}
+
+// parseDomains parses a comma-separated list of email domains.
+func parseDomains(s string) []string {
+	var domains []string
+	for _, d := range strings.Split(s, ",") {
+		if d = strings.ToLower(strings.Trim(strings.TrimSpace(d), "@.")); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+func validateDomains(s string) error {
+	for _, d := range parseDomains(s) {
+		if strings.ContainsAny(d, "@/ ") || !strings.Contains(d, ".") {
+			return fmt.Errorf("invalid domain: %s", d)
+		}
+	}
+	return nil
+}
+
+// emailDomain returns the lower-cased domain of an email address.
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(email[at+1:]))
+}
+
+// domainIn reports whether domain or one of its parent domains is in domains.
+func domainIn(domain string, domains func(string) bool) bool {
+	for domain != "" {
+		if domains(domain) {
+			return true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			return false
+		}
+		domain = parent
+	}
+	return false
+}
+
+// signupAllowed reports whether an unknown email may create an account in the realm.
+func signupAllowed(realm *Realm, email string) bool {
+	domain := emailDomain(email)
+	if domain == "" {
+		return false
+	}
+	switch realm.signupPolicy() {
+	case SignupOpen:
+		return true
+	case SignupAllowedDomains:
+		allowed := realm.signupDomains()
+		return domainIn(domain, func(d string) bool { return slices.Contains(allowed, d) })
+	case SignupBlockDisposable:
+		disposable := currentConfig().disposableDomains
+		return !domainIn(domain, func(d string) bool { return disposable[d] })
+	default:
+		return false
+	}
+}
+
+// mayLogIn reports whether a login link or code may be sent to the email: it has an account
+// or may sign up.
+func mayLogIn(r *http.Request, email string) bool {
+	realm := realmOf(r)
+	if _, err := repo.GetUserByEmail(realm.ID, email); err == nil {
+		return true
+	}
+	return signupAllowed(realm, email)
+}
+
+// loginUser returns the user of a verified email, creating the account if the email may
+// sign up.
+func loginUser(r *http.Request, email string) (*PasskeyUser, error) {
+	realm := realmOf(r)
+	if user, err := repo.GetUserByEmail(realm.ID, email); err == nil {
+		return user, nil
+	}
+	if !signupAllowed(realm, email) {
+		return nil, fmt.Errorf("sign-up not allowed for %s", email)
+	}
+	user, err := repo.CreateUser(realm.ID, email, email, email)
+	if err != nil {
+		// Another request may have created it in the meantime
+		if user, err := repo.GetUserByEmail(realm.ID, email); err == nil {
+			return user, nil
+		}
+		return nil, fmt.Errorf("can't create user: %w", err)
+	}
+	log.Printf("[INFO] created new user for email: %s", email)
+	return user, nil
+}
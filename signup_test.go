@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestSignupAllowed(t *testing.T) {
+	realm := func(policy, domains string) *Realm {
+		return &Realm{ID: "acme", SignupPolicy: &policy, SignupDomains: &domains}
+	}
+	cases := []struct {
+		realm *Realm
+		email string
+		want  bool
+	}{
+		{&Realm{ID: "acme"}, "a@example.com", true},
+		{realm(SignupOpen, ""), "a@mailinator.com", true},
+		{realm(SignupOpen, ""), "not-an-email", false},
+		{realm(SignupInviteOnly, ""), "a@example.com", false},
+		{realm(SignupAllowedDomains, "example.com, @acme.example"), "a@Example.COM", true},
+		{realm(SignupAllowedDomains, "example.com, @acme.example"), "a@eu.acme.example", true},
+		{realm(SignupAllowedDomains, "example.com, @acme.example"), "a@notexample.com", false},
+		{realm(SignupBlockDisposable, ""), "a@example.com", true},
+		{realm(SignupBlockDisposable, ""), "a@mailinator.com", false},
+		{realm(SignupBlockDisposable, ""), "a@x.yopmail.com", false},
+		{realm("unknown", ""), "a@example.com", false},
+	}
+	for _, c := range cases {
+		if got := signupAllowed(c.realm, c.email); got != c.want {
+			t.Errorf("signupAllowed(%s, %q) = %v; want %v", c.realm.signupPolicy(), c.email, got, c.want)
+		}
+	}
+}
+
+func TestValidateDomains(t *testing.T) {
+	if err := validateDomains("example.com, @acme.example"); err != nil {
+		t.Error(err)
+	}
+	for _, s := range []string{"localhost", "a@example.com", "example.com/x"} {
+		if validateDomains(s) == nil {
+			t.Errorf("validateDomains(%q) accepted", s)
+		}
+	}
+}
@@ -5,20 +5,22 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
-var ssoTokenTTL = time.Hour
-
 type SSOTokenData struct {
-	UserID    string `json:"user_id"`
-	ClientID  string `json:"client_id"`
-	SessionID string `json:"session_id"`
-	UserAgent string `json:"user_agent"`
-	Created   string `json:"created"`
+	UserID    string   `json:"user_id"`
+	ClientID  string   `json:"client_id"`
+	SessionID string   `json:"session_id"`
+	UserAgent string   `json:"user_agent"`
+	Created   string   `json:"created"`
+	AuthTime  int64    `json:"auth_time,omitempty"`
+	AMR       []string `json:"amr,omitempty"`
 }
 
 func generateCode() string {
@@ -28,16 +30,42 @@ func generateCode() string {
 }
 
 // SSOAuthorize handles the SSO authorization request.
-// GET /api/pub/sso/authorize?client_id=X&redirect_uri=URI&state=STATE[&sid=SID]
+// GET /api/pub/sso/authorize?client_id=X&redirect_uri=URI&state=STATE[&max_age=SECONDS][&prompt=login][&prf=1]
 //
-// If sid is provided and valid, it generates an auth code and redirects to redirect_uri.
+// If the sso_session cookie is valid, it generates an auth code and redirects to redirect_uri.
 // Otherwise, it redirects to the login page with SSO params preserved.
+// prompt=login, or a session authenticated more than max_age seconds ago, sends the user to
+// the login page with the time of the request as sso_auth_after. The session is kept, so a
+// cross-site request can't log the user out; the login page comes back with auth_after, and
+// the code is only issued for a login newer than that.
+// prf=1 sends the user through a passkey assertion that evaluates the PRF extension; the
+// output is appended to redirect_uri as the #prf= fragment.
 func SSOAuthorize(w http.ResponseWriter, r *http.Request) {
 	clientID := r.URL.Query().Get("client_id")
 	redirectURI := r.URL.Query().Get("redirect_uri")
 	state := r.URL.Query().Get("state")
+	prompt := r.URL.Query().Get("prompt")
+	prf := r.URL.Query().Get("prf") == "1"
+	maxAge := -1
+	if v := r.URL.Query().Get("max_age"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid max_age", http.StatusBadRequest)
+			return
+		}
+		maxAge = n
+	}
+	var authAfter int64
+	if v := r.URL.Query().Get("auth_after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid auth_after", http.StatusBadRequest)
+			return
+		}
+		authAfter = n
+	}
 
-	client, err := GetSSOClient(clientID)
+	client, err := getRealmClient(r, clientID)
 	if err != nil {
 		http.Error(w, "Invalid client_id", http.StatusBadRequest)
 		return
@@ -51,32 +79,120 @@ func SSOAuthorize(w http.ResponseWriter, r *http.Request) {
 	// Check if user already has a valid session via cookie
 	sid := getSessionID(r)
 	if sid != "" {
-		session, err := GetSession(sid)
+		session, err := GetLoginSession(sid)
+		if err == nil && !session.Expires.Before(time.Now()) && needsReauthentication(session, prompt, maxAge) {
+			redirectToLogin(w, r, clientID, redirectURI, state, prf, time.Now().Unix())
+			return
+		}
+		if err == nil && !session.Expires.Before(time.Now()) && authAfter > 0 && session.AuthTime.Unix() < authAfter {
+			// Not yet the fresh login the earlier request asked for
+			redirectToLogin(w, r, clientID, redirectURI, state, prf, authAfter)
+			return
+		}
 		if err == nil && !session.Expires.Before(time.Now()) {
-			code := generateCode()
-			userID := string(session.UserID)
-			// Store userID|sessionID so the token exchange can track which SSO session created it
-			redisClient.Set(ctx, fmt.Sprintf("sso_code:%s", code), userID+"|"+sid, 5*time.Minute)
-
-			redirectURL := fmt.Sprintf("%s?code=%s&state=%s",
-				redirectURI, url.QueryEscape(code), url.QueryEscape(state))
-			http.Redirect(w, r, redirectURL, http.StatusFound)
+			if user, err := repo.GetUser(string(session.UserID)); err != nil || !user.mayUseClient(clientID) {
+				http.Error(w, "You don't have access to this application", http.StatusForbidden)
+				return
+			}
+			if prf {
+				redirectToPRF(w, r, clientID, redirectURI, state)
+				return
+			}
+			http.Redirect(w, r, ssoCodeRedirect(r, string(session.UserID), sid, redirectURI, state), http.StatusFound)
 			return
 		}
 		// Session cookie present but invalid — clear stale cookies
 		// so the login page JS doesn't auto-redirect and loop
-		clearSessionCookies(w)
+		clearSessionCookies(w, r)
 	}
 
-	redirectToLogin(w, r, clientID, redirectURI, state)
+	redirectToLogin(w, r, clientID, redirectURI, state, prf, authAfter)
 }
 
-func redirectToLogin(w http.ResponseWriter, r *http.Request, clientID, redirectURI, state string) {
-	loginURL := fmt.Sprintf("/?sso_client_id=%s&sso_redirect_uri=%s&sso_state=%s",
+// ssoCodeRedirect issues an auth code for the session and returns the redirect_uri to send it to.
+func ssoCodeRedirect(r *http.Request, userID, sid, redirectURI, state string) string {
+	code := realmOf(r).newCode()
+	// Store userID|sessionID so the token exchange can track which SSO session created it
+	store.Set(fmt.Sprintf("sso_code:%s", code), userID+"|"+sid, currentConfig().TTL.SSOCode)
+	return fmt.Sprintf("%s?code=%s&state=%s",
+		redirectURI, url.QueryEscape(code), url.QueryEscape(state))
+}
+
+// needsReauthentication reports whether the authorization request asks for a fresher login
+// than the session provides.
+func needsReauthentication(session *Session, prompt string, maxAge int) bool {
+	if prompt == "login" {
+		return true
+	}
+	return maxAge >= 0 && time.Since(session.AuthTime) > time.Duration(maxAge)*time.Second
+}
+
+func redirectToLogin(w http.ResponseWriter, r *http.Request, clientID, redirectURI, state string, prf bool, authAfter int64) {
+	http.Redirect(w, r, realmPath(r, "/")+"?"+ssoLoginQuery(clientID, redirectURI, state, prf, authAfter), http.StatusFound)
+}
+
+// ssoLoginQuery returns the login page parameters that bring the user back to SSOAuthorize.
+// authAfter, if not 0, tells the login page to ask for a new login even with a session.
+func ssoLoginQuery(clientID, redirectURI, state string, prf bool, authAfter int64) string {
+	query := fmt.Sprintf("sso_client_id=%s&sso_redirect_uri=%s&sso_state=%s",
 		url.QueryEscape(clientID),
 		url.QueryEscape(redirectURI),
 		url.QueryEscape(state))
-	http.Redirect(w, r, loginURL, http.StatusFound)
+	if prf {
+		query += "&sso_prf=1"
+	}
+	if authAfter > 0 {
+		query += fmt.Sprintf("&sso_auth_after=%d", authAfter)
+	}
+	return query
+}
+
+// savePendingSSO validates an SSO authorization request sent along with an email login and
+// stores it until the login finishes. It returns the ID to reference it by.
+func savePendingSSO(r *http.Request, pending *PendingSSO, ttl time.Duration) (string, error) {
+	client, err := getRealmClient(r, pending.ClientID)
+	if err != nil {
+		return "", fmt.Errorf("invalid client_id")
+	}
+	if pending.RedirectURI != client.RedirectURI {
+		return "", fmt.Errorf("invalid redirect_uri")
+	}
+	id := generateCode()
+	if err := SavePendingSSO(id, pending, ttl); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// takePendingSSO returns and deletes the SSO authorization request an email login continues,
+// or nil if it has none.
+func takePendingSSO(userLogin *UserLogin) *PendingSSO {
+	if userLogin.SSORequest == nil {
+		return nil
+	}
+	pending, err := GetPendingSSO(*userLogin.SSORequest)
+	if err != nil {
+		log.Printf("[WARN] pending SSO request of login %s is gone: %s", userLogin.ID, err.Error())
+		return nil
+	}
+	DeletePendingSSO(*userLogin.SSORequest)
+	return pending
+}
+
+// ssoAuthorizeURL returns the SSOAuthorize URL that resumes a pending SSO request.
+func ssoAuthorizeURL(r *http.Request, pending *PendingSSO) string {
+	params := url.Values{
+		"client_id":    {pending.ClientID},
+		"redirect_uri": {pending.RedirectURI},
+		"state":        {pending.State},
+	}
+	if pending.PRF {
+		params.Set("prf", "1")
+	}
+	if pending.AuthAfter > 0 {
+		params.Set("auth_after", strconv.FormatInt(pending.AuthAfter, 10))
+	}
+	return realmPath(r, "/api/pub/sso/authorize") + "?" + params.Encode()
 }
 
 // SSOToken exchanges an auth code for an opaque token.
@@ -92,21 +208,22 @@ func SSOToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client, err := GetSSOClient(req.ClientID)
+	client, err := getRealmClient(r, req.ClientID)
 	if err != nil || client.ClientSecret != req.ClientSecret {
 		JSONResponse(w, "Invalid client credentials", http.StatusUnauthorized)
 		return
 	}
-
-	codeKey := fmt.Sprintf("sso_code:%s", req.Code)
-	codeVal, err := redisClient.Get(ctx, codeKey).Result()
-	if err != nil {
+	if !realmOf(r).owns(req.Code) {
 		JSONResponse(w, "Invalid or expired code", http.StatusBadRequest)
 		return
 	}
 
 	// One-time use
-	redisClient.Del(ctx, codeKey)
+	codeVal, err := store.GetDel(fmt.Sprintf("sso_code:%s", req.Code))
+	if err != nil {
+		JSONResponse(w, "Invalid or expired code", http.StatusBadRequest)
+		return
+	}
 
 	// Parse userID|sessionID
 	parts := strings.SplitN(codeVal, "|", 2)
@@ -116,8 +233,13 @@ func SSOToken(w http.ResponseWriter, r *http.Request) {
 		sessionID = parts[1]
 	}
 
+	if user, err := repo.GetUser(userID); err != nil || !user.mayUseClient(req.ClientID) {
+		JSONResponse(w, "Access to this client is not allowed", http.StatusForbidden)
+		return
+	}
+
 	// Generate opaque token with metadata
-	token := generateCode()
+	token := realmOf(r).newCode()
 	tokenData := SSOTokenData{
 		UserID:    userID,
 		ClientID:  req.ClientID,
@@ -125,19 +247,24 @@ func SSOToken(w http.ResponseWriter, r *http.Request) {
 		UserAgent: r.UserAgent(),
 		Created:   time.Now().Format("2006-01-02 15:04"),
 	}
+	if session, err := GetLoginSession(sessionID); err == nil && !session.AuthTime.IsZero() {
+		tokenData.AuthTime = session.AuthTime.Unix()
+		tokenData.AMR = session.AMR
+	}
 	dataJSON, _ := json.Marshal(tokenData)
 
 	tokenKey := fmt.Sprintf("sso_token:%s", token)
-	redisClient.Set(ctx, tokenKey, dataJSON, ssoTokenTTL)
+	ttl := currentConfig().TTL.SSOToken
+	store.Set(tokenKey, string(dataJSON), ttl)
 
 	// Track token in per-user set
 	userTokensKey := fmt.Sprintf("sso_user_tokens:%s", userID)
-	redisClient.SAdd(ctx, userTokensKey, token)
+	store.SAdd(userTokensKey, token)
 
 	JSONResponse(w, map[string]any{
 		"access_token": token,
 		"token_type":   "Bearer",
-		"expires_in":   int(ssoTokenTTL.Seconds()),
+		"expires_in":   int(ttl.Seconds()),
 	}, http.StatusOK)
 }
 
@@ -153,25 +280,33 @@ func SSOValidate(w http.ResponseWriter, r *http.Request) {
 
 	token := strings.TrimPrefix(authHeader, "Bearer ")
 	tokenData, err := getSSOTokenData(token)
-	if err != nil {
+	if err != nil || !realmOf(r).owns(token) {
 		JSONResponse(w, "Invalid or expired token", http.StatusUnauthorized)
 		return
 	}
 
 	// Extend TTL on every valid request
-	redisClient.Expire(ctx, fmt.Sprintf("sso_token:%s", token), ssoTokenTTL)
+	store.Expire(fmt.Sprintf("sso_token:%s", token), currentConfig().TTL.SSOToken)
 
-	user, err := GetUser(tokenData.UserID)
+	user, err := repo.GetUser(tokenData.UserID)
 	if err != nil {
 		JSONResponse(w, "User not found", http.StatusInternalServerError)
 		return
 	}
+	if !user.mayUseClient(tokenData.ClientID) {
+		JSONResponse(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
 
 	JSONResponse(w, map[string]any{
 		"sub":          user.ID,
 		"email":        user.Email,
 		"name":         user.Name,
 		"display_name": user.DisplayName,
+		"auth_time":    tokenData.AuthTime,
+		"amr":          tokenData.AMR,
+		"roles":        parseList(user.Roles),
+		"groups":       parseList(user.Groups),
 	}, http.StatusOK)
 }
 
@@ -182,17 +317,17 @@ func SSOLogout(w http.ResponseWriter, r *http.Request) {
 	if sid != "" {
 		DeleteSession(sid)
 	}
-	clearSessionCookies(w)
+	clearSessionCookies(w, r)
 
 	redirectURI := r.URL.Query().Get("redirect_uri")
 	if redirectURI == "" {
-		redirectURI = "/"
+		redirectURI = realmPath(r, "/")
 	}
 	http.Redirect(w, r, redirectURI, http.StatusFound)
 }
 
 func getSSOTokenData(token string) (*SSOTokenData, error) {
-	val, err := redisClient.Get(ctx, fmt.Sprintf("sso_token:%s", token)).Result()
+	val, err := store.Get(fmt.Sprintf("sso_token:%s", token))
 	if err != nil {
 		return nil, err
 	}
@@ -206,9 +341,9 @@ func getSSOTokenData(token string) (*SSOTokenData, error) {
 func revokeSSOToken(token string) {
 	tokenData, err := getSSOTokenData(token)
 	if err == nil {
-		redisClient.SRem(ctx, fmt.Sprintf("sso_user_tokens:%s", tokenData.UserID), token)
+		store.SRem(fmt.Sprintf("sso_user_tokens:%s", tokenData.UserID), token)
 	}
-	redisClient.Del(ctx, fmt.Sprintf("sso_token:%s", token))
+	store.Del(fmt.Sprintf("sso_token:%s", token))
 }
 
 // revokeSSOTokenAndSession revokes the token and also deletes the SSO session
@@ -216,12 +351,12 @@ func revokeSSOToken(token string) {
 func revokeSSOTokenAndSession(token string) {
 	tokenData, err := getSSOTokenData(token)
 	if err == nil {
-		redisClient.SRem(ctx, fmt.Sprintf("sso_user_tokens:%s", tokenData.UserID), token)
+		store.SRem(fmt.Sprintf("sso_user_tokens:%s", tokenData.UserID), token)
 		if tokenData.SessionID != "" {
 			DeleteSession(tokenData.SessionID)
 		}
 	}
-	redisClient.Del(ctx, fmt.Sprintf("sso_token:%s", token))
+	store.Del(fmt.Sprintf("sso_token:%s", token))
 }
 
 // SSORevoke revokes an opaque token immediately.
@@ -234,7 +369,9 @@ func SSORevoke(w http.ResponseWriter, r *http.Request) {
 	}
 
 	token := strings.TrimPrefix(authHeader, "Bearer ")
-	revokeSSOToken(token)
+	if realmOf(r).owns(token) {
+		revokeSSOToken(token)
+	}
 
 	JSONResponse(w, "Token revoked", http.StatusOK)
 }
@@ -251,7 +388,7 @@ func SSOSessions(w http.ResponseWriter, r *http.Request) {
 
 	userID := string(session.UserID)
 	userTokensKey := fmt.Sprintf("sso_user_tokens:%s", userID)
-	tokens, err := redisClient.SMembers(ctx, userTokensKey).Result()
+	tokens, err := store.SMembers(userTokensKey)
 	if err != nil {
 		JSONResponse(w, "Failed to get sessions", http.StatusInternalServerError)
 		return
@@ -270,11 +407,11 @@ func SSOSessions(w http.ResponseWriter, r *http.Request) {
 		data, err := getSSOTokenData(token)
 		if err != nil {
 			// Token expired, clean up from set
-			redisClient.SRem(ctx, userTokensKey, token)
+			store.SRem(userTokensKey, token)
 			continue
 		}
 		clientURL := ""
-		if client, err := GetSSOClient(data.ClientID); err == nil {
+		if client, err := repo.GetSSOClient(data.ClientID); err == nil {
 			if u, err := url.Parse(client.RedirectURI); err == nil {
 				clientURL = u.Scheme + "://" + u.Host
 			}
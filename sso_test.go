@@ -18,8 +18,8 @@ import (
 func setupTestServer(t *testing.T) (*httptest.Server, string, func()) {
 	t.Helper()
 
-	initRedis()
-	initDB()
+	initTestDB(t)
+	initTestStore(t)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /api/pub/sso/authorize", SSOAuthorize)
@@ -41,7 +41,6 @@ func setupTestServer(t *testing.T) (*httptest.Server, string, func()) {
 	return ts, redirectURI, func() {
 		db.Exec("DELETE FROM sso_client WHERE id = 'testclient'")
 		ts.Close()
-		redisClient.Close()
 		db.Close()
 	}
 }
@@ -50,16 +49,16 @@ func setupTestServer(t *testing.T) (*httptest.Server, string, func()) {
 func createTestUser(t *testing.T) (string, func()) {
 	t.Helper()
 	email := fmt.Sprintf("test_%s@example.com", uuid.New().String()[:8])
-	user, err := CreateUser(email, "Test User", "Test")
+	user, err := repo.CreateUser(defaultRealmID, email, "Test User", "Test")
 	if err != nil {
 		t.Fatalf("failed to create test user: %v", err)
 	}
 	return user.ID, func() {
-		db.Exec("DELETE FROM user WHERE id = ?", user.ID)
+		db.Exec("DELETE FROM `user` WHERE id = ?", user.ID)
 	}
 }
 
-// createTestSession creates a valid session in Redis and returns the session ID
+// createTestSession creates a valid session in the store and returns the session ID
 func createTestSession(t *testing.T, userID string) string {
 	t.Helper()
 	sessionID := uuid.New().String()
@@ -188,9 +187,9 @@ func TestSSOToken_CodeIsOneTimeUse(t *testing.T) {
 	userID, cleanupUser := createTestUser(t)
 	defer cleanupUser()
 
-	// Plant a code in Redis
+	// Plant a code in the store
 	code := generateCode()
-	redisClient.Set(ctx, fmt.Sprintf("sso_code:%s", code), userID, 5*time.Minute)
+	store.Set(fmt.Sprintf("sso_code:%s", code), userID, 5*time.Minute)
 
 	body := fmt.Sprintf(`{"code":"%s","client_id":"testclient","client_secret":"testsecret"}`, code)
 
@@ -402,10 +401,10 @@ func TestSSOLogout(t *testing.T) {
 		t.Error("logout: expected sso_session cookie to be cleared")
 	}
 
-	// Verify Redis session is deleted
+	// Verify the session is deleted
 	_, err = GetSession(sessionID)
 	if err == nil {
-		t.Error("logout: expected session to be deleted from Redis")
+		t.Error("logout: expected session to be deleted from the store")
 	}
 }
 
@@ -447,13 +446,13 @@ func TestSSOSessions(t *testing.T) {
 			ClientID: "testclient",
 			Created:  time.Now().Format("2006-01-02 15:04"),
 		})
-		redisClient.Set(ctx, fmt.Sprintf("sso_token:%s", token), data, ssoTokenTTL)
-		redisClient.SAdd(ctx, fmt.Sprintf("sso_user_tokens:%s", userID), token)
+		store.Set(fmt.Sprintf("sso_token:%s", token), string(data), currentConfig().TTL.SSOToken)
+		store.SAdd(fmt.Sprintf("sso_user_tokens:%s", userID), token)
 	}
 	defer func() {
-		redisClient.Del(ctx, fmt.Sprintf("sso_token:%s", token1))
-		redisClient.Del(ctx, fmt.Sprintf("sso_token:%s", token2))
-		redisClient.Del(ctx, fmt.Sprintf("sso_user_tokens:%s", userID))
+		store.Del(fmt.Sprintf("sso_token:%s", token1))
+		store.Del(fmt.Sprintf("sso_token:%s", token2))
+		store.Del(fmt.Sprintf("sso_user_tokens:%s", userID))
 	}()
 
 	jar, _ := cookiejar.New(nil)
@@ -540,11 +539,11 @@ func TestSSORevokeSession_WrongUser(t *testing.T) {
 		ClientID: "testclient",
 		Created:  time.Now().Format("2006-01-02 15:04"),
 	})
-	redisClient.Set(ctx, fmt.Sprintf("sso_token:%s", token), data, ssoTokenTTL)
-	redisClient.SAdd(ctx, fmt.Sprintf("sso_user_tokens:%s", user2ID), token)
+	store.Set(fmt.Sprintf("sso_token:%s", token), string(data), currentConfig().TTL.SSOToken)
+	store.SAdd(fmt.Sprintf("sso_user_tokens:%s", user2ID), token)
 	defer func() {
-		redisClient.Del(ctx, fmt.Sprintf("sso_token:%s", token))
-		redisClient.Del(ctx, fmt.Sprintf("sso_user_tokens:%s", user2ID))
+		store.Del(fmt.Sprintf("sso_token:%s", token))
+		store.Del(fmt.Sprintf("sso_user_tokens:%s", user2ID))
 	}()
 
 	// Login as user1
@@ -575,3 +574,53 @@ func TestSSORevokeSession_WrongUser(t *testing.T) {
 		t.Errorf("token should still be valid, got %d", resp.StatusCode)
 	}
 }
+
+func TestSSOAuthorize_PromptLogin_KeepsSession(t *testing.T) {
+	ts, redirectURI, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	userID, cleanupUser := createTestUser(t)
+	defer cleanupUser()
+	sid := uuid.New().String()
+	authTime := time.Now().Add(-time.Minute)
+	SaveLoginSession(sid, &Session{SessionData: webauthn.SessionData{UserID: []byte(userID), Expires: time.Now().Add(time.Hour)}, AuthTime: authTime}, time.Hour)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	authorize := func(query string) string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/pub/sso/authorize?client_id=testclient&redirect_uri="+url.QueryEscape(redirectURI)+"&state=s"+query, nil)
+		req.AddCookie(&http.Cookie{Name: "sso_session", Value: sid})
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("expected 302, got %d", resp.StatusCode)
+		}
+		return resp.Header.Get("Location")
+	}
+
+	loc := authorize("&prompt=login")
+	if !strings.Contains(loc, "sso_auth_after=") {
+		t.Fatalf("prompt=login: expected the login page with sso_auth_after, got: %s", loc)
+	}
+	if _, err := GetLoginSession(sid); err != nil {
+		t.Errorf("prompt=login ended the session: %v", err)
+	}
+	login, _ := url.Parse(loc)
+	authAfter := login.Query().Get("sso_auth_after")
+
+	// Coming back without a new login doesn't get a code
+	if loc := authorize("&auth_after=" + authAfter); strings.Contains(loc, "code=") {
+		t.Errorf("code issued for the old login: %s", loc)
+	}
+	// A login after the request does
+	session, _ := GetLoginSession(sid)
+	session.AuthTime = time.Now().Add(time.Second)
+	SaveLoginSession(sid, session, time.Hour)
+	if loc := authorize("&auth_after=" + authAfter); !strings.Contains(loc, "code=") {
+		t.Errorf("no code for the new login: %s", loc)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// requireStepUp returns the session if the user authenticated recently enough for a sensitive
+// action, else writes 401 "step_up_required" and returns nil. Recent means a passkey assertion
+// with user verification within ttl.step_up. Users without usable passkeys can't perform one,
+// so for them any authentication within the window is accepted.
+func requireStepUp(w http.ResponseWriter, r *http.Request) *Session {
+	session, err := GetLoginSession(getSessionID(r))
+	if err != nil {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	if time.Since(session.AuthTime) <= currentConfig().TTL.StepUp {
+		if slices.Contains(session.AMR, AMRMFA) {
+			return session
+		}
+		user, err := repo.GetUser(string(session.UserID))
+		if err == nil && len(user.LoginCredentialDescriptors()) == 0 {
+			return session
+		}
+	}
+	w.Header().Add("Access-Control-Expose-Headers", "step_up_required")
+	w.Header().Set("step_up_required", "1")
+	JSONResponse(w, "step_up_required", http.StatusUnauthorized)
+	return nil
+}
+
+/////////////////////////
+//                     //
+//    BeginStepUp      //
+//                     //
+/////////////////////////
+
+// BeginStepUp starts a WebAuthn assertion with required user verification for the logged-in user.
+// POST /api/stepup_start
+func BeginStepUp(w http.ResponseWriter, r *http.Request) {
+	session, err := GetLoginSession(getSessionID(r))
+	if err != nil {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, err := repo.GetUser(string(session.UserID))
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	allowed := user.LoginCredentialDescriptors()
+	if len(allowed) == 0 {
+		JSONResponse(w, "No usable passkeys", http.StatusBadRequest)
+		return
+	}
+	options, ceremony, err := getWebAuthn(r).BeginLogin(user,
+		webauthn.WithAllowedCredentials(allowed),
+		webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		msg := fmt.Sprintf("can't begin step-up: %s", err.Error())
+		log.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	stepUpSid := realmOf(r).newID()
+	err = SaveSession(stepUpSid, ceremony, currentConfig().TTL.Ceremony)
+	if err != nil {
+		log.Printf("[ERRO] can't save session: %s", err.Error())
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Access-Control-Expose-Headers", "stepup_sid")
+	w.Header().Set("stepup_sid", stepUpSid)
+	JSONResponse(w, options, http.StatusOK)
+}
+
+//////////////////////////
+//                      //
+//    FinishStepUp      //
+//                      //
+//////////////////////////
+
+// FinishStepUp verifies the assertion and refreshes auth_time and amr on the current session.
+// POST /api/stepup_finish
+func FinishStepUp(w http.ResponseWriter, r *http.Request) {
+	stepUpSid := realmHeader(r, "stepup_sid")
+	if stepUpSid == "" {
+		JSONResponse(w, "missing stepup_sid header", http.StatusBadRequest)
+		return
+	}
+	sid := getSessionID(r)
+	session, err := GetLoginSession(sid)
+	if err != nil {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ceremony, err := GetSession(stepUpSid)
+	if err != nil {
+		log.Printf("[ERRO] can't get session: %s", err.Error())
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	DeleteSession(stepUpSid)
+	if string(ceremony.UserID) != string(session.UserID) {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, err := repo.GetUser(string(session.UserID))
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	credential, err := getWebAuthn(r).FinishLogin(user, *ceremony, r)
+	if err != nil {
+		log.Printf("[ERRO] can't finish step-up: %s", err.Error())
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !credential.Flags.UserVerified {
+		JSONResponse(w, "User verification is required", http.StatusBadRequest)
+		return
+	}
+	if credential.Authenticator.CloneWarning && !handleCloneWarning(w, r, user, credential) {
+		return
+	}
+	user.UpdateCredential(credential, clientIP(r), r.UserAgent())
+
+	session.AuthTime = time.Now()
+	session.AMR = passkeyAMR(credential)
+	if err := UpdateLoginSession(sid, session); err != nil {
+		log.Printf("[ERRO] can't update session: %s", err.Error())
+		JSONResponse(w, "Failed to update session", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[INFO] step-up for user %s", user.ID)
+	JSONResponse(w, "Step-up Success", http.StatusOK)
+}
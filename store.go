@@ -0,0 +1,509 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Store keeps short-lived state: sessions, WebAuthn ceremony data, SSO codes and tokens, the
+// tokens of each user and rate limit counters. It is chosen by SESSION_STORE:
+//
+//	redis   Redis at REDIS_URL, shared by all instances
+//	memory  the process memory, for a single instance and tests
+//	sql     the database, shared by all instances without Redis
+//
+// A key holds either a value or a set of members. A TTL of 0 keeps a key until it is deleted.
+type Store interface {
+	Get(key string) (string, error)
+	Set(key, value string, ttl time.Duration) error
+	// Update replaces the value of an existing key without changing its TTL.
+	Update(key, value string) error
+	// GetDel returns the value of key and deletes it, so only one caller gets it.
+	GetDel(key string) (string, error)
+	Del(keys ...string) error
+	Expire(key string, ttl time.Duration) error
+	// TTL returns how long key lives, or 0 if it doesn't exist or doesn't expire.
+	TTL(key string) (time.Duration, error)
+	// Incr increments the counter at key. A new counter expires after ttl.
+	Incr(key string, ttl time.Duration) (int64, error)
+	SAdd(key, member string) error
+	SRem(key, member string) error
+	SMembers(key string) ([]string, error)
+}
+
+const (
+	StoreRedis  = "redis"
+	StoreMemory = "memory"
+	StoreSQL    = "sql"
+)
+
+var errKeyNotFound = errors.New("key not found")
+
+// newStore returns the store of kind. The sql store uses db, which must be open.
+func newStore(kind string) (Store, error) {
+	switch kind {
+	case StoreRedis:
+		return newRedisStore(redis.NewClient(&redis.Options{Addr: currentConfig().SessionStore.RedisURL})), nil
+	case StoreMemory:
+		return newMemoryStore(), nil
+	case StoreSQL:
+		return newSQLStore(db), nil
+	default:
+		return nil, fmt.Errorf("unknown SESSION_STORE %q, use one of %s, %s, %s", kind, StoreRedis, StoreMemory, StoreSQL)
+	}
+}
+
+////////////////////////
+//                    //
+//       Redis        //
+//                    //
+////////////////////////
+
+type redisStore struct {
+	client *redis.Client
+}
+
+func newRedisStore(client *redis.Client) *redisStore {
+	return &redisStore{client: client}
+}
+
+// redisResult maps redis.Nil, a missing key, to errKeyNotFound.
+func redisResult(val string, err error) (string, error) {
+	if err == redis.Nil {
+		return "", errKeyNotFound
+	}
+	return val, err
+}
+
+func (s *redisStore) Get(key string) (string, error) {
+	return redisResult(s.client.Get(ctx, key).Result())
+}
+
+func (s *redisStore) Set(key, value string, ttl time.Duration) error {
+	return s.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (s *redisStore) Update(key, value string) error {
+	_, err := redisResult(s.client.SetArgs(ctx, key, value, redis.SetArgs{KeepTTL: true, Mode: "XX"}).Result())
+	return err
+}
+
+func (s *redisStore) GetDel(key string) (string, error) {
+	return redisResult(s.client.GetDel(ctx, key).Result())
+}
+
+func (s *redisStore) Del(keys ...string) error {
+	return s.client.Del(ctx, keys...).Err()
+}
+
+func (s *redisStore) Expire(key string, ttl time.Duration) error {
+	return s.client.PExpire(ctx, key, ttl).Err()
+}
+
+func (s *redisStore) TTL(key string) (time.Duration, error) {
+	ttl, err := s.client.TTL(ctx, key).Result()
+	if err != nil || ttl < 0 {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+// Incr sends INCR and PEXPIRE NX in one transaction, so a counter never exists without its
+// TTL, even if the process dies in between. NX keeps the TTL set by the first increment.
+func (s *redisStore) Incr(key string, ttl time.Duration) (int64, error) {
+	var incr *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.Do(ctx, "PEXPIRE", key, ttl.Milliseconds(), "NX")
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (s *redisStore) SAdd(key, member string) error {
+	return s.client.SAdd(ctx, key, member).Err()
+}
+
+func (s *redisStore) SRem(key, member string) error {
+	return s.client.SRem(ctx, key, member).Err()
+}
+
+func (s *redisStore) SMembers(key string) ([]string, error) {
+	return s.client.SMembers(ctx, key).Result()
+}
+
+////////////////////////
+//                    //
+//       Memory       //
+//                    //
+////////////////////////
+
+// storeSweepInterval is how often expired keys are removed. Until then they are only hidden.
+const storeSweepInterval = time.Minute
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	swept   time.Time
+}
+
+type memoryEntry struct {
+	value   string
+	members map[string]bool
+	expires time.Time // zero if the entry doesn't expire
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: map[string]*memoryEntry{}, swept: time.Now()}
+}
+
+func expiresAfter(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// entry returns the live entry at key. The caller holds mu.
+func (s *memoryStore) entry(key string, now time.Time) *memoryEntry {
+	e := s.entries[key]
+	if e == nil {
+		return nil
+	}
+	if !e.expires.IsZero() && !now.Before(e.expires) {
+		delete(s.entries, key)
+		return nil
+	}
+	return e
+}
+
+// sweep removes the expired entries once per storeSweepInterval. The caller holds mu.
+func (s *memoryStore) sweep(now time.Time) {
+	if now.Sub(s.swept) < storeSweepInterval {
+		return
+	}
+	s.swept = now
+	for key := range s.entries {
+		s.entry(key, now)
+	}
+}
+
+func (s *memoryStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(key, time.Now())
+	if e == nil || e.members != nil {
+		return "", errKeyNotFound
+	}
+	return e.value, nil
+}
+
+func (s *memoryStore) Set(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	s.entries[key] = &memoryEntry{value: value, expires: expiresAfter(now, ttl)}
+	return nil
+}
+
+func (s *memoryStore) Update(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(key, time.Now())
+	if e == nil || e.members != nil {
+		return errKeyNotFound
+	}
+	e.value = value
+	return nil
+}
+
+func (s *memoryStore) GetDel(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(key, time.Now())
+	if e == nil || e.members != nil {
+		return "", errKeyNotFound
+	}
+	delete(s.entries, key)
+	return e.value, nil
+}
+
+func (s *memoryStore) Del(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+func (s *memoryStore) Expire(key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if e := s.entry(key, now); e != nil {
+		e.expires = expiresAfter(now, ttl)
+	}
+	return nil
+}
+
+func (s *memoryStore) TTL(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e := s.entry(key, now)
+	if e == nil || e.expires.IsZero() {
+		return 0, nil
+	}
+	return e.expires.Sub(now), nil
+}
+
+func (s *memoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	e := s.entry(key, now)
+	if e == nil {
+		e = &memoryEntry{value: "0", expires: expiresAfter(now, ttl)}
+		s.entries[key] = e
+	}
+	n, err := strconv.ParseInt(e.value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of %s is not a counter", key)
+	}
+	n++
+	e.value = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (s *memoryStore) SAdd(key, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	e := s.entry(key, now)
+	if e == nil || e.members == nil {
+		e = &memoryEntry{members: map[string]bool{}}
+		s.entries[key] = e
+	}
+	e.members[member] = true
+	return nil
+}
+
+func (s *memoryStore) SRem(key, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.entry(key, time.Now()); e != nil && e.members != nil {
+		delete(e.members, member)
+		if len(e.members) == 0 {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SMembers(key string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(key, time.Now())
+	if e == nil {
+		return nil, nil
+	}
+	members := make([]string, 0, len(e.members))
+	for member := range e.members {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+////////////////////////
+//                    //
+//        SQL         //
+//                    //
+////////////////////////
+
+// sqlStore keeps values in store_entry and sets in store_member. Sets don't expire. Expired
+// entries are ignored and deleted once per storeSweepInterval.
+type sqlStore struct {
+	db    *sqlDB
+	mu    sync.Mutex
+	swept time.Time
+}
+
+func newSQLStore(db *sqlDB) *sqlStore {
+	return &sqlStore{db: db, swept: time.Now()}
+}
+
+// nullTime returns t, or nil for the zero time, so it is stored as NULL.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func (s *sqlStore) sweep(now time.Time) {
+	s.mu.Lock()
+	due := now.Sub(s.swept) >= storeSweepInterval
+	if due {
+		s.swept = now
+	}
+	s.mu.Unlock()
+	if due {
+		if _, err := s.db.Exec("DELETE FROM store_entry WHERE expires <= ?", now); err != nil {
+			log.Printf("[ERRO] can't delete expired store entries: %s", err.Error())
+		}
+	}
+}
+
+func (s *sqlStore) Get(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow("SELECT value FROM store_entry WHERE id = ? AND (expires IS NULL OR expires > ?)", key, time.Now()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", errKeyNotFound
+	}
+	return value, err
+}
+
+func (s *sqlStore) Set(key, value string, ttl time.Duration) error {
+	now := time.Now()
+	s.sweep(now)
+	_, err := s.db.Exec(s.db.dialect.upsert("store_entry", "id", "value", "expires"), key, value, nullTime(expiresAfter(now, ttl)))
+	return err
+}
+
+func (s *sqlStore) Update(key, value string) error {
+	result, err := s.db.Exec("UPDATE store_entry SET value = ? WHERE id = ? AND (expires IS NULL OR expires > ?)", value, key, time.Now())
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errKeyNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) GetDel(key string) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var value string
+	err = tx.QueryRow("SELECT value FROM store_entry WHERE id = ? AND (expires IS NULL OR expires > ?)"+s.db.dialect.forUpdate(), key, time.Now()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", errKeyNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM store_entry WHERE id = ?", key); err != nil {
+		return "", err
+	}
+	return value, tx.Commit()
+}
+
+func (s *sqlStore) Del(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	if _, err := s.db.Exec("DELETE FROM store_entry WHERE id IN ("+placeholders+")", args...); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM store_member WHERE id IN ("+placeholders+")", args...)
+	return err
+}
+
+func (s *sqlStore) Expire(key string, ttl time.Duration) error {
+	now := time.Now()
+	_, err := s.db.Exec("UPDATE store_entry SET expires = ? WHERE id = ? AND (expires IS NULL OR expires > ?)", nullTime(expiresAfter(now, ttl)), key, now)
+	return err
+}
+
+func (s *sqlStore) TTL(key string) (time.Duration, error) {
+	now := time.Now()
+	var expires sql.NullTime
+	err := s.db.QueryRow("SELECT expires FROM store_entry WHERE id = ? AND (expires IS NULL OR expires > ?)", key, now).Scan(&expires)
+	if err == sql.ErrNoRows || !expires.Valid {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return expires.Time.Sub(now), nil
+}
+
+// Incr replaces an expired counter with a new one, then increments it under a row lock.
+func (s *sqlStore) Incr(key string, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	s.sweep(now)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM store_entry WHERE id = ? AND expires <= ?", key, now); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("INSERT INTO store_entry (id, value, expires) VALUES (?, ?, ?) "+s.db.dialect.ignoreDuplicate("id"), key, "0", nullTime(expiresAfter(now, ttl))); err != nil {
+		return 0, err
+	}
+	var value string
+	if err := tx.QueryRow("SELECT value FROM store_entry WHERE id = ?"+s.db.dialect.forUpdate(), key).Scan(&value); err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of %s is not a counter", key)
+	}
+	n++
+	if _, err := tx.Exec("UPDATE store_entry SET value = ? WHERE id = ?", strconv.FormatInt(n, 10), key); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func (s *sqlStore) SAdd(key, member string) error {
+	_, err := s.db.Exec("INSERT INTO store_member (id, member) VALUES (?, ?) "+s.db.dialect.ignoreDuplicate("id"), key, member)
+	return err
+}
+
+func (s *sqlStore) SRem(key, member string) error {
+	_, err := s.db.Exec("DELETE FROM store_member WHERE id = ? AND member = ?", key, member)
+	return err
+}
+
+func (s *sqlStore) SMembers(key string) ([]string, error) {
+	rows, err := s.db.Query("SELECT member FROM store_member WHERE id = ?", key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []string
+	for rows.Next() {
+		var member string
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
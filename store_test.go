@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// initTestStore uses the store of SESSION_STORE, or, when it isn't set, a new memory store,
+// so tests need no Redis server.
+func initTestStore(t *testing.T) {
+	t.Helper()
+	if os.Getenv("SESSION_STORE") == "" {
+		store = newMemoryStore()
+		return
+	}
+	var err error
+	if store, err = newStore(currentConfig().SessionStore.Kind); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testStore(t, newMemoryStore(), time.Sleep)
+	})
+	t.Run("sql", func(t *testing.T) {
+		initTestDB(t)
+		defer db.Close()
+		testStore(t, newSQLStore(db), time.Sleep)
+	})
+	t.Run("redis", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		s := newRedisStore(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+		testStore(t, s, server.FastForward)
+		// A counter left without a TTL gets one, so it can't lock anyone out forever
+		server.Set("stuck", "5")
+		if _, err := s.Incr("stuck", time.Minute); err != nil || server.TTL("stuck") != time.Minute {
+			t.Errorf("Incr = %v; TTL %s, want 1m", err, server.TTL("stuck"))
+		}
+	})
+}
+
+// testStore checks s, calling wait to let time pass.
+func testStore(t *testing.T, s Store, wait func(time.Duration)) {
+	if _, err := s.Get("missing"); err != errKeyNotFound {
+		t.Errorf("Get of a missing key = %v; want errKeyNotFound", err)
+	}
+	if err := s.Update("missing", "v"); err != errKeyNotFound {
+		t.Errorf("Update of a missing key = %v; want errKeyNotFound", err)
+	}
+
+	if err := s.Set("a", "1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("a", "2", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update("a", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := s.Get("a"); err != nil || val != "3" {
+		t.Errorf("Get = %q, %v; want 3", val, err)
+	}
+	if ttl, err := s.TTL("a"); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL after Update = %s, %v; want it kept", ttl, err)
+	}
+	if val, err := s.GetDel("a"); err != nil || val != "3" {
+		t.Errorf("GetDel = %q, %v", val, err)
+	}
+	if _, err := s.GetDel("a"); err != errKeyNotFound {
+		t.Errorf("second GetDel = %v; want errKeyNotFound", err)
+	}
+
+	if err := s.Set("forever", "x", 0); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := s.TTL("forever"); err != nil || ttl != 0 {
+		t.Errorf("TTL of a key without expiry = %s, %v", ttl, err)
+	}
+	if err := s.Set("short", "x", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("extended", "x", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Expire("extended", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		if n, err := s.Incr("counter", 50*time.Millisecond); err != nil || n != int64(i+1) {
+			t.Errorf("Incr = %d, %v; want %d", n, err, i+1)
+		}
+	}
+	wait(100 * time.Millisecond)
+	if _, err := s.Get("short"); err != errKeyNotFound {
+		t.Errorf("Get of an expired key = %v; want errKeyNotFound", err)
+	}
+	if _, err := s.Get("extended"); err != nil {
+		t.Errorf("Get of an extended key = %v", err)
+	}
+	if n, err := s.Incr("counter", time.Minute); err != nil || n != 1 {
+		t.Errorf("Incr of an expired counter = %d, %v; want 1", n, err)
+	}
+
+	for _, member := range []string{"t1", "t2", "t2", "t3"} {
+		if err := s.SAdd("set", member); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SRem("set", "t1"); err != nil {
+		t.Fatal(err)
+	}
+	members, err := s.SMembers("set")
+	slices.Sort(members)
+	if err != nil || !slices.Equal(members, []string{"t2", "t3"}) {
+		t.Errorf("SMembers = %v, %v", members, err)
+	}
+	if err := s.Del("set", "forever"); err != nil {
+		t.Fatal(err)
+	}
+	if members, err := s.SMembers("set"); err != nil || len(members) != 0 {
+		t.Errorf("SMembers after Del = %v, %v", members, err)
+	}
+	if _, err := s.Get("forever"); err != errKeyNotFound {
+		t.Errorf("Get after Del = %v; want errKeyNotFound", err)
+	}
+}
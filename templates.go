@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Mail templates come in pairs: {name}.txt is a text/template that also defines "subject",
+// {name}.html is an optional html/template for the HTML part. They are looked up per
+// language, first in MAIL_TEMPLATE_DIR/{realm}/{lang}/, then MAIL_TEMPLATE_DIR/{lang}/, then
+// the built-in templates/mail/{lang}/. The languages are taken from Accept-Language, then
+// English.
+
+const (
+	MailLoginLink         = "login_link"
+	MailLoginCode         = "login_code"
+	MailNewPasskey        = "new_passkey"
+	MailSecurityAlert     = "security_alert"
+	MailInvitation        = "invitation"
+	MailEmailChange       = "email_change"
+	MailEmailChangeNotice = "email_change_notice"
+)
+
+const defaultMailLanguage = "en"
+
+//go:embed templates/mail
+var builtinMailTemplates embed.FS
+
+// acceptLanguages returns the primary language subtags of an Accept-Language header,
+// most preferred first.
+func acceptLanguages(header string) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var langs []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q > 0 {
+			langs = append(langs, weighted{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	var result []string
+	for _, l := range langs {
+		result = append(result, l.lang)
+	}
+	return result
+}
+
+// mailTemplateFiles returns the text and HTML template of the first location that has the
+// text template. The HTML template is nil if that location has none.
+func mailTemplateFiles(realmID string, langs []string, name string) (text, html []byte, err error) {
+	type location struct {
+		fsys fs.FS
+		dir  string
+	}
+	var locations []location
+	dir := currentConfig().Mail.TemplateDir
+	for _, lang := range append(langs, defaultMailLanguage) {
+		if !fs.ValidPath(lang) || strings.Contains(lang, "/") {
+			continue
+		}
+		if dir != "" {
+			override := os.DirFS(dir)
+			locations = append(locations, location{override, path.Join(realmID, lang)}, location{override, lang})
+		}
+		locations = append(locations, location{builtinMailTemplates, path.Join("templates/mail", lang)})
+	}
+	for _, loc := range locations {
+		text, err := fs.ReadFile(loc.fsys, path.Join(loc.dir, name+".txt"))
+		if err != nil {
+			continue
+		}
+		html, _ := fs.ReadFile(loc.fsys, path.Join(loc.dir, name+".html"))
+		return text, html, nil
+	}
+	return nil, nil, fmt.Errorf("mail template %s not found", name)
+}
+
+// renderMail renders the named mail template for a realm in the first available of langs.
+// The realm's display name is available as .Realm.
+func renderMail(realm *Realm, langs []string, to, name string, data map[string]any) (*Mail, error) {
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["Realm"] = realm.DisplayName()
+
+	textSrc, htmlSrc, err := mailTemplateFiles(realm.ID, langs, name)
+	if err != nil {
+		return nil, err
+	}
+	textTmpl, err := template.New(name).Parse(string(textSrc))
+	if err != nil {
+		return nil, fmt.Errorf("can't parse mail template %s.txt: %w", name, err)
+	}
+	var subject, text bytes.Buffer
+	if err := textTmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("can't render subject of %s: %w", name, err)
+	}
+	if err := textTmpl.Execute(&text, data); err != nil {
+		return nil, fmt.Errorf("can't render mail %s: %w", name, err)
+	}
+	mail := &Mail{
+		RealmID: realm.ID,
+		To:      []string{to},
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+	}
+
+	if htmlSrc == nil {
+		return mail, nil
+	}
+	htmlTmpl, err := htmltemplate.New(name).Parse(string(htmlSrc))
+	if err != nil {
+		return nil, fmt.Errorf("can't parse mail template %s.html: %w", name, err)
+	}
+	var html bytes.Buffer
+	if err := htmlTmpl.Execute(&html, data); err != nil {
+		return nil, fmt.Errorf("can't render mail %s: %w", name, err)
+	}
+	mail.HTML = html.String()
+	return mail, nil
+}
+
+// SendMail renders the named mail template in the realm and language of the request and
+// queues it, see QueueMail.
+func SendMail(r *http.Request, to, name, dedupeKey string, expires time.Time, data map[string]any) error {
+	mail, err := renderMail(realmOf(r), acceptLanguages(r.Header.Get("Accept-Language")), to, name, data)
+	if err != nil {
+		return err
+	}
+	return QueueMail(mail, dedupeKey, expires)
+}
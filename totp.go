@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/elgs/gosqlcrud"
+	"github.com/google/uuid"
+	"github.com/skip2/go-qrcode"
+)
+
+// TOTP (RFC 6238) is for users whose devices can't create passkeys. Each realm chooses how
+// it may be used, see the TOTPMode constants. Codes are 6 digits over 30-second steps with
+// HMAC-SHA1, which every authenticator app supports. A code is accepted one step before or
+// after the current one, and never twice: the last accepted step is stored per enrolment.
+
+// TOTP modes of a realm, from Realm.TOTPMode or, for the default realm, the totp_mode
+// setting (default from TOTP_MODE).
+const (
+	TOTPModeOff          = "off"           // no TOTP
+	TOTPModeSecondFactor = "second_factor" // required after a magic-link login if enrolled
+	TOTPModeFallback     = "fallback"      // email plus TOTP code signs in without a passkey
+)
+
+var totpModes = []string{TOTPModeOff, TOTPModeSecondFactor, TOTPModeFallback}
+
+const (
+	totpDigits      = 6
+	totpPeriod      = 30
+	totpSkew        = 1 // steps accepted before and after the current one
+	totpMaxAttempts = 5
+	totpLockout     = 15 * time.Minute
+	// Failures of a user from all IPs, against guessing from rotating addresses
+	totpMaxAccountFailures = 20
+	totpAccountLockout     = time.Hour
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the code for a time step.
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for range totpDigits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// totpVerify checks a code against the steps around t and returns the step it matched.
+func totpVerify(secret []byte, code string, t time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := t.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth:// provisioning URI that authenticator apps scan.
+func totpURI(issuer, account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + params.Encode()
+}
+
+// totpModeOf returns the TOTP mode of the request's realm.
+func totpModeOf(r *http.Request) string {
+	mode := realmOf(r).totpMode()
+	if !slices.Contains(totpModes, mode) {
+		return TOTPModeOff
+	}
+	return mode
+}
+
+////////////////////////////
+//                        //
+//    TOTP Enrolment      //
+//                        //
+////////////////////////////
+
+// totpEnrolment is a secret shown to the user but not yet confirmed with a code.
+type totpEnrolment struct {
+	UserID string `json:"user_id"`
+	Secret string `json:"secret"`
+}
+
+// BeginTOTPEnrolment creates a secret and returns it with its provisioning URI and a QR code
+// rendered on the server, so the secret never leaves it for a third-party QR service.
+// Requires a recent step-up.
+// POST /api/totp_start
+func BeginTOTPEnrolment(w http.ResponseWriter, r *http.Request) {
+	if totpModeOf(r) == TOTPModeOff {
+		JSONResponse(w, "Authenticator apps are not enabled", http.StatusForbidden)
+		return
+	}
+	session := requireStepUp(w, r)
+	if session == nil {
+		return
+	}
+	user, err := repo.GetUser(string(session.UserID))
+	if err != nil {
+		JSONResponse(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		JSONResponse(w, "Failed to create secret", http.StatusInternalServerError)
+		return
+	}
+	secret := totpEncoding.EncodeToString(key)
+	if err := SaveTOTPEnrolment(getSessionID(r), &totpEnrolment{UserID: user.ID, Secret: secret}, currentConfig().TTL.TOTPEnrolment); err != nil {
+		log.Printf("[ERRO] can't save TOTP enrolment: %s", err.Error())
+		JSONResponse(w, "Failed to start enrolment", http.StatusInternalServerError)
+		return
+	}
+
+	uri := totpURI(realmOf(r).DisplayName(), user.Email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		log.Printf("[ERRO] can't render QR code: %s", err.Error())
+		JSONResponse(w, "Failed to start enrolment", http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, map[string]any{
+		"secret": secret,
+		"uri":    uri,
+		"qr":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, http.StatusOK)
+}
+
+// FinishTOTPEnrolment stores the secret once the user proved their app produces its codes.
+// POST /api/totp_finish {"code": "123456", "label": "..."}
+func FinishTOTPEnrolment(w http.ResponseWriter, r *http.Request) {
+	sid := getSessionID(r)
+	session, err := GetLoginSession(sid)
+	if err != nil {
+		JSONResponse(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Code  string `json:"code"`
+		Label string `json:"label"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	enrolment, err := GetTOTPEnrolment(sid)
+	if err != nil || enrolment.UserID != string(session.UserID) {
+		JSONResponse(w, "Enrolment expired, please try again", http.StatusBadRequest)
+		return
+	}
+	secret, err := totpEncoding.DecodeString(enrolment.Secret)
+	if err != nil {
+		JSONResponse(w, "Enrolment expired, please try again", http.StatusBadRequest)
+		return
+	}
+	step, ok := totpVerify(secret, req.Code, time.Now())
+	if !ok {
+		JSONResponse(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	label := strings.TrimSpace(req.Label)
+	if label == "" {
+		label = "Authenticator app"
+	}
+	if len(label) > 255 {
+		JSONResponse(w, "Label is too long", http.StatusBadRequest)
+		return
+	}
+	if err := CreateUserTOTP(enrolment.UserID, label, enrolment.Secret, step); err != nil {
+		log.Printf("[ERRO] can't save TOTP: %s", err.Error())
+		JSONResponse(w, "Failed to save authenticator app", http.StatusInternalServerError)
+		return
+	}
+	DeleteTOTPEnrolment(sid)
+	recordSecurityEvent(r, enrolment.UserID, "totp_enrolled", label)
+	JSONResponse(w, "Authenticator app added", http.StatusOK)
+}
+
+////////////////////////////
+//                        //
+//    TOTP Login          //
+//                        //
+////////////////////////////
+
+// holdForTOTP holds back an email login in a second_factor realm if the user has an
+// authenticator app: instead of a session, the browser gets a totp_pending cookie that
+// TOTPLogin exchanges for one. It returns true if the login was held back.
+func holdForTOTP(w http.ResponseWriter, r *http.Request, user *PasskeyUser) (bool, error) {
+	if totpModeOf(r) != TOTPModeSecondFactor {
+		return false, nil
+	}
+	totps, err := GetUserTOTPs(user.ID)
+	if err != nil || len(totps) == 0 {
+		return false, nil
+	}
+	pendingID := realmOf(r).newID()
+	ttl := currentConfig().TTL.Ceremony
+	if err := SaveTOTPPending(pendingID, user.ID, ttl); err != nil {
+		return true, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "totp_pending",
+		Value:    pendingID,
+		Path:     realmPath(r, "/"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(ttl.Seconds()),
+	})
+	return true, nil
+}
+
+// requireTOTP holds back a magic-link login for a TOTP code and redirects to the login page
+// to ask for it, keeping a pending SSO request. It returns true if the response was written.
+func requireTOTP(w http.ResponseWriter, r *http.Request, user *PasskeyUser, pending *PendingSSO) bool {
+	held, err := holdForTOTP(w, r, user)
+	if err != nil {
+		log.Printf("[ERRO] can't save TOTP pending login: %s", err.Error())
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return true
+	}
+	if held {
+		loginURL := realmPath(r, "/") + "?totp=1"
+		if pending != nil {
+			loginURL += "&" + ssoLoginQuery(pending.ClientID, pending.RedirectURI, pending.State, pending.PRF, pending.AuthAfter)
+		}
+		http.Redirect(w, r, loginURL, http.StatusFound)
+	}
+	return held
+}
+
+// TOTPLogin signs in with a TOTP code. After a magic link held back by requireTOTP it
+// completes that login; in a fallback realm the email and a code are enough.
+// POST /api/pub/totp_login {"email": "...", "code": "123456"}
+func TOTPLogin(w http.ResponseWriter, r *http.Request) {
+	var req Req
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var user *PasskeyUser
+	var err error
+	amr := []string{AMROTP}
+	cookie, cookieErr := r.Cookie("totp_pending")
+	if cookieErr == nil && realmOf(r).owns(cookie.Value) {
+		userID, err := GetTOTPPending(cookie.Value)
+		if err != nil {
+			JSONResponse(w, "Login expired, please request a new link", http.StatusBadRequest)
+			return
+		}
+		user, err = repo.GetUser(userID)
+		if err != nil {
+			JSONResponse(w, "Login expired, please request a new link", http.StatusBadRequest)
+			return
+		}
+		amr = []string{AMREmail, AMROTP, AMRMFA}
+	} else if totpModeOf(r) == TOTPModeFallback {
+		user, err = repo.GetUserByEmail(realmOf(r).ID, req.Email)
+		if err != nil {
+			JSONResponse(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+	} else {
+		JSONResponse(w, "Authenticator apps are not enabled", http.StatusForbidden)
+		return
+	}
+
+	// Counted per user and IP, so that one address locks only itself out quickly, and per
+	// user with a higher ceiling, so that rotating addresses or spelling variants of the
+	// email don't get a fresh budget for the same account.
+	failuresKey := fmt.Sprintf("totp_attempts:%s:%s", user.ID, clientIP(r))
+	accountKey := fmt.Sprintf("totp_failures:%s", user.ID)
+	if GetFailures(failuresKey) >= totpMaxAttempts || GetFailures(accountKey) >= totpMaxAccountFailures {
+		JSONResponse(w, "Too many attempts, please try again later", http.StatusTooManyRequests)
+		return
+	}
+	if !verifyUserTOTP(user.ID, req.Code) {
+		if CountFailure(failuresKey, totpLockout) == totpMaxAttempts {
+			recordSecurityEvent(r, user.ID, "totp_locked", fmt.Sprintf("%d failed attempts", totpMaxAttempts))
+		}
+		if CountFailure(accountKey, totpAccountLockout) == totpMaxAccountFailures {
+			recordSecurityEvent(r, user.ID, "totp_locked", fmt.Sprintf("%d failed attempts from all IPs", totpMaxAccountFailures))
+		}
+		JSONResponse(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	ResetFailures(failuresKey)
+	ResetFailures(accountKey)
+
+	if slices.Contains(amr, AMREmail) {
+		DeleteTOTPPending(cookie.Value)
+		http.SetCookie(w, &http.Cookie{Name: "totp_pending", Value: "", Path: realmPath(r, "/"), HttpOnly: true, SameSite: http.SameSiteLaxMode, MaxAge: -1})
+	}
+	createLoginSession(w, r, user.ID, amr)
+	log.Printf("[INFO] TOTP login for user %s", user.ID)
+	JSONResponse(w, "Login Success", http.StatusOK)
+}
+
+// verifyUserTOTP checks a code against all of the user's authenticator apps and marks its
+// step as used, so the same code can't be replayed.
+func verifyUserTOTP(userID, code string) bool {
+	totps, err := GetUserTOTPs(userID)
+	if err != nil {
+		log.Printf("[ERRO] can't get TOTPs: %s", err.Error())
+		return false
+	}
+	now := time.Now()
+	for _, t := range totps {
+		secret, err := totpEncoding.DecodeString(*t.Secret)
+		if err != nil {
+			continue
+		}
+		step, ok := totpVerify(secret, code, now)
+		if !ok {
+			continue
+		}
+		return UseTOTPStep(t.ID, step)
+	}
+	return false
+}
+
+////////////////////////////
+//                        //
+//    TOTP Model          //
+//                        //
+////////////////////////////
+
+type UserTOTP struct {
+	ID       string     `json:"id" db:"id" pk:"true"`
+	UserID   *string    `json:"user_id" db:"user_id"`
+	Label    *string    `json:"label" db:"label"`
+	Secret   *string    `json:"-" db:"secret"`
+	LastStep *int64     `json:"-" db:"last_step"`
+	Created  *time.Time `json:"created" db:"created"`
+	LastUsed *time.Time `json:"last_used" db:"last_used"`
+}
+
+func CreateUserTOTP(userID, label, secret string, step int64) error {
+	now := time.Now()
+	totp := &UserTOTP{
+		ID:       uuid.New().String(),
+		UserID:   &userID,
+		Label:    &label,
+		Secret:   &secret,
+		LastStep: &step,
+		Created:  &now,
+	}
+	result, err := gosqlcrud.Create(db, totp, "user_totp")
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no rows affected")
+	}
+	return nil
+}
+
+func GetUserTOTPs(userID string) ([]*UserTOTP, error) {
+	totps := []*UserTOTP{}
+	err := gosqlcrud.QueryToStructs(db, &totps, "SELECT * FROM user_totp WHERE user_id = ? ORDER BY created", userID)
+	return totps, err
+}
+
+func DeleteUserTOTP(userID, id string) (bool, error) {
+	result, err := db.Exec("DELETE FROM user_totp WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// RenameUserTOTP changes the label of one of the user's authenticator apps. It reports
+// false if the user has no such app.
+func RenameUserTOTP(userID, id, label string) (bool, error) {
+	totps, err := GetUserTOTPs(userID)
+	if err != nil {
+		return false, err
+	}
+	if !slices.ContainsFunc(totps, func(t *UserTOTP) bool { return t.ID == id }) {
+		return false, nil
+	}
+	// Not checked with RowsAffected: MySQL counts none when the label doesn't change
+	_, err = db.Exec("UPDATE user_totp SET label = ? WHERE id = ? AND user_id = ?", label, id, userID)
+	return err == nil, err
+}
+
+// UseTOTPStep records step as the last accepted one. It fails if that step or a later one
+// was already used.
+func UseTOTPStep(id string, step int64) bool {
+	result, err := db.Exec("UPDATE user_totp SET last_step = ?, last_used = ? WHERE id = ? AND (last_step IS NULL OR last_step < ?)",
+		step, time.Now(), id, step)
+	if err != nil {
+		log.Printf("[ERRO] can't update TOTP: %s", err.Error())
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n > 0
+}
+
+func SaveTOTPEnrolment(sessionID string, enrolment *totpEnrolment, ttl time.Duration) error {
+	dataJSON, err := json.Marshal(enrolment)
+	if err != nil {
+		return err
+	}
+	return store.Set(fmt.Sprintf("totp_enroll:%s", sessionID), string(dataJSON), ttl)
+}
+
+func GetTOTPEnrolment(sessionID string) (*totpEnrolment, error) {
+	val, err := store.Get(fmt.Sprintf("totp_enroll:%s", sessionID))
+	if err != nil {
+		return nil, err
+	}
+	var data totpEnrolment
+	if err := json.Unmarshal([]byte(val), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func DeleteTOTPEnrolment(sessionID string) error {
+	return store.Del(fmt.Sprintf("totp_enroll:%s", sessionID))
+}
+
+func SaveTOTPPending(id, userID string, ttl time.Duration) error {
+	return store.Set(fmt.Sprintf("totp_pending:%s", id), userID, ttl)
+}
+
+func GetTOTPPending(id string) (string, error) {
+	return store.Get(fmt.Sprintf("totp_pending:%s", id))
+}
+
+func DeleteTOTPPending(id string) error {
+	return store.Del(fmt.Sprintf("totp_pending:%s", id))
+}
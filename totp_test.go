@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA-1, truncated to six digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, c := range cases {
+		if got := totpCode(secret, c.unix/totpPeriod); got != c.code {
+			t.Errorf("totpCode(T=%d) = %s; want %s", c.unix, got, c.code)
+		}
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111109, 0)
+	step := now.Unix() / totpPeriod
+
+	for _, drift := range []int64{-1, 0, 1} {
+		code := totpCode(secret, step+drift)
+		got, ok := totpVerify(secret, code, now)
+		if !ok || got != step+drift {
+			t.Errorf("totpVerify(step%+d) = %d, %t; want %d, true", drift, got, ok, step+drift)
+		}
+	}
+	if _, ok := totpVerify(secret, totpCode(secret, step+2), now); ok {
+		t.Error("totpVerify accepted a code two steps ahead")
+	}
+	if _, ok := totpVerify(secret, "081 804", now); !ok {
+		t.Error("totpVerify rejected a code with a space")
+	}
+	if _, ok := totpVerify(secret, "08180", now); ok {
+		t.Error("totpVerify accepted a short code")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("Acme Login", "a@example.com", "JBSWY3DPEHPK3PXP")
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || !strings.HasSuffix(u.Path, "Acme Login:a@example.com") {
+		t.Errorf("totpURI = %s", uri)
+	}
+	q := u.Query()
+	if q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "Acme Login" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("totpURI query = %v", q)
+	}
+}
+
+func TestRenameUserTOTP(t *testing.T) {
+	initTestDB(t)
+	defer db.Close()
+	userID, cleanupUser := createTestUser(t)
+	defer cleanupUser()
+	otherID, cleanupOther := createTestUser(t)
+	defer cleanupOther()
+	if err := CreateUserTOTP(userID, "Phone", "JBSWY3DPEHPK3PXP", 0); err != nil {
+		t.Fatal(err)
+	}
+	totps, _ := GetUserTOTPs(userID)
+	id := totps[0].ID
+
+	for _, label := range []string{"Tablet", "Tablet"} {
+		if found, err := RenameUserTOTP(userID, id, label); !found || err != nil {
+			t.Errorf("RenameUserTOTP(%q) = %v, %v", label, found, err)
+		}
+	}
+	if totps, _ := GetUserTOTPs(userID); *totps[0].Label != "Tablet" {
+		t.Errorf("label = %q; want Tablet", *totps[0].Label)
+	}
+	if found, _ := RenameUserTOTP(otherID, id, "Mine"); found {
+		t.Error("RenameUserTOTP renamed another user's app")
+	}
+}
+
+func TestTOTPLoginLockout(t *testing.T) {
+	initTestDB(t)
+	defer db.Close()
+	initTestStore(t)
+	setTestConfig(t, func(c *Config) {
+		c.RelyingParty.ID, c.RelyingParty.Origins = "localhost", []string{"http://localhost"}
+		c.Policies.TOTPMode = TOTPModeFallback
+	})
+	reloadPasskeyStore()
+	userID, cleanupUser := createTestUser(t)
+	defer cleanupUser()
+	user, _ := repo.GetUser(userID)
+	if err := CreateUserTOTP(userID, "Phone", "JBSWY3DPEHPK3PXP", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(ip string) int {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/api/pub/totp_login", strings.NewReader(`{"email": "`+user.Email+`", "code": "000000"}`))
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		TOTPLogin(w, r)
+		return w.Code
+	}
+	for i := range totpMaxAttempts {
+		if code := login("192.0.2.1"); code != http.StatusBadRequest {
+			t.Fatalf("attempt %d = %d; want 400", i+1, code)
+		}
+	}
+	if code := login("192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Errorf("attempt from a locked IP = %d; want 429", code)
+	}
+	if code := login("192.0.2.2"); code != http.StatusBadRequest {
+		t.Errorf("attempt from another IP = %d; want 400", code)
+	}
+
+	// Rotating addresses doesn't get past the limit of the account
+	for i := totpMaxAttempts + 1; i < totpMaxAccountFailures; i++ {
+		login(fmt.Sprintf("198.51.100.%d", i))
+	}
+	if code := login("203.0.113.1"); code != http.StatusTooManyRequests {
+		t.Errorf("attempt after %d failures from all IPs = %d; want 429", totpMaxAccountFailures, code)
+	}
+}
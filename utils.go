@@ -1,8 +1,10 @@
 package main
 
 import (
-	"fmt"
-	"net/smtp"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
 	"os"
 	"strings"
 )
@@ -15,23 +17,45 @@ func getEnv(key, def string) string {
 	return def
 }
 
-func SendMail(to, subject, body string) error {
-	from := getEnv("SMTP_USER", "")
-	password := getEnv("SMTP_PASS", "")
-	smtpHost := getEnv("SMTP_HOST", "")
-	smtpPort := getEnv("SMTP_PORT", "")
-
-	toArray := strings.Split(to, ",")
+// hashToken hashes the random token of an invitation or email change link for storage.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-	msg := "From: " + from + "\n" +
-		"To: " + to + "\n" +
-		"Subject: " + subject + "\n\n" +
-		body
+// parseList splits a comma-separated list, dropping empty items.
+func parseList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
 
-	auth := smtp.PlainAuth("", from, password, smtpHost)
-	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, toArray, []byte(msg))
+// clientIP returns the address of the client. Behind trusted proxies it is the last
+// X-Forwarded-For hop that isn't a trusted proxy itself. Only trusted proxies may set
+// X-Forwarded-For; anyone else could use it to pick the IP that rate limits and allow-lists see.
+func clientIP(r *http.Request) string {
+	trustedProxies := currentConfig().trustedProxies
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return fmt.Errorf("failed to send mail: %w", err)
+		host = r.RemoteAddr
+	}
+	if !inNetworks(host, trustedProxies) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		host = hop
+		if !inNetworks(hop, trustedProxies) {
+			break
+		}
 	}
-	return nil
+	return host
 }
@@ -21,13 +21,30 @@ customElements.define('web-dashboard',
     clientsLoaded = false;
     users = [];
     usersLoaded = false;
+    isInviter = false;
+    invitations = [];
+    invitationsLoaded = false;
+    invitationForm = { email: '', expires: '', never_expires: false, roles: '', groups: '', clients: '' };
+    outbox = [];
+    outboxLoaded = false;
+    outboxFailedOnly = true;
     clientForm = { id: '', client_secret: '', redirect_uri: '', name: '' };
     clientEditMode = false;
     clientDialogTitle = '';
-    userForm = { id: '', email: '', name: '', display_name: '', is_active: false, is_admin: false };
+    renameForm = { id: '', type: '', label: '' };
+    userForm = { id: '', email: '', name: '', display_name: '', is_active: false, is_admin: false, roles: '', groups: '', clients: '' };
     logoutLoading = false;
     profileLoading = false;
+    emailChange = null;
+    emailForm = { email: '' };
+    emailLoading = false;
     registerLoading = false;
+    recoveryRemaining = 0;
+    recoveryCreated = '';
+    recoveryCodes = [];
+    recoveryLoading = false;
+    totpEnabled = false;
+    totpForm = { qr: '', secret: '', code: '', label: '' };
     confirmTitle = '';
     confirmMessage = '';
     confirmAction = '';
@@ -42,6 +59,10 @@ customElements.define('web-dashboard',
         this.loadClients();
       } else if (page === 'users') {
         this.loadUsers();
+      } else if (page === 'invitations') {
+        this.loadInvitations();
+      } else if (page === 'outbox') {
+        this.loadOutbox();
       }
     }
 
@@ -85,6 +106,7 @@ customElements.define('web-dashboard',
         this.aaguids = data;
         this.update();
       });
+      this.loadRealm();
       await this.loadUserData();
       if (this.page === 'sessions') {
         this.loadSSOSessions();
@@ -92,6 +114,10 @@ customElements.define('web-dashboard',
         this.loadClients();
       } else if (this.page === 'users' && this.isAdmin) {
         this.loadUsers();
+      } else if (this.page === 'invitations' && (this.isAdmin || this.isInviter)) {
+        this.loadInvitations();
+      } else if (this.page === 'outbox' && this.isAdmin) {
+        this.loadOutbox();
       }
     }
 
@@ -139,6 +165,7 @@ customElements.define('web-dashboard',
           this.userName = user.name || '';
           this.userDisplayName = user.display_name || '';
           this.isAdmin = !!user.is_admin;
+          this.isInviter = (user.roles || '').split(',').map(r => r.trim()).includes('inviter');
         } else {
           document.cookie = 'sso_logged_in=; Max-Age=0; Path=/';
           this.dispatchEvent(new CustomEvent('logout', { bubbles: true, composed: true }));
@@ -149,6 +176,8 @@ customElements.define('web-dashboard',
         return;
       }
       await this.loadCredentials();
+      await this.loadRecoveryCodes();
+      await this.loadEmailChange();
     }
 
     async loadCredentials() {
@@ -166,6 +195,131 @@ customElements.define('web-dashboard',
       }
     }
 
+    async loadRealm() {
+      try {
+        const response = await fetch(`${env.pubApiUrl}realm`);
+        if (response.ok) {
+          const realm = await response.json();
+          this.totpEnabled = !!realm.totp_mode && realm.totp_mode !== 'off';
+          this.update();
+        }
+      } catch (error) {
+        // silently fail
+      }
+    }
+
+    async openTOTPDialog() {
+      try {
+        const response = await this.fetchWithStepUp(`${env.apiUrl}totp_start`, { method: 'POST' });
+        const data = await response.json();
+        if (!response.ok) {
+          this.showToast(data, 'danger');
+          return;
+        }
+        this.totpForm = { qr: data.qr, secret: data.secret, code: '', label: '' };
+        this.update();
+        this.querySelector('.totp-dialog').showModal();
+      } catch (error) {
+        this.showToast(error.message, 'danger');
+      }
+    }
+
+    closeTOTPDialog() {
+      this.querySelector('.totp-dialog').close();
+    }
+
+    async finishTOTP() {
+      try {
+        const response = await fetch(`${env.apiUrl}totp_finish`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ code: this.totpForm.code, label: this.totpForm.label }),
+        });
+        const msg = await response.json();
+        if (response.ok) {
+          this.closeTOTPDialog();
+          this.showToast(msg);
+          await this.loadCredentials();
+        } else {
+          this.showToast(msg, 'danger');
+        }
+      } catch (error) {
+        this.showToast(error.message, 'danger');
+      }
+    }
+
+    async loadRecoveryCodes() {
+      try {
+        const response = await fetch(`${env.apiUrl}recovery_codes`);
+        if (response.ok) {
+          const data = await response.json();
+          this.recoveryRemaining = data.remaining || 0;
+          this.recoveryCreated = data.created || '';
+          this.update();
+        }
+      } catch (error) {
+        // silently fail
+      }
+    }
+
+    async regenerateRecoveryCodes() {
+      if (this.recoveryRemaining > 0) {
+        const confirmed = await this.showConfirm({
+          title: 'Generate New Codes',
+          message: 'Your current recovery codes will stop working.',
+          action: 'Generate',
+        });
+        if (!confirmed) return;
+      }
+      this.recoveryLoading = true;
+      this.update();
+      try {
+        const response = await this.fetchWithStepUp(`${env.apiUrl}recovery_codes`, { method: 'POST' });
+        const data = await response.json();
+        if (response.ok) {
+          this.recoveryCodes = data;
+          await this.loadRecoveryCodes();
+        } else {
+          this.showToast(data, 'danger');
+        }
+      } catch (error) {
+        this.showToast(error.message, 'danger');
+      } finally {
+        this.recoveryLoading = false;
+      }
+    }
+
+    // fetchWithStepUp performs a request to a sensitive endpoint. If the server asks for a
+    // fresh passkey verification, it runs the step-up ceremony and retries once.
+    async fetchWithStepUp(url, options = {}) {
+      const response = await fetch(url, options);
+      if (response.status !== 401 || !response.headers.get('step_up_required')) {
+        return response;
+      }
+      await this.stepUp();
+      return fetch(url, options);
+    }
+
+    async stepUp() {
+      const response = await fetch(`${env.apiUrl}stepup_start`, { method: 'POST' });
+      if (!response.ok) {
+        const msg = await response.json();
+        throw new Error('Re-authentication failed: ' + msg);
+      }
+      const stepUpSid = response.headers.get('stepup_sid');
+      const options = await response.json();
+      const assertionResponse = await SimpleWebAuthnBrowser.startAuthentication({ optionsJSON: options.publicKey });
+      const verificationResponse = await fetch(`${env.apiUrl}stepup_finish`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'stepup_sid': stepUpSid },
+        body: JSON.stringify(assertionResponse)
+      });
+      if (!verificationResponse.ok) {
+        const msg = await verificationResponse.json();
+        throw new Error('Re-authentication failed: ' + msg);
+      }
+    }
+
     showConfirm({ title = 'Confirm', message = '', action = 'Confirm', danger = false } = {}) {
       this.confirmTitle = title;
       this.confirmMessage = message;
@@ -194,7 +348,7 @@ customElements.define('web-dashboard',
       this.profileLoading = true;
       this.update();
       try {
-        const response = await fetch(`${env.apiUrl}profile`, {
+        const response = await this.fetchWithStepUp(`${env.apiUrl}profile`, {
           method: 'PUT',
           headers: { 'Content-Type': 'application/json' },
           body: JSON.stringify({ name: this.userName, display_name: this.userDisplayName })
@@ -215,6 +369,67 @@ customElements.define('web-dashboard',
       }
     }
 
+    async loadEmailChange() {
+      try {
+        const response = await fetch(`${env.apiUrl}email_change`);
+        if (response.ok) {
+          this.emailChange = await response.json();
+          this.update();
+        }
+      } catch (e) {}
+    }
+
+    openEmailDialog() {
+      this.emailForm = { email: '' };
+      this.update();
+      this.querySelector('.email-dialog').showModal();
+    }
+
+    closeEmailDialog() {
+      this.querySelector('.email-dialog').close();
+    }
+
+    async requestEmailChange() {
+      this.emailLoading = true;
+      this.update();
+      try {
+        const response = await this.fetchWithStepUp(`${env.apiUrl}email_change`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ email: this.emailForm.email }),
+        });
+        const result = await response.json();
+        if (response.ok) {
+          this.emailChange = result;
+          this.closeEmailDialog();
+          this.showToast(`Confirmation link sent to ${result.new_email}`);
+        } else {
+          this.showToast(result, 'danger');
+        }
+      } catch (e) {
+        this.showToast(e.message, 'danger');
+      } finally {
+        this.emailLoading = false;
+        this.update();
+      }
+    }
+
+    async cancelEmailChange() {
+      try {
+        const response = await fetch(`${env.apiUrl}email_change`, { method: 'DELETE' });
+        const msg = await response.json();
+        if (response.ok) {
+          this.emailChange = null;
+          this.update();
+          this.showToast(msg);
+        } else {
+          this.showToast(msg, 'danger');
+        }
+      } catch (e) {
+        this.showToast(e.message, 'danger');
+      }
+    }
+
     async deleteCredential(credId) {
       const confirmed = await this.showConfirm({
         title: 'Delete Passkey',
@@ -225,7 +440,7 @@ customElements.define('web-dashboard',
       if (!confirmed) return;
 
       try {
-        const response = await fetch(`${env.apiUrl}credentials?id=${encodeURIComponent(credId)}`, {
+        const response = await this.fetchWithStepUp(`${env.apiUrl}credentials?id=${encodeURIComponent(credId)}`, {
           method: 'DELETE',
         });
 
@@ -241,15 +456,41 @@ customElements.define('web-dashboard',
       }
     }
 
-    async registerPasskey() {
-      this.registerLoading = true;
+    openRenameDialog(cred) {
+      this.renameForm = { id: cred.id, type: cred.type, label: cred.label || '' };
       this.update();
+      this.querySelector('.rename-dialog').showModal();
+    }
+
+    closeRenameDialog() {
+      this.querySelector('.rename-dialog').close();
+    }
+
+    async renameCredential() {
       try {
-        const response = await fetch(`${env.pubApiUrl}passkey_register_start`, {
-          method: 'POST',
+        const response = await fetch(`${env.apiUrl}credential?id=${encodeURIComponent(this.renameForm.id)}`, {
+          method: 'PUT',
           headers: { 'Content-Type': 'application/json' },
-          body: JSON.stringify({ email: this.email })
+          body: JSON.stringify({ label: this.renameForm.label }),
         });
+        const msg = await response.json();
+        if (response.ok) {
+          this.closeRenameDialog();
+          this.showToast(msg);
+          await this.loadCredentials();
+        } else {
+          this.showToast(msg, 'danger');
+        }
+      } catch (e) {
+        this.showToast(e.message, 'danger');
+      }
+    }
+
+    async registerPasskey() {
+      this.registerLoading = true;
+      this.update();
+      try {
+        const response = await this.fetchWithStepUp(`${env.pubApiUrl}passkey_register_start`, { method: 'POST' });
 
         if (!response.ok) {
           const msg = await response.json();
@@ -270,7 +511,24 @@ customElements.define('web-dashboard',
           body: JSON.stringify(attestationResponse)
         });
 
-        const result = await verificationResponse.json();
+        let result = await verificationResponse.json();
+        if (verificationResponse.ok && result.status === 'confirm_replace') {
+          const replace = await this.showConfirm({
+            title: 'Replace Passkey',
+            message: result.message,
+            action: 'Replace',
+          });
+          const confirmResponse = await fetch(`${env.pubApiUrl}passkey_register_confirm`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json', 'register_sid': registerSid },
+            body: JSON.stringify({ replace })
+          });
+          result = await confirmResponse.json();
+          if (!confirmResponse.ok) {
+            this.showToast(result, 'danger');
+            return;
+          }
+        }
         if (!verificationResponse.ok) {
           this.showToast(result, 'danger');
         } else {
@@ -330,7 +588,7 @@ customElements.define('web-dashboard',
 
     async loadClients() {
       try {
-        const response = await fetch(`${env.apiUrl}admin/clients`);
+        const response = await this.fetchWithStepUp(`${env.apiUrl}admin/clients`);
         if (response.ok) {
           this.ssoClients = (await response.json()) || [];
           this.clientsLoaded = true;
@@ -363,7 +621,7 @@ customElements.define('web-dashboard',
         : `${env.apiUrl}admin/clients`;
       const method = this.clientEditMode ? 'PUT' : 'POST';
       try {
-        const response = await fetch(url, {
+        const response = await this.fetchWithStepUp(url, {
           method,
           headers: { 'Content-Type': 'application/json' },
           body: JSON.stringify(this.clientForm),
@@ -390,7 +648,7 @@ customElements.define('web-dashboard',
       });
       if (!confirmed) return;
       try {
-        const response = await fetch(`${env.apiUrl}admin/client?id=${encodeURIComponent(clientID)}`, { method: 'DELETE' });
+        const response = await this.fetchWithStepUp(`${env.apiUrl}admin/client?id=${encodeURIComponent(clientID)}`, { method: 'DELETE' });
         const msg = await response.json();
         if (response.ok) {
           this.showToast(msg);
@@ -405,7 +663,7 @@ customElements.define('web-dashboard',
 
     async loadUsers() {
       try {
-        const response = await fetch(`${env.apiUrl}admin/users`);
+        const response = await this.fetchWithStepUp(`${env.apiUrl}admin/users`);
         if (response.ok) {
           this.users = (await response.json()) || [];
           this.usersLoaded = true;
@@ -422,6 +680,9 @@ customElements.define('web-dashboard',
         display_name: user.display_name || '',
         is_active: !!user.is_active,
         is_admin: !!user.is_admin,
+        roles: user.roles || '',
+        groups: user.groups || '',
+        clients: user.clients || '',
       };
       this.update();
       this.querySelector('.user-dialog').showModal();
@@ -433,7 +694,7 @@ customElements.define('web-dashboard',
 
     async saveUser() {
       try {
-        const response = await fetch(`${env.apiUrl}admin/user?id=${encodeURIComponent(this.userForm.id)}`, {
+        const response = await this.fetchWithStepUp(`${env.apiUrl}admin/user?id=${encodeURIComponent(this.userForm.id)}`, {
           method: 'PUT',
           headers: { 'Content-Type': 'application/json' },
           body: JSON.stringify({
@@ -441,6 +702,9 @@ customElements.define('web-dashboard',
             display_name: this.userForm.display_name,
             is_active: this.userForm.is_active,
             is_admin: this.userForm.is_admin,
+            roles: this.userForm.roles,
+            groups: this.userForm.groups,
+            clients: this.userForm.clients,
           }),
         });
         const msg = await response.json();
@@ -465,7 +729,7 @@ customElements.define('web-dashboard',
       });
       if (!confirmed) return;
       try {
-        const response = await fetch(`${env.apiUrl}admin/user?id=${encodeURIComponent(user.id)}`, { method: 'DELETE' });
+        const response = await this.fetchWithStepUp(`${env.apiUrl}admin/user?id=${encodeURIComponent(user.id)}`, { method: 'DELETE' });
         const msg = await response.json();
         if (response.ok) {
           this.showToast(msg);
@@ -478,6 +742,106 @@ customElements.define('web-dashboard',
       }
     }
 
+    async loadInvitations() {
+      try {
+        const response = await this.fetchWithStepUp(`${env.apiUrl}admin/invitations`);
+        if (response.ok) {
+          this.invitations = (await response.json()) || [];
+          this.invitationsLoaded = true;
+          this.update();
+        }
+      } catch (e) {}
+    }
+
+    openInvitationDialog() {
+      this.invitationForm = { email: '', expires: '', never_expires: false, roles: '', groups: '', clients: '' };
+      this.update();
+      this.querySelector('.invitation-dialog').showModal();
+    }
+
+    closeInvitationDialog() {
+      this.querySelector('.invitation-dialog').close();
+    }
+
+    async createInvitation() {
+      const list = (s) => s.split(',').map(item => item.trim()).filter(item => item);
+      const form = this.invitationForm;
+      const body = {
+        email: form.email,
+        never_expires: form.never_expires,
+        roles: list(form.roles),
+        groups: list(form.groups),
+        clients: list(form.clients),
+      };
+      if (form.expires && !form.never_expires) body.expires = new Date(form.expires + 'T23:59:59').toISOString();
+      try {
+        const response = await this.fetchWithStepUp(`${env.apiUrl}admin/invitations`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify(body),
+        });
+        const result = await response.json();
+        if (response.ok) {
+          this.closeInvitationDialog();
+          this.showToast(`Invitation sent to ${result.email}`);
+          await this.loadInvitations();
+        } else {
+          this.showToast(result, 'danger');
+        }
+      } catch (e) {
+        this.showToast(e.message, 'danger');
+      }
+    }
+
+    async revokeInvitation(invitation) {
+      const confirmed = await this.showConfirm({
+        title: 'Revoke Invitation',
+        message: `Revoke the invitation for "${invitation.email}"? The link in the email will stop working.`,
+        action: 'Revoke',
+        danger: true,
+      });
+      if (!confirmed) return;
+      try {
+        const response = await this.fetchWithStepUp(`${env.apiUrl}admin/invitation?id=${encodeURIComponent(invitation.id)}`, { method: 'DELETE' });
+        const msg = await response.json();
+        if (response.ok) {
+          this.showToast(msg);
+          await this.loadInvitations();
+        } else {
+          this.showToast(msg, 'danger');
+        }
+      } catch (e) {
+        this.showToast(e.message, 'danger');
+      }
+    }
+
+    async loadOutbox() {
+      try {
+        const query = this.outboxFailedOnly ? '?status=dead' : '';
+        const response = await this.fetchWithStepUp(`${env.apiUrl}admin/mail${query}`);
+        if (response.ok) {
+          this.outbox = (await response.json()) || [];
+          this.outboxLoaded = true;
+          this.update();
+        }
+      } catch (e) {}
+    }
+
+    async resendMail(mail) {
+      try {
+        const response = await this.fetchWithStepUp(`${env.apiUrl}admin/mail/resend?id=${encodeURIComponent(mail.id)}`, { method: 'POST' });
+        const msg = await response.json();
+        if (response.ok) {
+          this.showToast(msg);
+          await this.loadOutbox();
+        } else {
+          this.showToast(msg, 'danger');
+        }
+      } catch (e) {
+        this.showToast(e.message, 'danger');
+      }
+    }
+
     async logout() {
       this.logoutLoading = true;
       this.update();
@@ -8,13 +8,29 @@ customElements.define('web-login',
       super(ast);
     }
 
+    title = 'az code lab';
+    logoUrl = '';
     email = '';
     savedEmail = '';
     rememberMe = false;
+    useCode = localStorage.getItem('emailMethod') === 'code';
+    codePrompt = false;
+    loginCode = '';
+    codeLoading = false;
     message = '';
     messageType = '';
     emailLoading = false;
     passkeyLoading = false;
+    totpPrompt = new URLSearchParams(location.search).get('totp') === '1';
+    totpFallback = false;
+    totpCode = '';
+    totpLoading = false;
+    recoveryMode = false;
+    recoveryCode = '';
+    recoveryLoading = false;
+    inviteToken = new URLSearchParams(location.search).get('invite') || '';
+    inviteEmail = '';
+    inviteLoading = false;
 
     async domReady() {
       this.savedEmail = localStorage.getItem('savedEmail') || '';
@@ -22,7 +38,96 @@ customElements.define('web-login',
         this.email = this.savedEmail;
         this.rememberMe = true;
       }
+      await this.loadRealm();
+      if (this.inviteToken) await this.loadInvitation();
+    }
+
+    async loadInvitation() {
+      try {
+        const response = await fetch(`${env.pubApiUrl}invitation`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ token: this.inviteToken })
+        });
+        const result = await response.json();
+        if (!response.ok) {
+          this.setMessage(result, 'danger');
+          return;
+        }
+        this.inviteEmail = result.email;
+        this.update();
+      } catch (error) {
+        this.setMessage(error.message, 'danger');
+      }
+    }
+
+    // acceptInvitation registers a passkey for the invited email, which creates the account
+    // and signs in.
+    async acceptInvitation() {
+      this.inviteLoading = true;
+      this.update();
+      try {
+        const startResponse = await fetch(`${env.pubApiUrl}invitation/register_start`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ token: this.inviteToken })
+        });
+        if (!startResponse.ok) throw new Error(await startResponse.json());
+        const registerSid = startResponse.headers.get('register_sid');
+        const options = await startResponse.json();
+
+        const attestationResponse = await SimpleWebAuthnBrowser.startRegistration({ optionsJSON: options.publicKey });
+        const finishResponse = await fetch(`${env.pubApiUrl}invitation/register_finish`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json', 'register_sid': registerSid },
+          body: JSON.stringify(attestationResponse)
+        });
+        const result = await finishResponse.json();
+        if (!finishResponse.ok) throw new Error(result);
+
+        localStorage.setItem('savedEmail', this.inviteEmail);
+        history.replaceState(null, '', location.pathname);
+        this.inviteToken = '';
+        this.inviteEmail = '';
+        if (this._handleSSORedirect()) return;
+        this.dispatchEvent(new CustomEvent('login', { bubbles: true, composed: true }));
+      } catch (error) {
+        this.setMessage(error.message, 'danger');
+      } finally {
+        this.inviteLoading = false;
+      }
+    }
+
+    async loadRealm() {
+      try {
+        const response = await fetch(`${env.pubApiUrl}realm`);
+        if (!response.ok) return;
+        const realm = await response.json();
+        this.title = realm.name || this.title;
+        this.logoUrl = realm.branding?.logo_url || '';
+        if (realm.branding?.primary_color) {
+          this.style.setProperty('--realm-color', realm.branding.primary_color);
+        }
+        this.totpFallback = realm.totp_mode === 'fallback';
+        document.title = this.title;
+        this.update();
+      } catch (error) {
+        // Keep the default branding
+      }
+    }
 
+    // _pendingSSO returns the SSO request this login belongs to, so a magic link opened in
+    // another tab can still go back into /sso/authorize.
+    _pendingSSO() {
+      const clientId = sessionStorage.getItem('sso_client_id');
+      if (!clientId) return null;
+      return {
+        client_id: clientId,
+        redirect_uri: sessionStorage.getItem('sso_redirect_uri') || '',
+        state: sessionStorage.getItem('sso_state') || '',
+        prf: !!sessionStorage.getItem('sso_prf'),
+        auth_after: Number(sessionStorage.getItem('sso_auth_after')) || 0,
+      };
     }
 
     _handleSSORedirect() {
@@ -31,17 +136,23 @@ customElements.define('web-login',
 
       const redirectUri = sessionStorage.getItem('sso_redirect_uri') || '';
       const state = sessionStorage.getItem('sso_state') || '';
+      const prf = sessionStorage.getItem('sso_prf');
+      const authAfter = sessionStorage.getItem('sso_auth_after');
 
       sessionStorage.removeItem('sso_client_id');
       sessionStorage.removeItem('sso_redirect_uri');
       sessionStorage.removeItem('sso_state');
+      sessionStorage.removeItem('sso_prf');
+      sessionStorage.removeItem('sso_auth_after');
 
       const params = new URLSearchParams({
         client_id: clientId,
         redirect_uri: redirectUri,
         state: state,
       });
-      window.location.href = `/api/pub/sso/authorize?${params.toString()}`;
+      if (prf) params.set('prf', '1');
+      if (authAfter) params.set('auth_after', authAfter);
+      window.location.href = `${env.pubApiUrl}sso/authorize?${params.toString()}`;
       return true;
     }
 
@@ -53,6 +164,10 @@ customElements.define('web-login',
       }
     }
 
+    onUseCodeChange() {
+      localStorage.setItem('emailMethod', this.useCode ? 'code' : 'link');
+    }
+
     saveEmailIfRemembered() {
       if (this.rememberMe) {
         localStorage.setItem('savedEmail', this.email);
@@ -90,13 +205,17 @@ customElements.define('web-login',
         const response = await fetch(`${env.pubApiUrl}login_start`, {
           method: 'POST',
           headers: { 'Content-Type': 'application/json' },
-          body: JSON.stringify({ email: this.email })
+          body: JSON.stringify({ email: this.email, method: this.useCode ? 'code' : 'link', sso: this._pendingSSO() })
         });
 
         const msg = await response.json();
         if (response.ok) {
           this.saveEmailIfRemembered();
+          this.codePrompt = this.useCode;
           this.setMessage(msg);
+          if (!this.useCode) {
+            this.pollForApproval();
+          }
         } else {
           this.setMessage(msg, 'danger');
         }
@@ -156,5 +275,181 @@ customElements.define('web-login',
         this.passkeyLoading = false;
       }
     }
+
+    async onCodeKeydown(event) {
+      if (event.key === 'Enter') {
+        await this.loginWithCode();
+      }
+    }
+
+    // pollForApproval waits for a magic link bound to this browser to be approved on another
+    // device. It stops when the link is used, denied or expires, or if links aren't bound.
+    async pollForApproval() {
+      clearTimeout(this._pollTimer);
+      const deadline = Date.now() + 10 * 60 * 1000;
+      const poll = async () => {
+        try {
+          const response = await fetch(`${env.pubApiUrl}login_poll`, { method: 'POST' });
+          const result = await response.json();
+          if (result.status === 'totp_required') {
+            this.totpPrompt = true;
+            this.setMessage('Enter the code from your authenticator app');
+            this.update();
+            return;
+          }
+          if (result.status === 'ok') {
+            if (result.redirect) {
+              ['sso_client_id', 'sso_redirect_uri', 'sso_state', 'sso_prf', 'sso_auth_after'].forEach(key => sessionStorage.removeItem(key));
+              window.location.href = result.redirect;
+              return;
+            }
+            if (this._handleSSORedirect()) return;
+            this.dispatchEvent(new CustomEvent('login', { bubbles: true, composed: true }));
+            return;
+          }
+          if (result.status !== 'pending') return;
+        } catch (error) {
+          // keep polling through network hiccups
+        }
+        if (Date.now() < deadline) {
+          this._pollTimer = setTimeout(poll, 3000);
+        }
+      };
+      this._pollTimer = setTimeout(poll, 3000);
+    }
+
+    async loginWithCode() {
+      if (!this.loginCode) {
+        this.setMessage('Please enter the code from your email', 'danger');
+        return;
+      }
+
+      this.codeLoading = true;
+      this.update();
+      try {
+        const response = await fetch(`${env.pubApiUrl}verify_code`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ email: this.email, code: this.loginCode })
+        });
+        const result = await response.json();
+        if (!response.ok) {
+          this.loginCode = '';
+          this.setMessage(result, 'danger');
+          return;
+        }
+        this.codePrompt = false;
+        this.loginCode = '';
+        if (result.status === 'totp_required') {
+          this.totpPrompt = true;
+          this.setMessage('Enter the code from your authenticator app');
+          return;
+        }
+        if (this._handleSSORedirect()) return;
+        this.dispatchEvent(new CustomEvent('login', { bubbles: true, composed: true }));
+      } catch (error) {
+        this.setMessage(error.message, 'danger');
+      } finally {
+        this.codeLoading = false;
+      }
+    }
+
+    async onTOTPKeydown(event) {
+      if (event.key === 'Enter') {
+        await this.loginWithTOTP();
+      }
+    }
+
+    // loginWithTOTP completes a magic-link login held back for a second factor (?totp=1),
+    // or signs in with email and code where the realm allows TOTP as a fallback.
+    async loginWithTOTP() {
+      if (!this.totpCode) {
+        this.setMessage('Please enter the code from your authenticator app', 'danger');
+        return;
+      }
+
+      this.totpLoading = true;
+      this.update();
+      try {
+        const response = await fetch(`${env.pubApiUrl}totp_login`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ email: this.email, code: this.totpCode })
+        });
+        const msg = await response.json();
+        if (response.ok) {
+          history.replaceState(null, '', location.pathname + location.hash);
+          if (this._handleSSORedirect()) return;
+          this.dispatchEvent(new CustomEvent('login', { bubbles: true, composed: true }));
+        } else {
+          this.totpCode = '';
+          this.setMessage(msg, 'danger');
+        }
+      } catch (error) {
+        this.setMessage(error.message, 'danger');
+      } finally {
+        this.totpLoading = false;
+      }
+    }
+
+    // recoverAccount redeems a recovery code and registers a new passkey in the recovery
+    // session it starts. The session ends with the registration; the user then signs in.
+    async recoverAccount() {
+      if (!this.email || !this.recoveryCode) {
+        this.setMessage('Please enter your email and a recovery code', 'danger');
+        return;
+      }
+
+      this.recoveryLoading = true;
+      this.update();
+      try {
+        const response = await fetch(`${env.pubApiUrl}recovery_login`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ email: this.email, code: this.recoveryCode })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+          this.setMessage(data, 'danger');
+          return;
+        }
+
+        const startResponse = await fetch(`${env.pubApiUrl}passkey_register_start`, { method: 'POST' });
+        if (!startResponse.ok) {
+          const msg = await startResponse.json();
+          throw new Error('Failed to get registration options: ' + msg);
+        }
+        const registerSid = startResponse.headers.get('register_sid');
+        const options = await startResponse.json();
+
+        const attestationResponse = await SimpleWebAuthnBrowser.startRegistration({ optionsJSON: options.publicKey });
+        const finishResponse = await fetch(`${env.pubApiUrl}passkey_register_finish`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json', 'register_sid': registerSid },
+          body: JSON.stringify(attestationResponse)
+        });
+        let result = await finishResponse.json();
+        if (finishResponse.ok && result.status === 'confirm_replace') {
+          const confirmResponse = await fetch(`${env.pubApiUrl}passkey_register_confirm`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json', 'register_sid': registerSid },
+            body: JSON.stringify({ replace: true })
+          });
+          result = await confirmResponse.json();
+          if (!confirmResponse.ok) throw new Error(result);
+        } else if (!finishResponse.ok) {
+          throw new Error(result);
+        }
+
+        this.recoveryMode = false;
+        this.recoveryCode = '';
+        this.savedEmail = data.email;
+        this.setMessage('Your new passkey is registered. Sign in with it now.');
+      } catch (error) {
+        this.setMessage(error.message, 'danger');
+      } finally {
+        this.recoveryLoading = false;
+      }
+    }
   }
 );
@@ -1,5 +1,6 @@
 import LWElement from './../../lib/lw-element.js';
 import ast from './ast.js';
+import env from '../../env.js';
 
 customElements.define('web-root',
   class extends LWElement {  // LWElement extends HTMLElement
@@ -13,6 +14,12 @@ customElements.define('web-root',
         sessionStorage.setItem('sso_client_id', urlParams.get('sso_client_id'));
         sessionStorage.setItem('sso_redirect_uri', urlParams.get('sso_redirect_uri') || '');
         sessionStorage.setItem('sso_state', urlParams.get('sso_state') || '');
+        sessionStorage.setItem('sso_prf', urlParams.get('sso_prf') || '');
+        sessionStorage.setItem('sso_auth_after', urlParams.get('sso_auth_after') || '');
+      }
+      // The application asked for a new login: show the login page even with a session
+      if (sessionStorage.getItem('sso_auth_after')) {
+        this.loggedIn = false;
       }
       // If logged in AND SSO params are present, redirect to /authorize immediately
       if (this.loggedIn && sessionStorage.getItem('sso_client_id')) {
@@ -21,10 +28,13 @@ customElements.define('web-root',
           redirect_uri: sessionStorage.getItem('sso_redirect_uri') || '',
           state: sessionStorage.getItem('sso_state') || '',
         });
+        if (sessionStorage.getItem('sso_prf')) params.set('prf', '1');
         sessionStorage.removeItem('sso_client_id');
         sessionStorage.removeItem('sso_redirect_uri');
         sessionStorage.removeItem('sso_state');
-        window.location.href = `/api/pub/sso/authorize?${params.toString()}`;
+        sessionStorage.removeItem('sso_prf');
+        sessionStorage.removeItem('sso_auth_after');
+        window.location.href = `${env.pubApiUrl}sso/authorize?${params.toString()}`;
       }
     }
 
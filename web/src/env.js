@@ -1,4 +1,8 @@
+// Realms selected by a path prefix are served under /r/{realm}/
+const realmPrefix = (window.location.pathname.match(/^\/r\/[^/]+/) || [''])[0];
+
 export default {
-  apiUrl: '/api/',
-  pubApiUrl: '/api/pub/'
-};
\ No newline at end of file
+  realmPrefix,
+  apiUrl: `${realmPrefix}/api/`,
+  pubApiUrl: `${realmPrefix}/api/pub/`
+};